@@ -1,6 +1,9 @@
 #!/bin/bash
 kubectl apply -f ../latency-aware-scheduler.yaml
 sleep 6
+# HMAC secret of the latency meter challenges, generated once and shared by all the meters
+kubectl get secret latency-meter-challenge >/dev/null 2>&1 || \
+    kubectl create secret generic latency-meter-challenge --from-literal=secret="$(head -c 32 /dev/urandom | base64)"
 kubectl apply -f nginx-deployment.yaml
 kubectl wait --for=condition=available --timeout=300s deployment/nginx-deployment
 kubectl apply -f lat-meas-serv.yaml
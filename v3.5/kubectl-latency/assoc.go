@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// latencyStatus tells how the latency compares to the thresholds of the app.
+func latencyStatus(app *AppView, latency int64) string {
+	switch {
+	case app == nil || (app.HardThresholdMs == nil && app.SoftThresholdMs == nil):
+		return "no thresholds"
+	case app.SoftThresholdMs != nil && latency <= *app.SoftThresholdMs:
+		return "within soft"
+	case app.HardThresholdMs != nil && latency <= *app.HardThresholdMs:
+		return "within hard"
+	}
+	return "violation"
+}
+
+// runAssoc prints the associations of the user and the measurements they were chosen from.
+func runAssoc(o *Options, userID string) error {
+	client, err := o.adminClient()
+	if err != nil {
+		return err
+	}
+	apps, err := client.Apps()
+	if err != nil {
+		return err
+	}
+	associations, err := client.Associations("")
+	if err != nil {
+		return err
+	}
+	matrix, err := client.Measurements("")
+	if err != nil {
+		return err
+	}
+	appViews := make(map[string]*AppView)
+	for i := range apps {
+		appViews[apps[i].App] = &apps[i]
+	}
+
+	found := false
+	w := newTabWriter()
+	fmt.Fprintf(w, "APP\tNODE\tPOD\tLATENCY\t%s\tSINCE\tMEASURED NODES\n", o.colored("", "STATUS"))
+	for _, association := range associations {
+		if association.User != userID {
+			continue
+		}
+		found = true
+		app := appViews[association.App]
+		measured := ""
+		for _, nodeName := range sortedKeys(matrix[association.App][userID]) {
+			measured += fmt.Sprintf("%s=%dms ", nodeName, matrix[association.App][userID][nodeName].LatencyMs)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%dms\t%s\t%s\t%s\n", association.App, association.Node, association.Pod, association.LatencyMs,
+			o.colored(latencyColor(app, association.LatencyMs), latencyStatus(app, association.LatencyMs)),
+			time.Since(association.CreatedAt).Round(time.Second), measured)
+	}
+	for _, appName := range sortedKeys(matrix) {
+		if _, measured := matrix[appName][userID]; !measured {
+			continue
+		}
+		associated := false
+		for _, association := range associations {
+			associated = associated || (association.User == userID && association.App == appName)
+		}
+		if !associated {
+			found = true
+			fmt.Fprintf(w, "%s\t<none>\t-\t-\t%s\t-\t", appName, o.colored("", "not associated"))
+			for _, nodeName := range sortedKeys(matrix[appName][userID]) {
+				fmt.Fprintf(w, "%s=%dms ", nodeName, matrix[appName][userID][nodeName].LatencyMs)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	w.Flush()
+	if !found {
+		return fmt.Errorf("user %s has no associations nor measurements", userID)
+	}
+	return nil
+}
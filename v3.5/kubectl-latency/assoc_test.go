@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func ms(value int64) *int64 { return &value }
+
+func TestLatencyStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		app     *AppView
+		latency int64
+		want    string
+	}{
+		{"unknown app", nil, 10, "no thresholds"},
+		{"no thresholds", &AppView{}, 10, "no thresholds"},
+		{"within soft", &AppView{HardThresholdMs: ms(40), SoftThresholdMs: ms(20)}, 20, "within soft"},
+		{"within hard", &AppView{HardThresholdMs: ms(40), SoftThresholdMs: ms(20)}, 30, "within hard"},
+		{"violation", &AppView{HardThresholdMs: ms(40), SoftThresholdMs: ms(20)}, 41, "violation"},
+		{"above the soft threshold only", &AppView{SoftThresholdMs: ms(20)}, 30, "violation"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := latencyStatus(tt.app, tt.latency); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
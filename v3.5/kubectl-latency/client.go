@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	schedulerNamespace = "kube-system"
+	schedulerSelector  = "component=latency-aware-scheduler"
+	adminPort          = 10262
+	adminPrefix        = "/admin/v1/"
+)
+
+type Options struct {
+	kubeconfig          string
+	server              string
+	token               string
+	caFile              string
+	insecure            bool
+	namespace           string
+	migrationsConfigMap string
+	noColor             bool
+
+	config    *rest.Config
+	clientset *kubernetes.Clientset
+}
+
+// The views returned by the admin API of the scheduler.
+
+type AppView struct {
+	App              string   `json:"app"`
+	HardThresholdMs  *int64   `json:"hardThresholdMs,omitempty"`
+	SoftThresholdMs  *int64   `json:"softThresholdMs,omitempty"`
+	Objective        string   `json:"objective,omitempty"`
+	BaselineReplicas *int32   `json:"baselineReplicas,omitempty"`
+	Paused           bool     `json:"paused"`
+	PauseSources     []string `json:"pauseSources,omitempty"`
+}
+
+type MeasurementView struct {
+	Pod       string    `json:"pod"`
+	LatencyMs int64     `json:"latencyMs"`
+	Requests  int64     `json:"requests"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type AssociationView struct {
+	App       string    `json:"app"`
+	User      string    `json:"user"`
+	Node      string    `json:"node"`
+	Pod       string    `json:"pod"`
+	LatencyMs int64     `json:"latencyMs"`
+	Soft      bool      `json:"soft"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Migration is a make-before-break migration, as kept by the scheduler in its ConfigMap.
+type Migration struct {
+	ID         string    `json:"id"`
+	App        string    `json:"app"`
+	SourcePod  string    `json:"sourcePod"`
+	SourceNode string    `json:"sourceNode"`
+	TargetNode string    `json:"targetNode"`
+	TargetPod  string    `json:"targetPod,omitempty"`
+	Reason     string    `json:"reason"`
+	Phase      string    `json:"phase"`
+	Message    string    `json:"message,omitempty"`
+	MovedUsers []string  `json:"movedUsers,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// AdminClient calls the admin API of the scheduler.
+type AdminClient struct {
+	server     string
+	httpClient *http.Client
+}
+
+func (o *Options) kubeConfig() (*rest.Config, error) {
+	if o.config != nil {
+		return o.config, nil
+	}
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = o.kubeconfig
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("error loading the kubeconfig: %v", err)
+	}
+	o.config = config
+	return config, nil
+}
+
+func (o *Options) kubeClient() (*kubernetes.Clientset, error) {
+	if o.clientset != nil {
+		return o.clientset, nil
+	}
+	config, err := o.kubeConfig()
+	if err != nil {
+		return nil, err
+	}
+	o.clientset, err = kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating clientset: %v", err)
+	}
+	return o.clientset, nil
+}
+
+// adminConfig authenticates to the admin API as the operator: with --token, or with the token of
+// the kubeconfig user (static or from its exec plugin). The certificate of the admin API is verified
+// with --ca-file, or with the CA of the cluster, unless --insecure.
+func (o *Options) adminConfig() (*rest.Config, error) {
+	config := &rest.Config{}
+	if o.token == "" || (o.caFile == "" && !o.insecure) {
+		kubeConfig, err := o.kubeConfig()
+		if err != nil {
+			return nil, err
+		}
+		config = rest.CopyConfig(kubeConfig)
+	}
+	if o.token != "" {
+		config.BearerToken, config.BearerTokenFile = o.token, ""
+		config.ExecProvider, config.AuthProvider = nil, nil
+	} else if config.BearerToken == "" && config.BearerTokenFile == "" && config.ExecProvider == nil && config.AuthProvider == nil {
+		return nil, fmt.Errorf("the kubeconfig user has no token to authenticate to the admin API, set --token")
+	}
+	config.Username, config.Password = "", ""
+	config.CertFile, config.KeyFile, config.CertData, config.KeyData = "", "", nil, nil
+	config.ServerName = "" // the admin API isn't served under the name of the API server
+	if o.caFile != "" {
+		config.CAFile, config.CAData = o.caFile, nil
+	}
+	config.Insecure = o.insecure
+	if o.insecure {
+		config.CAFile, config.CAData = "", nil
+	}
+	return config, nil
+}
+
+// adminClient connects to --server, or to the host of the scheduler pod (it runs on the host network).
+func (o *Options) adminClient() (*AdminClient, error) {
+	server := o.server
+	if server == "" {
+		clientset, err := o.kubeClient()
+		if err != nil {
+			return nil, err
+		}
+		pods, err := clientset.CoreV1().Pods(schedulerNamespace).List(context.Background(), metav1.ListOptions{LabelSelector: schedulerSelector})
+		if err != nil {
+			return nil, fmt.Errorf("error looking for the scheduler: %v", err)
+		}
+		for _, pod := range pods.Items {
+			if pod.Status.Phase == v1.PodRunning && pod.Status.HostIP != "" {
+				server = fmt.Sprintf("https://%s:%d", pod.Status.HostIP, adminPort)
+				break
+			}
+		}
+		if server == "" {
+			return nil, fmt.Errorf("no running scheduler pod in %s (%s), set --server", schedulerNamespace, schedulerSelector)
+		}
+	}
+
+	config, err := o.adminConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport, err := rest.TransportFor(config)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring the connection to the admin API: %v", err)
+	}
+	return &AdminClient{
+		server:     strings.TrimSuffix(server, "/"),
+		httpClient: &http.Client{Timeout: 10 * time.Second, Transport: transport},
+	}, nil
+}
+
+// get decodes the response of GET /admin/v1/<path> into out.
+func (c *AdminClient) get(path string, query url.Values, out interface{}) error {
+	endpoint := c.server + adminPrefix + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling the admin API: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading the response of %s: %v", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiError struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &apiError) == nil && apiError.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, apiError.Error)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, out)
+}
+
+func (c *AdminClient) Apps() ([]AppView, error) {
+	var apps []AppView
+	if err := c.get("apps", nil, &apps); err != nil {
+		return nil, err
+	}
+	return apps, nil
+}
+
+func (c *AdminClient) App(appName string) (*AppView, error) {
+	var app AppView
+	if err := c.get("apps/"+url.PathEscape(appName), nil, &app); err != nil {
+		return nil, err
+	}
+	return &app, nil
+}
+
+// Measurements returns the latency matrix, appName -> userID -> nodeName -> measurement (all apps if appName is empty).
+func (c *AdminClient) Measurements(appName string) (map[string]map[string]map[string]MeasurementView, error) {
+	query := url.Values{}
+	if appName != "" {
+		query.Set("app", appName)
+	}
+	var matrix map[string]map[string]map[string]MeasurementView
+	if err := c.get("measurements", query, &matrix); err != nil {
+		return nil, err
+	}
+	return matrix, nil
+}
+
+func (c *AdminClient) Associations(appName string) ([]AssociationView, error) {
+	query := url.Values{}
+	if appName != "" {
+		query.Set("app", appName)
+	}
+	var associations []AssociationView
+	if err := c.get("associations", query, &associations); err != nil {
+		return nil, err
+	}
+	return associations, nil
+}
+
+// migrations reads the migrations kept by the scheduler, if it runs with --eviction-mode migrate.
+func (o *Options) migrations() ([]Migration, error) {
+	clientset, err := o.kubeClient()
+	if err != nil {
+		return nil, err
+	}
+	namespace, name, ok := strings.Cut(o.migrationsConfigMap, "/")
+	if !ok {
+		return nil, fmt.Errorf("migrations-configmap must be in the form namespace/name")
+	}
+	configMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil // the scheduler doesn't migrate pods
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading the migrations: %v", err)
+	}
+	var migrations []Migration
+	for key, value := range configMap.Data {
+		var migration Migration
+		if err := json.Unmarshal([]byte(value), &migration); err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring migration %s: %v\n", key, err)
+			continue
+		}
+		migrations = append(migrations, migration)
+	}
+	return migrations, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKubeconfig writes a kubeconfig whose user authenticates with token and whose cluster CA is caPEM (none if empty).
+func writeKubeconfig(t *testing.T, caPEM []byte, token string) string {
+	ca := ""
+	if len(caPEM) > 0 {
+		ca = "    certificate-authority-data: " + base64.StdEncoding.EncodeToString(caPEM) + "\n"
+	}
+	user := "  user: {}\n"
+	if token != "" {
+		user = "  user:\n    token: " + token + "\n"
+	}
+	kubeconfig := "apiVersion: v1\nkind: Config\nclusters:\n- name: c\n  cluster:\n    server: https://127.0.0.1:6443\n" + ca +
+		"users:\n- name: u\n" + user +
+		"contexts:\n- name: ctx\n  context:\n    cluster: c\n    user: u\ncurrent-context: ctx\n"
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	if err := os.WriteFile(path, []byte(kubeconfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAdminClientConnection(t *testing.T) {
+	var authorization string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte(`[{"app": "nginx", "paused": false}]`))
+	}))
+	defer server.Close()
+	serverCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caFile, serverCA, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		clusterCA     []byte
+		kubeToken     string
+		token         string
+		caFile        string
+		insecure      bool
+		authorization string // sent to the admin API
+		wantErr       string
+	}{
+		{name: "cluster CA and kubeconfig token", clusterCA: serverCA, kubeToken: "operator", authorization: "Bearer operator"},
+		{name: "CA file", kubeToken: "operator", caFile: caFile, authorization: "Bearer operator"},
+		{name: "token flag over the kubeconfig", clusterCA: serverCA, kubeToken: "operator", token: "admin", authorization: "Bearer admin"},
+		{name: "unknown certificate", kubeToken: "operator", wantErr: "certificate"},
+		{name: "insecure", kubeToken: "operator", insecure: true, authorization: "Bearer operator"},
+		{name: "kubeconfig user without a token", clusterCA: serverCA, wantErr: "set --token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authorization = ""
+			options := &Options{
+				kubeconfig: writeKubeconfig(t, tt.clusterCA, tt.kubeToken),
+				server:     server.URL,
+				token:      tt.token,
+				caFile:     tt.caFile,
+				insecure:   tt.insecure,
+			}
+			client, err := options.adminClient()
+			if err == nil {
+				_, err = client.Apps()
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apps: %v", err)
+			}
+			if authorization != tt.authorization {
+				t.Errorf("authenticated with %q, want %q", authorization, tt.authorization)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"scheduler/shared/drain"
+)
+
+// Annotations written by the scheduler on the pods.
+const (
+	nodeHintAnnotation        = "latency-aware-scheduler/node-hint"
+	podDeletionCostAnnotation = "controller.kubernetes.io/pod-deletion-cost"
+	victimDeletionCost        = -2147483648
+)
+
+// runExplainPod gathers what the scheduler knows about the pod: where it runs and why, the users it
+// serves, whether it is being removed, and the events and migrations that concern it (the only
+// trace left once the pod is evicted).
+func runExplainPod(o *Options, podName string) error {
+	clientset, err := o.kubeClient()
+	if err != nil {
+		return err
+	}
+	pod, err := clientset.CoreV1().Pods(o.namespace).Get(context.Background(), podName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		pod = nil
+		fmt.Printf("Pod %s/%s not found: it was evicted or removed.\n", o.namespace, podName)
+	} else if err != nil {
+		return fmt.Errorf("error reading the pod: %v", err)
+	}
+
+	if pod != nil {
+		appName := pod.Labels["app"]
+		fmt.Printf("Pod %s/%s of app %s, %s on node %s (scheduler %s, created %s ago)\n", pod.Namespace, pod.Name, orNone(appName),
+			pod.Status.Phase, orNone(pod.Spec.NodeName), pod.Spec.SchedulerName, time.Since(pod.CreationTimestamp.Time).Round(time.Second))
+		if hint, ok := pod.Annotations[nodeHintAnnotation]; ok {
+			fmt.Printf("  Placement: node %s requested by the node hint of the pod\n", hint)
+		}
+		explainRemoval(pod)
+		if appName != "" {
+			if err := o.explainUsers(pod, appName); err != nil {
+				fmt.Printf("  Users: unavailable (%v)\n", err)
+			}
+		}
+	}
+
+	migrations, err := o.migrations()
+	if err != nil {
+		return err
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].StartedAt.Before(migrations[j].StartedAt) })
+	for _, migration := range migrations {
+		switch podName {
+		case migration.SourcePod:
+			fmt.Printf("  Migration %s: moved from node %s to %s (%s), %s %s ago: %s\n", migration.ID, migration.SourceNode, migration.TargetNode,
+				migration.Reason, migration.Phase, time.Since(migration.UpdatedAt).Round(time.Second), orNone(migration.Message))
+		case migration.TargetPod:
+			fmt.Printf("  Migration %s: replacement of pod %s (%s), %s %s ago: %s\n", migration.ID, migration.SourcePod,
+				migration.Reason, migration.Phase, time.Since(migration.UpdatedAt).Round(time.Second), orNone(migration.Message))
+		}
+	}
+
+	events, err := clientset.CoreV1().Events(o.namespace).List(context.Background(), metav1.ListOptions{
+		FieldSelector: fields.Set{"involvedObject.kind": "Pod", "involvedObject.name": podName}.String(),
+	})
+	if err != nil {
+		return fmt.Errorf("error listing the events of the pod: %v", err)
+	}
+	sort.Slice(events.Items, func(i, j int) bool { return eventTime(&events.Items[i]).Before(eventTime(&events.Items[j])) })
+	if len(events.Items) == 0 {
+		fmt.Println("  Events: none (they expire after an hour)")
+		return nil
+	}
+	fmt.Println("  Events:")
+	w := newTabWriter()
+	for i := range events.Items {
+		event := &events.Items[i]
+		source := event.Source.Component
+		if source == "" {
+			source = event.ReportingController
+		}
+		fmt.Fprintf(w, "    %s ago\t%s\t%s\t%s\n", time.Since(eventTime(event)).Round(time.Second), source, event.Reason, event.Message)
+	}
+	w.Flush()
+	return nil
+}
+
+func eventTime(event *v1.Event) time.Time {
+	if !event.LastTimestamp.IsZero() {
+		return event.LastTimestamp.Time
+	}
+	if !event.EventTime.IsZero() {
+		return event.EventTime.Time
+	}
+	return event.CreationTimestamp.Time
+}
+
+// explainRemoval tells whether the scheduler is removing the pod.
+func explainRemoval(pod *v1.Pod) {
+	if pod.DeletionTimestamp != nil {
+		fmt.Printf("  Removal: terminating since %s\n", pod.DeletionTimestamp.Format(time.RFC3339))
+	}
+	if deadline, ok := pod.Annotations[drain.DeadlineAnnotation]; ok {
+		if reason, evicted := pod.Annotations[drain.EvictionAnnotation]; evicted {
+			fmt.Printf("  Removal: draining until %s, then evicted (%s)\n", deadline, reason)
+		} else {
+			fmt.Printf("  Removal: draining until %s, then scaled in\n", deadline)
+		}
+	}
+	if value, ok := pod.Annotations[podDeletionCostAnnotation]; ok {
+		cost, _ := strconv.ParseInt(value, 10, 64)
+		if cost == victimDeletionCost {
+			fmt.Println("  Removal: first to go when the replicas decrease (chosen for scale-in)")
+		} else {
+			fmt.Printf("  Deletion cost: %d (value of the users it serves)\n", cost)
+		}
+	}
+}
+
+// explainUsers lists the users associated to the pod and how the users of the app see its node.
+func (o *Options) explainUsers(pod *v1.Pod, appName string) error {
+	client, err := o.adminClient()
+	if err != nil {
+		return err
+	}
+	app, err := client.App(appName)
+	if err != nil {
+		return err
+	}
+	associations, err := client.Associations(appName)
+	if err != nil {
+		return err
+	}
+	matrix, err := client.Measurements(appName)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("  Policy: %s, objective %s\n", thresholdsSummary(app), orNone(app.Objective))
+	if app.Paused {
+		fmt.Printf("  Paused: descheduling and autoscaling are paused (%v)\n", app.PauseSources)
+	}
+
+	served := 0
+	for _, association := range associations {
+		if association.Pod == pod.Name {
+			served++
+			fmt.Printf("  Serves user %s at %dms (%s)\n", association.User, association.LatencyMs,
+				o.colored(latencyColor(app, association.LatencyMs), latencyStatus(app, association.LatencyMs)))
+		}
+	}
+	if served == 0 {
+		fmt.Println("  Serves no associated user: it is a candidate for scale-in when the app is above its baseline replicas")
+	}
+
+	within, measured := 0, 0
+	for _, userID := range sortedKeys(matrix[appName]) {
+		measurement, ok := matrix[appName][userID][pod.Spec.NodeName]
+		if !ok {
+			continue
+		}
+		measured++
+		if latencyStatus(app, measurement.LatencyMs) != "violation" {
+			within++
+		}
+	}
+	if measured > 0 {
+		fmt.Printf("  Node %s: within the thresholds for %d of the %d users that measured it\n", pod.Spec.NodeName, within, measured)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"scheduler/shared/drain"
+)
+
+// captureStdout returns what run prints.
+func captureStdout(t *testing.T, run func()) string {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+	run()
+	writer.Close()
+	output, _ := io.ReadAll(reader)
+	return string(output)
+}
+
+func TestExplainRemoval(t *testing.T) {
+	deleted := metav1.NewTime(time.Unix(1700000000, 0).UTC())
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		deletion    *metav1.Time
+		want        []string // lines printed
+	}{
+		{"not removed", nil, nil, nil},
+		{"terminating", nil, &deleted, []string{"  Removal: terminating since 2023-11-14T22:13:20Z"}},
+		{"draining for a scale-in", map[string]string{drain.DeadlineAnnotation: "2023-11-14T22:15:00Z"}, nil,
+			[]string{"  Removal: draining until 2023-11-14T22:15:00Z, then scaled in"}},
+		{"draining for an eviction", map[string]string{drain.DeadlineAnnotation: "2023-11-14T22:15:00Z", drain.EvictionAnnotation: "hard"}, nil,
+			[]string{"  Removal: draining until 2023-11-14T22:15:00Z, then evicted (hard)"}},
+		{"chosen for scale-in", map[string]string{podDeletionCostAnnotation: "-2147483648"}, nil,
+			[]string{"  Removal: first to go when the replicas decrease (chosen for scale-in)"}},
+		{"value of its users", map[string]string{podDeletionCostAnnotation: "990"}, nil,
+			[]string{"  Deletion cost: 990 (value of the users it serves)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nginx-1", Annotations: tt.annotations, DeletionTimestamp: tt.deletion}}
+			output := captureStdout(t, func() { explainRemoval(pod) })
+			if want := strings.Join(tt.want, "\n"); strings.TrimSuffix(output, "\n") != want {
+				t.Errorf("got %q, want %q", output, want)
+			}
+		})
+	}
+}
+
+func TestEventTime(t *testing.T) {
+	created, emitted, last := time.Unix(100, 0), time.Unix(200, 0), time.Unix(300, 0)
+	tests := []struct {
+		name  string
+		event v1.Event
+		want  time.Time
+	}{
+		{"last occurrence", v1.Event{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.NewTime(created)}, EventTime: metav1.NewMicroTime(emitted), LastTimestamp: metav1.NewTime(last)}, last},
+		{"events.k8s.io event", v1.Event{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.NewTime(created)}, EventTime: metav1.NewMicroTime(emitted)}, emitted},
+		{"creation only", v1.Event{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.NewTime(created)}}, created},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := eventTime(&tt.event); !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
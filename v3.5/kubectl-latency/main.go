@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+const usage = `kubectl latency inspects the latency-aware scheduling through the admin API of the scheduler.
+
+Usage:
+  kubectl latency matrix <app>        users x nodes latency heatmap of the app
+  kubectl latency assoc <user>        associations of the user, for every app
+  kubectl latency explain pod <name>  why the pod was placed on its node, or evicted
+  kubectl latency policy              thresholds and compliance of every app
+
+Flags:
+`
+
+func main() {
+	var options Options
+	flags := flag.NewFlagSet("kubectl-latency", flag.ExitOnError)
+	flags.StringVar(&options.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file (default: KUBECONFIG or ~/.kube/config)")
+	flags.StringVar(&options.server, "server", "", "URL of the scheduler admin API (default: https://<scheduler host IP>:10262)")
+	flags.StringVar(&options.token, "token", os.Getenv("LATENCY_ADMIN_TOKEN"), "Bearer token of the admin API (default: LATENCY_ADMIN_TOKEN, or the credentials of the kubeconfig user)")
+	flags.StringVar(&options.caFile, "ca-file", "", "CA of the admin API certificate (default: the CA of the cluster in the kubeconfig)")
+	flags.BoolVar(&options.insecure, "insecure", false, "Don't verify the admin API certificate, e.g. the self-signed one of a scheduler without --tls-cert-file")
+	flags.StringVar(&options.namespace, "namespace", "default", "Namespace of the pods")
+	flags.StringVar(&options.migrationsConfigMap, "migrations-configmap", "kube-system/latency-aware-scheduler-migrations", "ConfigMap (namespace/name) of the scheduler migrations")
+	flags.BoolVar(&options.noColor, "no-color", false, "Don't color the output")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	var args []string // the flags can follow the subcommand
+	rest := os.Args[1:]
+	for {
+		flags.Parse(rest)
+		rest = flags.Args()
+		if len(rest) == 0 {
+			break
+		}
+		args = append(args, rest[0])
+		rest = rest[1:]
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	var err error
+	switch {
+	case args[0] == "matrix" && len(args) == 2:
+		err = runMatrix(&options, args[1])
+	case args[0] == "assoc" && len(args) == 2:
+		err = runAssoc(&options, args[1])
+	case args[0] == "explain" && len(args) == 3 && args[1] == "pod":
+		err = runExplainPod(&options, args[2])
+	case args[0] == "policy" && len(args) == 1:
+		err = runPolicy(&options)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
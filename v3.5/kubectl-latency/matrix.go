@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	colorReset  = "\033[0m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorRed    = "\033[31m"
+	// colorDefault has the same length as the other colors: tabwriter counts the escapes as text, so
+	// every cell of a colored column (header included) must carry the same escapes to stay aligned.
+	colorDefault = "\033[39m"
+)
+
+// latencyColor is green within the soft threshold, yellow within the hard one and red above it.
+func latencyColor(app *AppView, latency int64) string {
+	switch {
+	case app.SoftThresholdMs != nil && latency <= *app.SoftThresholdMs:
+		return colorGreen
+	case app.HardThresholdMs != nil && latency <= *app.HardThresholdMs:
+		if app.SoftThresholdMs == nil {
+			return colorGreen
+		}
+		return colorYellow
+	case app.HardThresholdMs != nil || app.SoftThresholdMs != nil:
+		return colorRed
+	}
+	return ""
+}
+
+func (o *Options) colored(color, text string) string {
+	if o.noColor {
+		return text
+	}
+	if color == "" {
+		color = colorDefault
+	}
+	return color + text + colorReset
+}
+
+// runMatrix prints the latency between every user and node of the app, marking the node of the
+// association with a star.
+func runMatrix(o *Options, appName string) error {
+	client, err := o.adminClient()
+	if err != nil {
+		return err
+	}
+	app, err := client.App(appName)
+	if err != nil {
+		return err
+	}
+	matrix, err := client.Measurements(appName)
+	if err != nil {
+		return err
+	}
+	associations, err := client.Associations(appName)
+	if err != nil {
+		return err
+	}
+	userMeasurements := matrix[appName]
+	if len(userMeasurements) == 0 {
+		fmt.Printf("No measurements for app %s\n", appName)
+		return nil
+	}
+	associatedNode := make(map[string]string) // userID -> nodeName
+	for _, association := range associations {
+		associatedNode[association.User] = association.Node
+	}
+	nodeSet := make(map[string]bool)
+	for _, nodeMeasurements := range userMeasurements {
+		for nodeName := range nodeMeasurements {
+			nodeSet[nodeName] = true
+		}
+	}
+	users := sortedKeys(userMeasurements)
+	nodes := sortedKeys(nodeSet)
+
+	fmt.Printf("App %s, latency in ms (%s), * = associated node\n\n", appName, thresholdsSummary(app))
+	// the cells are padded before coloring them
+	width := 4
+	for _, nodeName := range nodes {
+		if len(nodeName) > width {
+			width = len(nodeName)
+		}
+	}
+	userWidth := 4
+	for _, userID := range users {
+		if len(userID) > userWidth {
+			userWidth = len(userID)
+		}
+	}
+	header := fmt.Sprintf("%-*s", userWidth, "USER")
+	for _, nodeName := range nodes {
+		header += fmt.Sprintf("  %*s", width, nodeName)
+	}
+	fmt.Println(header)
+	for _, userID := range users {
+		row := fmt.Sprintf("%-*s", userWidth, userID)
+		for _, nodeName := range nodes {
+			measurement, ok := userMeasurements[userID][nodeName]
+			if !ok {
+				row += fmt.Sprintf("  %*s", width, "-")
+				continue
+			}
+			cell := fmt.Sprintf("%d", measurement.LatencyMs)
+			if associatedNode[userID] == nodeName {
+				cell += "*"
+			}
+			row += "  " + o.colored(latencyColor(app, measurement.LatencyMs), fmt.Sprintf("%*s", width, cell))
+		}
+		fmt.Println(row)
+	}
+	if !o.noColor && (app.HardThresholdMs != nil || app.SoftThresholdMs != nil) {
+		fmt.Printf("\n%s  %s  %s\n", o.colored(colorGreen, "within soft"), o.colored(colorYellow, "within hard"), o.colored(colorRed, "violation"))
+	}
+	return nil
+}
+
+func thresholdsSummary(app *AppView) string {
+	var parts []string
+	if app.HardThresholdMs != nil {
+		parts = append(parts, fmt.Sprintf("hard %dms", *app.HardThresholdMs))
+	}
+	if app.SoftThresholdMs != nil {
+		parts = append(parts, fmt.Sprintf("soft %dms", *app.SoftThresholdMs))
+	}
+	if len(parts) == 0 {
+		return "no thresholds"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func newTabWriter() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
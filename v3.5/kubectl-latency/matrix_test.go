@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestLatencyColor(t *testing.T) {
+	tests := []struct {
+		name    string
+		app     *AppView
+		latency int64
+		want    string
+	}{
+		{"no thresholds", &AppView{}, 10, ""},
+		{"within soft", &AppView{HardThresholdMs: ms(40), SoftThresholdMs: ms(20)}, 10, colorGreen},
+		{"within hard", &AppView{HardThresholdMs: ms(40), SoftThresholdMs: ms(20)}, 30, colorYellow},
+		{"within hard without soft threshold", &AppView{HardThresholdMs: ms(40)}, 30, colorGreen},
+		{"violation", &AppView{HardThresholdMs: ms(40)}, 50, colorRed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := latencyColor(tt.app, tt.latency); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestColored(t *testing.T) {
+	for _, color := range []string{colorGreen, colorYellow, colorRed} {
+		if len(color) != len(colorDefault) {
+			t.Errorf("color %q is not as long as the default one", color)
+		}
+	}
+	tests := []struct {
+		name    string
+		noColor bool
+		color   string
+		want    string
+	}{
+		{"colored", false, colorRed, colorRed + "text" + colorReset},
+		{"default color keeps the width of the column", false, "", colorDefault + "text" + colorReset},
+		{"no color", true, colorRed, "text"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (&Options{noColor: tt.noColor}).colored(tt.color, "text"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThresholdsSummary(t *testing.T) {
+	tests := []struct {
+		app  *AppView
+		want string
+	}{
+		{&AppView{}, "no thresholds"},
+		{&AppView{HardThresholdMs: ms(40)}, "hard 40ms"},
+		{&AppView{HardThresholdMs: ms(40), SoftThresholdMs: ms(20)}, "hard 40ms, soft 20ms"},
+	}
+	for _, tt := range tests {
+		if got := thresholdsSummary(tt.app); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
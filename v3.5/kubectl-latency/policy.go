@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// runPolicy prints the thresholds of every app and how many of its measured users are associated
+// within them.
+func runPolicy(o *Options) error {
+	client, err := o.adminClient()
+	if err != nil {
+		return err
+	}
+	apps, err := client.Apps()
+	if err != nil {
+		return err
+	}
+	associations, err := client.Associations("")
+	if err != nil {
+		return err
+	}
+	matrix, err := client.Measurements("")
+	if err != nil {
+		return err
+	}
+	associationsPerApp := make(map[string][]AssociationView)
+	for _, association := range associations {
+		associationsPerApp[association.App] = append(associationsPerApp[association.App], association)
+	}
+
+	w := newTabWriter()
+	fmt.Fprintf(w, "APP\tHARD\tSOFT\tOBJECTIVE\tBASELINE\tPAUSED\tUSERS\tASSOCIATED\t%s\t%s\n", o.colored("", "HARD COMPLIANCE"), o.colored("", "SOFT COMPLIANCE"))
+	for i := range apps {
+		app := &apps[i]
+		users := len(matrix[app.App])
+		withinHard, withinSoft := 0, 0
+		for _, association := range associationsPerApp[app.App] {
+			if app.HardThresholdMs != nil && association.LatencyMs <= *app.HardThresholdMs {
+				withinHard++
+			}
+			if app.SoftThresholdMs != nil && association.LatencyMs <= *app.SoftThresholdMs {
+				withinSoft++
+			}
+		}
+		paused := "no"
+		if app.Paused {
+			paused = "yes (" + strings.Join(app.PauseSources, ",") + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n", app.App,
+			optionalMs(app.HardThresholdMs), optionalMs(app.SoftThresholdMs), orNone(app.Objective), optionalReplicas(app.BaselineReplicas), paused,
+			users, len(associationsPerApp[app.App]),
+			o.compliance(app.HardThresholdMs != nil, withinHard, users), o.compliance(app.SoftThresholdMs != nil, withinSoft, users))
+	}
+	w.Flush()
+	return nil
+}
+
+// compliance is the share of the users associated within the threshold, colored by how far it is from all of them.
+func (o *Options) compliance(hasThreshold bool, within, users int) string {
+	if !hasThreshold || users == 0 {
+		return o.colored("", "-")
+	}
+	ratio := float64(within) / float64(users)
+	color := colorRed
+	switch {
+	case ratio == 1:
+		color = colorGreen
+	case ratio >= 0.9:
+		color = colorYellow
+	}
+	return o.colored(color, fmt.Sprintf("%.0f%% (%d/%d)", 100*ratio, within, users))
+}
+
+func optionalMs(value *int64) string {
+	if value == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%dms", *value)
+}
+
+func optionalReplicas(value *int32) string {
+	if value == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%d", *value)
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestCompliance(t *testing.T) {
+	tests := []struct {
+		name         string
+		hasThreshold bool
+		within       int
+		users        int
+		want         string
+	}{
+		{"no threshold", false, 0, 10, "-"},
+		{"no user", true, 0, 0, "-"},
+		{"every user", true, 10, 10, colorGreen + "100% (10/10)" + colorReset},
+		{"nearly every user", true, 9, 10, colorYellow + "90% (9/10)" + colorReset},
+		{"few users", true, 1, 3, colorRed + "33% (1/3)" + colorReset},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := (&Options{}).compliance(tt.hasThreshold, tt.within, tt.users)
+			if tt.want == "-" {
+				tt.want = colorDefault + "-" + colorReset
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOptionalValues(t *testing.T) {
+	replicas := int32(3)
+	tests := []struct {
+		got, want string
+	}{
+		{optionalMs(nil), "-"},
+		{optionalMs(ms(40)), "40ms"},
+		{optionalReplicas(nil), "-"},
+		{optionalReplicas(&replicas), "3"},
+		{orNone(""), "-"},
+		{orNone("minimax"), "minimax"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("got %q, want %q", tt.got, tt.want)
+		}
+	}
+}
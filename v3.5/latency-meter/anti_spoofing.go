@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	fastestRedemptionWindow = 5 * time.Minute       // a user slower for longer than this is measured again
+	redemptionSlack         = 20 * time.Millisecond // jitter allowed over the slowdown of the fastest redemption
+)
+
+// ChallengeIssuer hands out short-lived HMAC-signed challenges. The latency is measured by the meter
+// itself, as the time between the issue of a challenge and the arrival of the request that proves it,
+// so a client can't forge it by tampering with its own timestamps. A client can still hold a challenge
+// before presenting it to look slower: the TTL bounds the delay, and a redemption much slower than the
+// fastest one of the user in the last minutes is rejected.
+type ChallengeIssuer struct {
+	secret      []byte
+	ttl         time.Duration
+	maxSlowdown int64                // a redemption can take at most maxSlowdown times the fastest one (0: unbounded)
+	used        map[string]time.Time // nonce -> expiration, a challenge can be used only once
+	fastest     map[string]redemption
+	mu          sync.Mutex
+	now         func() time.Time
+}
+
+type redemption struct {
+	elapsed time.Duration
+	at      time.Time
+}
+
+// NewChallengeIssuer reads the HMAC secret from CHALLENGE_SECRET. It must be shared by all the meters
+// of an app, because the challenge and the proof may reach different pods; if it is not set a random
+// secret is generated and the challenges are valid only on this pod.
+func NewChallengeIssuer(ttl time.Duration, maxSlowdown int64) *ChallengeIssuer {
+	secret := []byte(os.Getenv("CHALLENGE_SECRET"))
+	if len(secret) == 0 {
+		fmt.Println("CHALLENGE_SECRET not set, using a random secret valid only for this pod")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			panic(fmt.Errorf("error generating the challenge secret: %v", err))
+		}
+	}
+	return &ChallengeIssuer{
+		secret:      secret,
+		ttl:         ttl,
+		maxSlowdown: maxSlowdown,
+		used:        make(map[string]time.Time),
+		fastest:     make(map[string]redemption),
+		now:         time.Now,
+	}
+}
+
+func (c *ChallengeIssuer) sign(payload string) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns a challenge bound to userID: base64(userID|issuedAtNanos|nonce).signature
+func (c *ChallengeIssuer) Issue(userID string) (string, error) {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s|%d|%s", userID, c.now().UnixNano(), hex.EncodeToString(nonce))))
+	return payload + "." + c.sign(payload), nil
+}
+
+// Verify checks a challenge presented by userID and returns the elapsed time since it was issued.
+func (c *ChallengeIssuer) Verify(userID, challenge string) (time.Duration, error) {
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("malformed challenge")
+	}
+	if !hmac.Equal([]byte(c.sign(parts[0])), []byte(parts[1])) {
+		return 0, fmt.Errorf("invalid challenge signature")
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("malformed challenge payload")
+	}
+	fields := strings.Split(string(decoded), "|")
+	if len(fields) != 3 {
+		return 0, fmt.Errorf("malformed challenge payload")
+	}
+	if fields[0] != userID {
+		return 0, fmt.Errorf("challenge issued to another user")
+	}
+	issuedAt, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed challenge timestamp")
+	}
+	now := c.now()
+	elapsed := now.Sub(time.Unix(0, issuedAt))
+	if elapsed > c.ttl {
+		return 0, fmt.Errorf("challenge expired")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for nonce, expiration := range c.used {
+		if now.After(expiration) {
+			delete(c.used, nonce)
+		}
+	}
+	for user, fastest := range c.fastest {
+		if now.Sub(fastest.at) > fastestRedemptionWindow {
+			delete(c.fastest, user)
+		}
+	}
+	if _, ok := c.used[fields[2]]; ok {
+		return 0, fmt.Errorf("challenge already used")
+	}
+	c.used[fields[2]] = time.Unix(0, issuedAt).Add(c.ttl)
+	fastest, ok := c.fastest[userID]
+	if ok && c.maxSlowdown > 0 && elapsed > time.Duration(c.maxSlowdown)*fastest.elapsed+redemptionSlack {
+		return 0, fmt.Errorf("challenge presented after %v, much slower than the fastest %v of the user", elapsed, fastest.elapsed)
+	}
+	if !ok || elapsed <= fastest.elapsed {
+		c.fastest[userID] = redemption{elapsed: elapsed, at: now}
+	}
+	return elapsed, nil
+}
+
+// MeasurementLimiter rate-limits the accepted measurements per user and per source IP,
+// and drops the physically impossible values.
+type MeasurementLimiter struct {
+	perUser     map[string]*rate.Limiter
+	perIP       map[string]*rate.Limiter
+	userLimit   rate.Limit
+	ipLimit     rate.Limit
+	burst       int
+	maxLatency  int64
+	lastCleanup time.Time
+	mu          sync.Mutex
+}
+
+// NewMeasurementLimiter reads MEASUREMENTS_PER_MINUTE_PER_USER, MEASUREMENTS_PER_MINUTE_PER_IP
+// and MAX_LATENCY_MS (the ceiling above which a measurement is considered impossible).
+func NewMeasurementLimiter() *MeasurementLimiter {
+	return &MeasurementLimiter{
+		perUser:     make(map[string]*rate.Limiter),
+		perIP:       make(map[string]*rate.Limiter),
+		userLimit:   rate.Limit(envInt("MEASUREMENTS_PER_MINUTE_PER_USER", 30)) / 60,
+		ipLimit:     rate.Limit(envInt("MEASUREMENTS_PER_MINUTE_PER_IP", 120)) / 60,
+		burst:       5,
+		maxLatency:  envInt("MAX_LATENCY_MS", 10000),
+		lastCleanup: time.Now(),
+	}
+}
+
+func envInt(name string, defaultValue int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(name), 10, 64)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func (m *MeasurementLimiter) limiter(limiters map[string]*rate.Limiter, key string, limit rate.Limit) *rate.Limiter {
+	l, ok := limiters[key]
+	if !ok {
+		l = rate.NewLimiter(limit, m.burst)
+		limiters[key] = l
+	}
+	return l
+}
+
+// Accept tells whether a measurement of latency (ms) from userID and sourceIP must be stored.
+func (m *MeasurementLimiter) Accept(userID, sourceIP string, latency int64) error {
+	if latency < 0 || latency > m.maxLatency {
+		return fmt.Errorf("impossible latency %d ms (allowed 0-%d)", latency, m.maxLatency)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Since(m.lastCleanup) > 10*time.Minute { // forget the limiters of inactive users
+		m.perUser = make(map[string]*rate.Limiter)
+		m.perIP = make(map[string]*rate.Limiter)
+		m.lastCleanup = time.Now()
+	}
+	// A measurement rejected by one limit doesn't take a token from the other
+	now := time.Now()
+	user := m.limiter(m.perUser, userID, m.userLimit).ReserveN(now, 1)
+	if !user.OK() || user.DelayFrom(now) > 0 {
+		user.CancelAt(now)
+		return fmt.Errorf("too many measurements for user %s", userID)
+	}
+	ip := m.limiter(m.perIP, sourceIP, m.ipLimit).ReserveN(now, 1)
+	if !ip.OK() || ip.DelayFrom(now) > 0 {
+		ip.CancelAt(now)
+		user.CancelAt(now)
+		return fmt.Errorf("too many measurements from %s", sourceIP)
+	}
+	return nil
+}
+
+// trustedProxies are the networks (TRUSTED_PROXIES, comma separated CIDRs) whose X-Forwarded-For
+// header is trusted, e.g. the routing managers.
+func trustedProxies() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			fmt.Println("Ignoring invalid trusted proxy CIDR", cidr, ":", err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// clientIP returns the source IP of the request, following X-Forwarded-For only if the
+// request comes from a trusted proxy.
+func clientIP(r *http.Request, proxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote := net.ParseIP(host)
+	forwarded := r.Header.Get("X-Forwarded-For")
+	if remote == nil || forwarded == "" {
+		return host
+	}
+	for _, network := range proxies {
+		if network.Contains(remote) {
+			hops := strings.Split(forwarded, ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+	return host
+}
+
+// MeasurementGuard groups the checks applied to every client-supplied measurement.
+type MeasurementGuard struct {
+	challenges            *ChallengeIssuer
+	limiter               *MeasurementLimiter
+	proxies               []*net.IPNet
+	allowClientTimestamps bool // legacy X-Timestamp measurements, trivially forgeable
+}
+
+// NewMeasurementGuard reads CHALLENGE_TTL_MS, which defaults to MAX_LATENCY_MS and can't be lower:
+// the latency of a challenge redeemed after its TTL can't be measured, so the ceiling would be unreachable.
+func NewMeasurementGuard() (*MeasurementGuard, error) {
+	proxies := trustedProxies()
+	if len(proxies) == 0 {
+		fmt.Println("TRUSTED_PROXIES not set: behind the routing managers all the users share their IP, and its measurement limit")
+	}
+	limiter := NewMeasurementLimiter()
+	ttl := envInt("CHALLENGE_TTL_MS", limiter.maxLatency)
+	if ttl < limiter.maxLatency {
+		return nil, fmt.Errorf("CHALLENGE_TTL_MS %d is lower than MAX_LATENCY_MS %d: the latencies in between couldn't be measured", ttl, limiter.maxLatency)
+	}
+	return &MeasurementGuard{
+		challenges:            NewChallengeIssuer(time.Duration(ttl)*time.Millisecond, envInt("CHALLENGE_MAX_SLOWDOWN", 4)),
+		limiter:               limiter,
+		proxies:               proxies,
+		allowClientTimestamps: os.Getenv("ALLOW_CLIENT_TIMESTAMPS") == "true",
+	}, nil
+}
+
+// Measure returns the latency (ms) proved by the request, or an error if the request carries
+// no valid proof or the measurement must be dropped.
+func (g *MeasurementGuard) Measure(r *http.Request, userID string) (int64, error) {
+	if userID == "" {
+		return 0, fmt.Errorf("missing user id")
+	}
+	var latency int64
+	if challenge := r.Header.Get("X-Challenge"); challenge != "" {
+		elapsed, err := g.challenges.Verify(userID, challenge)
+		if err != nil {
+			return 0, err
+		}
+		latency = elapsed.Milliseconds()
+	} else if clientTimestampStr := r.Header.Get("X-Timestamp"); g.allowClientTimestamps && clientTimestampStr != "" {
+		clientTimestamp, err := strconv.ParseInt(clientTimestampStr, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("error parsing client timestamp %s", clientTimestampStr)
+		}
+		latency = time.Now().UnixNano()/int64(time.Millisecond) - clientTimestamp
+	} else {
+		return 0, fmt.Errorf("no timing proof")
+	}
+	if err := g.limiter.Accept(userID, clientIP(r, g.proxies), latency); err != nil {
+		return 0, err
+	}
+	return latency, nil
+}
+
+// handleChallenge issues a challenge to the user in the id query parameter.
+func (g *MeasurementGuard) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("id")
+	if userID == "" {
+		http.Error(w, "User ID not provided", http.StatusBadRequest)
+		return
+	}
+	challenge, err := g.challenges.Issue(userID)
+	if err != nil {
+		http.Error(w, "Error issuing challenge", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(challenge))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChallengeVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    string // presenting the challenge issued to "u1"
+		tamper  func(challenge string) string
+		delays  []time.Duration // redemptions of the user before this one, each with a new challenge
+		delay   time.Duration
+		reuse   bool
+		wantErr string
+	}{
+		{name: "valid", user: "u1", delay: 30 * time.Millisecond},
+		{name: "issued to another user", user: "u2", delay: 30 * time.Millisecond, wantErr: "another user"},
+		{name: "tampered signature", user: "u1", tamper: func(c string) string { return c + "x" }, wantErr: "signature"},
+		{name: "malformed", user: "u1", tamper: func(string) string { return "abc" }, wantErr: "malformed"},
+		{name: "expired", user: "u1", delay: 1100 * time.Millisecond, wantErr: "expired"},
+		{name: "used twice", user: "u1", delay: 30 * time.Millisecond, reuse: true, wantErr: "already used"},
+		{name: "within the slowdown of the fastest", user: "u1", delays: []time.Duration{30 * time.Millisecond}, delay: 130 * time.Millisecond},
+		{name: "held much longer than the fastest", user: "u1", delays: []time.Duration{30 * time.Millisecond}, delay: 500 * time.Millisecond, wantErr: "much slower"},
+		{name: "the fastest is forgotten after the window", user: "u1", delays: []time.Duration{30 * time.Millisecond, fastestRedemptionWindow}, delay: 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CHALLENGE_SECRET", "secret")
+			issuer := NewChallengeIssuer(time.Second, 4)
+			now := time.Unix(1000, 0)
+			issuer.now = func() time.Time { return now }
+			for _, delay := range tt.delays {
+				if delay >= fastestRedemptionWindow {
+					now = now.Add(delay) // idle user
+					continue
+				}
+				challenge, _ := issuer.Issue("u1")
+				now = now.Add(delay)
+				if _, err := issuer.Verify("u1", challenge); err != nil {
+					t.Fatalf("earlier redemption: %v", err)
+				}
+			}
+
+			challenge, err := issuer.Issue("u1")
+			if err != nil {
+				t.Fatalf("Issue: %v", err)
+			}
+			if tt.tamper != nil {
+				challenge = tt.tamper(challenge)
+			}
+			now = now.Add(tt.delay)
+			elapsed, err := issuer.Verify(tt.user, challenge)
+			if tt.reuse && err == nil {
+				elapsed, err = issuer.Verify(tt.user, challenge)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if elapsed != tt.delay {
+				t.Errorf("measured %v, want %v", elapsed, tt.delay)
+			}
+		})
+	}
+}
+
+func TestChallengeSecretShared(t *testing.T) {
+	t.Setenv("CHALLENGE_SECRET", "shared")
+	issuer, verifier := NewChallengeIssuer(time.Second, 0), NewChallengeIssuer(time.Second, 0)
+	challenge, _ := issuer.Issue("u1")
+	if _, err := verifier.Verify("u1", challenge); err != nil {
+		t.Errorf("challenge refused by another meter with the same secret: %v", err)
+	}
+	t.Setenv("CHALLENGE_SECRET", "")
+	if _, err := NewChallengeIssuer(time.Second, 0).Verify("u1", challenge); err == nil {
+		t.Error("challenge accepted by a meter with another secret")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	_, routingManagers, _ := net.ParseCIDR("10.244.0.0/16")
+	proxies := []*net.IPNet{routingManagers}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		proxies    []*net.IPNet
+		want       string
+	}{
+		{"direct client", "192.0.2.7:5000", "", proxies, "192.0.2.7"},
+		{"forwarded by a trusted proxy", "10.244.1.5:5000", "192.0.2.7", proxies, "192.0.2.7"},
+		{"last hop of a trusted proxy", "10.244.1.5:5000", "203.0.113.1, 192.0.2.7", proxies, "192.0.2.7"},
+		{"forged by an untrusted client", "192.0.2.7:5000", "203.0.113.1", proxies, "192.0.2.7"},
+		{"no trusted proxy", "10.244.1.5:5000", "192.0.2.7", nil, "10.244.1.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/?id=u1", nil)
+			request.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				request.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := clientIP(request, tt.proxies); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMeasurementLimiter(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests [][2]string // userID, sourceIP
+		latency  int64
+		accepted int
+	}{
+		{"impossible latency", [][2]string{{"u1", "192.0.2.1"}}, 20000, 0},
+		{"negative latency", [][2]string{{"u1", "192.0.2.1"}}, -1, 0},
+		{"burst of one user", repeat([2]string{"u1", "192.0.2.1"}, 8), 30, 5},
+		{"users behind distinct IPs", append(repeat([2]string{"u1", "192.0.2.1"}, 5), repeat([2]string{"u2", "192.0.2.2"}, 5)...), 30, 10},
+		{"users behind one IP share its limit", append(repeat([2]string{"u1", "192.0.2.1"}, 5), repeat([2]string{"u2", "192.0.2.1"}, 5)...), 30, 5},
+		{"user rejected without taking from the IP limit", append(append(repeat([2]string{"u1", "192.0.2.1"}, 5), repeat([2]string{"u1", "192.0.2.2"}, 3)...), repeat([2]string{"u2", "192.0.2.2"}, 5)...), 30, 10},
+		{"IP rejected without taking from the user limit", append(append(repeat([2]string{"u1", "192.0.2.1"}, 5), repeat([2]string{"u2", "192.0.2.1"}, 3)...), repeat([2]string{"u2", "192.0.2.2"}, 5)...), 30, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewMeasurementLimiter()
+			accepted := 0
+			for _, request := range tt.requests {
+				if limiter.Accept(request[0], request[1], tt.latency) == nil {
+					accepted++
+				}
+			}
+			if accepted != tt.accepted {
+				t.Errorf("accepted %d measurements, want %d", accepted, tt.accepted)
+			}
+		})
+	}
+}
+
+func TestNewMeasurementGuard(t *testing.T) {
+	tests := []struct {
+		name       string
+		ttl        string
+		maxLatency string
+		want       time.Duration // TTL of the challenges
+		wantErr    bool
+	}{
+		{"TTL of the default ceiling", "", "", 10 * time.Second, false},
+		{"TTL of the ceiling", "", "2000", 2 * time.Second, false},
+		{"TTL above the ceiling", "3000", "2000", 3 * time.Second, false},
+		{"TTL below the ceiling", "1000", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CHALLENGE_TTL_MS", tt.ttl)
+			t.Setenv("MAX_LATENCY_MS", tt.maxLatency)
+			guard, err := NewMeasurementGuard()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && guard.challenges.ttl != tt.want {
+				t.Errorf("got TTL %v, want %v", guard.challenges.ttl, tt.want)
+			}
+		})
+	}
+}
+
+func repeat(request [2]string, n int) [][2]string {
+	requests := make([][2]string, n)
+	for i := range requests {
+		requests[i] = request
+	}
+	return requests
+}
@@ -9,16 +9,19 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
-	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"scheduler/shared/controltls"
+	"scheduler/shared/tokenauth"
 )
 
 type LatencyMeasurement struct {
@@ -26,27 +29,54 @@ type LatencyMeasurement struct {
 	PodName      string
 	Measurement  int64
 	Timestamp    time.Time
+	Requests     int64  // requests of the user since the last read, for the capacity of the pods
+	SourceIP     string `json:",omitempty"` // client IP, for the cohorts of the scheduler
 }
 
 type LatencyMeasurements struct {
-	data map[string]*LatencyMeasurement
+	data     map[string]*LatencyMeasurement
+	requests map[string]int64
+	mu       sync.Mutex
 } //per ogni utente ho una una misura!
 
 func NewLatencyMeasurements() *LatencyMeasurements {
 	return &LatencyMeasurements{
-		data: make(map[string]*LatencyMeasurement),
+		data:     make(map[string]*LatencyMeasurement),
+		requests: make(map[string]int64),
 	}
 }
+
+// Data returns a copy of the measurements, with the requests of every user.
 func (l *LatencyMeasurements) Data() map[string]*LatencyMeasurement {
-	return l.data
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	data := make(map[string]*LatencyMeasurement, len(l.data))
+	for userID, measurement := range l.data {
+		measurement := *measurement
+		measurement.Requests = l.requests[userID]
+		data[userID] = &measurement
+	}
+	return data
 }
 
 func (l *LatencyMeasurements) AddLatency(userID string, measurement *LatencyMeasurement) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	l.data[userID] = measurement
 }
 
+// CountRequest counts a request of the user, measured or not.
+func (l *LatencyMeasurements) CountRequest(userID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.requests[userID]++
+}
+
 func (l *LatencyMeasurements) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	l.data = make(map[string]*LatencyMeasurement)
+	l.requests = make(map[string]int64)
 }
 
 func getCurrentPod(clientset *kubernetes.Clientset) (*v1.Pod, error) {
@@ -101,26 +131,26 @@ func LatencyCalculated(w http.ResponseWriter, r *http.Request) {
 }
 */
 
-func latencyMiddleware(next http.Handler, pod *v1.Pod, latencyMeasurements *LatencyMeasurements) http.Handler {
+func latencyMiddleware(next http.Handler, pod *v1.Pod, latencyMeasurements *LatencyMeasurements, guard *MeasurementGuard) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("/ contacted (IP: ", r.RemoteAddr, ")") //DEBUG
 
-		userID := r.URL.Query().Get("id")                 // Extract the userID from the query parameters
-		clientTimestampStr := r.Header.Get("X-Timestamp") // Extract the user timestamp from the header
+		userID := r.URL.Query().Get("id") // Extract the userID from the query parameters
+		latencyMeasurements.CountRequest(userID)
 
-		// Convert the latency to an integer
-		clientTimestamp, err := strconv.ParseInt(clientTimestampStr, 10, 64)
+		latency, err := guard.Measure(r, userID)
 		if err != nil {
-			fmt.Println("Error parsing client timestamp. \tuserID: ", userID, "\tClientTimestamp: ", clientTimestampStr) //DEBUG
+			fmt.Println("Measurement dropped. \tuserID: ", userID, "\treason: ", err) //DEBUG
+			droppedMeasurements.Inc()
 		} else {
-			serverTimestamp := time.Now().UnixNano() / int64(time.Millisecond) // Current time in milliseconds
-			latency := serverTimestamp - clientTimestamp
+			measuredLatency.Observe(float64(latency))
 			fmt.Println("Latency calculated!\tlatency: ", latency, "\tuserID(IP): ", userID, "\tPodNamespace: ", pod.Namespace) //DEBUG
 			latencyMeasurements.AddLatency(userID, &LatencyMeasurement{
 				PodNamespace: pod.Namespace,
 				PodName:      pod.Name,
 				Measurement:  latency,
 				Timestamp:    time.Now(),
+				SourceIP:     clientIP(r, guard.proxies),
 			})
 		}
 
@@ -140,24 +170,42 @@ func measureLatency(clientset *kubernetes.Clientset, latencyMeasurements *Latenc
 
 	router := mux.NewRouter()
 
-	headers := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", "X-Timestamp"})
+	headers := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", "X-Timestamp", "X-Challenge"})
 	methods := handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"})
 	origins := handlers.AllowedOrigins([]string{"*"})
 
-	router.Handle("/", latencyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/measurements" {
-			// Proxy the request to the application
-			proxyURL, _ := url.Parse(appAddress)
-			proxy := httputil.NewSingleHostReverseProxy(proxyURL)
-			proxy.ServeHTTP(w, r)
+	guard, err := NewMeasurementGuard()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	router.HandleFunc("/challenge", guard.handleChallenge).Methods("GET")
+	var appHandler http.Handler = latencyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Proxy the request to the application
+		proxyURL, _ := url.Parse(appAddress)
+		proxy := httputil.NewSingleHostReverseProxy(proxyURL)
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			fmt.Println("Error proxying the request to the app:", err)
+			proxyErrors.Inc()
+			w.WriteHeader(http.StatusBadGateway)
 		}
-	}), pod, latencyMeasurements)).Methods("GET")
+		proxy.ServeHTTP(w, r)
+	}), pod, latencyMeasurements, guard)
+	// Test mode: artificial per-node/user/source delays, applied before the request is measured
+	injector, err := NewLatencyInjector(pod.Spec.NodeName, guard.proxies)
+	if err != nil { // a bad test-only file must not take down the meter and the app behind it
+		fmt.Println("Error enabling latency injection, measuring without it:", err)
+	} else if injector != nil {
+		appHandler = injector.Middleware(appHandler)
+	}
+	router.Handle("/", promhttp.InstrumentHandlerDuration(requestDuration, appHandler)).Methods("GET")
 	//router.HandleFunc("/latency", LatencyCalculated).Methods("GET") //anotherway to mesure latency
-	router.HandleFunc("/measurements", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println("/measurements contacted (IP: ", r.RemoteAddr, ")") //DEBUG
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
+	// The control endpoints are served on their own port, over TLS and only to the projected token of the scheduler
+	controlRouter := mux.NewRouter()
+	authenticator := tokenauth.New(clientset, tokenauth.AllowedUsersFromEnv(), tokenauth.AudiencesFromEnv()...)
+	controlRouter.Handle("/measurements", authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Println("/measurements contacted (IP: ", r.RemoteAddr, ")") //DEBUG
 
 		latencyMeasurementsJSON, err := json.Marshal(latencyMeasurements.Data())
 		if err != nil {
@@ -165,9 +213,29 @@ func measureLatency(clientset *kubernetes.Clientset, latencyMeasurements *Latenc
 			return
 		}
 
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
 		w.Write(latencyMeasurementsJSON)
 		latencyMeasurements.Reset()
-	}).Methods("GET")
+	}))).Methods("GET")
+	controlRouter.Handle("/metrics", promhttp.Handler()) // read-only, scraped by Prometheus without token
+
+	controlPort := os.Getenv("CONTROL_PORT")
+	if controlPort == "" {
+		controlPort = "8081"
+	}
+	tlsConfig, err := controltls.ServerConfigFromEnv()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	controlServer := &http.Server{Addr: ":" + controlPort, Handler: controlRouter, TLSConfig: tlsConfig}
+	go func() {
+		fmt.Println("Control endpoints listening at port", controlPort)
+		if err := controlServer.ListenAndServeTLS("", ""); err != nil {
+			fmt.Println("Error serving the control endpoints:", err)
+		}
+	}()
 
 	http.ListenAndServe(":8080", handlers.CORS(headers, methods, origins)(router))
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// InjectionRule adds an artificial delay to the requests it matches. All the criteria that are set
+// must match; a rule without criteria matches every request.
+type InjectionRule struct {
+	Node        string  `json:"node,omitempty"`        // node of the meter, rules for other nodes are ignored
+	UserPattern string  `json:"userPattern,omitempty"` // glob on the user ID, e.g. "eu-*"
+	SourceCIDR  string  `json:"sourceCIDR,omitempty"`  // source network of the request
+	DelayMs     int64   `json:"delayMs"`
+	JitterMs    int64   `json:"jitterMs,omitempty"`
+	Jitter      string  `json:"jitter,omitempty"` // "uniform" (delay ± jitterMs, default) or "normal" (stddev jitterMs)
+	LossPercent float64 `json:"lossPercent,omitempty"`
+
+	network *net.IPNet
+}
+
+// LatencyInjector emulates heterogeneous users without `tc`: it delays (or drops) the requests
+// before they are measured, so the measured latency grows by the injected delay.
+type LatencyInjector struct {
+	rules   []*InjectionRule
+	proxies []*net.IPNet
+	random  *rand.Rand
+	mu      sync.Mutex // rand.Rand is not safe for concurrent use
+}
+
+// NewLatencyInjector loads the rules from the JSON file in LATENCY_INJECTION_FILE and keeps only the
+// ones that apply to nodeName. It returns nil if injection is not enabled or the file does not exist.
+func NewLatencyInjector(nodeName string, proxies []*net.IPNet) (*LatencyInjector, error) {
+	file := os.Getenv("LATENCY_INJECTION_FILE")
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) { // e.g. optional ConfigMap not created
+		fmt.Println("Latency injection disabled:", file, "not found")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading latency injection rules: %v", err)
+	}
+	var rules []*InjectionRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("error parsing latency injection rules: %v", err)
+	}
+
+	injector := &LatencyInjector{
+		proxies: proxies,
+		random:  rand.New(rand.NewSource(envInt("LATENCY_INJECTION_SEED", time.Now().UnixNano()))),
+	}
+	for i, rule := range rules {
+		if rule.Node != "" && rule.Node != nodeName {
+			continue
+		}
+		if rule.SourceCIDR != "" {
+			if _, rule.network, err = net.ParseCIDR(rule.SourceCIDR); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid source CIDR %s: %v", i, rule.SourceCIDR, err)
+			}
+		}
+		if rule.UserPattern != "" {
+			if _, err := path.Match(rule.UserPattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid user pattern %s: %v", i, rule.UserPattern, err)
+			}
+		}
+		if rule.Jitter != "" && rule.Jitter != "uniform" && rule.Jitter != "normal" {
+			return nil, fmt.Errorf("rule %d: unknown jitter distribution %s", i, rule.Jitter)
+		}
+		if rule.DelayMs < 0 || rule.JitterMs < 0 || rule.LossPercent < 0 || rule.LossPercent > 100 {
+			return nil, fmt.Errorf("rule %d: delay, jitter and loss must be positive, loss at most 100", i)
+		}
+		injector.rules = append(injector.rules, rule)
+	}
+	fmt.Printf("Latency injection enabled: %d of %d rules apply to node %s\n", len(injector.rules), len(rules), nodeName)
+	return injector, nil
+}
+
+// match returns the first rule matching the request, or nil.
+func (l *LatencyInjector) match(userID, sourceIP string) *InjectionRule {
+	ip := net.ParseIP(sourceIP)
+	for _, rule := range l.rules {
+		if rule.UserPattern != "" {
+			if matched, _ := path.Match(rule.UserPattern, userID); !matched {
+				continue
+			}
+		}
+		if rule.network != nil && (ip == nil || !rule.network.Contains(ip)) {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+// sample draws the delay of a request, and whether it is lost.
+func (l *LatencyInjector) sample(rule *InjectionRule) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rule.LossPercent > 0 && l.random.Float64()*100 < rule.LossPercent {
+		return 0, true
+	}
+	delay := float64(rule.DelayMs)
+	if rule.JitterMs > 0 {
+		if rule.Jitter == "normal" {
+			delay += l.random.NormFloat64() * float64(rule.JitterMs)
+		} else {
+			delay += (l.random.Float64()*2 - 1) * float64(rule.JitterMs)
+		}
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return time.Duration(delay * float64(time.Millisecond)), false
+}
+
+// Middleware delays the matching requests; a lost request has its connection closed without response.
+func (l *LatencyInjector) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule := l.match(r.URL.Query().Get("id"), clientIP(r, l.proxies))
+		if rule == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		delay, lost := l.sample(rule)
+		if lost {
+			injections.WithLabelValues("loss").Inc()
+			if hijacker, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hijacker.Hijack(); err == nil {
+					conn.Close()
+					return
+				}
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		injections.WithLabelValues("delay").Inc()
+		time.Sleep(delay)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLatencyInjector(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string // "" for no file
+		rules1  int    // rules applying to node n1
+		wantErr string
+	}{
+		{name: "missing file", rules: ""},
+		{name: "rules of other nodes are ignored", rules: `[{"node": "n1", "delayMs": 10}, {"node": "n2", "delayMs": 10}, {"delayMs": 5}]`, rules1: 2},
+		{name: "invalid JSON", rules: `[{"delayMs": }]`, wantErr: "parsing"},
+		{name: "invalid source CIDR", rules: `[{"sourceCIDR": "10.0.0.0/33", "delayMs": 10}]`, wantErr: "CIDR"},
+		{name: "invalid user pattern", rules: `[{"userPattern": "[eu", "delayMs": 10}]`, wantErr: "pattern"},
+		{name: "unknown jitter", rules: `[{"delayMs": 10, "jitterMs": 2, "jitter": "pareto"}]`, wantErr: "jitter"},
+		{name: "negative delay", rules: `[{"delayMs": -1}]`, wantErr: "positive"},
+		{name: "loss above 100", rules: `[{"delayMs": 1, "lossPercent": 101}]`, wantErr: "positive"},
+		{name: "invalid rule of another node", rules: `[{"node": "n2", "sourceCIDR": "nope"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "rules.json")
+			if tt.rules != "" {
+				if err := os.WriteFile(file, []byte(tt.rules), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv("LATENCY_INJECTION_FILE", file)
+			injector, err := NewLatencyInjector("n1", nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewLatencyInjector: %v", err)
+			}
+			if tt.rules == "" {
+				if injector != nil {
+					t.Error("injection enabled without rules file")
+				}
+				return
+			}
+			if len(injector.rules) != tt.rules1 {
+				t.Errorf("got %d rules, want %d", len(injector.rules), tt.rules1)
+			}
+		})
+	}
+}
+
+func TestLatencyInjectorMatch(t *testing.T) {
+	_, europe, _ := net.ParseCIDR("192.0.2.0/24")
+	injector := &LatencyInjector{rules: []*InjectionRule{
+		{UserPattern: "eu-*", SourceCIDR: "192.0.2.0/24", network: europe, DelayMs: 10},
+		{UserPattern: "us-*", DelayMs: 20},
+		{SourceCIDR: "192.0.2.0/24", network: europe, DelayMs: 30},
+	}}
+	tests := []struct {
+		name     string
+		userID   string
+		sourceIP string
+		want     int64 // delay of the matched rule, -1 for none
+	}{
+		{"user and network", "eu-1", "192.0.2.7", 10},
+		{"user only", "us-1", "203.0.113.1", 20},
+		{"first matching rule", "us-1", "192.0.2.7", 20},
+		{"network only", "asia-1", "192.0.2.7", 30},
+		{"user outside the network", "eu-1", "203.0.113.1", -1},
+		{"invalid source", "eu-1", "", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := int64(-1)
+			if rule := injector.match(tt.userID, tt.sourceIP); rule != nil {
+				got = rule.DelayMs
+			}
+			if got != tt.want {
+				t.Errorf("matched the rule with delay %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLatencyInjectorSample(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     InjectionRule
+		min, max time.Duration
+		lost     bool
+	}{
+		{"fixed delay", InjectionRule{DelayMs: 40}, 40 * time.Millisecond, 40 * time.Millisecond, false},
+		{"uniform jitter", InjectionRule{DelayMs: 40, JitterMs: 10}, 30 * time.Millisecond, 50 * time.Millisecond, false},
+		{"jitter below zero", InjectionRule{DelayMs: 1, JitterMs: 10}, 0, 11 * time.Millisecond, false},
+		{"normal jitter", InjectionRule{DelayMs: 40, JitterMs: 5, Jitter: "normal"}, 0, time.Second, false},
+		{"always lost", InjectionRule{DelayMs: 40, LossPercent: 100}, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LATENCY_INJECTION_SEED", "1")
+			file := filepath.Join(t.TempDir(), "rules.json")
+			if err := os.WriteFile(file, []byte("[]"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("LATENCY_INJECTION_FILE", file)
+			injector, err := NewLatencyInjector("n1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				delay, lost := injector.sample(&tt.rule)
+				if lost != tt.lost || delay < tt.min || delay > tt.max {
+					t.Fatalf("sampled %v (lost %t), want [%v, %v] (lost %t)", delay, lost, tt.min, tt.max, tt.lost)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// latencyBuckets cover the usual latency thresholds of the apps, in milliseconds.
+var latencyBuckets = []float64{5, 10, 20, 30, 40, 50, 75, 100, 150, 200, 300, 500, 1000}
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "latency_meter_request_duration_seconds",
+		Help:    "Duration of the requests proxied to the application.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"code", "method"})
+	measuredLatency = prometheus.NewHistogram(prometheus.HistogramOpts{ // per user in the measurements, not in the labels
+		Name:    "latency_meter_measured_latency_milliseconds",
+		Help:    "Latencies measured for the users of the pod.",
+		Buckets: latencyBuckets,
+	})
+	droppedMeasurements = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "latency_meter_dropped_measurements_total",
+		Help: "Measurements without a valid timing proof, rate-limited or out of range.",
+	})
+	proxyErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "latency_meter_proxy_errors_total",
+		Help: "Errors proxying the requests to the application.",
+	})
+	injections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "latency_meter_injections_total",
+		Help: "Requests delayed or dropped by the latency injection test mode.",
+	}, []string{"type"})
+)
+
+func init() {
+	prometheus.MustRegister(requestDuration, measuredLatency, droppedMeasurements, proxyErrors, injections)
+}
@@ -0,0 +1,3 @@
+module load-generator
+
+go 1.20
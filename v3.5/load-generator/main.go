@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sample is a single request of a simulated user.
+type Sample struct {
+	Run       int
+	UserID    string
+	ElapsedMs int64 // since the start of the run
+	LatencyMs int64 // round trip time of the request, measured by the client
+	Status    int
+	Error     string
+}
+
+type UserSummary struct {
+	UserID        string  `json:"userId"`
+	Requests      int     `json:"requests"`
+	Errors        int     `json:"errors"`
+	ErrorRate     float64 `json:"errorRate"`
+	MeanLatencyMs float64 `json:"meanLatencyMs"`
+	P50LatencyMs  int64   `json:"p50LatencyMs"`
+	P95LatencyMs  int64   `json:"p95LatencyMs"`
+	ConvergenceMs int64   `json:"convergenceMs"` // -1 if the user never stayed under the threshold
+}
+
+type RunSummary struct {
+	Run                 int           `json:"run"`
+	Label               string        `json:"label"`
+	Requests            int           `json:"requests"`
+	ErrorRate           float64       `json:"errorRate"`
+	MeanLatencyMs       float64       `json:"meanLatencyMs"`
+	P95LatencyMs        int64         `json:"p95LatencyMs"`
+	ConvergedUsers      int           `json:"convergedUsers"`
+	MeanConvergenceMs   float64       `json:"meanConvergenceMs"` // over the converged users
+	MaxConvergenceMs    int64         `json:"maxConvergenceMs"`
+	UsersUnderThreshold float64       `json:"usersUnderThreshold"` // fraction of the users whose mean latency is under the threshold
+	Users               []UserSummary `json:"users"`
+}
+
+type Config struct {
+	URL       string
+	Users     int
+	IDPrefix  string
+	Duration  time.Duration
+	ThinkTime time.Duration
+	Jitter    time.Duration
+	Probe     string // challenge, timestamp or none
+	Threshold int64
+	Stable    int
+	Timeout   time.Duration
+}
+
+// simulateUser sends requests as userID until the end of the run, waiting ThinkTime (± Jitter) between them.
+func simulateUser(cfg Config, client *http.Client, run int, userID string, start time.Time, r *rand.Rand, samples chan<- Sample) {
+	for time.Since(start) < cfg.Duration {
+		sample := Sample{Run: run, UserID: userID, ElapsedMs: time.Since(start).Milliseconds()}
+		latency, status, err := probe(cfg, client, userID)
+		sample.LatencyMs = latency.Milliseconds()
+		sample.Status = status
+		if err != nil {
+			sample.Error = err.Error()
+		}
+		samples <- sample
+
+		think := cfg.ThinkTime
+		if cfg.Jitter > 0 {
+			think += time.Duration(r.Int63n(int64(2*cfg.Jitter))) - cfg.Jitter
+		}
+		if think > 0 {
+			time.Sleep(think)
+		}
+	}
+}
+
+// endpoint returns the URL of path under the base URL of the service, for userID.
+func endpoint(base, path, userID string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("%s is not an absolute URL", base)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	query := u.Query()
+	query.Set("id", userID)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// probe sends one request to the app, with the timing proof expected by the latency meter,
+// and returns the round trip time of the request.
+func probe(cfg Config, client *http.Client, userID string) (time.Duration, int, error) {
+	appURL, err := endpoint(cfg.URL, "/", userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	req, err := http.NewRequest(http.MethodGet, appURL, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	switch cfg.Probe {
+	case "challenge":
+		challengeURL, err := endpoint(cfg.URL, "/challenge", userID)
+		if err != nil {
+			return 0, 0, err
+		}
+		resp, err := client.Get(challengeURL)
+		if err != nil {
+			return 0, 0, err
+		}
+		challenge, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return 0, resp.StatusCode, fmt.Errorf("error getting the challenge: %s", resp.Status)
+		}
+		req.Header.Set("X-Challenge", string(challenge))
+	case "timestamp":
+		req.Header.Set("X-Timestamp", strconv.FormatInt(time.Now().UnixMilli(), 10))
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return time.Since(start), 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	latency := time.Since(start)
+	if resp.StatusCode != http.StatusOK {
+		return latency, resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return latency, resp.StatusCode, nil
+}
+
+func percentile(sorted []int64, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)*p+99)/100-1]
+}
+
+// convergence returns the elapsed time of the first request of the first sequence of `stable`
+// consecutive successful requests under the threshold, or -1 if the user never converged.
+func convergence(samples []Sample, threshold int64, stable int) int64 {
+	consecutive := 0
+	var first int64
+	for _, sample := range samples {
+		if sample.Error != "" {
+			continue
+		}
+		if sample.LatencyMs >= threshold {
+			consecutive = 0
+			continue
+		}
+		if consecutive == 0 {
+			first = sample.ElapsedMs
+		}
+		consecutive++
+		if consecutive == stable {
+			return first
+		}
+	}
+	return -1
+}
+
+func summarize(cfg Config, run int, label string, samples []Sample) RunSummary {
+	perUser := make(map[string][]Sample)
+	for _, sample := range samples {
+		perUser[sample.UserID] = append(perUser[sample.UserID], sample)
+	}
+	summary := RunSummary{Run: run, Label: label, Requests: len(samples)}
+	var allLatencies []int64
+	var errors int
+	var convergenceSum int64
+	var usersUnder int
+	for userID, userSamples := range perUser {
+		sort.Slice(userSamples, func(i, j int) bool { return userSamples[i].ElapsedMs < userSamples[j].ElapsedMs })
+		user := UserSummary{UserID: userID, Requests: len(userSamples)}
+		var latencies []int64
+		var sum int64
+		for _, sample := range userSamples {
+			if sample.Error != "" {
+				user.Errors++
+				continue
+			}
+			latencies = append(latencies, sample.LatencyMs)
+			sum += sample.LatencyMs
+		}
+		user.ErrorRate = float64(user.Errors) / float64(user.Requests)
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		if len(latencies) > 0 {
+			user.MeanLatencyMs = float64(sum) / float64(len(latencies))
+			if user.MeanLatencyMs < float64(cfg.Threshold) {
+				usersUnder++
+			}
+		}
+		user.P50LatencyMs = percentile(latencies, 50)
+		user.P95LatencyMs = percentile(latencies, 95)
+		user.ConvergenceMs = convergence(userSamples, cfg.Threshold, cfg.Stable)
+		if user.ConvergenceMs >= 0 {
+			summary.ConvergedUsers++
+			convergenceSum += user.ConvergenceMs
+			if user.ConvergenceMs > summary.MaxConvergenceMs {
+				summary.MaxConvergenceMs = user.ConvergenceMs
+			}
+		}
+		errors += user.Errors
+		allLatencies = append(allLatencies, latencies...)
+		summary.Users = append(summary.Users, user)
+	}
+	sort.Slice(summary.Users, func(i, j int) bool { return summary.Users[i].UserID < summary.Users[j].UserID })
+	sort.Slice(allLatencies, func(i, j int) bool { return allLatencies[i] < allLatencies[j] })
+
+	if len(samples) > 0 {
+		summary.ErrorRate = float64(errors) / float64(len(samples))
+	}
+	if len(allLatencies) > 0 {
+		var sum int64
+		for _, latency := range allLatencies {
+			sum += latency
+		}
+		summary.MeanLatencyMs = float64(sum) / float64(len(allLatencies))
+	}
+	summary.P95LatencyMs = percentile(allLatencies, 95)
+	if summary.ConvergedUsers > 0 {
+		summary.MeanConvergenceMs = float64(convergenceSum) / float64(summary.ConvergedUsers)
+	}
+	if len(perUser) > 0 {
+		summary.UsersUnderThreshold = float64(usersUnder) / float64(len(perUser))
+	}
+	return summary
+}
+
+func runCommand(command string) error {
+	if command == "" {
+		return nil
+	}
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func main() {
+	var cfg Config
+	var runs int
+	var label, samplesPath, summaryPath, setupCmd, teardownCmd string
+	var seed int64
+	flag.StringVar(&cfg.URL, "url", "", "Base URL of the service, e.g. http://10.11.167.5")
+	flag.IntVar(&cfg.Users, "users", 10, "Concurrent simulated users, each with its own ID")
+	flag.StringVar(&cfg.IDPrefix, "id-prefix", "user", "Prefix of the user IDs")
+	flag.DurationVar(&cfg.Duration, "duration", 5*time.Minute, "Duration of every run")
+	flag.DurationVar(&cfg.ThinkTime, "think-time", time.Second, "Time between two requests of the same user")
+	flag.DurationVar(&cfg.Jitter, "think-jitter", 200*time.Millisecond, "Random variation of the think time")
+	flag.StringVar(&cfg.Probe, "probe", "challenge", "Timing proof sent to the latency meter: challenge, timestamp or none")
+	flag.Int64Var(&cfg.Threshold, "threshold", 40, "Latency threshold (ms) used for the convergence time")
+	flag.IntVar(&cfg.Stable, "stable", 3, "Consecutive requests under the threshold needed to consider a user converged")
+	flag.DurationVar(&cfg.Timeout, "timeout", 10*time.Second, "Timeout of every request")
+	flag.IntVar(&runs, "runs", 1, "Number of runs")
+	flag.StringVar(&label, "label", "latency-aware", "Label of the runs in the results, e.g. the scheduler under test")
+	flag.StringVar(&setupCmd, "setup", "", "Command executed before every run, e.g. ./start.sh")
+	flag.StringVar(&teardownCmd, "teardown", "", "Command executed after every run, e.g. ./stop.sh")
+	flag.StringVar(&samplesPath, "samples", "", "CSV file where every request is written")
+	flag.StringVar(&summaryPath, "summary", "", "JSON file where the summary of the runs is written (stdout if empty)")
+	flag.Int64Var(&seed, "seed", time.Now().UnixNano(), "Seed of the think time jitter")
+	flag.Parse()
+
+	if cfg.URL == "" {
+		fmt.Fprintln(os.Stderr, "--url must be specified")
+		os.Exit(1)
+	}
+	if _, err := endpoint(cfg.URL, "/", ""); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid --url:", err)
+		os.Exit(1)
+	}
+	if cfg.Probe != "challenge" && cfg.Probe != "timestamp" && cfg.Probe != "none" {
+		fmt.Fprintln(os.Stderr, "--probe must be challenge, timestamp or none")
+		os.Exit(1)
+	}
+
+	var samplesWriter *csv.Writer
+	if samplesPath != "" {
+		file, err := os.Create(samplesPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error creating the samples file:", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		samplesWriter = csv.NewWriter(file)
+		samplesWriter.Write([]string{"label", "run", "user", "elapsed_ms", "latency_ms", "status", "error"})
+		defer samplesWriter.Flush()
+	}
+
+	// A new connection per request, so every request pays the network round trip like a new user would
+	client := &http.Client{Timeout: cfg.Timeout, Transport: &http.Transport{DisableKeepAlives: true}}
+	var summaries []RunSummary
+	for run := 1; run <= runs; run++ {
+		if err := runCommand(setupCmd); err != nil {
+			fmt.Fprintf(os.Stderr, "Error running the setup of run %d: %v\n", run, err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Run %d: %d users for %s\n", run, cfg.Users, cfg.Duration)
+
+		samples := make(chan Sample, cfg.Users)
+		var collected []Sample
+		done := make(chan struct{})
+		go func() {
+			for sample := range samples {
+				collected = append(collected, sample)
+			}
+			close(done)
+		}()
+
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 1; i <= cfg.Users; i++ {
+			wg.Add(1)
+			go func(userID string, r *rand.Rand) {
+				defer wg.Done()
+				simulateUser(cfg, client, run, userID, start, r, samples)
+			}(fmt.Sprintf("%s-%d", cfg.IDPrefix, i), rand.New(rand.NewSource(seed+int64(i))))
+		}
+		wg.Wait()
+		close(samples)
+		<-done
+
+		if samplesWriter != nil {
+			for _, sample := range collected {
+				samplesWriter.Write([]string{label, strconv.Itoa(sample.Run), sample.UserID, strconv.FormatInt(sample.ElapsedMs, 10),
+					strconv.FormatInt(sample.LatencyMs, 10), strconv.Itoa(sample.Status), sample.Error})
+			}
+			samplesWriter.Flush()
+		}
+		summary := summarize(cfg, run, label, collected)
+		summaries = append(summaries, summary)
+		fmt.Fprintf(os.Stderr, "Run %d: mean latency %.1f ms, p95 %d ms, error rate %.3f, converged users %d/%d (mean %.0f ms)\n",
+			run, summary.MeanLatencyMs, summary.P95LatencyMs, summary.ErrorRate, summary.ConvergedUsers, cfg.Users, summary.MeanConvergenceMs)
+
+		if err := runCommand(teardownCmd); err != nil {
+			fmt.Fprintf(os.Stderr, "Error running the teardown of run %d: %v\n", run, err)
+		}
+	}
+
+	output := os.Stdout
+	if summaryPath != "" {
+		file, err := os.Create(summaryPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error creating the summary file:", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		output = file
+	}
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(summaries)
+}
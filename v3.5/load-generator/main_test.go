@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestEndpoint(t *testing.T) {
+	tests := []struct {
+		base, path, userID string
+		want               string
+		wantErr            bool
+	}{
+		{"http://10.11.167.5", "/", "user-1", "http://10.11.167.5/?id=user-1", false},
+		{"http://10.11.167.5/", "/", "user-1", "http://10.11.167.5/?id=user-1", false},
+		{"http://10.11.167.5:8080/", "/challenge", "user-1", "http://10.11.167.5:8080/challenge?id=user-1", false},
+		{"http://rm.example/app/", "/challenge", "user-1", "http://rm.example/app/challenge?id=user-1", false},
+		{"http://rm.example", "/", "user 1&x=2", "http://rm.example/?id=user+1%26x%3D2", false},
+		{"10.11.167.5", "/", "user-1", "", true},
+		{"://bad", "/", "user-1", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.base+tt.path, func(t *testing.T) {
+			got, err := endpoint(tt.base, tt.path, tt.userID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
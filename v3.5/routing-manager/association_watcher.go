@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/tools/cache"
+	"scheduler/shared/cohorts"
+)
+
+const (
+	associationsConfigMapPrefix = "user-associations-"
+	associationsDataKey         = "associations.json"
+)
+
+// watchAssociations keeps the associations of appName in sync with the ConfigMap shard
+// published by the descheduler. Every replica of the routing manager runs its own watch.
+func (ks *KubernetesService) watchAssociations(namespace, appName string, u *UserClusterAssociation, stopCh <-chan struct{}) {
+	configMapName := associationsConfigMapPrefix + appName
+	listWatch := cache.NewListWatchFromClient(
+		ks.clientset.CoreV1().RESTClient(),
+		"configmaps",
+		namespace,
+		fields.OneTermEqualSelector("metadata.name", configMapName),
+	)
+
+	handleConfigMap := func(obj interface{}) {
+		if configMap, ok := obj.(*v1.ConfigMap); ok {
+			u.applyConfigMap(appName, configMap)
+		}
+	}
+
+	_, controller := cache.NewInformer(listWatch, &v1.ConfigMap{}, 5*time.Minute, cache.ResourceEventHandlerFuncs{
+		AddFunc: handleConfigMap,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			handleConfigMap(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			log.Printf("ConfigMap %s/%s deleted, dropping associations for app %s", namespace, configMapName, appName)
+			u.UpdateAppAssociations(appName, nil)
+		},
+	})
+
+	log.Printf("Watching associations in ConfigMap %s/%s", namespace, configMapName)
+	controller.Run(stopCh)
+}
+
+// applyConfigMap replaces the associations of appName, and the cohorts, with the ones of the shard.
+func (u *UserClusterAssociation) applyConfigMap(appName string, configMap *v1.ConfigMap) {
+	var userAssociations map[string]*ClusterInfo
+	if err := json.Unmarshal([]byte(configMap.Data[associationsDataKey]), &userAssociations); err != nil {
+		log.Printf("Error decoding associations from ConfigMap %s/%s: %v", configMap.Namespace, configMap.Name, err)
+		return
+	}
+	u.UpdateAppAssociations(appName, userAssociations)
+	var config *cohorts.Config
+	if payload, ok := configMap.Data[cohorts.DataKey]; ok {
+		var err error
+		if config, err = cohorts.Parse(payload); err != nil {
+			log.Printf("Error decoding cohorts from ConfigMap %s/%s, routing by user only: %v", configMap.Namespace, configMap.Name, err)
+		}
+	}
+	u.SetCohorts(config)
+}
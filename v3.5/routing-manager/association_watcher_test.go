@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"scheduler/shared/cohorts"
+)
+
+func TestApplyConfigMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]string
+		want    map[string]map[string]string // userID -> appName -> pod
+		cohorts bool                         // enabled after the shard
+	}{
+		{
+			name: "associations of the app replaced",
+			data: map[string]string{associationsDataKey: `{"u1": {"PodName": "nginx-2"}, "u3": {"PodName": "nginx-1"}}`},
+			want: map[string]map[string]string{"u1": {"nginx": "nginx-2", "redis": "redis-1"}, "u3": {"nginx": "nginx-1"}},
+		},
+		{
+			name: "users left without associations dropped",
+			data: map[string]string{associationsDataKey: `{}`},
+			want: map[string]map[string]string{"u1": {"redis": "redis-1"}},
+		},
+		{
+			name:    "invalid shard ignored",
+			data:    map[string]string{associationsDataKey: `{`},
+			want:    map[string]map[string]string{"u1": {"nginx": "nginx-1", "redis": "redis-1"}, "u2": {"nginx": "nginx-1"}},
+			cohorts: true, // of the previous shard
+		},
+		{
+			name:    "cohorts of the shard",
+			data:    map[string]string{associationsDataKey: `{}`, cohorts.DataKey: `{"prefixV4": 24, "prefixV6": 48}`},
+			want:    map[string]map[string]string{"u1": {"redis": "redis-1"}},
+			cohorts: true,
+		},
+		{
+			name: "invalid cohorts routed by user only",
+			data: map[string]string{associationsDataKey: `{}`, cohorts.DataKey: `{"prefixV4": 0}`},
+			want: map[string]map[string]string{"u1": {"redis": "redis-1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &UserClusterAssociation{Data: map[string]map[string]*ClusterInfo{
+				"u1": {"nginx": {PodName: "nginx-1"}, "redis": {PodName: "redis-1"}},
+				"u2": {"nginx": {PodName: "nginx-1"}},
+			}}
+			u.SetCohorts(&cohorts.Config{PrefixV4: 16, PrefixV6: 32}) // published by the previous shard
+			u.applyConfigMap("nginx", &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: associationsConfigMapPrefix + "nginx", Namespace: "routing"},
+				Data:       tt.data,
+			})
+			if len(u.Data) != len(tt.want) {
+				t.Errorf("got users %v, want %v", u.Data, tt.want)
+			}
+			for userID, apps := range tt.want {
+				if len(u.Data[userID]) != len(apps) {
+					t.Errorf("user %s: got %v, want %v", userID, u.Data[userID], apps)
+				}
+				for appName, podName := range apps {
+					if clusterInfo, ok := u.getClusterInfoForUser(userID, appName); !ok || clusterInfo.PodName != podName {
+						t.Errorf("user %s app %s: got %+v, want pod %s", userID, appName, clusterInfo, podName)
+					}
+				}
+			}
+			if (u.cohorts != nil) != tt.cohorts {
+				t.Errorf("cohorts %+v, want enabled %v", u.cohorts, tt.cohorts)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"scheduler/shared/cohorts"
+)
+
+// SetCohorts replaces the cohort configuration, nil if the descheduler doesn't use cohorts.
+func (u *UserClusterAssociation) SetCohorts(config *cohorts.Config) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.cohorts = config
+}
+
+// getClusterInfoForCohort returns the association of the cohort of the user, if cohorts are enabled
+// and the user isn't kept individually by the descheduler.
+func (u *UserClusterAssociation) getClusterInfoForCohort(userID, sourceIP, appName string) (*ClusterInfo, string, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	if u.cohorts == nil {
+		return nil, "", false
+	}
+	cohort := u.cohorts.Cohort(userID, sourceIP)
+	if cohort == userID {
+		return nil, "", false
+	}
+	clusterInfo, exists := u.Data[cohort][appName]
+	return clusterInfo, cohort, exists
+}
+
+// trustedProxies parses TRUSTED_PROXIES, the comma separated networks whose X-Forwarded-For is
+// trusted (e.g. the load balancer in front of the routing manager).
+func trustedProxies() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("Ignoring invalid trusted proxy CIDR %s: %v", cidr, err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// clientIP returns the source IP of the request, following X-Forwarded-For only if the
+// request comes from a trusted proxy.
+func clientIP(r *http.Request, proxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote := net.ParseIP(host)
+	forwarded := r.Header.Get("X-Forwarded-For")
+	if remote == nil || forwarded == "" {
+		return host
+	}
+	for _, network := range proxies {
+		if network.Contains(remote) {
+			hops := strings.Split(forwarded, ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+	return host
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"scheduler/shared/cohorts"
+)
+
+func TestGetClusterInfoForCohort(t *testing.T) {
+	config, err := cohorts.Parse(`{"prefixV4":24,"prefixV6":48,"regions":[{"cidr":"198.51.100.0/24","region":"eu-west"}],"overrides":["vip"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	associations := map[string]map[string]*ClusterInfo{
+		"net:192.0.2.0/24": {"nginx": {PodName: "nginx-1"}},
+		"region:eu-west":   {"nginx": {PodName: "nginx-2"}},
+	}
+	tests := []struct {
+		name     string
+		config   *cohorts.Config
+		userID   string
+		sourceIP string
+		cohort   string
+		pod      string
+	}{
+		{"user of a network", config, "u1", "192.0.2.7", "net:192.0.2.0/24", "nginx-1"},
+		{"user of a region", config, "u1", "198.51.100.7", "region:eu-west", "nginx-2"},
+		{"cohort without association", config, "u1", "203.0.113.7", "", ""},
+		{"user kept individually", config, "vip", "192.0.2.7", "", ""},
+		{"no source IP", config, "u1", "", "", ""},
+		{"cohorts disabled", nil, "u1", "192.0.2.7", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &UserClusterAssociation{Data: associations}
+			u.SetCohorts(tt.config)
+			clusterInfo, cohort, exists := u.getClusterInfoForCohort(tt.userID, tt.sourceIP, "nginx")
+			if exists != (tt.pod != "") {
+				t.Fatalf("got association %+v of cohort %q, want pod %q", clusterInfo, cohort, tt.pod)
+			}
+			if exists && (clusterInfo.PodName != tt.pod || cohort != tt.cohort) {
+				t.Errorf("got pod %s of cohort %s, want %s of %s", clusterInfo.PodName, cohort, tt.pod, tt.cohort)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		proxies []string
+	}{
+		{"unset", "", nil},
+		{"list of networks", "10.244.0.0/16, 192.168.1.0/24", []string{"10.244.0.0/16", "192.168.1.0/24"}},
+		{"invalid networks ignored", "10.244.0.0/16,nope,", []string{"10.244.0.0/16"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXIES", tt.env)
+			proxies := trustedProxies()
+			if len(proxies) != len(tt.proxies) {
+				t.Fatalf("got %v, want %v", proxies, tt.proxies)
+			}
+			for i, network := range proxies {
+				if network.String() != tt.proxies[i] {
+					t.Errorf("got %s, want %s", network, tt.proxies[i])
+				}
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	_, balancers, _ := net.ParseCIDR("10.244.0.0/16")
+	proxies := []*net.IPNet{balancers}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		proxies    []*net.IPNet
+		want       string
+	}{
+		{"direct client", "192.0.2.7:5000", "", proxies, "192.0.2.7"},
+		{"forwarded by a trusted proxy", "10.244.1.5:5000", "192.0.2.7", proxies, "192.0.2.7"},
+		{"last hop of a trusted proxy", "10.244.1.5:5000", "203.0.113.1, 192.0.2.7", proxies, "192.0.2.7"},
+		{"forged by an untrusted client", "192.0.2.7:5000", "203.0.113.1", proxies, "192.0.2.7"},
+		{"no trusted proxy", "10.244.1.5:5000", "192.0.2.7", nil, "10.244.1.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/?id=u1", nil)
+			request.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				request.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := clientIP(request, tt.proxies); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
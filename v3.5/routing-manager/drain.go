@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"scheduler/shared/drain"
+)
+
+const drainPollInterval = 500 * time.Millisecond
+
+// DrainTracker counts the requests in flight to every pod and, when the descheduler marks a pod as
+// draining, stops routing new requests to it and acknowledges once they are done (or the deadline passed).
+type DrainTracker struct {
+	clientset kubernetes.Interface
+	replica   string               // name of this routing manager pod, the key of its acknowledgements
+	inFlight  map[string]int       // podName -> requests in flight, long-lived connections included
+	draining  map[string]time.Time // podName -> drain deadline
+	mu        sync.Mutex
+}
+
+func NewDrainTracker(clientset kubernetes.Interface, replica string) *DrainTracker {
+	return &DrainTracker{
+		clientset: clientset,
+		replica:   replica,
+		inFlight:  make(map[string]int),
+		draining:  make(map[string]time.Time),
+	}
+}
+
+// Begin counts a request proxied to podName; End must be called when it is done.
+func (dt *DrainTracker) Begin(podName string) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.inFlight[podName]++
+}
+
+func (dt *DrainTracker) End(podName string) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.inFlight[podName]--
+	if dt.inFlight[podName] <= 0 {
+		delete(dt.inFlight, podName)
+	}
+}
+
+func (dt *DrainTracker) IsDraining(podName string) bool {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	_, ok := dt.draining[podName]
+	return ok
+}
+
+// markDraining starts the drain of the pod, if it isn't already draining.
+func (dt *DrainTracker) markDraining(pod *v1.Pod, deadline time.Time) {
+	dt.mu.Lock()
+	_, ok := dt.draining[pod.Name]
+	dt.draining[pod.Name] = deadline
+	dt.mu.Unlock()
+	if ok {
+		return
+	}
+	log.Printf("Pod %s is draining until %s, no new requests are routed to it", pod.Name, deadline.Format(time.RFC3339))
+	if _, acked := pod.Annotations[drain.AckAnnotation(dt.replica)]; acked {
+		return
+	}
+	go dt.acknowledge(pod.Namespace, pod.Name, deadline)
+}
+
+func (dt *DrainTracker) forget(podName string) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	delete(dt.draining, podName)
+}
+
+// acknowledge waits until the requests in flight to the pod are done, or the deadline, and then
+// acknowledges the drain on the pod.
+func (dt *DrainTracker) acknowledge(namespace, podName string, deadline time.Time) {
+	result := drainCompleted
+	for {
+		dt.mu.Lock()
+		inFlight := dt.inFlight[podName]
+		_, draining := dt.draining[podName]
+		dt.mu.Unlock()
+		if !draining {
+			return // deleted, or no longer draining
+		}
+		if inFlight == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("Drain of pod %s timed out with %d requests in flight", podName, inFlight)
+			result = drainTimedOut
+			break
+		}
+		time.Sleep(drainPollInterval)
+	}
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pod, err := dt.clientset.CoreV1().Pods(namespace).Get(context.Background(), podName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if pod.Annotations == nil {
+			pod.Annotations = make(map[string]string)
+		}
+		pod.Annotations[drain.AckAnnotation(dt.replica)] = time.Now().Format(time.RFC3339)
+		_, err = dt.clientset.CoreV1().Pods(namespace).Update(context.Background(), pod, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		log.Printf("Error acknowledging the drain of pod %s: %v", podName, err)
+		return
+	}
+	drains.WithLabelValues(result).Inc()
+	log.Printf("Drain of pod %s acknowledged", podName)
+}
+
+// watchDrains follows the pods of appName and drains the ones marked by the descheduler.
+func (ks *KubernetesService) watchDrains(appName string, dt *DrainTracker, stopCh <-chan struct{}) {
+	listWatch := cache.NewFilteredListWatchFromClient(
+		ks.clientset.CoreV1().RESTClient(),
+		"pods",
+		"default",
+		func(options *metav1.ListOptions) {
+			options.LabelSelector = labels.SelectorFromSet(labels.Set{"app": appName}).String()
+			options.FieldSelector = fields.Everything().String()
+		},
+	)
+
+	handlePod := func(obj interface{}) {
+		pod, ok := obj.(*v1.Pod)
+		if !ok {
+			return
+		}
+		deadline, draining, err := drain.Deadline(pod.Annotations)
+		if !draining {
+			dt.forget(pod.Name)
+			return
+		}
+		if err != nil {
+			log.Printf("Ignoring the drain deadline of pod %s: %v", pod.Name, err)
+			return
+		}
+		dt.markDraining(pod, deadline)
+	}
+
+	_, controller := cache.NewInformer(listWatch, &v1.Pod{}, 5*time.Minute, cache.ResourceEventHandlerFuncs{
+		AddFunc: handlePod,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			handlePod(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if pod, ok := obj.(*v1.Pod); ok {
+				dt.forget(pod.Name)
+			}
+		},
+	})
+
+	log.Printf("Watching the drains of the pods of app %s", appName)
+	controller.Run(stopCh)
+}
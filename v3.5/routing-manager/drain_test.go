@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"scheduler/shared/drain"
+)
+
+func TestDrainTrackerAcknowledge(t *testing.T) {
+	tests := []struct {
+		name     string
+		inFlight int
+		deadline time.Duration // from now
+		draining bool
+		acked    bool
+	}{
+		{"no request in flight", 0, time.Minute, true, true},
+		{"requests in flight past the deadline", 2, -time.Second, true, true},
+		{"no longer draining", 0, time.Minute, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nginx-1", Namespace: "default"}}
+			clientset := fake.NewSimpleClientset(pod)
+			dt := NewDrainTracker(clientset, "rm-1")
+			for i := 0; i < tt.inFlight; i++ {
+				dt.Begin(pod.Name)
+			}
+			deadline := time.Now().Add(tt.deadline)
+			if tt.draining {
+				dt.draining[pod.Name] = deadline
+			}
+			dt.acknowledge(pod.Namespace, pod.Name, deadline)
+
+			updated, err := clientset.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, acked := updated.Annotations[drain.AckAnnotation("rm-1")]; acked != tt.acked {
+				t.Errorf("acknowledged %v, want %v", acked, tt.acked)
+			}
+		})
+	}
+}
+
+func TestDrainTrackerInFlight(t *testing.T) {
+	dt := NewDrainTracker(fake.NewSimpleClientset(), "rm-1")
+	dt.Begin("p")
+	dt.Begin("p")
+	dt.End("p")
+	if dt.inFlight["p"] != 1 {
+		t.Errorf("%d requests in flight, want 1", dt.inFlight["p"])
+	}
+	dt.End("p")
+	if _, ok := dt.inFlight["p"]; ok {
+		t.Error("pod without requests in flight still counted")
+	}
+	dt.draining["p"] = time.Now()
+	if !dt.IsDraining("p") {
+		t.Error("draining pod not reported")
+	}
+	dt.forget("p")
+	if dt.IsDraining("p") {
+		t.Error("forgotten pod still draining")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	routingAssociated = "associated"
+	routingFallback   = "fallback"
+	drainCompleted    = "completed"
+	drainTimedOut     = "timed_out"
+)
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "routing_manager_request_duration_seconds",
+		Help:    "Duration of the requests routed to the pods of the app.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"code", "method"})
+	routingDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "routing_manager_routing_decisions_total",
+		Help: "Routing decisions by type: associated pod or fallback to a random pod.",
+	}, []string{"type"})
+	proxyErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "routing_manager_proxy_errors_total",
+		Help: "Errors proxying the requests to the pods.",
+	})
+	drains = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "routing_manager_drains_total",
+		Help: "Drains of pods acknowledged to the descheduler, by result (completed, timed_out).",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(requestDuration, routingDecisions, proxyErrors, drains)
+}
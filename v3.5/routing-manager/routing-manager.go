@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -15,9 +16,14 @@ import (
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"scheduler/shared/cohorts"
+	"scheduler/shared/controltls"
+	"scheduler/shared/tokenauth"
 )
 
 // ClusterInfo ...
@@ -30,8 +36,9 @@ type ClusterInfo struct {
 
 // UserClusterAssociation ...
 type UserClusterAssociation struct {
-	Data map[string]map[string]*ClusterInfo //userID -> appName -> cluster measure
-	mu   sync.RWMutex
+	Data    map[string]map[string]*ClusterInfo //userID -> appName -> cluster measure
+	cohorts *cohorts.Config                    // users without association are routed by their cohort, if set
+	mu      sync.RWMutex
 }
 
 // UpdateAssociations ...
@@ -40,9 +47,32 @@ func (u *UserClusterAssociation) UpdateAssociations(associations map[string]map[
 	u.mu.Lock()
 	defer u.mu.Unlock()
 
+	if associations == nil {
+		associations = make(map[string]map[string]*ClusterInfo)
+	}
 	u.Data = associations
 }
 
+// UpdateAppAssociations replaces the associations of a single app, leaving the other apps untouched.
+func (u *UserClusterAssociation) UpdateAppAssociations(appName string, userAssociations map[string]*ClusterInfo) {
+	log.Printf("Updating associations for app %s (%d users)", appName, len(userAssociations))
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for userID, appAssociations := range u.Data {
+		delete(appAssociations, appName)
+		if len(appAssociations) == 0 {
+			delete(u.Data, userID)
+		}
+	}
+	for userID, clusterInfo := range userAssociations {
+		if _, ok := u.Data[userID]; !ok {
+			u.Data[userID] = make(map[string]*ClusterInfo)
+		}
+		u.Data[userID][appName] = clusterInfo
+	}
+}
+
 // handleUpdateAssociations ...
 func (u *UserClusterAssociation) handleUpdateAssociations(w http.ResponseWriter, r *http.Request) {
 	log.Println("Handling update associations request")
@@ -52,6 +82,11 @@ func (u *UserClusterAssociation) handleUpdateAssociations(w http.ResponseWriter,
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if associations == nil {
+		log.Println("Rejecting a null associations body")
+		http.Error(w, "associations must be a JSON object", http.StatusBadRequest)
+		return
+	}
 
 	u.UpdateAssociations(associations)
 	w.WriteHeader(http.StatusOK)
@@ -90,34 +125,37 @@ func (ks *KubernetesService) GetPodIP(podName string) (string, error) {
 	return pod.Status.PodIP, nil
 }
 
-func (ks *KubernetesService) GetRandomPodIP(appName string) (string, error) {
+// GetRandomPod returns the name and IP of a random running pod of the app, skipping the excluded ones.
+func (ks *KubernetesService) GetRandomPod(appName string, exclude func(podName string) bool) (string, string, error) {
 	pods, err := ks.clientset.CoreV1().Pods("default").List(context.Background(), metav1.ListOptions{
 		LabelSelector: "app=" + appName, // Assicurati che questo selettore sia corretto per la tua configurazione
 	})
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	if len(pods.Items) == 0 {
-		return "", fmt.Errorf("no pods found for the app %s", appName)
+	var candidates []v1.Pod
+	for _, pod := range pods.Items {
+		if pod.Status.PodIP != "" && !exclude(pod.Name) {
+			candidates = append(candidates, pod)
+		}
 	}
-
-	// Seleziona un pod casuale dalla lista
-	randomIndex := rand.Intn(len(pods.Items))
-	randomPod := pods.Items[randomIndex]
-
-	if randomPod.Status.PodIP == "" {
-		return "", fmt.Errorf("selected pod has no IP")
+	if len(candidates) == 0 {
+		return "", "", fmt.Errorf("no pods with an IP found for the app %s", appName)
 	}
 
-	return randomPod.Status.PodIP, nil
+	// Seleziona un pod casuale dalla lista
+	randomPod := candidates[rand.Intn(len(candidates))]
+	return randomPod.Name, randomPod.Status.PodIP, nil
 }
 
 // RoutingManager ...
 type RoutingManager struct {
 	userClusterAssociations *UserClusterAssociation
 	kubernetesService       *KubernetesService
+	drainTracker            *DrainTracker
 	appName                 string
+	proxies                 []*net.IPNet
 }
 
 // ServeHTTP ...
@@ -135,37 +173,52 @@ func (rm *RoutingManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Looking up cluster info for user ID: %s", userID)
 	// Get the cluster info based on the user ID
 	clusterInfo, exists := rm.userClusterAssociations.getClusterInfoForUser(userID, rm.appName)
-	var target string
+	if !exists {
+		var cohort string
+		if clusterInfo, cohort, exists = rm.userClusterAssociations.getClusterInfoForCohort(userID, clientIP(r, rm.proxies), rm.appName); exists {
+			log.Printf("User ID %s routed by the association of its cohort %s", userID, cohort)
+		}
+	}
+	if exists && rm.drainTracker.IsDraining(clusterInfo.PodName) {
+		log.Printf("Pod %s of user ID %s is draining, using default service", clusterInfo.PodName, userID)
+		exists = false
+	}
+	var podName, podIP string
 	if exists {
 		log.Printf("User ID %s is associated with cluster info: %+v", userID, clusterInfo)
-		podIP, err := rm.kubernetesService.GetPodIP(clusterInfo.PodName)
-		if err != nil {
+		var err error
+		podName = clusterInfo.PodName
+		podIP, err = rm.kubernetesService.GetPodIP(podName)
+		if err != nil || podIP == "" {
 			log.Printf("Failed to get IP for pod %s: %v", clusterInfo.PodName, err)
 			log.Printf("Using default service...")
-			podIP, err := rm.kubernetesService.GetRandomPodIP(rm.appName)
-			if err != nil {
-				log.Printf("Failed to get a random pod IP: %v", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			target = fmt.Sprintf("%s:8080", podIP)
 		}
-		target = fmt.Sprintf("%s:8080", podIP)
 	} else {
 		log.Printf("No cluster info found for user ID %s, using default service", userID)
-		podIP, err := rm.kubernetesService.GetRandomPodIP(rm.appName)
+	}
+	if podIP != "" {
+		routingDecisions.WithLabelValues(routingAssociated).Inc()
+	} else {
+		var err error
+		podName, podIP, err = rm.kubernetesService.GetRandomPod(rm.appName, rm.drainTracker.IsDraining)
 		if err != nil {
 			log.Printf("Failed to get a random pod IP: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		target = fmt.Sprintf("%s:8080", podIP)
+		routingDecisions.WithLabelValues(routingFallback).Inc()
 	}
+	target := fmt.Sprintf("%s:8080", podIP)
 
 	log.Printf("Proxying request to target: %s", target)
 
 	// Create a reverse proxy to forward the request
 	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: target})
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("Error proxying request to %s: %v", target, err)
+		proxyErrors.Inc()
+		w.WriteHeader(http.StatusBadGateway)
+	}
 
 	// Update the request with the destination host
 	r.URL.Host = target
@@ -174,6 +227,8 @@ func (rm *RoutingManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	r.Host = target
 
 	// Forward the request to the corresponding pod or service
+	rm.drainTracker.Begin(podName)
+	defer rm.drainTracker.End(podName)
 	proxy.ServeHTTP(w, r)
 	log.Println("Request has been proxied to target")
 }
@@ -202,24 +257,62 @@ func main() {
 		log.Fatal("APP_NAME environment variable not set or empty")
 	}
 
+	associationsNamespace, exists := os.LookupEnv("ASSOCIATIONS_NAMESPACE")
+	if !exists || associationsNamespace == "" {
+		associationsNamespace = "routing"
+	}
+
 	userClusterAssociations := &UserClusterAssociation{
 		Data: make(map[string]map[string]*ClusterInfo),
 	}
+	go kubernetesService.watchAssociations(associationsNamespace, appName, userClusterAssociations, make(chan struct{}))
+
+	// The drains are acknowledged in the name of this pod
+	podName, exists := os.LookupEnv("POD_NAME")
+	if !exists || podName == "" {
+		if podName, err = os.Hostname(); err != nil {
+			log.Fatalf("POD_NAME environment variable not set and no hostname: %v", err)
+		}
+	}
+	drainTracker := NewDrainTracker(kubernetesService.clientset, podName)
+	go kubernetesService.watchDrains(appName, drainTracker, make(chan struct{}))
 
 	rm := &RoutingManager{
 		userClusterAssociations: userClusterAssociations,
 		kubernetesService:       kubernetesService,
+		drainTracker:            drainTracker,
 		appName:                 appName, // Set the default service
+		proxies:                 trustedProxies(),
 	}
 
 	router := mux.NewRouter()
-	router.HandleFunc("/update-associations", userClusterAssociations.handleUpdateAssociations).Methods("POST")
-	router.PathPrefix("/").Handler(rm) // Catch-all route for incoming traffic to be managed
+	router.PathPrefix("/").Handler(promhttp.InstrumentHandlerDuration(requestDuration, rm)) // Catch-all route for incoming traffic to be managed
 
 	headers := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", "X-User-Header"})
 	methods := handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"})
 	origins := handlers.AllowedOrigins([]string{"*"})
 
+	// The control endpoints are served on their own port, over TLS and only to the projected token of the scheduler
+	controlPort, exists := os.LookupEnv("CONTROL_PORT")
+	if !exists || controlPort == "" {
+		controlPort = "9090"
+	}
+	authenticator := tokenauth.New(kubernetesService.clientset, tokenauth.AllowedUsersFromEnv(), tokenauth.AudiencesFromEnv()...)
+	controlRouter := mux.NewRouter()
+	controlRouter.Handle("/update-associations", authenticator.Middleware(http.HandlerFunc(userClusterAssociations.handleUpdateAssociations))).Methods("POST")
+	controlRouter.Handle("/metrics", promhttp.Handler()) // read-only, scraped by Prometheus without token
+	tlsConfig, err := controltls.ServerConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	controlServer := &http.Server{Addr: ":" + controlPort, Handler: controlRouter, TLSConfig: tlsConfig}
+	go func() {
+		log.Printf("Control endpoints listening at port %s", controlPort)
+		if err := controlServer.ListenAndServeTLS("", ""); err != nil {
+			log.Printf("Error serving the control endpoints: %v", err)
+		}
+	}()
+
 	log.Println("Server is ready to handle requests at port 80")
 	http.ListenAndServe(":80", handlers.CORS(headers, methods, origins)(router))
 }
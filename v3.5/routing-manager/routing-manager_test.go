@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleUpdateAssociations(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		users  int // users associated afterwards
+	}{
+		{"associations replaced", `{"u2": {"nginx": {"PodName": "nginx-2"}}, "u3": {"nginx": {"PodName": "nginx-1"}}}`, http.StatusOK, 2},
+		{"empty object", `{}`, http.StatusOK, 0},
+		{"null body rejected", `null`, http.StatusBadRequest, 1},
+		{"invalid body rejected", `{`, http.StatusBadRequest, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &UserClusterAssociation{Data: map[string]map[string]*ClusterInfo{"u1": {"nginx": {PodName: "nginx-1"}}}}
+			recorder := httptest.NewRecorder()
+			u.handleUpdateAssociations(recorder, httptest.NewRequest(http.MethodPost, "/update-associations", strings.NewReader(tt.body)))
+			if recorder.Code != tt.status {
+				t.Errorf("got status %d, want %d", recorder.Code, tt.status)
+			}
+			if len(u.Data) != tt.users {
+				t.Errorf("got %d users, want %d", len(u.Data), tt.users)
+			}
+			u.UpdateAppAssociations("redis", map[string]*ClusterInfo{"u4": {PodName: "redis-1"}}) // must not panic
+			if _, ok := u.getClusterInfoForUser("u4", "redis"); !ok {
+				t.Error("app associations not applied afterwards")
+			}
+		})
+	}
+}
+
+func TestUpdateAssociationsNil(t *testing.T) {
+	u := &UserClusterAssociation{Data: map[string]map[string]*ClusterInfo{"u1": {"nginx": {PodName: "nginx-1"}}}}
+	u.UpdateAssociations(nil)
+	if u.Data == nil || len(u.Data) != 0 {
+		t.Errorf("got %v, want an empty map", u.Data)
+	}
+	u.UpdateAppAssociations("nginx", map[string]*ClusterInfo{"u2": {PodName: "nginx-2"}})
+	if clusterInfo, ok := u.getClusterInfoForUser("u2", "nginx"); !ok || clusterInfo.PodName != "nginx-2" {
+		t.Errorf("got %v, %v", clusterInfo, ok)
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"scheduler/shared/controltls"
+	"scheduler/shared/tokenauth"
+)
+
+const adminPrefix = "/admin/v1/"
+
+// AdminServer serves the JSON admin API of the scheduler, for the operators.
+type AdminServer struct {
+	descheduler   *Descheduler
+	scheduler     *CustomScheduler
+	pauseSignals  chan<- PauseSignal
+	authenticator *tokenauth.Authenticator
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// AppPause is the pause state of an app, with its sources (annotation, admin_api).
+type AppPause struct {
+	App     string   `json:"app"`
+	Paused  bool     `json:"paused"`
+	Sources []string `json:"sources,omitempty"`
+}
+
+// AppView is an app as seen by the descheduler: thresholds, objective and the replicas before it was scaled.
+type AppView struct {
+	App              string           `json:"app"`
+	HardThresholdMs  *int64           `json:"hardThresholdMs,omitempty"`
+	SoftThresholdMs  *int64           `json:"softThresholdMs,omitempty"`
+	Objective        LatencyObjective `json:"objective,omitempty"`
+	BaselineReplicas *int32           `json:"baselineReplicas,omitempty"`
+	Paused           bool             `json:"paused"`
+	PauseSources     []string         `json:"pauseSources,omitempty"` // as of the last cycle
+}
+
+// ThresholdsRequest changes the thresholds of an app; the thresholds not set are unchanged, 0 removes one.
+type ThresholdsRequest struct {
+	HardMs *int64 `json:"hardMs"`
+	SoftMs *int64 `json:"softMs"`
+}
+
+type MeasurementView struct {
+	Pod       string    `json:"pod"`
+	LatencyMs int64     `json:"latencyMs"`
+	Requests  int64     `json:"requests"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type AssociationView struct {
+	App       string    `json:"app"`
+	User      string    `json:"user"`
+	Node      string    `json:"node"`
+	Pod       string    `json:"pod"`
+	LatencyMs int64     `json:"latencyMs"`
+	Soft      bool      `json:"soft"` // within the soft threshold
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// cycleSnapshot is the state left by the last descheduling cycle, read by the admin API without
+// waiting for the cycle running.
+type cycleSnapshot struct {
+	measurements map[string]map[string]map[string]*LatencyMeasurement // appName -> userID -> nodeName -> measurement
+	associations map[string]map[string]*ClusterInfo                   // userID -> appName -> cluster info
+	pauseState   map[string][]string                                  // appName -> sources of the pause
+}
+
+// publishSnapshot copies the state for the admin API; it is called by the cycle, under cycleMutex.
+func (d *Descheduler) publishSnapshot() {
+	pauseState := make(map[string][]string, len(d.pauseState))
+	for appName, sources := range d.pauseState {
+		pauseState[appName] = sources
+	}
+	snapshot := &cycleSnapshot{
+		measurements: d.latencyMeasurements.GetMeasurements(),
+		associations: d.user_Cluster.GetUserClusterAssociations(),
+		pauseState:   pauseState,
+	}
+	d.snapshotMutex.Lock()
+	d.snapshot = snapshot
+	d.snapshotMutex.Unlock()
+}
+
+// lastSnapshot returns the state of the last cycle (empty before the first one).
+func (d *Descheduler) lastSnapshot() *cycleSnapshot {
+	d.snapshotMutex.RLock()
+	defer d.snapshotMutex.RUnlock()
+	if d.snapshot == nil {
+		return &cycleSnapshot{}
+	}
+	return d.snapshot
+}
+
+func NewAdminServer(descheduler *Descheduler, scheduler *CustomScheduler, pauseSignals chan<- PauseSignal, authenticator *tokenauth.Authenticator) *AdminServer {
+	return &AdminServer{
+		descheduler:   descheduler,
+		scheduler:     scheduler,
+		pauseSignals:  pauseSignals,
+		authenticator: authenticator,
+	}
+}
+
+// handlePauses lists the paused apps: GET /admin/v1/pauses
+func (a *AdminServer) handlePauses(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "only GET is allowed"})
+		return
+	}
+	paused, err := a.descheduler.PausedApps()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, adminError{Error: err.Error()})
+		return
+	}
+	pauses := make([]AppPause, 0, len(paused))
+	for _, appName := range sortedKeys(paused) {
+		pauses = append(pauses, AppPause{App: appName, Paused: true, Sources: paused[appName]})
+	}
+	writeJSON(w, http.StatusOK, pauses)
+}
+
+// handleApps routes the requests on the apps:
+//
+//	GET  /admin/v1/apps                    list the apps with their thresholds and replica baselines
+//	GET  /admin/v1/apps/<app>              one app
+//	PUT  /admin/v1/apps/<app>/thresholds   change the thresholds, {"hardMs": 50, "softMs": 20} (0 removes one)
+//	POST /admin/v1/apps/<app>/pause        pause the descheduling and autoscaling of the app
+//	POST /admin/v1/apps/<app>/resume       resume it (the annotation of the Deployment must be removed too)
+func (a *AdminServer) handleApps(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, adminPrefix+"apps"), "/")
+	appName, action, _ := strings.Cut(path, "/")
+	switch {
+	case appName == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, a.appViews(""))
+	case action == "" && r.Method == http.MethodGet:
+		views := a.appViews(appName)
+		if len(views) == 0 {
+			writeJSON(w, http.StatusNotFound, adminError{Error: fmt.Sprintf("app %s not found", appName)})
+			return
+		}
+		writeJSON(w, http.StatusOK, views[0])
+	case action == "thresholds" && r.Method == http.MethodPut:
+		a.setThresholds(w, r, appName)
+	case (action == "pause" || action == "resume") && r.Method == http.MethodPost:
+		a.pauseApp(w, appName, action == "pause")
+	default:
+		writeJSON(w, http.StatusNotFound, adminError{Error: fmt.Sprintf("no route for %s %s", r.Method, r.URL.Path)})
+	}
+}
+
+// appViews returns the known apps (only appName if not empty): the ones with thresholds, a replica
+// baseline or measurements.
+func (a *AdminServer) appViews(appName string) []AppView {
+	d := a.descheduler
+	snapshot := d.lastSnapshot()
+	hardThresholds := d.hardLatencyThresholds.GetAll()
+	softThresholds := d.softLatencyThresholds.GetAll()
+	objectives := d.objectives.GetAll()
+	d.replicasMutex.RLock()
+	defaultReplicas := make(map[string]int32, len(d.defaultReplicas))
+	for name, replicas := range d.defaultReplicas {
+		defaultReplicas[name] = replicas
+	}
+	d.replicasMutex.RUnlock()
+	apps := make(map[string]bool)
+	for name := range hardThresholds {
+		apps[name] = true
+	}
+	for name := range softThresholds {
+		apps[name] = true
+	}
+	for name := range defaultReplicas {
+		apps[name] = true
+	}
+	for name := range snapshot.measurements {
+		apps[name] = true
+	}
+
+	views := make([]AppView, 0, len(apps))
+	for _, name := range sortedKeys(apps) {
+		if appName != "" && name != appName {
+			continue
+		}
+		view := AppView{App: name, Objective: objectives[name], PauseSources: snapshot.pauseState[name]}
+		if latency, ok := hardThresholds[name]; ok {
+			view.HardThresholdMs = &latency
+		}
+		if latency, ok := softThresholds[name]; ok {
+			view.SoftThresholdMs = &latency
+		}
+		if replicas, ok := defaultReplicas[name]; ok {
+			view.BaselineReplicas = &replicas
+		}
+		view.Paused = len(view.PauseSources) > 0
+		views = append(views, view)
+	}
+	return views
+}
+
+// setThresholds changes the thresholds of the app at runtime; they are used from the next scheduling
+// and descheduling cycle, and kept in the state checkpoint over the pod annotations. A removed
+// threshold is read again from the pods of the app when they are scheduled.
+func (a *AdminServer) setThresholds(w http.ResponseWriter, r *http.Request, appName string) {
+	if len(a.appViews(appName)) == 0 {
+		_, err := a.descheduler.clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), appName+"-deployment", metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			writeJSON(w, http.StatusNotFound, adminError{Error: fmt.Sprintf("app %s not found", appName)})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, adminError{Error: err.Error()})
+			return
+		}
+	}
+	var request ThresholdsRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{Error: fmt.Sprintf("invalid body: %v", err)})
+		return
+	}
+	if err := a.applyThresholds(appName, request); err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+		return
+	}
+	view := AppView{App: appName}
+	if views := a.appViews(appName); len(views) > 0 {
+		view = views[0]
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+func (a *AdminServer) applyThresholds(appName string, request ThresholdsRequest) error {
+	if request.HardMs == nil && request.SoftMs == nil {
+		return fmt.Errorf("hardMs or softMs must be set")
+	}
+	if (request.HardMs != nil && *request.HardMs < 0) || (request.SoftMs != nil && *request.SoftMs < 0) {
+		return fmt.Errorf("thresholds can't be negative")
+	}
+	d := a.descheduler
+	d.cycleMutex.Lock()
+	defer d.cycleMutex.Unlock()
+	hard, hasHard := d.hardLatencyThresholds.GetLatency(appName)
+	soft, hasSoft := d.softLatencyThresholds.GetLatency(appName)
+	if request.HardMs != nil {
+		hard, hasHard = *request.HardMs, *request.HardMs > 0
+	}
+	if request.SoftMs != nil {
+		soft, hasSoft = *request.SoftMs, *request.SoftMs > 0
+	}
+	if hasHard && hasSoft && soft > hard {
+		return fmt.Errorf("soft threshold %dms above the hard threshold %dms", soft, hard)
+	}
+
+	if request.HardMs != nil {
+		if hasHard {
+			d.hardLatencyThresholds.SetLatency(appName, hard)
+		} else {
+			d.hardLatencyThresholds.RemoveLatency(appName)
+		}
+	}
+	if request.SoftMs != nil {
+		if hasSoft {
+			d.softLatencyThresholds.SetLatency(appName, soft)
+		} else {
+			d.softLatencyThresholds.RemoveLatency(appName)
+		}
+	}
+	d.overridesMutex.Lock()
+	override := d.thresholdOverrides[appName]
+	if request.HardMs != nil {
+		override.HardMs = thresholdOverride(hard, hasHard)
+	}
+	if request.SoftMs != nil {
+		override.SoftMs = thresholdOverride(soft, hasSoft)
+	}
+	if override.HardMs == nil && override.SoftMs == nil {
+		delete(d.thresholdOverrides, appName)
+	} else {
+		d.thresholdOverrides[appName] = override
+	}
+	d.overridesMutex.Unlock()
+	fmt.Printf("Admin API: thresholds of app %s changed (hard: %dms, set %v; soft: %dms, set %v)\n", appName, hard, hasHard, soft, hasSoft)
+	return nil
+}
+
+// thresholdOverride is the threshold kept over the pod annotations, nil once it is removed.
+func thresholdOverride(latency int64, set bool) *int64 {
+	if !set {
+		return nil
+	}
+	return &latency
+}
+
+func (a *AdminServer) pauseApp(w http.ResponseWriter, appName string, pause bool) {
+	deployment, err := a.descheduler.clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), appName+"-deployment", metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		writeJSON(w, http.StatusNotFound, adminError{Error: fmt.Sprintf("app %s not found", appName)})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, adminError{Error: err.Error()})
+		return
+	}
+
+	a.pauseSignals <- PauseSignal{isPaused: pause, appName: appName}
+	var sources []string
+	if paused, _ := strconv.ParseBool(deployment.Annotations[pausedAnnotation]); paused {
+		sources = append(sources, pauseSourceAnnotation)
+	}
+	if pause {
+		sources = append(sources, pauseSourceAdminAPI)
+	}
+	writeJSON(w, http.StatusOK, AppPause{App: appName, Paused: len(sources) > 0, Sources: sources})
+}
+
+// handleMeasurements returns the latency matrix, appName -> userID -> nodeName -> measurement:
+// GET /admin/v1/measurements[?app=<app>]
+func (a *AdminServer) handleMeasurements(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "only GET is allowed"})
+		return
+	}
+	appName := r.URL.Query().Get("app")
+	matrix := make(map[string]map[string]map[string]MeasurementView)
+	for name, userMeasurements := range a.descheduler.lastSnapshot().measurements {
+		if appName != "" && name != appName {
+			continue
+		}
+		matrix[name] = make(map[string]map[string]MeasurementView)
+		for userID, nodeMeasurements := range userMeasurements {
+			matrix[name][userID] = make(map[string]MeasurementView)
+			for nodeName, measurement := range nodeMeasurements {
+				matrix[name][userID][nodeName] = MeasurementView{
+					Pod:       measurement.PodName,
+					LatencyMs: measurement.Measurement,
+					Requests:  measurement.Requests,
+					Timestamp: measurement.Timestamp,
+				}
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, matrix)
+}
+
+// handleAssociations lists the user associations: GET /admin/v1/associations[?app=<app>]
+func (a *AdminServer) handleAssociations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "only GET is allowed"})
+		return
+	}
+	appName := r.URL.Query().Get("app")
+	associations := a.descheduler.lastSnapshot().associations
+	views := []AssociationView{}
+	for _, userID := range sortedKeys(associations) {
+		for _, name := range sortedKeys(associations[userID]) {
+			if appName != "" && name != appName {
+				continue
+			}
+			clusterInfo := associations[userID][name]
+			views = append(views, AssociationView{
+				App:       name,
+				User:      userID,
+				Node:      clusterInfo.ClusterName,
+				Pod:       clusterInfo.PodName,
+				LatencyMs: clusterInfo.Latency,
+				Soft:      clusterInfo.HasSoftConstraint,
+				CreatedAt: clusterInfo.CreatedAt,
+			})
+		}
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// handleReevaluate starts a descheduling cycle without waiting for the next one: POST /admin/v1/reevaluate
+func (a *AdminServer) handleReevaluate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "only POST is allowed"})
+		return
+	}
+	select {
+	case a.descheduler.reevaluate <- struct{}{}:
+	default: // a cycle is already requested
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "descheduling cycle requested"})
+}
+
+// handleVisitedNodes returns (GET) or resets (DELETE) the nodes already used by the scheduler for
+// every app, or only for the app in the app parameter: /admin/v1/visited-nodes[?app=<app>]
+func (a *AdminServer) handleVisitedNodes(w http.ResponseWriter, r *http.Request) {
+	appName := r.URL.Query().Get("app")
+	a.scheduler.mutex.Lock()
+	defer a.scheduler.mutex.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		visitedNodesPerApp := make(map[string][]string)
+		for name, visitedNodes := range a.scheduler.visitedNodesPerApp {
+			if appName == "" || name == appName {
+				visitedNodesPerApp[name] = sortedKeys(visitedNodes)
+			}
+		}
+		writeJSON(w, http.StatusOK, visitedNodesPerApp)
+	case http.MethodDelete:
+		if appName == "" {
+			a.scheduler.visitedNodesPerApp = make(map[string]map[string]bool)
+			fmt.Println("Admin API: visited nodes of every app reset")
+		} else {
+			delete(a.scheduler.visitedNodesPerApp, appName)
+			fmt.Printf("Admin API: visited nodes of app %s reset\n", appName)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "only GET and DELETE are allowed"})
+	}
+}
+
+// Handler returns the routes of the admin API, behind the authentication.
+func (a *AdminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminPrefix+"pauses", a.handlePauses)
+	mux.HandleFunc(adminPrefix+"apps", a.handleApps)
+	mux.HandleFunc(adminPrefix+"apps/", a.handleApps)
+	mux.HandleFunc(adminPrefix+"measurements", a.handleMeasurements)
+	mux.HandleFunc(adminPrefix+"associations", a.handleAssociations)
+	mux.HandleFunc(adminPrefix+"reevaluate", a.handleReevaluate)
+	mux.HandleFunc(adminPrefix+"visited-nodes", a.handleVisitedNodes)
+	return a.authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := tokenauth.User(r)
+		fmt.Printf("Admin API: %s %s by %s\n", r.Method, r.URL.Path, user.Username)
+		mux.ServeHTTP(w, r)
+	}))
+}
+
+// Serve listens with the given certificate, or with a self-signed one if certFile is empty.
+func (a *AdminServer) Serve(address, certFile, keyFile string) {
+	server := &http.Server{Addr: address, Handler: a.Handler()}
+
+	fmt.Println("Serving admin API at", address)
+	var err error
+	if certFile != "" {
+		err = server.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		certificate, certErr := controltls.SelfSigned("latency-aware-scheduler")
+		if certErr != nil {
+			fmt.Println("Error generating the certificate of the admin API:", certErr)
+			return
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+		err = server.ListenAndServeTLS("", "")
+	}
+	if err != nil {
+		fmt.Println("Error serving the admin API:", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"scheduler/shared/tokenauth"
+)
+
+const testAdmin = "system:serviceaccount:kube-system:latency-admin"
+
+// newTestAdminServer serves the admin API of d to the operators with the token "admin-token", and
+// authenticates "other-token" as another identity.
+func newTestAdminServer(d *Descheduler, clientset *fake.Clientset) http.Handler {
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		switch review.Spec.Token {
+		case "admin-token":
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: testAdmin}}
+		case "other-token":
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:custom-scheduler"}}
+		default:
+			review.Status = authenticationv1.TokenReviewStatus{Error: "invalid token"}
+		}
+		return true, review, nil
+	})
+	return NewAdminServer(d, nil, nil, tokenauth.New(clientset, tokenauth.AllowedUsers(testAdmin))).Handler()
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"invalid token", "Bearer nope", http.StatusUnauthorized},
+		{"identity not allowed", "Bearer other-token", http.StatusForbidden},
+		{"allowed identity", "Bearer admin-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, clientset := newTestDescheduler()
+			handler := newTestAdminServer(d, clientset)
+			request := httptest.NewRequest(http.MethodGet, adminPrefix+"apps", nil)
+			if tt.authorization != "" {
+				request.Header.Set("Authorization", tt.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if recorder.Code != tt.want {
+				t.Errorf("got status %d, want %d", recorder.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminApps(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		body      string
+		want      int
+		hard      int64 // hard threshold of the app in the response, 0 if none
+		overrides int   // thresholds kept for the checkpoint
+	}{
+		{name: "unknown app", method: http.MethodGet, path: "apps/b", want: http.StatusNotFound},
+		{name: "known app", method: http.MethodGet, path: "apps/a", want: http.StatusOK, hard: 40},
+		{name: "thresholds of an unknown app", method: http.MethodPut, path: "apps/b/thresholds", body: `{"hardMs": 50}`, want: http.StatusNotFound},
+		{name: "thresholds of a known app", method: http.MethodPut, path: "apps/a/thresholds", body: `{"hardMs": 50}`, want: http.StatusOK, hard: 50, overrides: 1},
+		{name: "thresholds of a deployed app not seen yet", method: http.MethodPut, path: "apps/c/thresholds", body: `{"hardMs": 50}`, want: http.StatusOK, hard: 50, overrides: 1},
+		{name: "threshold removed", method: http.MethodPut, path: "apps/a/thresholds", body: `{"hardMs": 0}`, want: http.StatusOK},
+		{name: "soft above hard", method: http.MethodPut, path: "apps/a/thresholds", body: `{"softMs": 60}`, want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, clientset := newTestDescheduler(testDeployment("a", 1), testDeployment("c", 1))
+			d.hardLatencyThresholds.SetLatency("a", 40)
+			handler := newTestAdminServer(d, clientset)
+			request := httptest.NewRequest(tt.method, adminPrefix+tt.path, strings.NewReader(tt.body))
+			request.Header.Set("Authorization", "Bearer admin-token")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if recorder.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", recorder.Code, tt.want, recorder.Body)
+			}
+			if len(d.thresholdOverrides) != tt.overrides {
+				t.Errorf("%d threshold overrides, want %d", len(d.thresholdOverrides), tt.overrides)
+			}
+			if recorder.Code != http.StatusOK {
+				return
+			}
+			var view AppView
+			if err := json.Unmarshal(recorder.Body.Bytes(), &view); err != nil {
+				t.Fatal(err)
+			}
+			var hard int64
+			if view.HardThresholdMs != nil {
+				hard = *view.HardThresholdMs
+			}
+			if hard != tt.hard {
+				t.Errorf("hard threshold %d, want %d", hard, tt.hard)
+			}
+		})
+	}
+}
+
+// TestAdminReadsDuringCycle reads the state while a descheduling cycle runs: the reads return the
+// state of the last cycle instead of waiting.
+func TestAdminReadsDuringCycle(t *testing.T) {
+	d, clientset := newTestDescheduler()
+	d.user_Cluster.RestoreAssociation("u1", "a", &ClusterInfo{ClusterName: "n1", PodName: "a-1"})
+	d.publishSnapshot()
+	handler := newTestAdminServer(d, clientset)
+	d.cycleMutex.Lock()
+	defer d.cycleMutex.Unlock()
+
+	for _, path := range []string{"apps", "measurements", "associations"} {
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			request := httptest.NewRequest(http.MethodGet, adminPrefix+path, nil)
+			request.Header.Set("Authorization", "Bearer admin-token")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			done <- recorder
+		}()
+		select {
+		case recorder := <-done:
+			if recorder.Code != http.StatusOK {
+				t.Errorf("%s: got status %d", path, recorder.Code)
+			}
+			if path == "associations" && !strings.Contains(recorder.Body.String(), `"pod":"a-1"`) {
+				t.Errorf("associations of the last cycle missing: %s", recorder.Body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s blocked by the cycle", path)
+		}
+	}
+}
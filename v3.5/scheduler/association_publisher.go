@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"scheduler/shared/cohorts"
+)
+
+const (
+	associationsConfigMapPrefix = "user-associations-"
+	associationsLabel           = "latency-aware-scheduler/associations"
+	associationsDataKey         = "associations.json"
+	maxConfigMapDataSize        = 1000 * 1024 // the API server refuses objects bigger than ~1MiB
+)
+
+// AssociationPublisher writes the user-cluster associations into one ConfigMap per app,
+// so that every routing manager replica can watch its own shard.
+type AssociationPublisher struct {
+	clientset kubernetes.Interface
+	namespace string
+	published map[string]string // appName -> last published payload
+	cohorts   string            // cohort configuration published with the associations, if enabled
+}
+
+func NewAssociationPublisher(clientset kubernetes.Interface, namespace string) *AssociationPublisher {
+	return &AssociationPublisher{
+		clientset: clientset,
+		namespace: namespace,
+		published: make(map[string]string),
+	}
+}
+
+func associationsConfigMapName(appName string) string {
+	return associationsConfigMapPrefix + appName
+}
+
+// Publish splits the associations per app and updates only the ConfigMaps whose content changed.
+// Apps that no longer have associations get an empty shard, so routing managers drop stale entries.
+func (p *AssociationPublisher) Publish(associations *UserClusterAssociation) error {
+	perApp := make(map[string]map[string]*ClusterInfo) // appName -> userID -> cluster info
+	for userID, appAssociations := range associations.GetUserClusterAssociations() {
+		for appName, clusterInfo := range appAssociations {
+			if _, ok := perApp[appName]; !ok {
+				perApp[appName] = make(map[string]*ClusterInfo)
+			}
+			perApp[appName][userID] = clusterInfo
+		}
+	}
+	for appName := range p.published {
+		if _, ok := perApp[appName]; !ok {
+			perApp[appName] = make(map[string]*ClusterInfo)
+		}
+	}
+
+	var failed []string
+	for appName, userAssociations := range perApp {
+		jsonData, err := json.Marshal(userAssociations)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", appName, err))
+			continue
+		}
+		payload := string(jsonData)
+		if p.published[appName] == payload {
+			continue
+		}
+		if len(payload) > maxConfigMapDataSize {
+			failed = append(failed, fmt.Sprintf("%s: associations too large (%d bytes)", appName, len(payload)))
+			continue
+		}
+		if err := p.writeShard(appName, payload); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", appName, err))
+			continue
+		}
+		p.published[appName] = payload
+		fmt.Printf("Published %d associations for app %s in ConfigMap %s/%s\n", len(userAssociations), appName, p.namespace, associationsConfigMapName(appName))
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("error publishing associations: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (p *AssociationPublisher) writeShard(appName, payload string) error {
+	configMaps := p.clientset.CoreV1().ConfigMaps(p.namespace)
+	name := associationsConfigMapName(appName)
+
+	configMap, err := configMaps.Get(context.Background(), name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		configMap = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: p.namespace,
+				Labels: map[string]string{
+					associationsLabel: "true",
+					"app":             appName,
+				},
+			},
+			Data: map[string]string{associationsDataKey: payload},
+		}
+		if p.cohorts != "" {
+			configMap.Data[cohorts.DataKey] = p.cohorts
+		}
+		_, err = configMaps.Create(context.Background(), configMap, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	configMap.Data[associationsDataKey] = payload
+	if p.cohorts != "" {
+		configMap.Data[cohorts.DataKey] = p.cohorts
+	} else {
+		delete(configMap.Data, cohorts.DataKey)
+	}
+	_, err = configMaps.Update(context.Background(), configMap, metav1.UpdateOptions{})
+	return err
+}
+
+// Restore loads the previously published associations, so they survive a restart of the descheduler.
+func (p *AssociationPublisher) Restore(associations *UserClusterAssociation) error {
+	configMaps, err := p.clientset.CoreV1().ConfigMaps(p.namespace).List(context.Background(), metav1.ListOptions{
+		LabelSelector: associationsLabel + "=true",
+	})
+	if err != nil {
+		return fmt.Errorf("error listing association ConfigMaps: %v", err)
+	}
+	for _, configMap := range configMaps.Items {
+		appName := strings.TrimPrefix(configMap.Name, associationsConfigMapPrefix)
+		payload := configMap.Data[associationsDataKey]
+		var userAssociations map[string]*ClusterInfo
+		if err := json.Unmarshal([]byte(payload), &userAssociations); err != nil {
+			fmt.Printf("Error unmarshaling associations from ConfigMap %s: %v\n", configMap.Name, err)
+			continue
+		}
+		for userID, clusterInfo := range userAssociations {
+			associations.RestoreAssociation(userID, appName, clusterInfo)
+		}
+		if configMap.Data[cohorts.DataKey] == p.cohorts {
+			p.published[appName] = payload // else published again with the current cohorts
+		}
+		fmt.Printf("Restored %d associations for app %s\n", len(userAssociations), appName)
+	}
+	return nil
+}
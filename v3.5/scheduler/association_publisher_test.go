@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"scheduler/shared/cohorts"
+)
+
+func TestAssociationPublisherPublish(t *testing.T) {
+	tests := []struct {
+		name    string
+		rounds  []map[string]map[string]string // per Publish: userID -> appName -> pod
+		cohorts string
+		want    map[string]map[string]string // ConfigMap -> userID -> pod
+		updates int                          // writes after the first round
+	}{
+		{
+			name:   "one shard per app",
+			rounds: []map[string]map[string]string{{"u1": {"a": "a-1", "b": "b-1"}, "u2": {"a": "a-2"}}},
+			want: map[string]map[string]string{
+				"user-associations-a": {"u1": "a-1", "u2": "a-2"},
+				"user-associations-b": {"u1": "b-1"},
+			},
+		},
+		{
+			name: "unchanged shards are not written again",
+			rounds: []map[string]map[string]string{
+				{"u1": {"a": "a-1", "b": "b-1"}},
+				{"u1": {"a": "a-1", "b": "b-2"}},
+			},
+			want: map[string]map[string]string{
+				"user-associations-a": {"u1": "a-1"},
+				"user-associations-b": {"u1": "b-2"},
+			},
+			updates: 1,
+		},
+		{
+			name: "an app without associations gets an empty shard",
+			rounds: []map[string]map[string]string{
+				{"u1": {"a": "a-1", "b": "b-1"}},
+				{"u1": {"a": "a-1"}},
+			},
+			want: map[string]map[string]string{
+				"user-associations-a": {"u1": "a-1"},
+				"user-associations-b": {},
+			},
+			updates: 1,
+		},
+		{
+			name:    "the cohorts are published with the associations",
+			rounds:  []map[string]map[string]string{{"net:10.0.0.0/24": {"a": "a-1"}}},
+			cohorts: `{"prefixV4":24,"prefixV6":48}`,
+			want:    map[string]map[string]string{"user-associations-a": {"net:10.0.0.0/24": "a-1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			publisher := NewAssociationPublisher(clientset, "routing")
+			publisher.cohorts = tt.cohorts
+			updates := 0
+			for round, associations := range tt.rounds {
+				before := len(clientset.Actions())
+				if err := publisher.Publish(associationsOf(associations)); err != nil {
+					t.Fatalf("Publish: %v", err)
+				}
+				if round > 0 {
+					for _, action := range clientset.Actions()[before:] {
+						if action.GetVerb() == "update" || action.GetVerb() == "create" {
+							updates++
+						}
+					}
+				}
+			}
+			if updates != tt.updates {
+				t.Errorf("got %d writes after the first round, want %d", updates, tt.updates)
+			}
+			for name, want := range tt.want {
+				configMap, err := clientset.CoreV1().ConfigMaps("routing").Get(context.Background(), name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("ConfigMap %s: %v", name, err)
+				}
+				var got map[string]*ClusterInfo
+				if err := json.Unmarshal([]byte(configMap.Data[associationsDataKey]), &got); err != nil {
+					t.Fatalf("ConfigMap %s: %v", name, err)
+				}
+				if len(got) != len(want) {
+					t.Errorf("ConfigMap %s: got %d associations, want %d", name, len(got), len(want))
+				}
+				for userID, podName := range want {
+					if got[userID] == nil || got[userID].PodName != podName {
+						t.Errorf("ConfigMap %s: user %s associated to %+v, want pod %s", name, userID, got[userID], podName)
+					}
+				}
+				if configMap.Data[cohorts.DataKey] != tt.cohorts {
+					t.Errorf("ConfigMap %s: cohorts %q, want %q", name, configMap.Data[cohorts.DataKey], tt.cohorts)
+				}
+			}
+		})
+	}
+}
+
+func TestAssociationPublisherRestore(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	publisher := NewAssociationPublisher(clientset, "routing")
+	if err := publisher.Publish(associationsOf(map[string]map[string]string{"u1": {"a": "a-1"}, "u2": {"a": "a-2", "b": "b-1"}})); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	restarted := NewAssociationPublisher(clientset, "routing")
+	restored := NewUserClusterAssociation()
+	if err := restarted.Restore(restored); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	for userID, apps := range map[string]map[string]string{"u1": {"a": "a-1"}, "u2": {"a": "a-2", "b": "b-1"}} {
+		for appName, podName := range apps {
+			clusterInfo, ok := restored.GetUserClusterAssociation(userID, appName)
+			if !ok || clusterInfo.PodName != podName {
+				t.Errorf("user %s app %s: restored %+v, want pod %s", userID, appName, clusterInfo, podName)
+			}
+		}
+	}
+	if restored.Changed() {
+		t.Error("restored associations are marked as changed")
+	}
+	before := len(clientset.Actions())
+	if err := restarted.Publish(restored); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	for _, action := range clientset.Actions()[before:] {
+		if action.GetVerb() == "update" {
+			t.Errorf("restored shard published again: %v", action)
+		}
+	}
+}
+
+// TestUserClusterAssociationConcurrentRestore restores associations while they are read, as the
+// publisher does at startup while the admin API and the informers already run (go test -race).
+func TestUserClusterAssociationConcurrentRestore(t *testing.T) {
+	associations := NewUserClusterAssociation()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			associations.RestoreAssociation("u", "a", &ClusterInfo{PodName: "p", CreatedAt: time.Now()})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			associations.GetUserClusterAssociations()
+			associations.IsPodAssociated("a", "p")
+		}
+	}()
+	wg.Wait()
+}
+
+// associationsOf builds the associations userID -> appName -> pod, on the node of the same name.
+func associationsOf(pods map[string]map[string]string) *UserClusterAssociation {
+	associations := NewUserClusterAssociation()
+	for userID, apps := range pods {
+		for appName, podName := range apps {
+			associations.RestoreAssociation(userID, appName, &ClusterInfo{ClusterName: podName, PodName: podName})
+		}
+	}
+	return associations
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	maxUsersPerPodAnnotation = "max_users_per_pod"
+	maxRPSPerPodAnnotation   = "max_rps_per_pod"
+	userRateSmoothing        = 0.5 // weight of the last cycle in the request rate of a user
+)
+
+// podLoad is the users associated to a pod and their requests per second.
+type podLoad struct {
+	users int
+	rps   float64
+}
+
+// AppCapacity is how many users a pod of the app can serve; zero values mean no limit.
+type AppCapacity struct {
+	MaxUsersPerPod int
+	MaxRPSPerPod   float64
+}
+
+func (c AppCapacity) limited() bool {
+	return c.MaxUsersPerPod > 0 || c.MaxRPSPerPod > 0
+}
+
+// getAppCapacity reads the capacity from the max_users_per_pod and max_rps_per_pod annotations of the pod.
+func getAppCapacity(pod *v1.Pod) (AppCapacity, error) {
+	var capacity AppCapacity
+	if value, ok := pod.Annotations[maxUsersPerPodAnnotation]; ok {
+		users, err := strconv.Atoi(value)
+		if err != nil {
+			return capacity, fmt.Errorf("error parsing %s: %v", maxUsersPerPodAnnotation, err)
+		}
+		capacity.MaxUsersPerPod = users
+	}
+	if value, ok := pod.Annotations[maxRPSPerPodAnnotation]; ok {
+		rps, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return capacity, fmt.Errorf("error parsing %s: %v", maxRPSPerPodAnnotation, err)
+		}
+		capacity.MaxRPSPerPod = rps
+	}
+	return capacity, nil
+}
+
+// refreshAppPods reads the running pods of appName, grouped by node, and the capacity of the app.
+func (d *Descheduler) refreshAppPods(appName string) error {
+	pods, err := d.clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("app=%s", appName),
+	})
+	if err != nil {
+		return fmt.Errorf("error retrieving pods: %v", err)
+	}
+	nodePods := make(map[string][]string)
+	capacity := AppCapacity{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Spec.NodeName == "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+		nodePods[pod.Spec.NodeName] = append(nodePods[pod.Spec.NodeName], pod.Name)
+		if !capacity.limited() {
+			if capacity, err = getAppCapacity(pod); err != nil {
+				fmt.Printf("Ignoring the capacity of pod %s: %v\n", pod.Name, err)
+			}
+		}
+	}
+	d.appPods[appName] = nodePods
+	d.capacities[appName] = capacity
+	d.refreshPodLoads(appName)
+	return nil
+}
+
+// refreshPodLoads counts the users associated to every pod of the app and their requests, once per
+// cycle; associate and dissociate keep the counts up to date during the cycle.
+func (d *Descheduler) refreshPodLoads(appName string) {
+	loads := make(map[string]*podLoad)
+	for userID, clusterInfo := range d.user_Cluster.GetAppAssociations(appName) {
+		load, ok := loads[clusterInfo.PodName]
+		if !ok {
+			load = &podLoad{}
+			loads[clusterInfo.PodName] = load
+		}
+		load.users++
+		load.rps += d.userRates[appName][userID]
+	}
+	d.podLoads[appName] = loads
+}
+
+// moveLoad moves the load of the user from the pod from to the pod to; either can be empty.
+func (d *Descheduler) moveLoad(appName, userID, from, to string) {
+	loads, ok := d.podLoads[appName]
+	if !ok || from == to {
+		return
+	}
+	rate := d.userRates[appName][userID]
+	if load, ok := loads[from]; ok {
+		load.users--
+		load.rps -= rate
+	}
+	if to != "" {
+		load, ok := loads[to]
+		if !ok {
+			load = &podLoad{}
+			loads[to] = load
+		}
+		load.users++
+		load.rps += rate
+	}
+}
+
+// dissociate removes the association of the user, and its load from its pod.
+func (d *Descheduler) dissociate(userID, appName string) {
+	if current, ok := d.user_Cluster.GetUserClusterAssociation(userID, appName); ok {
+		d.moveLoad(appName, userID, current.PodName, "")
+	}
+	d.user_Cluster.RemoveUserClusterAssiciation(userID, appName)
+}
+
+// updateUserRates smooths the requests per second of every user, from the requests counted by the
+// meters since the previous cycle; users that are no longer measured are forgotten.
+func (d *Descheduler) updateUserRates(measurements map[string]map[string]map[string]*LatencyMeasurement) {
+	for appName, userMeasurements := range d.latencyMeasurements.GetMeasurements() {
+		rates := make(map[string]float64)
+		for userID := range userMeasurements {
+			var requests int64
+			for _, measurement := range measurements[appName][userID] {
+				requests += measurement.Requests
+			}
+			rate := float64(requests) / checkInterval.Seconds()
+			if previous, ok := d.userRates[appName][userID]; ok {
+				rate = userRateSmoothing*rate + (1-userRateSmoothing)*previous
+			}
+			rates[userID] = rate
+		}
+		d.userRates[appName] = rates
+	}
+}
+
+// podLoad returns the users associated to podName, but userID, and their requests per second.
+func (d *Descheduler) podLoad(appName, podName, userID string) (int, float64) {
+	load, ok := d.podLoads[appName][podName]
+	if !ok {
+		return 0, 0
+	}
+	users, rps := load.users, load.rps
+	if current, ok := d.user_Cluster.GetUserClusterAssociation(userID, appName); ok && current.PodName == podName {
+		users--
+		rps -= d.userRates[appName][userID]
+	}
+	return users, math.Max(rps, 0)
+}
+
+func (d *Descheduler) hasRoom(appName, podName, userID string) bool {
+	capacity := d.capacities[appName]
+	users, rps := d.podLoad(appName, podName, userID)
+	if capacity.MaxUsersPerPod > 0 && users+1 > capacity.MaxUsersPerPod {
+		return false
+	}
+	if capacity.MaxRPSPerPod > 0 && rps+d.userRates[appName][userID] > capacity.MaxRPSPerPod {
+		return false
+	}
+	return true
+}
+
+// associate associates the user to a pod on nodeName, like AddAssociation, but respecting the capacity
+// of the app: the measured pod is preferred, then the least loaded pod of the node with room.
+func (d *Descheduler) associate(userID, appName, nodeName string, measurement *LatencyMeasurement, isSoft bool) {
+	objective := d.objectives.GetObjective(appName)
+	if !d.capacities[appName].limited() {
+		d.addAssociation(userID, appName, nodeName, measurement, isSoft, objective)
+		return
+	}
+	if current, ok := d.user_Cluster.GetUserClusterAssociation(userID, appName); ok && !objective.replacesAssociation(current, measurement.Measurement, isSoft) {
+		return
+	}
+
+	podName := ""
+	if d.hasRoom(appName, measurement.PodName, userID) && containsString(d.appPods[appName][nodeName], measurement.PodName) {
+		podName = measurement.PodName
+	} else {
+		bestUsers := -1
+		for _, candidate := range d.appPods[appName][nodeName] {
+			if !d.hasRoom(appName, candidate, userID) {
+				continue
+			}
+			if users, _ := d.podLoad(appName, candidate, userID); bestUsers == -1 || users < bestUsers {
+				podName, bestUsers = candidate, users
+			}
+		}
+	}
+	if podName == "" {
+		fmt.Printf("No capacity left on node %s for user %s of app %s\n", nodeName, userID, appName)
+		d.denyUser(appName, userID)
+		return
+	}
+	associated := *measurement
+	associated.PodName = podName
+	d.addAssociation(userID, appName, nodeName, &associated, isSoft, objective)
+}
+
+// addAssociation is AddAssociation, moving the load of the user to its new pod.
+func (d *Descheduler) addAssociation(userID, appName, nodeName string, measurement *LatencyMeasurement, isSoft bool, objective LatencyObjective) {
+	from := ""
+	if current, ok := d.user_Cluster.GetUserClusterAssociation(userID, appName); ok {
+		from = current.PodName
+	}
+	d.user_Cluster.AddAssociation(userID, appName, nodeName, measurement, isSoft, objective)
+	if current, ok := d.user_Cluster.GetUserClusterAssociation(userID, appName); ok {
+		d.moveLoad(appName, userID, from, current.PodName)
+	}
+}
+
+// shedOverload removes the associations of the pods beyond the capacity of the app, starting from
+// the users with the highest latency, so they are associated again where there is room.
+func (d *Descheduler) shedOverload(appName string) {
+	capacity := d.capacities[appName]
+	if !capacity.limited() {
+		return
+	}
+	podUsers := make(map[string][]string) // podName -> users
+	for userID, clusterInfo := range d.user_Cluster.GetAppAssociations(appName) {
+		podUsers[clusterInfo.PodName] = append(podUsers[clusterInfo.PodName], userID)
+	}
+	for _, podName := range sortedKeys(podUsers) {
+		users := podUsers[podName]
+		sort.Slice(users, func(i, j int) bool {
+			a, _ := d.user_Cluster.GetUserClusterAssociation(users[i], appName)
+			b, _ := d.user_Cluster.GetUserClusterAssociation(users[j], appName)
+			if a.Latency != b.Latency {
+				return a.Latency < b.Latency
+			}
+			return users[i] < users[j]
+		})
+		kept := 0
+		rps := 0.0
+		for _, userID := range users {
+			rate := d.userRates[appName][userID]
+			if (capacity.MaxUsersPerPod > 0 && kept+1 > capacity.MaxUsersPerPod) || (capacity.MaxRPSPerPod > 0 && kept > 0 && rps+rate > capacity.MaxRPSPerPod) {
+				fmt.Printf("Pod %s over capacity, removing the association of user %s\n", podName, userID)
+				d.dissociate(userID, appName)
+				d.denyUser(appName, userID)
+				continue
+			}
+			kept++
+			rps += rate
+		}
+	}
+}
+
+// denyUser records that the user couldn't be associated for lack of capacity.
+func (d *Descheduler) denyUser(appName, userID string) {
+	if _, ok := d.deniedUsers[appName]; !ok {
+		d.deniedUsers[appName] = make(map[string]bool)
+	}
+	d.deniedUsers[appName][userID] = true
+}
+
+// hasRoomOnNode tells whether a pod of the app on nodeName can take the user.
+func (d *Descheduler) hasRoomOnNode(appName, nodeName, userID string) bool {
+	for _, podName := range d.appPods[appName][nodeName] {
+		if d.hasRoom(appName, podName, userID) {
+			return true
+		}
+	}
+	return false
+}
+
+// capacityRunsOut tells whether a capacity-limited app needs another replica: some user is left
+// without association because the pods on its valid nodes are full, or the load exceeds the total capacity.
+// The users denied since the previous check are forgotten.
+func (d *Descheduler) capacityRunsOut(appName string) bool {
+	denied := d.deniedUsers[appName]
+	delete(d.deniedUsers, appName)
+	for _, userID := range sortedKeys(denied) {
+		if _, ok := d.user_Cluster.GetUserClusterAssociation(userID, appName); !ok {
+			fmt.Printf("User %s of app %s left without association by the capacity of the pods\n", userID, appName)
+			return true
+		}
+	}
+	pods := 0
+	for _, nodePods := range d.appPods[appName] {
+		pods += len(nodePods)
+	}
+	return d.requiredReplicas(appName) > pods
+}
+
+// requiredReplicas is the number of pods needed by the measured users of the app and their requests.
+func (d *Descheduler) requiredReplicas(appName string) int {
+	capacity := d.capacities[appName]
+	required := 0
+	if capacity.MaxUsersPerPod > 0 {
+		users := d.latencyMeasurements.CountUsers(appName)
+		required = (users + capacity.MaxUsersPerPod - 1) / capacity.MaxUsersPerPod
+	}
+	if capacity.MaxRPSPerPod > 0 {
+		rps := 0.0
+		for _, rate := range d.userRates[appName] {
+			rps += rate
+		}
+		if byRate := int(math.Ceil(rps / capacity.MaxRPSPerPod)); byRate > required {
+			required = byRate
+		}
+	}
+	return required
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
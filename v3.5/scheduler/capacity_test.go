@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestGetAppCapacity(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        AppCapacity
+		wantErr     bool
+	}{
+		{"no limit", nil, AppCapacity{}, false},
+		{"users", map[string]string{maxUsersPerPodAnnotation: "10"}, AppCapacity{MaxUsersPerPod: 10}, false},
+		{"users and requests", map[string]string{maxUsersPerPodAnnotation: "10", maxRPSPerPodAnnotation: "2.5"}, AppCapacity{MaxUsersPerPod: 10, MaxRPSPerPod: 2.5}, false},
+		{"invalid users", map[string]string{maxUsersPerPodAnnotation: "ten"}, AppCapacity{}, true},
+		{"invalid requests", map[string]string{maxRPSPerPodAnnotation: "fast"}, AppCapacity{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getAppCapacity(testPod("a", "a-1", "n1", tt.annotations))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssociateWithinCapacity(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity AppCapacity
+		rates    map[string]float64
+		users    []string // associated in order, each measured on pod a-1 of node n1
+		want     map[string]string
+		denied   []string
+	}{
+		{
+			name:     "unlimited",
+			capacity: AppCapacity{},
+			users:    []string{"u1", "u2", "u3"},
+			want:     map[string]string{"u1": "a-1", "u2": "a-1", "u3": "a-1"},
+		},
+		{
+			name:     "users beyond the measured pod go to the least loaded pod of the node",
+			capacity: AppCapacity{MaxUsersPerPod: 1},
+			users:    []string{"u1", "u2"},
+			want:     map[string]string{"u1": "a-1", "u2": "a-2"},
+		},
+		{
+			name:     "users beyond the node capacity are denied",
+			capacity: AppCapacity{MaxUsersPerPod: 1},
+			users:    []string{"u1", "u2", "u3"},
+			want:     map[string]string{"u1": "a-1", "u2": "a-2"},
+			denied:   []string{"u3"},
+		},
+		{
+			name:     "requests per second",
+			capacity: AppCapacity{MaxRPSPerPod: 10},
+			rates:    map[string]float64{"u1": 6, "u2": 6, "u3": 3},
+			users:    []string{"u1", "u2", "u3"},
+			want:     map[string]string{"u1": "a-1", "u2": "a-2", "u3": "a-1"},
+		},
+		{
+			name:     "a user associated again keeps its room",
+			capacity: AppCapacity{MaxUsersPerPod: 1},
+			users:    []string{"u1", "u1"},
+			want:     map[string]string{"u1": "a-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDescheduler()
+			d.capacities["a"] = tt.capacity
+			d.appPods["a"] = map[string][]string{"n1": {"a-1", "a-2"}}
+			d.userRates["a"] = tt.rates
+			d.refreshPodLoads("a")
+			for i, userID := range tt.users {
+				d.associate(userID, "a", "n1", &LatencyMeasurement{PodName: "a-1", Measurement: int64(10 - i), Timestamp: time.Now()}, false)
+			}
+			for userID, podName := range tt.want {
+				if clusterInfo, ok := d.user_Cluster.GetUserClusterAssociation(userID, "a"); !ok || clusterInfo.PodName != podName {
+					t.Errorf("user %s associated to %+v, want pod %s", userID, clusterInfo, podName)
+				}
+			}
+			for _, userID := range tt.denied {
+				if !d.deniedUsers["a"][userID] {
+					t.Errorf("user %s not denied", userID)
+				}
+			}
+			checkPodLoads(t, d, "a")
+		})
+	}
+}
+
+func TestShedOverload(t *testing.T) {
+	d, _ := newTestDescheduler()
+	d.capacities["a"] = AppCapacity{MaxUsersPerPod: 2}
+	d.appPods["a"] = map[string][]string{"n1": {"a-1"}}
+	for i, latency := range []int64{30, 10, 20} {
+		d.user_Cluster.RestoreAssociation(fmt.Sprintf("u%d", i+1), "a", &ClusterInfo{ClusterName: "n1", PodName: "a-1", Latency: latency, CreatedAt: time.Now()})
+	}
+	d.refreshPodLoads("a")
+	d.shedOverload("a")
+	if _, ok := d.user_Cluster.GetUserClusterAssociation("u1", "a"); ok || !d.deniedUsers["a"]["u1"] {
+		t.Error("the user with the highest latency kept its association")
+	}
+	for _, userID := range []string{"u2", "u3"} {
+		if _, ok := d.user_Cluster.GetUserClusterAssociation(userID, "a"); !ok {
+			t.Errorf("user %s lost its association", userID)
+		}
+	}
+	checkPodLoads(t, d, "a")
+}
+
+func TestRequiredReplicas(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity AppCapacity
+		users    int
+		rates    map[string]float64
+		want     int
+	}{
+		{"no limit", AppCapacity{}, 5, nil, 0},
+		{"by users", AppCapacity{MaxUsersPerPod: 2}, 5, nil, 3},
+		{"by requests", AppCapacity{MaxRPSPerPod: 10}, 1, map[string]float64{"u1": 25}, 3},
+		{"the highest of the two", AppCapacity{MaxUsersPerPod: 5, MaxRPSPerPod: 10}, 5, map[string]float64{"u1": 15}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDescheduler()
+			d.capacities["a"] = tt.capacity
+			d.userRates["a"] = tt.rates
+			for i := 0; i < tt.users; i++ {
+				d.latencyMeasurements.AddLatency("a", fmt.Sprintf("u%d", i), "n1", &LatencyMeasurement{PodName: "a-1", Measurement: 10, Timestamp: clock.Now()})
+			}
+			if got := d.requiredReplicas("a"); got != tt.want {
+				t.Errorf("got %d replicas, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// checkPodLoads compares the loads kept during the cycle with the ones counted from the associations.
+func checkPodLoads(t *testing.T, d *Descheduler, appName string) {
+	t.Helper()
+	kept := d.podLoads[appName]
+	d.refreshPodLoads(appName)
+	for podName, load := range d.podLoads[appName] {
+		if kept[podName] == nil || kept[podName].users != load.users || kept[podName].rps != load.rps {
+			t.Errorf("pod %s: kept load %+v, counted %+v", podName, kept[podName], load)
+		}
+	}
+	for podName, load := range kept {
+		if _, ok := d.podLoads[appName][podName]; !ok && load.users != 0 {
+			t.Errorf("pod %s: kept load %+v without associations", podName, load)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVirtualClockAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		after    time.Duration
+		advances []time.Duration
+		fired    bool
+	}{
+		{"not advanced", checkInterval, nil, false},
+		{"advanced short of the duration", checkInterval, []time.Duration{10 * time.Second, 10 * time.Second}, false},
+		{"advanced by the duration", checkInterval, []time.Duration{checkInterval}, true},
+		{"advanced in steps past the duration", checkInterval, []time.Duration{20 * time.Second, 20 * time.Second}, true},
+		{"no duration", 0, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Unix(1700000000, 0)
+			c := NewVirtualClock(start)
+			timer := c.After(tt.after)
+			for _, d := range tt.advances {
+				c.Advance(d)
+			}
+			select {
+			case at := <-timer:
+				if !tt.fired {
+					t.Fatalf("fired at %v", at)
+				}
+				if at.Before(start.Add(tt.after)) {
+					t.Errorf("fired at %v, before the deadline", at)
+				}
+			default:
+				if tt.fired {
+					t.Fatal("not fired")
+				}
+			}
+		})
+	}
+}
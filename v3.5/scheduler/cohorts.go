@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"scheduler/shared/cohorts"
+)
+
+// NewCohortConfig loads the cohorts of the users (scheduler/shared/cohorts) from the flags.
+func NewCohortConfig(prefixV4, prefixV6 int, regionsFile string, overrides []string) (*cohorts.Config, error) {
+	config, err := cohorts.Load(prefixV4, prefixV6, regionsFile, overrides)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("User cohorts enabled: /%d IPv4 and /%d IPv6 networks, %d regions, %d users kept individually\n",
+		prefixV4, prefixV6, len(config.Regions), config.KeptIndividually())
+	return config, nil
+}
+
+// EnableCohorts makes the descheduler and the routing managers work on cohorts of users instead of
+// individual users.
+func (d *Descheduler) EnableCohorts(config *cohorts.Config) error {
+	payload, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	d.cohorts = config
+	d.publisher.cohorts = string(payload)
+	return nil
+}
+
+// aggregateCohorts merges the measurements of the users of a cohort, appName -> userID -> nodeName,
+// into appName -> cohort -> nodeName: the latency on a node is the mean of its users weighted by
+// their requests, and the requests are summed.
+func aggregateCohorts(c *cohorts.Config, measurements map[string]map[string]map[string]*LatencyMeasurement) map[string]map[string]map[string]*LatencyMeasurement {
+	aggregated := make(map[string]map[string]map[string]*LatencyMeasurement)
+	for appName, users := range measurements {
+		appCohorts := make(map[string]map[string]*LatencyMeasurement)
+		weights := make(map[string]map[string]int64) // cohort -> nodeName -> weight of the mean
+		for _, userID := range sortedKeys(users) {
+			for nodeName, measurement := range users[userID] {
+				cohort := c.Cohort(userID, measurement.SourceIP)
+				if _, ok := appCohorts[cohort]; !ok {
+					appCohorts[cohort] = make(map[string]*LatencyMeasurement)
+					weights[cohort] = make(map[string]int64)
+				}
+				weight := measurement.Requests
+				if weight < 1 {
+					weight = 1
+				}
+				merged, ok := appCohorts[cohort][nodeName]
+				if !ok {
+					copied := *measurement
+					if cohort != userID {
+						copied.SourceIP = ""
+					}
+					appCohorts[cohort][nodeName] = &copied
+					weights[cohort][nodeName] = weight
+					continue
+				}
+				total := weights[cohort][nodeName] + weight
+				merged.Measurement = (merged.Measurement*weights[cohort][nodeName] + measurement.Measurement*weight + total/2) / total
+				merged.Requests += measurement.Requests
+				if measurement.Timestamp.After(merged.Timestamp) {
+					merged.Timestamp = measurement.Timestamp
+					merged.PodNamespace, merged.PodName = measurement.PodNamespace, measurement.PodName
+				}
+				weights[cohort][nodeName] = total
+			}
+		}
+		if len(appCohorts) < len(users) {
+			fmt.Printf("Cohorts of app %s: %d users measured in %d cohorts\n", appName, len(users), len(appCohorts))
+		}
+		aggregated[appName] = appCohorts
+	}
+	return aggregated
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"scheduler/shared/cohorts"
+)
+
+func TestAggregateCohorts(t *testing.T) {
+	config, err := cohorts.Load(24, 48, "", []string{"vip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	earlier, later := time.Unix(1000, 0), time.Unix(2000, 0)
+	tests := []struct {
+		name     string
+		users    map[string]map[string]*LatencyMeasurement // userID -> nodeName -> measurement of app a
+		want     map[string]map[string]int64               // cohort -> nodeName -> latency
+		requests map[string]int64                          // cohort -> requests on n1
+		pod      string                                    // pod of the cohort on n1: the one measured last
+	}{
+		{
+			name: "users of a network merged by their requests",
+			users: map[string]map[string]*LatencyMeasurement{
+				"u1": {"n1": {PodName: "a-1", Measurement: 10, Requests: 3, SourceIP: "192.0.2.1", Timestamp: earlier}},
+				"u2": {"n1": {PodName: "a-2", Measurement: 50, Requests: 1, SourceIP: "192.0.2.2", Timestamp: later}},
+			},
+			want:     map[string]map[string]int64{"net:192.0.2.0/24": {"n1": 20}},
+			requests: map[string]int64{"net:192.0.2.0/24": 4},
+			pod:      "a-2",
+		},
+		{
+			name: "users without requests weigh one",
+			users: map[string]map[string]*LatencyMeasurement{
+				"u1": {"n1": {PodName: "a-1", Measurement: 10, SourceIP: "192.0.2.1", Timestamp: later}},
+				"u2": {"n1": {PodName: "a-2", Measurement: 30, SourceIP: "192.0.2.2", Timestamp: earlier}},
+			},
+			want:     map[string]map[string]int64{"net:192.0.2.0/24": {"n1": 20}},
+			requests: map[string]int64{"net:192.0.2.0/24": 0},
+			pod:      "a-1",
+		},
+		{
+			name: "users of different networks kept apart",
+			users: map[string]map[string]*LatencyMeasurement{
+				"u1": {"n1": {Measurement: 10, SourceIP: "192.0.2.1"}, "n2": {Measurement: 40, SourceIP: "192.0.2.1"}},
+				"u2": {"n1": {Measurement: 30, SourceIP: "198.51.100.2"}},
+			},
+			want: map[string]map[string]int64{"net:192.0.2.0/24": {"n1": 10, "n2": 40}, "net:198.51.100.0/24": {"n1": 30}},
+		},
+		{
+			name: "users kept individually",
+			users: map[string]map[string]*LatencyMeasurement{
+				"vip": {"n1": {Measurement: 10, SourceIP: "192.0.2.1"}},
+				"old": {"n1": {Measurement: 30}}, // measured by a meter that doesn't report the IP
+			},
+			want: map[string]map[string]int64{"vip": {"n1": 10}, "old": {"n1": 30}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aggregated := aggregateCohorts(config, map[string]map[string]map[string]*LatencyMeasurement{"a": tt.users})["a"]
+			if len(aggregated) != len(tt.want) {
+				t.Fatalf("got %d cohorts, want %d: %v", len(aggregated), len(tt.want), aggregated)
+			}
+			for cohort, nodes := range tt.want {
+				for nodeName, latency := range nodes {
+					measurement, ok := aggregated[cohort][nodeName]
+					if !ok || measurement.Measurement != latency {
+						t.Errorf("cohort %s on %s: got %+v, want %dms", cohort, nodeName, measurement, latency)
+					}
+				}
+			}
+			for cohort, requests := range tt.requests {
+				if got := aggregated[cohort]["n1"].Requests; got != requests {
+					t.Errorf("cohort %s: %d requests, want %d", cohort, got, requests)
+				}
+			}
+			for cohort := range tt.requests {
+				if got := aggregated[cohort]["n1"]; got.PodName != tt.pod || got.SourceIP != "" {
+					t.Errorf("cohort %s: pod %s, source IP %q, want pod %s and no IP", cohort, got.PodName, got.SourceIP, tt.pod)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultTokenFile is the projected ServiceAccount token of the scheduler for the control endpoints
+// (audience tokenauth.DefaultAudience), rejected by the API server and accepted only by them.
+const defaultTokenFile = "/var/run/secrets/latency-control/token"
+
+// ControlClient calls the control endpoints of the latency meters and of the routing manager over TLS,
+// authenticating with the projected ServiceAccount token of the scheduler.
+type ControlClient struct {
+	httpClient *http.Client
+	tokenFile  string
+}
+
+func NewControlClient(tokenFile string, tlsConfig *tls.Config) *ControlClient {
+	return &ControlClient{
+		httpClient: &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+		tokenFile:  tokenFile,
+	}
+}
+
+func (c *ControlClient) Do(method, endpoint, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	// The projected token is rotated by the kubelet, so it is read again at every request
+	token, err := os.ReadFile(c.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading token file %s: %v", c.tokenFile, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	return c.httpClient.Do(req)
+}
+
+func (c *ControlClient) Get(endpoint string) (*http.Response, error) {
+	return c.Do(http.MethodGet, endpoint, "", nil)
+}
+
+func (c *ControlClient) Post(endpoint, contentType string, body io.Reader) (*http.Response, error) {
+	return c.Do(http.MethodPost, endpoint, contentType, body)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestControlClient(t *testing.T) {
+	tests := []struct {
+		name        string
+		tokens      []string // content of the token file at every request, "" if missing
+		post        bool
+		wantErr     bool
+		wantHeaders []string // Authorization of every request
+	}{
+		{"get with the token", []string{"token-1\n"}, false, false, []string{"Bearer token-1"}},
+		{"post with the token", []string{"token-1"}, true, false, []string{"Bearer token-1"}},
+		{"rotated token read again", []string{"token-1", "token-2"}, false, false, []string{"Bearer token-1", "Bearer token-2"}},
+		{"missing token file", []string{""}, false, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var headers []string
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				headers = append(headers, r.Header.Get("Authorization"))
+				if tt.post {
+					body, _ := io.ReadAll(r.Body)
+					if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || string(body) != "{}" {
+						t.Errorf("got %s %q with content type %q", r.Method, body, r.Header.Get("Content-Type"))
+					}
+				}
+			}))
+			defer server.Close()
+			tokenFile := filepath.Join(t.TempDir(), "token")
+			client := NewControlClient(tokenFile, server.Client().Transport.(*http.Transport).TLSClientConfig)
+			for _, token := range tt.tokens {
+				if token != "" {
+					if err := os.WriteFile(tokenFile, []byte(token), 0o600); err != nil {
+						t.Fatal(err)
+					}
+				}
+				var response *http.Response
+				var err error
+				if tt.post {
+					response, err = client.Post(server.URL, "application/json", strings.NewReader("{}"))
+				} else {
+					response, err = client.Get(server.URL)
+				}
+				if tt.wantErr {
+					if err == nil {
+						t.Error("request sent without a token")
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("request: %v", err)
+				}
+				response.Body.Close()
+			}
+			if strings.Join(headers, ",") != strings.Join(tt.wantHeaders, ",") {
+				t.Errorf("got Authorization %q, want %q", headers, tt.wantHeaders)
+			}
+		})
+	}
+}
+
+// writeTokenFile writes the token "control-token" and returns its file.
+func writeTokenFile(t *testing.T) string {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("control-token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return tokenFile
+}
+
+func TestGetLatencyMeasurements(t *testing.T) {
+	var scraped []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scraped = append(scraped, r.URL.Path+" "+r.Header.Get("Authorization"))
+		io.WriteString(w, `{"u1": {"Measurement": 12}}`)
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	// Every pod listens at the address of the server, only the meters must be contacted
+	meter := testPod("a", "a-1", "n1", nil)
+	meter.Labels["latency-meter"] = "enabled"
+	other := testPod("a", "a-2", "n2", nil)
+	system := testPod("dns", "dns-1", "n1", nil)
+	system.Namespace, system.Labels["latency-meter"] = "kube-system", "enabled"
+	for _, pod := range []*v1.Pod{meter, other, system} {
+		pod.Status.PodIP = host
+	}
+	d, _ := newTestDescheduler(meter, other, system)
+	d.controlClient = NewControlClient(writeTokenFile(t), server.Client().Transport.(*http.Transport).TLSClientConfig)
+	d.meterControlPort, _ = strconv.Atoi(port)
+
+	measurements, err := d.getLatencyMeasurements()
+	if err != nil {
+		t.Fatalf("getLatencyMeasurements: %v", err)
+	}
+	if len(scraped) != 1 || scraped[0] != "/measurements Bearer control-token" {
+		t.Errorf("got requests %q, want one to the meter with the token", scraped)
+	}
+	if measurement := measurements["a"]["u1"]["n1"]; measurement == nil || measurement.Measurement != 12 || len(measurements["a"]["u1"]) != 1 {
+		t.Errorf("got measurements %v", measurements["a"]["u1"])
+	}
+}
@@ -7,17 +7,22 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"scheduler/shared/cohorts"
+	"scheduler/shared/drain"
 )
 
 type Descheduler struct {
-	clientset             *kubernetes.Clientset
+	clientset             kubernetes.Interface
 	mutex                 *sync.Mutex
 	latencyMeasurements   *LatencyMeasurements
 	user_Cluster          *UserClusterAssociation
@@ -26,11 +31,62 @@ type Descheduler struct {
 	softValidNodes        *LatencyMeasurements
 	hardLatencyThresholds *LatencyThresholds
 	softLatencyThresholds *LatencyThresholds
-	defaultReplicas       map[string]int32
+	objectives            *LatencyObjectives
+	defaultReplicas       map[string]int32 // written by the cycle under replicasMutex, read under it by the other goroutines
+	replicasMutex         sync.RWMutex
+	publisher             *AssociationPublisher
+	routingManagerAddress string
+	controlClient         *ControlClient
+	meterControlPort      int
+	meterSelector         string
+	metricsTopUsers       int   // users per app with their own latency series
+	minPodBenefit         int64 // benefit a pod on a bad node needs to be kept, see podBenefits
+	stats                 *LatencyStatsStore
+	autoscalingDisabled   bool             // the replicas are managed by an HPA on the external metrics
+	stateStore            *StateStore      // checkpoints of the state, disabled if nil
+	scheduler             *CustomScheduler // owner of the visited nodes, checkpointed with the descheduler state
+	globalPlacement       bool             // plan the placement on the whole latency matrix instead of per user
+	maxReplicas           int              // replica budget of the global placement
+	capacities            map[string]AppCapacity
+	appPods               map[string]map[string][]string // appName -> nodeName -> running pods
+	userRates             map[string]map[string]float64  // appName -> userID -> requests per second
+	deniedUsers           map[string]map[string]bool     // appName -> users that found no pod with room
+	podLoads              map[string]map[string]*podLoad // appName -> podName -> load, counted once per cycle
+	migrations            *MigrationStore                // make-before-break migrations instead of deletions, disabled if nil
+	drainTimeout          time.Duration                  // pods are drained by the routing managers before the eviction, disabled if 0
+	recorder              record.EventRecorder
+	pausedApps            map[string]bool     // apps paused through the admin API
+	pauseMutex            sync.Mutex          // guards pausedApps, changed by the admin API
+	pauseState            map[string][]string // appName -> sources of the pause in the last cycle
+	cycleMutex            sync.Mutex          // held by a descheduling cycle, so the admin API changes apply between cycles
+	snapshot              *cycleSnapshot      // state of the last cycle, read by the admin API
+	snapshotMutex         sync.RWMutex
+	thresholdOverrides    map[string]ThresholdsRequest // appName -> thresholds set through the admin API, checkpointed
+	overridesMutex        sync.Mutex                   // guards thresholdOverrides, changed by the admin API
+	reevaluate            chan struct{}                // starts a cycle before checkInterval, requested by the admin API
+	lifecycleInformers    bool                         // prune deleted nodes and pods between the cycles
+	pendingPrunes         []lifecyclePrune             // queued by the informers
+	pruneMutex            sync.Mutex                   // guards pendingPrunes
+	pruneSignal           chan struct{}                // wakes pruneBetweenCycles up
+	workerNodes           int64                        // kept by the node informer, read atomically
+	explorer              *Explorer                    // probe replicas on unmeasured nodes, disabled if nil
+	cohorts               *cohorts.Config              // users grouped by network or region, disabled if nil
+	// collectMeasurements returns appName -> userID -> nodeName -> measurement (replaced in simulation mode)
+	collectMeasurements func() (map[string]map[string]map[string]*LatencyMeasurement, error)
 }
 
-func NewDescheduler(clientset *kubernetes.Clientset, mutex *sync.Mutex, latencyMeasurements *LatencyMeasurements, hardLatencyThresholds, softLatencyThresholds *LatencyThresholds) *Descheduler {
-	return &Descheduler{
+const (
+	checkInterval = 30 * time.Second
+	// appNamespace is the namespace of the Deployments of the apps, for the scheduler and the descheduler.
+	appNamespace = "default"
+	// defaultMeterSelector selects the pods with a latency meter, the only ones sent the token of the scheduler.
+	defaultMeterSelector = "latency-meter=enabled"
+	// defaultMetricsTopUsers bounds the series of latency_aware_descheduler_worst_user_latency_milliseconds.
+	defaultMetricsTopUsers = 10
+)
+
+func NewDescheduler(clientset kubernetes.Interface, mutex *sync.Mutex, latencyMeasurements *LatencyMeasurements, hardLatencyThresholds, softLatencyThresholds *LatencyThresholds, objectives *LatencyObjectives, publisher *AssociationPublisher, routingManagerAddress string, controlClient *ControlClient, meterControlPort int, autoscalingDisabled bool) *Descheduler {
+	d := &Descheduler{
 		clientset:             clientset,
 		mutex:                 mutex,
 		latencyMeasurements:   latencyMeasurements,
@@ -40,95 +96,359 @@ func NewDescheduler(clientset *kubernetes.Clientset, mutex *sync.Mutex, latencyM
 		softValidNodes:        NewLatencyMeasurements(),
 		hardLatencyThresholds: hardLatencyThresholds,
 		softLatencyThresholds: softLatencyThresholds,
+		objectives:            objectives,
 		defaultReplicas:       make(map[string]int32),
+		publisher:             publisher,
+		routingManagerAddress: routingManagerAddress,
+		controlClient:         controlClient,
+		meterControlPort:      meterControlPort,
+		meterSelector:         defaultMeterSelector,
+		metricsTopUsers:       defaultMetricsTopUsers,
+		stats:                 NewLatencyStatsStore(),
+		autoscalingDisabled:   autoscalingDisabled,
+		capacities:            make(map[string]AppCapacity),
+		appPods:               make(map[string]map[string][]string),
+		userRates:             make(map[string]map[string]float64),
+		deniedUsers:           make(map[string]map[string]bool),
+		podLoads:              make(map[string]map[string]*podLoad),
+		pausedApps:            make(map[string]bool),
+		pauseState:            make(map[string][]string),
+		thresholdOverrides:    make(map[string]ThresholdsRequest),
+		reevaluate:            make(chan struct{}, 1),
+		pruneSignal:           make(chan struct{}, 1),
+		recorder:              newEventRecorder(clientset, deschedulerComponent),
 	}
+	d.collectMeasurements = d.getLatencyMeasurements
+	return d
 }
 
 func (d *Descheduler) Run() {
-	checkInterval := 30 * time.Second
 	N_tot, err := d.getTotalNodes()
 	if err != nil {
 		fmt.Printf("Error getting totNodes: %v\n", err)
 		return
 	}
+	d.cycleMutex.Lock()
+	if err := d.publisher.Restore(d.user_Cluster); err != nil {
+		fmt.Println(err.Error())
+	}
+	if d.stateStore != nil {
+		if err := d.restoreState(); err != nil {
+			fmt.Printf("Error restoring the scheduler state: %v\n", err)
+		}
+	}
+	if d.migrations != nil {
+		if err := d.migrations.Load(); err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+	d.publishSnapshot()
+	d.cycleMutex.Unlock()
+	if d.lifecycleInformers {
+		atomic.StoreInt64(&d.workerNodes, int64(N_tot))
+		d.runLifecycleInformers(make(chan struct{}))
+	}
 
 	for {
-		time.Sleep(checkInterval)
-		fmt.Println("\nDescheduler: Trying getting new measurements:")
-		// Get latency measurements from sentinel pod (latency meter)
-		latencyMeasurements, err := d.getLatencyMeasurements()
-		if err != nil {
-			fmt.Printf("Error getting latency measurements: %v\n", err)
+		select {
+		case <-clock.After(checkInterval):
+		case <-d.reevaluate:
+			fmt.Println("Descheduling cycle requested through the admin API")
+		}
+		if d.lifecycleInformers {
+			N_tot = int(atomic.LoadInt64(&d.workerNodes))
+		}
+		d.RunOnce(N_tot)
+	}
+}
+
+// RunOnce runs a single descheduling cycle. Apps and users are visited in a fixed order,
+// so the same measurements always lead to the same decisions.
+func (d *Descheduler) RunOnce(N_tot int) {
+	d.cycleMutex.Lock()
+	defer d.cycleMutex.Unlock()
+	defer d.publishSnapshot()
+	d.applyPrunes()
+	fmt.Println("\nDescheduler: Trying getting new measurements:")
+	// Get latency measurements from sentinel pod (latency meter)
+	latencyMeasurements, err := d.collectMeasurements()
+	if err != nil {
+		fmt.Printf("Error getting latency measurements: %v\n", err)
+		return
+	}
+	if d.cohorts != nil {
+		latencyMeasurements = aggregateCohorts(d.cohorts, latencyMeasurements)
+	}
+	d.user_Cluster.CleanupAssociationsOlderThan(5) //REFRESH USERS-CLUSTERS ASSOCIATIONS
+	d.latencyMeasurements.UpdateMeasurements(latencyMeasurements)
+	d.latencyMeasurements.CleanupMeasurementsOlderThan(5) //REFRESH MEASUREMENTS
+	d.invalidNodes.CleanupMeasurementsOlderThan(5)
+	d.updateUserRates(latencyMeasurements)
+	if d.explorer != nil {
+		d.explorer.observe(latencyMeasurements, d.hardLatencyThresholds)
+	}
+	d.advanceMigrations()
+	d.completeDrains()
+	currentMeasurements := d.latencyMeasurements.GetMeasurements()
+	worstUserLatency.Reset() // the worst users change every cycle
+	for _, appName := range sortedKeys(currentMeasurements) {
+		userMeasurements := currentMeasurements[appName]
+		currentAppReplicas, ok := d.defaultReplicas[appName]
+		if !ok {
+			currentAppReplicas, err = d.getReplicasByApp(appName) //set the default replica number for the app if not exists
+			if err != nil {
+				fmt.Println(err)
+			}
+			d.replicasMutex.Lock()
+			d.defaultReplicas[appName] = currentAppReplicas
+			d.replicasMutex.Unlock()
+		}
+		if err := d.refreshAppPods(appName); err != nil {
+			fmt.Printf("Error reading the pods of app %s: %v\n", appName, err)
+		}
+		if d.checkPause(appName) {
+			continue
+		}
+		if !d.globalPlacement {
+			d.shedOverload(appName)
+		}
+		observeWorstUsers(appName, userMeasurements, d.metricsTopUsers)
+		for _, userID := range sortedKeys(userMeasurements) {
+			nodesMeasurements := userMeasurements[userID]
+
+			fmt.Println("App: ", appName) //DEBUG
+			fmt.Println("Current Replica set: ", currentAppReplicas, "\tDefault Replca set: ", d.defaultReplicas[appName])
+			fmt.Println("User: ", userID) //DEBUG
+			fmt.Println("Measurements: ") //DEBUG
+
+			for nodeName, nodeMeasurements := range nodesMeasurements {
+				fmt.Println(nodeName, ": ", nodeMeasurements.Measurement) //DEBUG
+				userLatency.WithLabelValues(appName, nodeName).Observe(float64(nodeMeasurements.Measurement))
+			}
+			if d.globalPlacement {
+				continue
+			}
+			err := d.descheduleInvalidNodes(appName, userID, nodesMeasurements)
+			if err != nil {
+				fmt.Printf("Error descheduling pods in the InvalideNodes: %v\n", err)
+			}
+			_, needSoftCondition := d.softLatencyThresholds.GetLatency(appName)
+			fmt.Println("Soft Condition to be checked: ", needSoftCondition) //DEBUG
+			if needSoftCondition /*&& N_misured == N_tot*/ {                 //Se ho una soft contraint: CICLO FINALE per i soft nodes
+				fmt.Println("Checking the Soft Condition...") //DEBUG
+				d.descheduleWorstHardValidNodes(N_tot, appName, userID)
+			}
+			fmt.Println() //DEBUG
+		}
+		if d.globalPlacement {
+			d.runGlobalPlacement(appName)
 			continue
 		}
-		d.user_Cluster.CleanupAssociationsOlderThan(5) //REFRESH USERS-CLUSTERS ASSOCIATIONS
-		d.latencyMeasurements.UpdateMeasurements(latencyMeasurements)
-		d.latencyMeasurements.CleanupMeasurementsOlderThan(5)                                     //REFRESH MEASUREMENTS
-		fmt.Printf("Current latency measurements: %v\n", d.latencyMeasurements.GetMeasurements()) //debug
-
-		for appName, userMeasurements := range d.latencyMeasurements.GetMeasurements() {
-			currentAppReplicas, ok := d.defaultReplicas[appName]
-			if !ok {
-				d.defaultReplicas[appName], err = d.getReplicasByApp(appName) //set the default replica number for the app if not exists
-				if err != nil {
-					fmt.Println(err)
-				}
-				currentAppReplicas = d.defaultReplicas[appName]
+		//SEND INFORMATION TO THE CUSTOM LOAD BALANCER()
+		if d.autoscalingDisabled {
+			continue
+		}
+		if d.capacities[appName].limited() && d.capacityRunsOut(appName) {
+			fmt.Println("Pods out of capacity, increasing the replica sets...") //DEBUG
+			if nodeName, ok := d.chooseScaleUpNode(appName, true); ok {
+				err = d.increaseReplicasOnNode(appName, nodeName, "capacity")
+			} else {
+				err = d.increaseReplicas(appName)
 			}
-			for userID, nodesMeasurements := range userMeasurements {
-
-				fmt.Println("App: ", appName) //DEBUG
-				fmt.Println("Current Replica set: ", currentAppReplicas, "\tDefault Replca set: ", d.defaultReplicas[appName])
-				fmt.Println("User: ", userID) //DEBUG
-				fmt.Println("Measurements: ") //DEBUG
-
-				/*DEBUG*/
-				for nodeName, nodeMeasurements := range nodesMeasurements {
-					fmt.Println(nodeName, ": ", nodeMeasurements.Measurement) //DEBUG
-				}
-				err := d.descheduleInvalidNodes(appName, userID, nodesMeasurements)
-				if err != nil {
-					fmt.Printf("Error descheduling pods in the InvalideNodes: %v\n", err)
-				}
-				_, needSoftCondition := d.softLatencyThresholds.GetLatency(appName)
-				fmt.Println("Soft Condition to be checked: ", needSoftCondition) //DEBUG
-				if needSoftCondition /*&& N_misured == N_tot*/ {                 //Se ho una soft contraint: CICLO FINALE per i soft nodes
-					fmt.Println("Checking the Soft Condition...") //DEBUG
-					d.descheduleWorstHardValidNodes(N_tot, appName, userID)
-				}
-				fmt.Println() //DEBUG
+			if err != nil {
+				fmt.Printf("Error increasing replicas for app %s: %v\n", appName, err)
 			}
-			//SEND INFORMATION TO THE CUSTOM LOAD BALANCER()
-			if d.AllPodsAssigned(appName) {
-				fmt.Println("All pods assigned to users, increasing the replica sets...") //DEBUG
-				err := d.increaseReplicas(appName)
-				if err != nil {
-					fmt.Printf("Error increasing replicas for app %s: %v\n", appName, err)
-				}
+		} else if !d.capacities[appName].limited() && d.AllPodsAssigned(appName) {
+			fmt.Println("All pods assigned to users, increasing the replica sets...") //DEBUG
+			if nodeName, ok := d.chooseScaleUpNode(appName, false); ok {
+				err = d.increaseReplicasOnNode(appName, nodeName, "unserved users")
 			} else {
-				fmt.Print("NOT INCREASING THE REPLICA SET.\n\n") //DEBUG
+				err = d.increaseReplicas(appName)
+			}
+			if err != nil {
+				fmt.Printf("Error increasing replicas for app %s: %v\n", appName, err)
 			}
+		} else if !d.explore(appName) {
+			fmt.Print("NOT INCREASING THE REPLICA SET.\n\n") //DEBUG
+		}
 
-			if currentAppReplicas > d.defaultReplicas[appName] { //if there are too Replicas, I check if I need to deschedule some Pods
-				d.descheduleUnassociatedPods(appName, d.user_Cluster, &currentAppReplicas)
+		if currentAppReplicas > d.defaultReplicas[appName] { //if there are too Replicas, I check if I need to deschedule some Pods
+			if err := d.descheduleUnassociatedPods(appName, d.user_Cluster, &currentAppReplicas); err != nil && err != errPodDraining {
+				fmt.Printf("Error descheduling the unassociated pods of app %s: %v\n", appName, err)
 			}
 		}
-		if d.user_Cluster.changed {
-			fmt.Printf("SENDING THE ASSOCIATION DATA TO ROUTING MANAGER:\n")
-			err = d.sendAssociationsToRoutingManager(d.user_Cluster)
-			if err != nil {
-				fmt.Println(err.Error())
+	}
+	d.updateAssociationMetrics()
+	d.stats.Set(computeAppLatencyStats(d.latencyMeasurements.GetMeasurements(), d.user_Cluster))
+	d.publishAssociations()
+	if d.stateStore != nil {
+		if err := d.stateStore.Save(d.captureState()); err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+	if d.migrations != nil {
+		if err := d.migrations.Save(); err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+}
+
+// publishAssociations sends the associations to the routing managers, if they changed.
+func (d *Descheduler) publishAssociations() {
+	if !d.user_Cluster.Changed() {
+		fmt.Printf("ASSOCIATION DATA DIDN'T CHANGED\n")
+		return
+	}
+	fmt.Printf("PUBLISHING THE ASSOCIATION DATA:\n")
+	err := d.publisher.Publish(d.user_Cluster)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+	if d.routingManagerAddress != "" {
+		if err := d.sendAssociationsToRoutingManager(d.user_Cluster); err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+	if err == nil {
+		d.user_Cluster.SetChanged(false)
+	}
+}
+
+// EnableStateCheckpoints saves the state of the descheduler and of the scheduler at the end of every
+// cycle, and restores it when Run starts.
+func (d *Descheduler) EnableStateCheckpoints(stateStore *StateStore, scheduler *CustomScheduler) {
+	d.stateStore = stateStore
+	d.scheduler = scheduler
+}
+
+// SetMeterSelector sets the label selector of the pods whose latency meters are scraped.
+func (d *Descheduler) SetMeterSelector(selector string) {
+	d.meterSelector = selector
+}
+
+// SetMinPodBenefit sets the benefit above which a pod that is on a bad node for a user is kept.
+func (d *Descheduler) SetMinPodBenefit(benefit int64) {
+	d.minPodBenefit = benefit
+}
+
+// SetMetricsTopUsers sets how many users per app have their own latency series (0: none).
+func (d *Descheduler) SetMetricsTopUsers(topUsers int) {
+	d.metricsTopUsers = topUsers
+}
+
+func (d *Descheduler) captureState() *SchedulerState {
+	d.mutex.Lock()
+	visitedNodesPerApp := make(map[string]map[string]bool)
+	for appName, visitedNodes := range d.scheduler.visitedNodesPerApp {
+		visitedNodesPerApp[appName] = make(map[string]bool)
+		for nodeName, visited := range visitedNodes {
+			visitedNodesPerApp[appName][nodeName] = visited
+		}
+	}
+	d.mutex.Unlock()
+	d.pauseMutex.Lock()
+	pausedApps := sortedKeys(d.pausedApps)
+	d.pauseMutex.Unlock()
+	d.replicasMutex.RLock()
+	defaultReplicas := make(map[string]int32, len(d.defaultReplicas))
+	for appName, replicas := range d.defaultReplicas {
+		defaultReplicas[appName] = replicas
+	}
+	d.replicasMutex.RUnlock()
+	d.overridesMutex.Lock()
+	thresholdOverrides := make(map[string]ThresholdsRequest, len(d.thresholdOverrides))
+	for appName, override := range d.thresholdOverrides {
+		thresholdOverrides[appName] = override
+	}
+	d.overridesMutex.Unlock()
+	return &SchedulerState{
+		Measurements:          d.latencyMeasurements.GetMeasurements(),
+		Associations:          d.user_Cluster.GetUserClusterAssociations(),
+		HardLatencyThresholds: d.hardLatencyThresholds.GetAll(),
+		SoftLatencyThresholds: d.softLatencyThresholds.GetAll(),
+		LatencyObjectives:     d.objectives.GetAll(),
+		DefaultReplicas:       defaultReplicas,
+		VisitedNodesPerApp:    visitedNodesPerApp,
+		PausedApps:            pausedApps,
+		ThresholdOverrides:    thresholdOverrides,
+	}
+}
+
+// restoreState loads the last checkpoint (merged with the associations restored by the publisher),
+// checks it against the cluster and puts it back in place.
+func (d *Descheduler) restoreState() error {
+	state, err := d.stateStore.Load()
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		fmt.Println("No scheduler state to restore")
+		return nil
+	}
+	for userID, appAssociations := range d.user_Cluster.GetUserClusterAssociations() {
+		for appName, clusterInfo := range appAssociations {
+			if _, ok := state.Associations[userID][appName]; ok {
+				continue
 			}
-			d.user_Cluster.changed = false
-		} else {
-			fmt.Printf("ASSOCIATION DATA DIDN'T CHANGED\n")
+			if _, ok := state.Associations[userID]; !ok {
+				state.Associations[userID] = make(map[string]*ClusterInfo)
+			}
+			state.Associations[userID][appName] = clusterInfo
 		}
+	}
+	if err := d.reconcileState(state); err != nil {
+		return err
+	}
 
+	d.latencyMeasurements.UpdateMeasurements(state.Measurements)
+	d.user_Cluster.ReplaceAssociations(state.Associations)
+	for appName, latency := range state.HardLatencyThresholds {
+		d.hardLatencyThresholds.SetLatency(appName, latency)
+	}
+	for appName, latency := range state.SoftLatencyThresholds {
+		d.softLatencyThresholds.SetLatency(appName, latency)
+	}
+	for appName, objective := range state.LatencyObjectives {
+		if err := d.objectives.SetObjective(appName, objective); err != nil {
+			fmt.Printf("Ignoring the restored objective: %v\n", err)
+		}
+	}
+	d.replicasMutex.Lock()
+	for appName, replicas := range state.DefaultReplicas {
+		d.defaultReplicas[appName] = replicas
+	}
+	d.replicasMutex.Unlock()
+	d.pauseMutex.Lock()
+	for _, appName := range state.PausedApps {
+		d.pausedApps[appName] = true
+	}
+	d.pauseMutex.Unlock()
+	d.overridesMutex.Lock()
+	for appName, override := range state.ThresholdOverrides {
+		d.thresholdOverrides[appName] = override
 	}
+	d.overridesMutex.Unlock()
+	d.mutex.Lock()
+	for appName, visitedNodes := range state.VisitedNodesPerApp {
+		d.scheduler.visitedNodesPerApp[appName] = visitedNodes
+	}
+	d.mutex.Unlock()
+	fmt.Printf("Restored the scheduler state saved at %s: %d apps, %d users with associations\n", state.SavedAt.Format(time.RFC3339), len(state.DefaultReplicas), len(state.Associations))
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 func (d *Descheduler) getLatencyMeasurements() (map[string]map[string]map[string]*LatencyMeasurement, error) {
-	pods, err := d.clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{})
+	// Only the meters get the token of the scheduler, not every pod of the cluster
+	pods, err := d.clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{LabelSelector: d.meterSelector})
 	if err != nil {
 		return nil, fmt.Errorf("Error listing pods: %v", err)
 	}
@@ -141,18 +461,24 @@ func (d *Descheduler) getLatencyMeasurements() (map[string]map[string]map[string
 		if strings.HasPrefix(pod.Namespace, "kube") || strings.HasPrefix(pod.Namespace, "routing") || strings.HasPrefix(pod.Namespace, "liqo") || strings.HasPrefix(pod.Namespace, "metallb") || strings.HasPrefix(pod.Namespace, "local") || len(pod.Status.PodIP) == 0 { //scarto i pod di sistema o non ancora schedulati
 			continue
 		}
-		endpoint := fmt.Sprintf("http://%s:8080/measurements", pod.Status.PodIP)
+		endpoint := fmt.Sprintf("https://%s:%d/measurements", pod.Status.PodIP, d.meterControlPort)
 		fmt.Println("Contacting: ", endpoint) //DEBUG
-		resp, err := http.Get(endpoint)
+		resp, err := d.controlClient.Get(endpoint)
 		if err != nil {
 			fmt.Printf("Error getting latency measurements from pod %s: %v\n", pod.Name, err)
+			scrapeErrors.WithLabelValues(pod.Namespace).Inc()
 			continue
 		}
-		defer resp.Body.Close()
-
 		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
 		if err != nil {
 			fmt.Printf("Error reading response body from pod %s: %v\n", pod.Name, err)
+			scrapeErrors.WithLabelValues(pod.Namespace).Inc()
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			fmt.Printf("Error getting latency measurements from pod %s: status %s\n", pod.Name, resp.Status)
+			scrapeErrors.WithLabelValues(pod.Namespace).Inc()
 			continue
 		}
 
@@ -160,6 +486,7 @@ func (d *Descheduler) getLatencyMeasurements() (map[string]map[string]map[string
 		err = json.Unmarshal(body, &currentPodMeasurements)
 		if err != nil {
 			fmt.Printf("Error unmarshaling latency measurements from pod %s: %v\n", pod.Name, err)
+			scrapeErrors.WithLabelValues(pod.Namespace).Inc()
 			continue
 		}
 
@@ -191,8 +518,12 @@ func (d *Descheduler) getLatencyMeasurements() (map[string]map[string]map[string
 	return measurements, nil
 }
 
-func (d *Descheduler) DescheduleAllPodsPerNode(appName, userID, nodeName string) (int, error) {
+// DeschedulePodsPerNode deletes the pods of the app on nodeName that no user needs: the pods
+// associated to some user are kept, and so are the pods whose benefit for the users of the app
+// (see podBenefits) is above minPodBenefit, even if nodeName is bad for userID, who measured latency on it.
+func (d *Descheduler) DeschedulePodsPerNode(appName, userID, nodeName, reason string, latency int64) (int, error) {
 	descheduledPods := 0
+	message := d.evictionMessage(appName, userID, nodeName, latency, reason)
 	// Get the list of pods on the worst performing node
 	pods, err := d.clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{
 		FieldSelector: "spec.nodeName=" + nodeName,
@@ -202,6 +533,8 @@ func (d *Descheduler) DescheduleAllPodsPerNode(appName, userID, nodeName string)
 		return descheduledPods, err
 	}
 
+	var candidates []v1.Pod
+	var associatedPods []string
 	for _, pod := range pods.Items {
 		// Add any necessary filters here, e.g., by labels or namespace
 		if pod.Namespace == "kube-system" || strings.HasPrefix(pod.Namespace, "routing") || strings.HasPrefix(pod.Namespace, "liqo") || strings.HasPrefix(pod.Namespace, "metallb") || strings.HasPrefix(pod.Namespace, "local") || len(pod.Status.PodIP) == 0 { //scarto i pod di sistema o non ancora schedulati
@@ -211,28 +544,49 @@ func (d *Descheduler) DescheduleAllPodsPerNode(appName, userID, nodeName string)
 		if !ok {
 			continue
 		}
-		if currentAppName != appName {
+		if currentAppName != appName || pod.Spec.NodeName != nodeName {
 			continue
 		}
 		// Check if the pod's deletion policy allows it to be deleted. If not, skip to the next pod.
 		if pod.DeletionGracePeriodSeconds != nil && *pod.DeletionGracePeriodSeconds != 0 {
 			continue
 		}
-		needContinue := false
 		//Check if another user is associated to this pod
-		userClusterAssociations := d.user_Cluster.GetUserClusterAssociations()
-		for _, appAssociation := range userClusterAssociations { //check in all userAssosiactions if there is the pod
-			clusterMeasure := appAssociation[appName]
-			if clusterMeasure != nil && clusterMeasure.PodName == pod.Name {
-				fmt.Println("The pod ", pod.Name, " is associated to a user. So undeschedulable for now.") //DEBUG
-				needContinue = true
-				break
-			}
+		if d.user_Cluster.IsPodAssociated(appName, pod.Name) {
+			fmt.Println("The pod ", pod.Name, " is associated to a user. So undeschedulable for now.") //DEBUG
+			associatedPods = append(associatedPods, pod.Name)
+			continue
 		}
-		if needContinue {
+		candidates = append(candidates, pod)
+	}
+
+	candidateNames := make([]string, len(candidates))
+	for i, pod := range candidates {
+		candidateNames[i] = pod.Name
+	}
+	benefits := d.podBenefits(appName, nodeName, associatedPods, candidateNames)
+	for _, pod := range candidates {
+		if benefit := benefits[pod.Name]; benefit > d.minPodBenefit {
+			fmt.Printf("The pod %s is kept: node %s is bad for user %s but the pod has benefit %d for the users of app %s\n", pod.Name, nodeName, userID, benefit, appName) //DEBUG
+			continue
+		}
+		if d.migrations != nil {
+			if !d.migrations.isMigrating(pod.Name) && d.startMigration(appName, &pod, reason) {
+				d.recordPodEvent(&pod, appName, v1.EventTypeNormal, "Migrating", "Replacing the pod on a better node: "+message)
+				descheduledPods++
+			}
 			continue
 		}
 
+		if _, draining := pod.Annotations[drain.DeadlineAnnotation]; !draining && d.drainTimeout > 0 {
+			d.recordPodEvent(&pod, appName, v1.EventTypeNormal, "Draining", "Draining the pod before descheduling it: "+message)
+		}
+		if drained, err := d.drainPod(appName, &pod, reason); err != nil || !drained {
+			if err != nil {
+				fmt.Println(err.Error())
+			}
+			continue // deleted by completeDrains once drained
+		}
 		err = d.clientset.CoreV1().Pods(pod.Namespace).Delete(context.Background(), pod.Name, metav1.DeleteOptions{})
 		if err != nil {
 			// Log error and continue with next pod
@@ -240,24 +594,111 @@ func (d *Descheduler) DescheduleAllPodsPerNode(appName, userID, nodeName string)
 			continue
 		}
 		descheduledPods++
+		evictions.WithLabelValues(appName, reason).Inc()
+		d.recordPodEvent(&pod, appName, v1.EventTypeNormal, "Descheduled", "Deleted the pod: "+message)
 		fmt.Println("Successfully deleted pod", pod.Name)
 	}
 	return descheduledPods, nil
 }
 
+// podBenefits scores the candidate pods of the app on nodeName by the users that would move to them:
+// the users whose best node within the hard threshold (or the soft one, without a hard threshold) is
+// nodeName, and who aren't served there or better already. Each adds its gain: its margin to the
+// threshold without an association, the latency it would save with one. The movers, by decreasing
+// gain, fill the room left (MaxUsersPerPod) in the associated pods on nodeName first, then in the
+// candidates in order; without a user capacity they all go to the first of these pods, so a single
+// pod of the node is worth keeping for them.
+func (d *Descheduler) podBenefits(appName, nodeName string, associatedPods, candidates []string) map[string]int64 {
+	benefits := make(map[string]int64)
+	threshold, ok := d.hardLatencyThresholds.GetLatency(appName)
+	if !ok {
+		if threshold, ok = d.softLatencyThresholds.GetLatency(appName); !ok {
+			return benefits
+		}
+	}
+	type mover struct {
+		userID string
+		gain   int64
+	}
+	var movers []mover
+	for userID, nodeMeasurements := range d.latencyMeasurements.GetAppMeasurements(appName) {
+		measurement, ok := nodeMeasurements[nodeName]
+		if !ok || measurement.Measurement > threshold {
+			continue
+		}
+		best := true
+		for _, other := range nodeMeasurements {
+			if other.Measurement < measurement.Measurement {
+				best = false
+				break
+			}
+		}
+		if !best {
+			continue
+		}
+		gain := threshold - measurement.Measurement + 1
+		if clusterInfo, associated := d.user_Cluster.GetUserClusterAssociation(userID, appName); associated {
+			if clusterInfo.ClusterName == nodeName {
+				continue
+			}
+			gain = clusterInfo.Latency - measurement.Measurement
+		}
+		if gain > 0 {
+			movers = append(movers, mover{userID, gain})
+		}
+	}
+	sort.Slice(movers, func(i, j int) bool {
+		if movers[i].gain != movers[j].gain {
+			return movers[i].gain > movers[j].gain
+		}
+		return movers[i].userID < movers[j].userID
+	})
+
+	maxUsers := d.capacities[appName].MaxUsersPerPod
+	users := make(map[string]int) // podName -> associated users
+	for _, clusterInfo := range d.user_Cluster.GetAppAssociations(appName) {
+		users[clusterInfo.PodName]++
+	}
+	pods := append(append([]string{}, associatedPods...), candidates...)
+	for i := 0; len(movers) > 0 && i < len(pods); i++ {
+		room := len(movers)
+		if maxUsers > 0 && maxUsers-users[pods[i]] < room {
+			room = maxUsers - users[pods[i]]
+		}
+		if room <= 0 {
+			continue
+		}
+		for _, m := range movers[:room] {
+			benefits[pods[i]] += m.gain
+		}
+		movers = movers[room:]
+	}
+	for _, podName := range associatedPods {
+		delete(benefits, podName)
+	}
+	return benefits
+}
+
 func (d *Descheduler) getTotalNodes() (int, error) {
 	nodes, err := d.clientset.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
 	if err != nil {
 		return -1, err
 	}
-	return len(nodes.Items) - 1, nil
+	workers := 0
+	for _, node := range nodes.Items {
+		if _, ok := node.Labels["node-role.kubernetes.io/control-plane"]; !ok {
+			workers++
+		}
+	}
+	return workers, nil
 }
 
 func (d *Descheduler) descheduleInvalidNodes(appName, userID string, nodesMeasurements map[string]*LatencyMeasurement) error {
 	h, hExists := d.hardLatencyThresholds.GetLatency(appName)
 	s, sExists := d.softLatencyThresholds.GetLatency(appName)
 
-	for nodeName, latency := range nodesMeasurements {
+	for _, nodeName := range sortedKeys(nodesMeasurements) {
+		latency := nodesMeasurements[nodeName]
 		if hExists && latency.Measurement <= h { //hard valid node
 			d.handleValidNode(appName, userID, nodeName, latency, s, sExists)
 		} else if hExists { //invalid node
@@ -278,45 +719,45 @@ func (d *Descheduler) handleValidNode(appName, userID string, nodeName string, l
 		if latency.Measurement <= s { // SOFT valid node
 			d.softValidNodes.AddLatency(appName, userID, nodeName, latency)
 			d.hardValidNodes.DeleteLatency(appName, userID, nodeName)
-			d.user_Cluster.AddAssociation(userID, appName, nodeName, latency, true)
+			d.associate(userID, appName, nodeName, latency, true)
 		} else { // JUST HARD valid node
 			d.hardValidNodes.AddLatency(appName, userID, nodeName, latency)
 			d.softValidNodes.DeleteLatency(appName, userID, nodeName)
-			d.user_Cluster.AddAssociation(userID, appName, nodeName, latency, false)
+			d.associate(userID, appName, nodeName, latency, false)
 		}
 		//d.invalidNodes.DeleteLatency(userID, appName, nodeName)
 	} else { // JUST HARD valid node
 		d.hardValidNodes.AddLatency(appName, userID, nodeName, latency)
-		d.user_Cluster.AddAssociation(userID, appName, nodeName, latency, false)
+		d.associate(userID, appName, nodeName, latency, false)
 	}
 }
 
 func (d *Descheduler) handleInvalidNode(appName, userID string, nodeName string, latency *LatencyMeasurement) {
 	fmt.Println(nodeName, " is an invalid node for the user: ", userID)
-	//d.invalidNodes.AddLatency(userID, appName, nodeName, latency)
+	d.invalidNodes.AddLatency(appName, userID, nodeName, latency) // remembered to avoid the node when scaling up
 	d.latencyMeasurements.DeleteLatency(appName, userID, nodeName)
 	d.hardValidNodes.DeleteLatency(appName, userID, nodeName)
 	d.softValidNodes.DeleteLatency(appName, userID, nodeName)
-	d.user_Cluster.RemoveUserClusterAssiciation(userID, appName)
-	d.DescheduleAllPodsPerNode(appName, userID, nodeName)
+	d.dissociate(userID, appName)
+	d.DeschedulePodsPerNode(appName, userID, nodeName, evictionReasonInvalidNode, latency.Measurement)
 }
 
 func (d *Descheduler) handleSoftOnlyNode(appName, userID string, nodeName string, latency *LatencyMeasurement, s int64) {
 	if latency.Measurement <= s { // SOFT VALID NODE
 		d.softValidNodes.AddLatency(appName, userID, nodeName, latency)
 		d.hardValidNodes.DeleteLatency(appName, userID, nodeName)
-		d.user_Cluster.AddAssociation(userID, appName, nodeName, latency, true) //if it exists, I substitute it because a soft costraint is more strict
+		d.associate(userID, appName, nodeName, latency, true) //if it exists, I substitute it because a soft costraint is more strict
 	} else { // JUST HARD VALID NODE
 		d.hardValidNodes.AddLatency(appName, userID, nodeName, latency)
 		d.softValidNodes.DeleteLatency(appName, userID, nodeName)
-		d.user_Cluster.AddAssociation(userID, appName, nodeName, latency, false)
+		d.associate(userID, appName, nodeName, latency, false)
 
 	} // JUST HARD VALID NODE
 	//d.invalidNodes.DeleteLatency(userID, appName, nodeName)
 }
 
 func (d *Descheduler) descheduleWorstHardValidNodes(N_tot int, appName, userID string) error {
-	hardValidNodes := d.hardValidNodes.GetMeasurements()[appName][userID]
+	hardValidNodes := d.hardValidNodes.GetUserMeasurements(appName, userID)
 	sortedNodes := SortNodesByMeasurement(hardValidNodes)
 
 	N_softValid := d.softValidNodes.GetTotalMeasurementsPerUserApp(appName, userID)
@@ -325,16 +766,16 @@ func (d *Descheduler) descheduleWorstHardValidNodes(N_tot int, appName, userID s
 	fmt.Println("softValidNodes: ", N_softValid, "\thardValidNodes: ", N_hardValid, "\ttotNodes: ", N_tot) //DEBUG
 	for _, nodeName := range sortedNodes {
 		if N_softValid+(N_hardValid-1) < N_tot/2 { //soft condition
-			d.user_Cluster.AddAssociation(userID, appName, nodeName, d.hardValidNodes.data[appName][userID][nodeName], false) // se non esiste, l'ho eliminato precedentemente
+			d.associate(userID, appName, nodeName, hardValidNodes[nodeName], false) // se non esiste, l'ho eliminato precedentemente
 			break
 		}
 		fmt.Println("The Soft Condition is valid, preceed descheudling the word HardValid Node...") //DEBUG
 		if a, exists := d.user_Cluster.GetUserClusterAssociation(userID, appName); exists {         //elimino l'associazione poichè ce n'è una migliore
 			if a.ClusterName == nodeName {
-				d.user_Cluster.RemoveUserClusterAssiciation(userID, appName)
+				d.dissociate(userID, appName)
 			}
 		}
-		if _, err := d.DescheduleAllPodsPerNode(appName, userID, nodeName); err != nil {
+		if _, err := d.DeschedulePodsPerNode(appName, userID, nodeName, evictionReasonSoftCondition, hardValidNodes[nodeName].Measurement); err != nil {
 			fmt.Printf("Error descheduling pods: %v\n", err)
 			return err
 		}
@@ -351,7 +792,7 @@ func (d *Descheduler) descheduleWorstHardValidNodes(N_tot int, appName, userID s
 }
 
 func (d *Descheduler) AllPodsAssigned(appName string) bool {
-	time.Sleep(3 * time.Second) //need to wait the new potential scheduling
+	clock.Sleep(3 * time.Second) //need to wait the new potential scheduling
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
@@ -376,16 +817,7 @@ func (d *Descheduler) AllPodsAssigned(appName string) bool {
 		if pod.DeletionGracePeriodSeconds != nil && *pod.DeletionGracePeriodSeconds != 0 {
 			continue
 		}
-		userClusterAssociations := d.user_Cluster.GetUserClusterAssociations()
-		podFoundInAssociations := false
-		for _, appAssociation := range userClusterAssociations { //check in all userAssosiactions if there is the pod
-			clusterMeasure := appAssociation[appName]
-			if clusterMeasure != nil && clusterMeasure.PodName == pod.Name {
-				podFoundInAssociations = true
-				break
-			}
-		}
-		if !podFoundInAssociations {
+		if !d.user_Cluster.IsPodAssociated(appName, pod.Name) {
 			fmt.Println("\nThe pod ", pod.Name, " is not associated to any user.") //DEBUG
 			return false
 		}
@@ -394,20 +826,21 @@ func (d *Descheduler) AllPodsAssigned(appName string) bool {
 }
 
 func (d *Descheduler) increaseReplicas(appName string) error {
-	deployment, err := d.clientset.AppsV1().Deployments("default").Get(context.Background(), appName+"-deployment", metav1.GetOptions{})
+	deployment, err := d.clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), appName+"-deployment", metav1.GetOptions{})
 	if err != nil {
 		return fmt.Errorf("Error retrieving deployment: %v", err)
 	}
 	*deployment.Spec.Replicas++
-	_, err = d.clientset.AppsV1().Deployments("default").Update(context.Background(), deployment, metav1.UpdateOptions{})
+	_, err = d.clientset.AppsV1().Deployments(appNamespace).Update(context.Background(), deployment, metav1.UpdateOptions{})
 	if err != nil {
 		return fmt.Errorf("Error updating deployment: %v", err)
 	}
+	replicaChanges.WithLabelValues(appName, "up").Inc()
 	return nil
 }
 
 func (d *Descheduler) getReplicasByApp(appName string) (int32, error) {
-	deployment, err := d.clientset.AppsV1().Deployments("default").Get(context.Background(), appName+"-deployment", metav1.GetOptions{})
+	deployment, err := d.clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), appName+"-deployment", metav1.GetOptions{})
 	if err != nil {
 		return -1, fmt.Errorf("Error retrieving deployment: %v", err)
 	}
@@ -426,75 +859,51 @@ func (d *Descheduler) descheduleUnassociatedPods(appName string, uca *UserCluste
 	unassociatedPods := []*v1.Pod{}
 
 	// Check each pod if it's associated
-	for _, pod := range pods.Items {
-		podAssociated := false
-		for _, userAssociations := range uca.GetUserClusterAssociations() {
-			clusterInfo := userAssociations[appName]
-			if clusterInfo.PodName == pod.Name {
-				podAssociated = true
-				break
-			}
-			if podAssociated {
-				break
-			}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil || (d.migrations != nil && d.migrations.isMigrating(pod.Name)) {
+			continue // already being removed, or replaced by a migration
+		}
+		if d.explorer != nil && d.explorer.isProbing(appName, pod.Spec.NodeName) {
+			continue // probe waiting for its measurements
 		}
 		// If pod is not associated, add it to the list of unassociated pods
-		if !podAssociated {
-			unassociatedPods = append(unassociatedPods, &pod)
+		if !uca.IsPodAssociated(appName, pod.Name) {
+			unassociatedPods = append(unassociatedPods, pod)
 		}
 	}
 
-	// If there are more than one unassociated pods, delete all but one
-	if len(unassociatedPods) > 1 {
-		for _, pod := range unassociatedPods[1:] { // keep the first one, delete the rest
-			// Only deschedule pods and decrease the replicas count if the current replicas count is more than the default
-			if *currentReplicas <= d.defaultReplicas[appName] {
-				return nil
-			}
-
-			deployment, err := d.clientset.AppsV1().Deployments("default").Get(context.Background(), appName+"-deployment", metav1.GetOptions{})
-			if err != nil {
-				return fmt.Errorf("error retrieving deployment: %v", err)
-			}
-
-			// Pause the deployment
-			deployment.Spec.Paused = true
-			_, err = d.clientset.AppsV1().Deployments("default").Update(context.Background(), deployment, metav1.UpdateOptions{})
-			if err != nil {
-				return fmt.Errorf("error pausing deployment: %v", err)
-			}
-
-			// Decrease the replicas count
-			*deployment.Spec.Replicas--
-			_, err = d.clientset.AppsV1().Deployments("default").Update(context.Background(), deployment, metav1.UpdateOptions{})
-			if err != nil {
-				return fmt.Errorf("error decreasing deployment replicas: %v", err)
-			}
-
-			// Decrease the current replicas count
-			*currentReplicas--
-
-			// Delete the unassociated pod
-			err = d.clientset.CoreV1().Pods(pod.Namespace).Delete(context.Background(), pod.Name, metav1.DeleteOptions{})
-			if err != nil {
-				return fmt.Errorf("error deleting pod %s: %v", pod.Name, err)
-			}
-
-			// Unpause the deployment
-			deployment.Spec.Paused = false
-			_, err = d.clientset.AppsV1().Deployments("default").Update(context.Background(), deployment, metav1.UpdateOptions{})
-			if err != nil {
-				return fmt.Errorf("error unpausing deployment: %v", err)
-			}
+	// If there are more than one unassociated pods, remove all but one, in a single scale-in
+	var victims []string
+	for i, pod := range unassociatedPods {
+		if i == 0 {
+			continue // keep the first one, remove the rest
 		}
+		// Only deschedule pods if the replicas count stays at least the default
+		if *currentReplicas-int32(len(victims)) <= d.defaultReplicas[appName] {
+			break
+		}
+		victims = append(victims, pod.Name)
 	}
-
+	if err := d.scaleIn(appName, victims, evictionReasonScaleIn); err != nil {
+		return err
+	}
+	// Decrease the current replicas count once the replicas are decreased, not while the victims drain
+	*currentReplicas -= int32(len(victims))
 	return nil
 }
 
+func (d *Descheduler) updateAssociationMetrics() {
+	associationCount.Reset()
+	for _, appAssociations := range d.user_Cluster.GetUserClusterAssociations() {
+		for appName := range appAssociations {
+			associationCount.WithLabelValues(appName).Inc()
+		}
+	}
+}
+
 func (d *Descheduler) sendAssociationsToRoutingManager(associations *UserClusterAssociation) error {
-	routing_manager_service_IP := "10.11.167.5"
-	endpoint := fmt.Sprintf("http://%s/update-associations", routing_manager_service_IP)
+	endpoint := fmt.Sprintf("https://%s/update-associations", d.routingManagerAddress)
 
 	// Converti le associazioni dell'utente in JSON
 	jsonData, err := json.Marshal(associations.GetUserClusterAssociations())
@@ -506,7 +915,7 @@ func (d *Descheduler) sendAssociationsToRoutingManager(associations *UserCluster
 	fmt.Printf("Sending the following JSON data to the routing manager: %s\n", string(jsonData))
 
 	// Esegui la richiesta POST al routing manager
-	resp, err := http.Post(endpoint, "application/json", bytes.NewBuffer(jsonData))
+	resp, err := d.controlClient.Post(endpoint, "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("Error sending associations to routing-manager: %v", err)
 	}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// TestDeschedulePodsPerNode evicts the pods of node n1, bad for user u0, unless the users that would move
+// to them make them worth keeping.
+func TestDeschedulePodsPerNode(t *testing.T) {
+	tests := []struct {
+		name          string
+		pods          []string                    // pods of the app on n1
+		latencies     map[string]map[string]int64 // user -> node -> latency, hard threshold of 50 ms
+		associations  map[string]string           // user -> pod on n1 (or on n2 with a "b-" prefix)
+		assocLatency  int64                       // latency of the associations
+		maxUsers      int                         // users per pod, unlimited if 0
+		minPodBenefit int64
+		wantKept      []string
+	}{
+		{
+			name:      "no user moves to n1",
+			pods:      []string{"a-1", "a-2"},
+			latencies: map[string]map[string]int64{"u0": {"n1": 90, "n2": 30}},
+			wantKept:  nil,
+		},
+		{
+			name:      "one pod kept for an unserved user",
+			pods:      []string{"a-1", "a-2"},
+			latencies: map[string]map[string]int64{"u0": {"n1": 90}, "u1": {"n1": 20, "n2": 40}},
+			wantKept:  []string{"a-1"},
+		},
+		{
+			name:          "benefit not above the threshold",
+			pods:          []string{"a-1", "a-2"},
+			latencies:     map[string]map[string]int64{"u0": {"n1": 90}, "u1": {"n1": 20}},
+			minPodBenefit: 31, // margin of u1
+			wantKept:      nil,
+		},
+		{
+			name:         "movers served by the associated pod",
+			pods:         []string{"a-1", "a-2", "a-3"},
+			latencies:    map[string]map[string]int64{"u0": {"n1": 90}, "u1": {"n1": 20}},
+			associations: map[string]string{"u2": "a-1"},
+			wantKept:     []string{"a-1"},
+		},
+		{
+			name:         "movers beyond the capacity of the associated pod",
+			pods:         []string{"a-1", "a-2", "a-3", "a-4"},
+			latencies:    map[string]map[string]int64{"u0": {"n1": 90}, "u1": {"n1": 20}, "u3": {"n1": 30}},
+			associations: map[string]string{"u2": "a-1"},
+			maxUsers:     1,
+			wantKept:     []string{"a-1", "a-2", "a-3"},
+		},
+		{
+			name:         "user served better elsewhere",
+			pods:         []string{"a-1"},
+			latencies:    map[string]map[string]int64{"u0": {"n1": 90}, "u1": {"n1": 20}},
+			associations: map[string]string{"u1": "b-1"},
+			assocLatency: 15,
+			wantKept:     nil,
+		},
+		{
+			name:         "user served worse elsewhere",
+			pods:         []string{"a-1"},
+			latencies:    map[string]map[string]int64{"u0": {"n1": 90}, "u1": {"n1": 20}},
+			associations: map[string]string{"u1": "b-1"},
+			assocLatency: 45,
+			wantKept:     []string{"a-1"},
+		},
+		{
+			name:      "n1 not the best node of the user",
+			pods:      []string{"a-1"},
+			latencies: map[string]map[string]int64{"u0": {"n1": 90}, "u1": {"n1": 20, "n2": 10}},
+			wantKept:  nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := []runtime.Object{testNode("n1"), testNode("n2"), testPod("a", "b-1", "n2", nil)}
+			for _, podName := range tt.pods {
+				pod := testPod("a", podName, "n1", nil)
+				pod.Status.PodIP = "10.0.0.1"
+				objects = append(objects, pod)
+			}
+			d, clientset := newTestDescheduler(objects...)
+			d.recorder = record.NewFakeRecorder(10)
+			d.hardLatencyThresholds.SetLatency("a", 50)
+			d.capacities["a"] = AppCapacity{MaxUsersPerPod: tt.maxUsers}
+			d.SetMinPodBenefit(tt.minPodBenefit)
+			for userID, nodes := range tt.latencies {
+				for nodeName, latency := range nodes {
+					d.latencyMeasurements.AddLatency("a", userID, nodeName, &LatencyMeasurement{Measurement: latency, Timestamp: clock.Now()})
+				}
+			}
+			for userID, podName := range tt.associations {
+				nodeName := "n1"
+				if podName == "b-1" {
+					nodeName = "n2"
+				}
+				d.user_Cluster.RestoreAssociation(userID, "a", &ClusterInfo{ClusterName: nodeName, PodName: podName, Latency: tt.assocLatency, CreatedAt: clock.Now()})
+			}
+
+			if _, err := d.DeschedulePodsPerNode("a", "u0", "n1", evictionReasonInvalidNode, 90); err != nil {
+				t.Fatalf("DeschedulePodsPerNode: %v", err)
+			}
+			pods, err := clientset.CoreV1().Pods(appNamespace).List(context.Background(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var kept []string
+			for _, pod := range pods.Items {
+				if pod.Spec.NodeName == "n1" {
+					kept = append(kept, pod.Name)
+				}
+			}
+			sort.Strings(kept)
+			if !reflect.DeepEqual(kept, tt.wantKept) {
+				t.Errorf("kept %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
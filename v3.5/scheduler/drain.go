@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"scheduler/shared/drain"
+)
+
+// The drain annotations are shared with the routing managers (scheduler/shared/drain); the evictions
+// that wait for the drain are done by completeDrains.
+const (
+	routingManagerSelector      = "app=routing-manager"
+	routingManagerAppAnnotation = "app-name"
+)
+
+// errPodDraining is returned when the pods to remove are still draining; the removal is retried later.
+var errPodDraining = fmt.Errorf("pods still draining")
+
+// EnableDraining makes the descheduler drain the pods through the routing managers before evicting them.
+func (d *Descheduler) EnableDraining(timeout time.Duration) {
+	d.drainTimeout = timeout
+}
+
+// routingManagers returns the names of the running routing manager pods of the app.
+func (d *Descheduler) routingManagers(appName string) ([]string, error) {
+	pods, err := d.clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{
+		LabelSelector: routingManagerSelector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing the routing managers: %v", err)
+	}
+	var replicas []string
+	for _, pod := range pods.Items {
+		if pod.Annotations[routingManagerAppAnnotation] == appName && pod.Status.Phase == v1.PodRunning && pod.DeletionTimestamp == nil {
+			replicas = append(replicas, pod.Name)
+		}
+	}
+	return replicas, nil
+}
+
+// drainPod tells whether the pod is drained: every routing manager of the app acknowledged, or the
+// drain deadline passed. The first call marks the pod as draining, with the eviction reason if the
+// pod is to be deleted by completeDrains (empty if the caller removes it).
+func (d *Descheduler) drainPod(appName string, pod *v1.Pod, evictionReason string) (bool, error) {
+	if d.drainTimeout == 0 {
+		return true, nil
+	}
+	replicas, err := d.routingManagers(appName)
+	if err != nil {
+		return false, err
+	}
+	if len(replicas) == 0 {
+		return true, nil // nobody routes to the pod
+	}
+
+	deadline, draining, err := drain.Deadline(pod.Annotations)
+	if !draining {
+		deadline := clock.Now().Add(d.drainTimeout)
+		err := d.updatePodAnnotations(pod.Namespace, pod.Name, func(annotations map[string]string) {
+			annotations[drain.DeadlineAnnotation] = deadline.Format(time.RFC3339)
+			if evictionReason != "" {
+				annotations[drain.EvictionAnnotation] = evictionReason
+			}
+		})
+		if err != nil {
+			return false, fmt.Errorf("error marking pod %s as draining: %v", pod.Name, err)
+		}
+		fmt.Printf("Draining pod %s of app %s until %s\n", pod.Name, appName, deadline.Format(time.RFC3339))
+		return false, nil
+	}
+	if err != nil {
+		return true, nil // unreadable deadline: don't block the eviction
+	}
+	pending := drain.Pending(pod.Annotations, replicas)
+	if pending == 0 {
+		drains.WithLabelValues(appName, drainResultAcknowledged).Inc()
+		return true, nil
+	}
+	if clock.Now().After(deadline) {
+		fmt.Printf("Drain of pod %s timed out: %d routing managers didn't acknowledge\n", pod.Name, pending)
+		drains.WithLabelValues(appName, drainResultTimedOut).Inc()
+		return true, nil
+	}
+	fmt.Printf("Pod %s still draining: %d routing managers didn't acknowledge\n", pod.Name, pending)
+	return false, nil
+}
+
+func (d *Descheduler) updatePodAnnotations(namespace, podName string, update func(annotations map[string]string)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pod, err := d.clientset.CoreV1().Pods(namespace).Get(context.Background(), podName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if pod.Annotations == nil {
+			pod.Annotations = make(map[string]string)
+		}
+		update(pod.Annotations)
+		_, err = d.clientset.CoreV1().Pods(namespace).Update(context.Background(), pod, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// completeDrains deletes the pods whose eviction waited for the drain, once drained, and stops the
+// drains that nobody completed (the pod was kept after all), so the routing managers use the pod again.
+func (d *Descheduler) completeDrains() {
+	if d.drainTimeout == 0 {
+		return
+	}
+	pods, err := d.clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		fmt.Printf("Error listing pods: %v\n", err)
+		return
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		deadline, draining, err := drain.Deadline(pod.Annotations)
+		appName, hasApp := pod.Labels["app"]
+		if !draining || !hasApp || pod.DeletionTimestamp != nil {
+			continue
+		}
+		reason, evict := pod.Annotations[drain.EvictionAnnotation]
+		if !evict {
+			if err == nil && clock.Since(deadline) > 2*checkInterval {
+				fmt.Printf("Drain of pod %s abandoned, routing to it again\n", pod.Name)
+				err = d.updatePodAnnotations(pod.Namespace, pod.Name, func(annotations map[string]string) {
+					for key := range annotations {
+						if key == drain.DeadlineAnnotation || strings.HasPrefix(key, drain.AckAnnotationPrefix) {
+							delete(annotations, key)
+						}
+					}
+				})
+				if err != nil && !errors.IsNotFound(err) {
+					fmt.Printf("Error stopping the drain of pod %s: %v\n", pod.Name, err)
+				}
+			}
+			continue
+		}
+		drained, err := d.drainPod(appName, pod, reason)
+		if err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+		if !drained {
+			continue
+		}
+		if err := d.clientset.CoreV1().Pods(pod.Namespace).Delete(context.Background(), pod.Name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			fmt.Println("Failed to delete pod", pod.Name, "with error", err.Error())
+			continue
+		}
+		evictions.WithLabelValues(appName, reason).Inc()
+		d.recordPodEvent(pod, appName, v1.EventTypeNormal, "Descheduled", fmt.Sprintf("Deleted the drained pod (%s)", reason))
+		fmt.Println("Successfully deleted drained pod", pod.Name)
+	}
+}
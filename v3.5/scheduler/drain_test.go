@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"scheduler/shared/drain"
+)
+
+func TestDrainPod(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	future, past := now.Add(time.Minute).Format(time.RFC3339), now.Add(-time.Second).Format(time.RFC3339)
+	routingManager := testPod("routing-manager", "rm-1", "n1", map[string]string{routingManagerAppAnnotation: "a"})
+	tests := []struct {
+		name           string
+		timeout        time.Duration
+		routing        bool
+		annotations    map[string]string
+		drained        bool
+		wantAnnotation string // drain annotation expected on the pod afterwards
+	}{
+		{name: "draining disabled", timeout: 0, routing: true, drained: true},
+		{name: "no routing manager", timeout: time.Minute, drained: true},
+		{name: "first call marks the pod", timeout: time.Minute, routing: true, drained: false, wantAnnotation: drain.EvictionAnnotation},
+		{name: "acknowledged", timeout: time.Minute, routing: true, annotations: map[string]string{drain.DeadlineAnnotation: future, drain.AckAnnotation("rm-1"): future}, drained: true},
+		{name: "still draining", timeout: time.Minute, routing: true, annotations: map[string]string{drain.DeadlineAnnotation: future}, drained: false},
+		{name: "deadline passed", timeout: time.Minute, routing: true, annotations: map[string]string{drain.DeadlineAnnotation: past}, drained: true},
+		{name: "unreadable deadline", timeout: time.Minute, routing: true, annotations: map[string]string{drain.DeadlineAnnotation: "soon"}, drained: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(previous Clock) { clock = previous }(clock)
+			clock = NewVirtualClock(now)
+			pod := testPod("a", "a-1", "n1", tt.annotations)
+			objects := []runtime.Object{pod}
+			if tt.routing {
+				objects = append(objects, routingManager)
+			}
+			d, clientset := newTestDescheduler(objects...)
+			d.EnableDraining(tt.timeout)
+
+			drained, err := d.drainPod("a", pod, evictionReasonScaleIn)
+			if err != nil {
+				t.Fatalf("drainPod: %v", err)
+			}
+			if drained != tt.drained {
+				t.Errorf("drained %v, want %v", drained, tt.drained)
+			}
+			if tt.wantAnnotation != "" {
+				updated, _ := clientset.CoreV1().Pods("default").Get(context.Background(), "a-1", metav1.GetOptions{})
+				if updated.Annotations[drain.DeadlineAnnotation] != future || updated.Annotations[tt.wantAnnotation] == "" {
+					t.Errorf("pod annotated with %v", updated.Annotations)
+				}
+			}
+		})
+	}
+}
+
+func TestDescheduleUnassociatedPods(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		replicas int32 // current replicas afterwards
+		deployed int32 // replicas of the deployment afterwards
+		wantErr  error
+	}{
+		{"scaled in", 0, 1, 1, nil},
+		{"victims draining", time.Minute, 3, 3, errPodDraining},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, clientset := newTestDescheduler(
+				testNode("n1"), testDeployment("a", 3),
+				testPod("a", "a-1", "n1", nil), testPod("a", "a-2", "n1", nil), testPod("a", "a-3", "n1", nil),
+				testPod("routing-manager", "rm-1", "n1", map[string]string{routingManagerAppAnnotation: "a"}),
+			)
+			d.EnableDraining(tt.timeout)
+			d.defaultReplicas["a"] = 1
+			replicas := int32(3)
+
+			if err := d.descheduleUnassociatedPods("a", d.user_Cluster, &replicas); err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if replicas != tt.replicas {
+				t.Errorf("current replicas %d, want %d", replicas, tt.replicas)
+			}
+			deployment, _ := clientset.AppsV1().Deployments("default").Get(context.Background(), "a-deployment", metav1.GetOptions{})
+			if *deployment.Spec.Replicas != tt.deployed {
+				t.Errorf("deployment replicas %d, want %d", *deployment.Spec.Replicas, tt.deployed)
+			}
+		})
+	}
+}
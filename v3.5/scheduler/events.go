@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	schedulerComponent   = "latency-aware-scheduler"
+	deschedulerComponent = "latency-aware-descheduler"
+)
+
+// errNoNodes makes the pod Unschedulable; the other scheduling errors are SchedulerError.
+var errNoNodes = fmt.Errorf("no nodes available")
+
+// newEventRecorder records the Events of the component through the API server; repeated Events
+// are aggregated by the recorder.
+func newEventRecorder(clientset kubernetes.Interface, component string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: component})
+}
+
+// SchedulingDecision explains why the scheduler chose a node, in the Scheduled Event of the pod.
+type SchedulingDecision struct {
+	Score         float64
+	RunnerUp      string // empty if no other node was compared
+	RunnerUpScore float64
+	Reason        string
+	NewRound      bool // every node already had a pod of the app, so they were all candidates again
+	Hinted        bool // the node of the placement hint was chosen
+}
+
+func (decision *SchedulingDecision) String() string {
+	message := fmt.Sprintf("%s (score %.0f)", decision.Reason, decision.Score)
+	if decision.NewRound {
+		message += ", every node already had a pod of the app"
+	}
+	if decision.RunnerUp != "" {
+		return message + fmt.Sprintf("; runner-up %s (score %.0f)", decision.RunnerUp, decision.RunnerUpScore)
+	}
+	return message + "; no runner-up"
+}
+
+// recordSchedulingFailure sets the PodScheduled condition of the pod to False and records a
+// FailedScheduling Event, so the failure is visible with kubectl describe.
+func (s *CustomScheduler) recordSchedulingFailure(key string, schedulingErr error) {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return
+	}
+	reason := v1.PodReasonSchedulerError
+	if schedulingErr == errNoNodes {
+		reason = v1.PodReasonUnschedulable
+	}
+	var pod *v1.Pod
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pod, err = s.clientset.CoreV1().Pods(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		condition := v1.PodCondition{
+			Type:               v1.PodScheduled,
+			Status:             v1.ConditionFalse,
+			Reason:             reason,
+			Message:            schedulingErr.Error(),
+			LastTransitionTime: metav1.Now(),
+		}
+		for i, current := range pod.Status.Conditions {
+			if current.Type != v1.PodScheduled {
+				continue
+			}
+			if current.Status == condition.Status && current.Reason == condition.Reason && current.Message == condition.Message {
+				return nil
+			}
+			if current.Status == condition.Status {
+				condition.LastTransitionTime = current.LastTransitionTime
+			}
+			pod.Status.Conditions = append(pod.Status.Conditions[:i], pod.Status.Conditions[i+1:]...)
+			break
+		}
+		pod.Status.Conditions = append(pod.Status.Conditions, condition)
+		_, err = s.clientset.CoreV1().Pods(namespace).UpdateStatus(context.Background(), pod, metav1.UpdateOptions{})
+		return err
+	})
+	if errors.IsNotFound(err) {
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error setting the PodScheduled condition of pod %s: %v\n", key, err)
+	}
+	if pod != nil {
+		s.recorder.Eventf(pod, v1.EventTypeWarning, "FailedScheduling", "%s: %v", reason, schedulingErr)
+	}
+}
+
+// deploymentReference refers to the Deployment of the app, for its Events.
+func deploymentReference(appName string) *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind:       "Deployment",
+		APIVersion: "apps/v1",
+		Namespace:  appNamespace,
+		Name:       appName + "-deployment",
+	}
+}
+
+// recordPodEvent records the Event on the pod and on the Deployment of its app.
+func (d *Descheduler) recordPodEvent(pod *v1.Pod, appName, eventType, reason, message string) {
+	d.recorder.Event(pod, eventType, reason, message)
+	d.recorder.Eventf(deploymentReference(appName), eventType, reason, "Pod %s: %s", pod.Name, message)
+}
+
+// evictionMessage names the user, the latency it measured on the node and the threshold it violates.
+func (d *Descheduler) evictionMessage(appName, userID, nodeName string, latency int64, reason string) string {
+	if reason == evictionReasonSoftCondition {
+		threshold, _ := d.softLatencyThresholds.GetLatency(appName)
+		return fmt.Sprintf("user %s measured %dms on node %s, above the soft threshold %dms, and enough nodes are within it", userID, latency, nodeName, threshold)
+	}
+	threshold, _ := d.hardLatencyThresholds.GetLatency(appName)
+	return fmt.Sprintf("user %s measured %dms on node %s, above the hard threshold %dms", userID, latency, nodeName, threshold)
+}
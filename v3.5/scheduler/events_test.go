@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestSchedulingDecisionString(t *testing.T) {
+	tests := []struct {
+		decision SchedulingDecision
+		want     string
+	}{
+		{SchedulingDecision{Score: 12, Reason: "lowest latency"}, "lowest latency (score 12); no runner-up"},
+		{SchedulingDecision{Score: 12, Reason: "lowest latency", RunnerUp: "n2", RunnerUpScore: 30}, "lowest latency (score 12); runner-up n2 (score 30)"},
+		{SchedulingDecision{Score: 0, Reason: "round-robin", NewRound: true}, "round-robin (score 0), every node already had a pod of the app; no runner-up"},
+	}
+	for _, tt := range tests {
+		if got := tt.decision.String(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestRecordSchedulingFailure(t *testing.T) {
+	scheduled := func(status v1.ConditionStatus, reason, message string) v1.PodCondition {
+		return v1.PodCondition{Type: v1.PodScheduled, Status: status, Reason: reason, Message: message}
+	}
+	tests := []struct {
+		name       string
+		conditions []v1.PodCondition
+		err        error
+		want       v1.PodCondition
+		updated    bool
+	}{
+		{"no nodes", nil, errNoNodes, scheduled(v1.ConditionFalse, v1.PodReasonUnschedulable, errNoNodes.Error()), true},
+		{"other error", nil, fmt.Errorf("boom"), scheduled(v1.ConditionFalse, v1.PodReasonSchedulerError, "boom"), true},
+		{"same condition not updated", []v1.PodCondition{scheduled(v1.ConditionFalse, v1.PodReasonUnschedulable, errNoNodes.Error())}, errNoNodes,
+			scheduled(v1.ConditionFalse, v1.PodReasonUnschedulable, errNoNodes.Error()), false},
+		{"condition replaced", []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionFalse}, scheduled(v1.ConditionFalse, v1.PodReasonSchedulerError, "boom")}, errNoNodes,
+			scheduled(v1.ConditionFalse, v1.PodReasonUnschedulable, errNoNodes.Error()), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := testPod("a", "a-1", "", nil)
+			pod.Status.Conditions = tt.conditions
+			clientset := fake.NewSimpleClientset(pod)
+			s := NewCustomScheduler(clientset, &sync.Mutex{}, NewLatencyThreshold(), NewLatencyThreshold(), NewLatencyObjectives())
+			recorder := record.NewFakeRecorder(10)
+			s.recorder = recorder
+
+			s.recordSchedulingFailure("default/a-1", tt.err)
+			updated := false
+			for _, action := range clientset.Actions() {
+				updated = updated || action.GetVerb() == "update"
+			}
+			if updated != tt.updated {
+				t.Errorf("pod status updated %v, want %v", updated, tt.updated)
+			}
+			pod, _ = clientset.CoreV1().Pods("default").Get(context.Background(), "a-1", metav1.GetOptions{})
+			var conditions []v1.PodCondition
+			for _, condition := range pod.Status.Conditions {
+				if condition.Type == v1.PodScheduled {
+					conditions = append(conditions, condition)
+				}
+			}
+			if len(conditions) != 1 || conditions[0].Status != tt.want.Status || conditions[0].Reason != tt.want.Reason || conditions[0].Message != tt.want.Message {
+				t.Errorf("PodScheduled conditions %+v, want %+v", conditions, tt.want)
+			}
+			if len(pod.Status.Conditions) != len(tt.conditions) && len(tt.conditions) > 0 { // the others kept
+				t.Errorf("conditions %+v, want the other conditions kept", pod.Status.Conditions)
+			}
+			select {
+			case event := <-recorder.Events:
+				if !strings.HasPrefix(event, "Warning FailedScheduling "+tt.want.Reason) {
+					t.Errorf("got event %q", event)
+				}
+			default:
+				t.Error("no FailedScheduling event")
+			}
+		})
+	}
+}
+
+func TestRecordSchedulingFailureDeletedPod(t *testing.T) {
+	s := NewCustomScheduler(fake.NewSimpleClientset(), &sync.Mutex{}, NewLatencyThreshold(), NewLatencyThreshold(), NewLatencyObjectives())
+	recorder := record.NewFakeRecorder(10)
+	s.recorder = recorder
+	s.recordSchedulingFailure("default/gone", errNoNodes)
+	if len(recorder.Events) != 0 {
+		t.Errorf("event recorded for a deleted pod: %q", <-recorder.Events)
+	}
+}
+
+func TestEvictionMessage(t *testing.T) {
+	tests := []struct {
+		reason string
+		want   string
+	}{
+		{evictionReasonSoftCondition, "user u1 measured 35ms on node n1, above the soft threshold 30ms, and enough nodes are within it"},
+		{evictionReasonScaleIn, "user u1 measured 35ms on node n1, above the hard threshold 40ms"},
+	}
+	d, _ := newTestDescheduler()
+	d.hardLatencyThresholds.SetLatency("a", 40)
+	d.softLatencyThresholds.SetLatency("a", 30)
+	for _, tt := range tests {
+		if got := d.evictionMessage("a", "u1", "n1", 35, tt.reason); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.reason, got, tt.want)
+		}
+	}
+}
+
+func TestRecordPodEvent(t *testing.T) {
+	d, _ := newTestDescheduler()
+	recorder := record.NewFakeRecorder(10)
+	d.recorder = recorder
+	d.recordPodEvent(testPod("a", "a-1", "n1", nil), "a", v1.EventTypeNormal, "ScaledIn", "no user")
+	for _, want := range []string{"Normal ScaledIn no user", "Normal ScaledIn Pod a-1: no user"} {
+		if event := <-recorder.Events; event != want {
+			t.Errorf("got event %q, want %q", event, want)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ExplorationPolicy decides when a probe replica is placed on a node that the users of an app
+// haven't measured enough. Every user has an estimate, per node, of the probability that the node is
+// within the hard threshold of the app.
+type ExplorationPolicy string
+
+const (
+	explorationNone          ExplorationPolicy = "none"           // nodes are only explored by the scheduler, round-robin
+	explorationEpsilonGreedy ExplorationPolicy = "epsilon-greedy" // a random node with probability explorationEpsilon
+	explorationUCB           ExplorationPolicy = "ucb"            // the node with the highest upper confidence bound (UCB1)
+	explorationThompson      ExplorationPolicy = "thompson"       // the node with the highest sample of its Beta posterior
+)
+
+const (
+	// explorationBudgetAnnotation, on the Deployment of an app, overrides the probes allowed per hour.
+	explorationBudgetAnnotation = "latency-aware-scheduler/exploration-budget"
+	explorationWindow           = time.Hour
+	explorationEpsilon          = 0.1
+	// explorationDiscount weights down the past samples at every cycle (half-life of about 7 minutes),
+	// so the estimates follow the latencies that change over time.
+	explorationDiscount = 0.95
+	// probeTimeout ends a probe whose node wasn't measured; the replica is then scaled in as any
+	// unassociated pod.
+	probeTimeout = 10 * time.Minute
+)
+
+// armEstimate counts the discounted measurements of a user on a node within (successes) and above
+// (failures) the hard threshold: their posterior is Beta(successes+1, failures+1).
+type armEstimate struct {
+	successes  float64
+	failures   float64
+	lastSample time.Time
+}
+
+func (a *armEstimate) samples() float64 {
+	return a.successes + a.failures
+}
+
+// mean is the expected probability that the node is within the threshold for the user.
+func (a *armEstimate) mean() float64 {
+	return (a.successes + 1) / (a.samples() + 2)
+}
+
+// Probe is a replica placed by the exploration on Node.
+type Probe struct {
+	Node      string
+	StartedAt time.Time
+}
+
+// Explorer keeps the estimates and the probes of every app. It is only used by the descheduling
+// cycle, under its mutex.
+type Explorer struct {
+	policy ExplorationPolicy
+	budget int // probes allowed per app per explorationWindow
+	rand   *rand.Rand
+	arms   map[string]map[string]map[string]*armEstimate // appName -> userID -> nodeName -> estimate
+	probes map[string][]Probe                            // appName -> probes of the last explorationWindow
+}
+
+func NewExplorer(policy ExplorationPolicy, budget int, seed int64) (*Explorer, error) {
+	switch policy {
+	case explorationEpsilonGreedy, explorationUCB, explorationThompson:
+	default:
+		return nil, fmt.Errorf("unknown exploration policy %q", policy)
+	}
+	if budget < 0 {
+		return nil, fmt.Errorf("the exploration budget can't be negative")
+	}
+	return &Explorer{
+		policy: policy,
+		budget: budget,
+		rand:   rand.New(rand.NewSource(seed)),
+		arms:   make(map[string]map[string]map[string]*armEstimate),
+		probes: make(map[string][]Probe),
+	}, nil
+}
+
+// EnableExploration makes the descheduler place probe replicas on the nodes chosen by the explorer,
+// when it doesn't scale up the app for its users.
+func (d *Descheduler) EnableExploration(explorer *Explorer) {
+	d.explorer = explorer
+}
+
+// observe discounts the estimates and adds the new measurements of the apps with a hard threshold.
+func (e *Explorer) observe(measurements map[string]map[string]map[string]*LatencyMeasurement, hardThresholds *LatencyThresholds) {
+	for appName, users := range e.arms {
+		for userID, nodes := range users {
+			for nodeName, arm := range nodes {
+				arm.successes *= explorationDiscount
+				arm.failures *= explorationDiscount
+				if arm.samples() < 0.01 {
+					delete(nodes, nodeName)
+				}
+			}
+			if len(nodes) == 0 {
+				delete(users, userID)
+			}
+		}
+		if len(users) == 0 {
+			delete(e.arms, appName)
+		}
+	}
+	for appName, users := range measurements {
+		h, ok := hardThresholds.GetLatency(appName)
+		if !ok {
+			continue
+		}
+		for userID, nodes := range users {
+			for nodeName, measurement := range nodes {
+				arm := e.arm(appName, userID, nodeName)
+				if !measurement.Timestamp.After(arm.lastSample) {
+					continue // already counted
+				}
+				arm.lastSample = measurement.Timestamp
+				if measurement.Measurement <= h {
+					arm.successes++
+				} else {
+					arm.failures++
+				}
+			}
+		}
+	}
+}
+
+func (e *Explorer) arm(appName, userID, nodeName string) *armEstimate {
+	if _, ok := e.arms[appName]; !ok {
+		e.arms[appName] = make(map[string]map[string]*armEstimate)
+	}
+	if _, ok := e.arms[appName][userID]; !ok {
+		e.arms[appName][userID] = make(map[string]*armEstimate)
+	}
+	arm, ok := e.arms[appName][userID][nodeName]
+	if !ok {
+		arm = &armEstimate{}
+		e.arms[appName][userID][nodeName] = arm
+	}
+	return arm
+}
+
+// forgetNode drops the estimates and the probes of a deleted node.
+func (e *Explorer) forgetNode(nodeName string) {
+	for _, users := range e.arms {
+		for _, nodes := range users {
+			delete(nodes, nodeName)
+		}
+	}
+	for appName, probes := range e.probes {
+		var kept []Probe
+		for _, probe := range probes {
+			if probe.Node != nodeName {
+				kept = append(kept, probe)
+			}
+		}
+		e.probes[appName] = kept
+	}
+}
+
+// isProbing tells whether a probe of the app on nodeName is waiting for its first measurement.
+func (e *Explorer) isProbing(appName, nodeName string) bool {
+	for _, probe := range e.probes[appName] {
+		if probe.Node == nodeName && !e.probeDone(appName, probe) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Explorer) probeDone(appName string, probe Probe) bool {
+	if clock.Since(probe.StartedAt) >= probeTimeout {
+		return true
+	}
+	for _, nodes := range e.arms[appName] {
+		if arm, ok := nodes[probe.Node]; ok && arm.lastSample.After(probe.StartedAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// choose returns, for every user, the node its policy picks among nodes.
+func (e *Explorer) choose(appName string, users, nodes []string) map[string]string {
+	choices := make(map[string]string)
+	for _, userID := range users {
+		arms := e.arms[appName][userID]
+		estimate := func(nodeName string) *armEstimate {
+			if arm, ok := arms[nodeName]; ok {
+				return arm
+			}
+			return &armEstimate{}
+		}
+		if e.policy == explorationEpsilonGreedy && e.rand.Float64() < explorationEpsilon {
+			choices[userID] = nodes[e.rand.Intn(len(nodes))]
+			continue
+		}
+		var total float64
+		for _, nodeName := range nodes {
+			total += estimate(nodeName).samples()
+		}
+		best, bestIndex := "", math.Inf(-1)
+		for _, nodeName := range nodes {
+			arm := estimate(nodeName)
+			var index float64
+			switch e.policy {
+			case explorationEpsilonGreedy:
+				index = arm.mean()
+			case explorationUCB:
+				if arm.samples() < 1 {
+					index = math.Inf(1)
+				} else {
+					index = arm.mean() + math.Sqrt(2*math.Log(total+1)/arm.samples())
+				}
+			case explorationThompson:
+				index = e.sampleBeta(arm.successes+1, arm.failures+1)
+			}
+			if index > bestIndex {
+				best, bestIndex = nodeName, index
+			}
+		}
+		choices[userID] = best
+	}
+	return choices
+}
+
+// sampleBeta draws from Beta(a, b) as X/(X+Y), with X ~ Gamma(a) and Y ~ Gamma(b).
+func (e *Explorer) sampleBeta(a, b float64) float64 {
+	x := e.sampleGamma(a)
+	return x / (x + e.sampleGamma(b))
+}
+
+// sampleGamma draws from Gamma(shape, 1) with the method of Marsaglia and Tsang (shape >= 1).
+func (e *Explorer) sampleGamma(shape float64) float64 {
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := e.rand.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := e.rand.Float64()
+		if math.Log(u) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
+
+// explorationBudget returns the probes allowed per hour to the app, by the annotation of its
+// Deployment or by default.
+func (d *Descheduler) explorationBudget(appName string) int {
+	deployment, err := d.clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), appName+"-deployment", metav1.GetOptions{})
+	if err != nil {
+		return d.explorer.budget
+	}
+	value, ok := deployment.Annotations[explorationBudgetAnnotation]
+	if !ok {
+		return d.explorer.budget
+	}
+	budget, err := strconv.Atoi(value)
+	if err != nil || budget < 0 {
+		fmt.Printf("Ignoring the exploration budget %q of app %s\n", value, appName)
+		return d.explorer.budget
+	}
+	return budget
+}
+
+// explore places a probe replica on the worker node without a pod of the app that most users pick
+// by the exploration policy, if no probe is waiting for its measurements and the budget allows it.
+// It returns true if the replicas were increased.
+func (d *Descheduler) explore(appName string) bool {
+	e := d.explorer
+	if e == nil {
+		return false
+	}
+	if _, ok := d.hardLatencyThresholds.GetLatency(appName); !ok {
+		return false // nothing to learn without a threshold
+	}
+	var recent []Probe
+	for _, probe := range e.probes[appName] {
+		if clock.Since(probe.StartedAt) < explorationWindow {
+			recent = append(recent, probe)
+		}
+	}
+	e.probes[appName] = recent
+	for _, probe := range recent {
+		if !e.probeDone(appName, probe) {
+			fmt.Printf("Exploration of app %s: waiting for the measurements of the probe on node %s\n", appName, probe.Node)
+			return false
+		}
+	}
+	budget := d.explorationBudget(appName)
+	if len(recent) >= budget {
+		fmt.Printf("Exploration of app %s: budget of %d probes per hour spent\n", appName, budget)
+		return false
+	}
+
+	nodes, err := d.clientset.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		fmt.Printf("Error listing nodes: %v\n", err)
+		return false
+	}
+	var workers []string
+	for _, node := range nodes.Items {
+		if _, ok := node.Labels["node-role.kubernetes.io/control-plane"]; ok || node.Spec.Unschedulable || !nodeReady(&node) {
+			continue
+		}
+		workers = append(workers, node.Name)
+	}
+	users := sortedKeys(d.latencyMeasurements.GetAppMeasurements(appName))
+	if len(workers) == 0 || len(users) == 0 {
+		return false
+	}
+	votes := make(map[string]int)
+	for _, nodeName := range e.choose(appName, users, workers) {
+		if len(d.appPods[appName][nodeName]) == 0 {
+			votes[nodeName]++
+		}
+	}
+	best := ""
+	for _, nodeName := range sortedKeys(votes) {
+		if best == "" || votes[nodeName] > votes[best] {
+			best = nodeName
+		}
+	}
+	if best == "" {
+		return false // every user picked a node that already has a pod
+	}
+	if err := d.increaseReplicasOnNode(appName, best, "exploration"); err != nil {
+		fmt.Printf("Error increasing replicas for app %s: %v\n", appName, err)
+		return false
+	}
+	e.probes[appName] = append(e.probes[appName], Probe{Node: best, StartedAt: clock.Now()})
+	explorationProbes.WithLabelValues(appName, string(e.policy)).Inc()
+	d.recorder.Eventf(deploymentReference(appName), v1.EventTypeNormal, "Exploring",
+		"Probe replica on node %s, picked by %d of %d users (%s, %d of %d probes this hour)", best, votes[best], len(users), e.policy, len(e.probes[appName]), budget)
+	return true
+}
+
+func nodeReady(node *v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return true // no condition reported yet
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestNewExplorer(t *testing.T) {
+	tests := []struct {
+		policy  ExplorationPolicy
+		budget  int
+		wantErr string
+	}{
+		{explorationEpsilonGreedy, 2, ""},
+		{explorationUCB, 0, ""},
+		{explorationThompson, 1, ""},
+		{explorationNone, 2, "unknown exploration policy"},
+		{"random", 2, "unknown exploration policy"},
+		{explorationUCB, -1, "negative"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			_, err := NewExplorer(tt.policy, tt.budget, 1)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("NewExplorer: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExplorerObserve(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	measured := func(latency int64, seconds int) *LatencyMeasurement {
+		return &LatencyMeasurement{Measurement: latency, Timestamp: start.Add(time.Duration(seconds) * time.Second)}
+	}
+	tests := []struct {
+		name      string
+		rounds    []map[string]*LatencyMeasurement // per cycle: nodeName -> measurement of u1 for app a
+		threshold bool
+		successes float64 // of u1 on n1
+		failures  float64
+		forgotten bool // the estimate of u1 on n1 dropped
+	}{
+		{"within the threshold", []map[string]*LatencyMeasurement{{"n1": measured(30, 1)}}, true, 1, 0, false},
+		{"above the threshold", []map[string]*LatencyMeasurement{{"n1": measured(50, 1)}}, true, 0, 1, false},
+		{"same measurement counted once", []map[string]*LatencyMeasurement{{"n1": measured(30, 1)}, {"n1": measured(30, 1)}}, true, 0.95, 0, false},
+		{"past samples discounted", []map[string]*LatencyMeasurement{{"n1": measured(50, 1)}, {"n1": measured(30, 2)}}, true, 1, 0.95, false},
+		{"no threshold", []map[string]*LatencyMeasurement{{"n1": measured(30, 1)}}, false, 0, 0, true},
+		{"estimate forgotten once discounted away", append([]map[string]*LatencyMeasurement{{"n1": measured(30, 1)}}, make([]map[string]*LatencyMeasurement, 100)...), true, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewExplorer(explorationUCB, 2, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			thresholds := NewLatencyThreshold()
+			if tt.threshold {
+				thresholds.SetLatency("a", 40)
+			}
+			for _, nodes := range tt.rounds {
+				e.observe(map[string]map[string]map[string]*LatencyMeasurement{"a": {"u1": nodes}}, thresholds)
+			}
+			arm, ok := e.arms["a"]["u1"]["n1"]
+			if tt.forgotten {
+				if ok {
+					t.Errorf("estimate %+v kept", arm)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("no estimate")
+			}
+			if math.Abs(arm.successes-tt.successes) > 1e-9 || math.Abs(arm.failures-tt.failures) > 1e-9 {
+				t.Errorf("got %v successes and %v failures, want %v and %v", arm.successes, arm.failures, tt.successes, tt.failures)
+			}
+		})
+	}
+}
+
+func TestExplorerChoose(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ExplorationPolicy
+		arms   map[string][2]float64 // nodeName -> successes, failures of every user
+		want   string                // picked by most users
+	}{
+		{"ucb favours the unmeasured node", explorationUCB, map[string][2]float64{"n1": {20, 0}, "n2": {20, 0}}, "n3"},
+		{"ucb picks the best measured node", explorationUCB, map[string][2]float64{"n1": {20, 0}, "n2": {0, 20}, "n3": {10, 10}}, "n1"},
+		{"thompson picks the best node", explorationThompson, map[string][2]float64{"n1": {0, 20}, "n2": {20, 0}, "n3": {0, 20}}, "n2"},
+		{"epsilon-greedy picks the best node", explorationEpsilonGreedy, map[string][2]float64{"n1": {0, 20}, "n2": {0, 20}, "n3": {20, 0}}, "n3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewExplorer(tt.policy, 2, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var users []string
+			for i := 0; i < 100; i++ {
+				userID := "u" + strconv.Itoa(i)
+				users = append(users, userID)
+				for nodeName, counts := range tt.arms {
+					arm := e.arm("a", userID, nodeName)
+					arm.successes, arm.failures = counts[0], counts[1]
+				}
+			}
+			votes := make(map[string]int)
+			for _, nodeName := range e.choose("a", users, []string{"n1", "n2", "n3"}) {
+				votes[nodeName]++
+			}
+			if votes[tt.want] < 80 {
+				t.Errorf("votes %v, want most for %s", votes, tt.want)
+			}
+		})
+	}
+}
+
+func TestExplore(t *testing.T) {
+	budget := func(value string) runtime.Object {
+		deployment := testDeployment("a", 1)
+		deployment.Annotations = map[string]string{explorationBudgetAnnotation: value}
+		return deployment
+	}
+	cordoned := testNode("n3")
+	cordoned.Spec.Unschedulable = true
+	tests := []struct {
+		name      string
+		objects   []runtime.Object
+		threshold bool
+		probes    []Probe // earlier probes, minutes ago on n2
+		measured  bool    // u1 measured n2 after the earlier probes
+		want      string  // node of the new probe, "" if none
+	}{
+		{"probe on the unmeasured node", []runtime.Object{testDeployment("a", 1), testNode("n1"), testNode("n2")}, true, nil, false, "n2"},
+		{"no threshold", []runtime.Object{testDeployment("a", 1), testNode("n1"), testNode("n2")}, false, nil, false, ""},
+		{"only nodes with a pod or unschedulable", []runtime.Object{testDeployment("a", 1), testNode("n1"), cordoned}, true, nil, false, ""},
+		{"probe waiting for its measurements", []runtime.Object{testDeployment("a", 1), testNode("n1"), testNode("n2")}, true, []Probe{{Node: "n2"}}, false, ""},
+		{"next probe once measured", []runtime.Object{testDeployment("a", 1), testNode("n1"), testNode("n2"), testNode("n3")}, true, []Probe{{Node: "n2"}}, true, "n3"},
+		{"budget spent", []runtime.Object{testDeployment("a", 1), testNode("n1"), testNode("n2")}, true, []Probe{{Node: "n2"}, {Node: "n2"}}, true, ""},
+		{"budget of the annotation", []runtime.Object{budget("0"), testNode("n1"), testNode("n2")}, true, nil, false, ""},
+		{"invalid budget annotation ignored", []runtime.Object{budget("x"), testNode("n1"), testNode("n2")}, true, nil, false, "n2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(previous Clock) { clock = previous }(clock)
+			start := time.Unix(1700000000, 0)
+			virtualClock := NewVirtualClock(start)
+			clock = virtualClock
+			d, clientset := newTestDescheduler(tt.objects...)
+			explorer, err := NewExplorer(explorationUCB, 2, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.EnableExploration(explorer)
+			if tt.threshold {
+				d.hardLatencyThresholds.SetLatency("a", 40)
+			}
+			d.appPods["a"] = map[string][]string{"n1": {"a-1"}}
+			for _, probe := range tt.probes {
+				probe.StartedAt = start
+				explorer.probes["a"] = append(explorer.probes["a"], probe)
+			}
+			virtualClock.Advance(time.Minute)
+			d.latencyMeasurements.AddLatency("a", "u1", "n1", &LatencyMeasurement{Measurement: 30, Timestamp: clock.Now()})
+			if tt.measured {
+				d.latencyMeasurements.AddLatency("a", "u1", "n2", &LatencyMeasurement{Measurement: 60, Timestamp: clock.Now()})
+			}
+			explorer.observe(d.latencyMeasurements.GetMeasurements(), d.hardLatencyThresholds)
+
+			probes := len(explorer.probes["a"])
+			if explored := d.explore("a"); explored != (tt.want != "") {
+				t.Fatalf("explored %v, want a probe on %q", explored, tt.want)
+			}
+			deployment, err := clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), "a-deployment", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				if *deployment.Spec.Replicas != 1 || len(explorer.probes["a"]) > probes {
+					t.Errorf("%d replicas and probes %v, want no probe", *deployment.Spec.Replicas, explorer.probes["a"])
+				}
+				return
+			}
+			intents := getPlacementIntents(deployment)
+			if *deployment.Spec.Replicas != 2 || len(intents) != 1 || intents[0].Node != tt.want {
+				t.Errorf("%d replicas and intents %+v, want a replica on %s", *deployment.Spec.Replicas, intents, tt.want)
+			}
+			if last := explorer.probes["a"][len(explorer.probes["a"])-1]; last.Node != tt.want || !last.StartedAt.Equal(clock.Now()) {
+				t.Errorf("probe %+v, want on %s", last, tt.want)
+			}
+		})
+	}
+}
+
+func TestNodeReady(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions []v1.NodeCondition
+		want       bool
+	}{
+		{"no condition yet", nil, true},
+		{"ready", []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}, true},
+		{"not ready", []v1.NodeCondition{{Type: v1.NodeMemoryPressure, Status: v1.ConditionFalse}, {Type: v1.NodeReady, Status: v1.ConditionFalse}}, false},
+		{"unknown", []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionUnknown}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nodeReady(&v1.Node{Status: v1.NodeStatus{Conditions: tt.conditions}}); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	externalmetrics "k8s.io/metrics/pkg/apis/external_metrics/v1beta1"
+	"scheduler/shared/controltls"
+)
+
+const externalMetricsPrefix = "/apis/external.metrics.k8s.io/v1beta1"
+
+// The external metrics served per app, selected by the HPA with the label app=<appName>.
+var externalMetricValues = map[string]func(*AppLatencyStats) *resource.Quantity{
+	"latency_unserved_users_ratio": func(s *AppLatencyStats) *resource.Quantity {
+		return resource.NewMilliQuantity(int64(s.UnservedRatio*1000), resource.DecimalSI)
+	},
+	"latency_unserved_users": func(s *AppLatencyStats) *resource.Quantity {
+		return resource.NewQuantity(int64(s.UnservedUsers), resource.DecimalSI)
+	},
+	"latency_user_p95_milliseconds": func(s *AppLatencyStats) *resource.Quantity {
+		return resource.NewQuantity(s.P95LatencyMs, resource.DecimalSI)
+	},
+	"latency_user_max_milliseconds": func(s *AppLatencyStats) *resource.Quantity {
+		return resource.NewQuantity(s.MaxLatencyMs, resource.DecimalSI)
+	},
+	"latency_user_mean_milliseconds": func(s *AppLatencyStats) *resource.Quantity {
+		return resource.NewMilliQuantity(int64(s.MeanLatencyMs*1000), resource.DecimalSI)
+	},
+}
+
+// ExternalMetricsServer serves the external.metrics.k8s.io API (through an APIService),
+// so HorizontalPodAutoscalers can scale the apps on the latency of their users.
+type ExternalMetricsServer struct {
+	stats         *LatencyStatsStore
+	checkInterval time.Duration
+}
+
+func NewExternalMetricsServer(stats *LatencyStatsStore, checkInterval time.Duration) *ExternalMetricsServer {
+	return &ExternalMetricsServer{
+		stats:         stats,
+		checkInterval: checkInterval,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(obj)
+}
+
+func (e *ExternalMetricsServer) handleResourceList(w http.ResponseWriter, r *http.Request) {
+	resourceList := &metav1.APIResourceList{
+		TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+		GroupVersion: externalmetrics.SchemeGroupVersion.String(),
+	}
+	for metricName := range externalMetricValues {
+		resourceList.APIResources = append(resourceList.APIResources, metav1.APIResource{
+			Name:       metricName,
+			Namespaced: true,
+			Kind:       "ExternalMetricValueList",
+			Verbs:      metav1.Verbs{"get"},
+		})
+	}
+	writeJSON(w, http.StatusOK, resourceList)
+}
+
+// ServeHTTP handles /apis/external.metrics.k8s.io/v1beta1/namespaces/<namespace>/<metric>?labelSelector=app=<appName>
+func (e *ExternalMetricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, externalMetricsPrefix), "/")
+	if path == "" {
+		e.handleResourceList(w, r)
+		return
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 || parts[0] != "namespaces" {
+		writeJSON(w, http.StatusNotFound, metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonNotFound, Code: http.StatusNotFound})
+		return
+	}
+	// The stats are of the Deployments of appNamespace: an HPA of another namespace gets none of them
+	if namespace := parts[1]; namespace != appNamespace {
+		writeJSON(w, http.StatusNotFound, metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonNotFound, Code: http.StatusNotFound,
+			Message: fmt.Sprintf("no latency-aware app in namespace %s", namespace)})
+		return
+	}
+	metricName := parts[2]
+	valueOf, ok := externalMetricValues[metricName]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonNotFound, Code: http.StatusNotFound,
+			Message: fmt.Sprintf("external metric %s not found", metricName)})
+		return
+	}
+	selector, err := labels.Parse(r.URL.Query().Get("labelSelector"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonBadRequest, Code: http.StatusBadRequest, Message: err.Error()})
+		return
+	}
+
+	windowSeconds := int64(e.checkInterval.Seconds())
+	metricList := &externalmetrics.ExternalMetricValueList{
+		TypeMeta: metav1.TypeMeta{Kind: "ExternalMetricValueList", APIVersion: externalmetrics.SchemeGroupVersion.String()},
+		Items:    []externalmetrics.ExternalMetricValue{},
+	}
+	for appName, appStats := range e.stats.Get() {
+		metricLabels := map[string]string{"app": appName}
+		if !selector.Matches(labels.Set(metricLabels)) {
+			continue
+		}
+		metricList.Items = append(metricList.Items, externalmetrics.ExternalMetricValue{
+			MetricName:    metricName,
+			MetricLabels:  metricLabels,
+			Timestamp:     metav1.NewTime(appStats.ComputedAt),
+			WindowSeconds: &windowSeconds,
+			Value:         *valueOf(appStats),
+		})
+	}
+	writeJSON(w, http.StatusOK, metricList)
+}
+
+// Serve listens with the given certificate, or with a self-signed one if certFile is empty
+// (the APIService must then set insecureSkipTLSVerify).
+func (e *ExternalMetricsServer) Serve(address, certFile, keyFile string) {
+	mux := http.NewServeMux()
+	mux.Handle(externalMetricsPrefix, e)
+	mux.Handle(externalMetricsPrefix+"/", e)
+	server := &http.Server{Addr: address, Handler: mux}
+
+	fmt.Println("Serving external metrics API at", address)
+	var err error
+	if certFile != "" {
+		err = server.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		certificate, certErr := controltls.SelfSigned("latency-aware-scheduler")
+		if certErr != nil {
+			fmt.Println("Error generating the certificate of the external metrics API:", certErr)
+			return
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+		err = server.ListenAndServeTLS("", "")
+	}
+	if err != nil {
+		fmt.Println("Error serving the external metrics API:", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	externalmetrics "k8s.io/metrics/pkg/apis/external_metrics/v1beta1"
+)
+
+func TestExternalMetricsServer(t *testing.T) {
+	stats := NewLatencyStatsStore()
+	stats.Set(map[string]*AppLatencyStats{
+		"a": {Users: 4, UnservedUsers: 1, UnservedRatio: 0.25, P95LatencyMs: 80, MaxLatencyMs: 90, MeanLatencyMs: 42.5, ComputedAt: time.Unix(1700000000, 0)},
+		"b": {Users: 1, P95LatencyMs: 10, MaxLatencyMs: 10, MeanLatencyMs: 10},
+	})
+	server := NewExternalMetricsServer(stats, checkInterval)
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		values map[string]string // appName -> value
+	}{
+		{"unserved ratio", "/namespaces/default/latency_unserved_users_ratio?labelSelector=app%3Da", http.StatusOK, map[string]string{"a": "250m"}},
+		{"unserved users", "/namespaces/default/latency_unserved_users?labelSelector=app%3Da", http.StatusOK, map[string]string{"a": "1"}},
+		{"p95", "/namespaces/default/latency_user_p95_milliseconds?labelSelector=app%3Da", http.StatusOK, map[string]string{"a": "80"}},
+		{"max", "/namespaces/default/latency_user_max_milliseconds?labelSelector=app%3Da", http.StatusOK, map[string]string{"a": "90"}},
+		{"mean", "/namespaces/default/latency_user_mean_milliseconds?labelSelector=app%3Da", http.StatusOK, map[string]string{"a": "42500m"}},
+		{"every app without selector", "/namespaces/default/latency_user_max_milliseconds", http.StatusOK, map[string]string{"a": "90", "b": "10"}},
+		{"no app selected", "/namespaces/default/latency_user_max_milliseconds?labelSelector=app%3Dc", http.StatusOK, map[string]string{}},
+		{"unknown metric", "/namespaces/default/cpu", http.StatusNotFound, nil},
+		{"other namespace", "/namespaces/other/latency_user_max_milliseconds?labelSelector=app%3Da", http.StatusNotFound, nil},
+		{"other namespace without selector", "/namespaces/kube-system/latency_unserved_users", http.StatusNotFound, nil},
+		{"invalid path", "/namespaces/default", http.StatusNotFound, nil},
+		{"invalid selector", "/namespaces/default/latency_unserved_users?labelSelector=app%3D%3D%3D", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, externalMetricsPrefix+tt.path, nil))
+			if recorder.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", recorder.Code, tt.status, recorder.Body)
+			}
+			if tt.values == nil {
+				return
+			}
+			var list externalmetrics.ExternalMetricValueList
+			if err := json.Unmarshal(recorder.Body.Bytes(), &list); err != nil {
+				t.Fatal(err)
+			}
+			if len(list.Items) != len(tt.values) {
+				t.Fatalf("got %d values, want %v", len(list.Items), tt.values)
+			}
+			for _, item := range list.Items {
+				if want := tt.values[item.MetricLabels["app"]]; item.Value.String() != want {
+					t.Errorf("app %s: got %s, want %s", item.MetricLabels["app"], item.Value.String(), want)
+				}
+				if *item.WindowSeconds != int64(checkInterval.Seconds()) {
+					t.Errorf("window of %ds", *item.WindowSeconds)
+				}
+			}
+		})
+	}
+}
+
+func TestExternalMetricsResourceList(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	NewExternalMetricsServer(NewLatencyStatsStore(), checkInterval).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, externalMetricsPrefix, nil))
+	var list metav1.APIResourceList
+	if err := json.Unmarshal(recorder.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.GroupVersion != externalmetrics.SchemeGroupVersion.String() || len(list.APIResources) != len(externalMetricValues) {
+		t.Errorf("got %s with %d resources", list.GroupVersion, len(list.APIResources))
+	}
+}
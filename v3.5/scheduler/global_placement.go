@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PlacementProblem is the input of the global placement of an app: which nodes should host a pod
+// so that the fewest users violate the latency thresholds, within the replica budget.
+type PlacementProblem struct {
+	Latencies     map[string]map[string]int64 // userID -> nodeName -> latency
+	HardThreshold int64                       // -1 if not set
+	SoftThreshold int64                       // -1 if not set
+	Objective     LatencyObjective
+	Pods          map[string][]string // nodeName -> pods of the app running there
+	Candidates    map[string]bool     // nodes with room for a new pod of the app
+	MinReplicas   int
+	MaxReplicas   int // maximum number of pods of the app
+}
+
+// PlacementPlan is the difference between the current placement and the best one found.
+type PlacementPlan struct {
+	Nodes             []string // nodes that should host the app
+	Add               []string // nodes that need a new pod
+	Remove            []string // pods to remove
+	Violations        int      // users violating the thresholds with the planned placement
+	CurrentViolations int      // users violating the thresholds with the current placement
+}
+
+type placementScore struct {
+	violations     int   // users above the hard threshold (or the soft one, if it is the only one)
+	softViolations int   // users above the soft threshold
+	totalLatency   int64 // sum of the best latency of every user
+	maxLatency     int64 // best latency of the worst served user
+}
+
+// better compares two scores: the hard violations first, then the objective of the app.
+func (a placementScore) better(b placementScore, objective LatencyObjective) bool {
+	if a.violations != b.violations {
+		return a.violations < b.violations
+	}
+	switch objective {
+	case ObjectiveMinimax:
+		if a.maxLatency != b.maxLatency {
+			return a.maxLatency < b.maxLatency
+		}
+	case ObjectiveSoftCount:
+		if a.softViolations != b.softViolations {
+			return a.softViolations < b.softViolations
+		}
+	}
+	return a.totalLatency < b.totalLatency
+}
+
+// improves tells whether a is worth one more replica compared with b: it must reduce the hard
+// violations or improve the metric of the objective.
+func (a placementScore) improves(b placementScore, objective LatencyObjective) bool {
+	switch {
+	case a.violations != b.violations:
+		return a.violations < b.violations
+	case objective == ObjectiveMinimax:
+		return a.maxLatency < b.maxLatency
+	case objective == ObjectiveSoftCount:
+		return a.softViolations < b.softViolations
+	default:
+		return a.totalLatency < b.totalLatency
+	}
+}
+
+// evaluate scores a set of nodes; a user is served by the best node of the set it was measured on.
+func (p *PlacementProblem) evaluate(nodes map[string]bool) placementScore {
+	var score placementScore
+	for _, nodeLatencies := range p.Latencies {
+		best := int64(-1)
+		for nodeName, latency := range nodeLatencies {
+			if nodes[nodeName] && (best == -1 || latency < best) {
+				best = latency
+			}
+		}
+		switch {
+		case best == -1:
+			score.violations++
+			score.softViolations++
+			continue
+		case p.HardThreshold >= 0 && best > p.HardThreshold:
+			score.violations++
+		case p.HardThreshold < 0 && p.SoftThreshold >= 0 && best > p.SoftThreshold:
+			score.violations++
+		}
+		if p.SoftThreshold >= 0 && best > p.SoftThreshold {
+			score.softViolations++
+		}
+		score.totalLatency += best
+		if best > score.maxLatency {
+			score.maxLatency = best
+		}
+	}
+	return score
+}
+
+// planPlacement solves the problem as a facility location: nodes are added greedily while they reduce
+// the violations, then single swaps are tried until none improves the placement. Nodes nobody was
+// measured on are explored one at a time while some users are still violating the thresholds.
+func planPlacement(p *PlacementProblem) *PlacementPlan {
+	measured := make(map[string]bool)
+	for _, nodeLatencies := range p.Latencies {
+		for nodeName := range nodeLatencies {
+			measured[nodeName] = true
+		}
+	}
+	var eligible, unexplored []string
+	for _, nodeName := range sortedKeys(p.Candidates) {
+		if measured[nodeName] {
+			eligible = append(eligible, nodeName)
+		} else if len(p.Pods[nodeName]) == 0 {
+			unexplored = append(unexplored, nodeName)
+		}
+	}
+	for _, nodeName := range sortedKeys(p.Pods) {
+		if measured[nodeName] && !p.Candidates[nodeName] {
+			eligible = append(eligible, nodeName)
+		}
+	}
+	sort.Strings(eligible)
+
+	current := make(map[string]bool)
+	for nodeName := range p.Pods {
+		current[nodeName] = true
+	}
+	plan := &PlacementPlan{CurrentViolations: p.evaluate(current).violations}
+
+	// Greedy: add the node that improves the score the most, within the replica budget
+	selected := make(map[string]bool)
+	score := p.evaluate(selected)
+	planned := 0
+	for {
+		bestNode := ""
+		bestScore := score
+		for _, nodeName := range eligible {
+			if selected[nodeName] || planned+p.replicasOn(nodeName) > p.MaxReplicas {
+				continue
+			}
+			selected[nodeName] = true
+			if candidateScore := p.evaluate(selected); candidateScore.better(bestScore, p.Objective) {
+				bestNode, bestScore = nodeName, candidateScore
+			}
+			delete(selected, nodeName)
+		}
+		if bestNode == "" || !bestScore.improves(score, p.Objective) {
+			break
+		}
+		selected[bestNode] = true
+		score = bestScore
+		planned += p.replicasOn(bestNode)
+	}
+
+	// Local search: swap a selected node with a non-selected one while it helps
+	for improved := true; improved; {
+		improved = false
+		for _, out := range sortedKeys(selected) {
+			for _, in := range eligible {
+				if selected[in] || planned-p.replicasOn(out)+p.replicasOn(in) > p.MaxReplicas {
+					continue
+				}
+				delete(selected, out)
+				selected[in] = true
+				if candidateScore := p.evaluate(selected); candidateScore.better(score, p.Objective) {
+					score = candidateScore
+					planned += p.replicasOn(in) - p.replicasOn(out)
+					improved = true
+					break
+				}
+				delete(selected, in)
+				selected[out] = true
+			}
+			if improved {
+				break
+			}
+		}
+	}
+
+	// Pods on nodes not measured yet are kept if the budget allows, they were just created to explore them
+	for _, nodeName := range sortedKeys(p.Pods) {
+		if !measured[nodeName] && planned+len(p.Pods[nodeName]) <= p.MaxReplicas {
+			selected[nodeName] = true
+			planned += len(p.Pods[nodeName])
+		}
+	}
+	if score.violations > 0 && planned < p.MaxReplicas && len(unexplored) > 0 {
+		selected[unexplored[0]] = true
+		planned++
+	}
+
+	// Keep the default number of replicas, removing the pods of the least useful nodes first
+	var removable []string
+	for _, nodeName := range sortedKeys(p.Pods) {
+		if !selected[nodeName] {
+			removable = append(removable, nodeName)
+		}
+	}
+	sort.SliceStable(removable, func(i, j int) bool {
+		return p.usefulness(selected, removable[i]) > p.usefulness(selected, removable[j])
+	})
+	for _, nodeName := range removable {
+		if planned >= p.MinReplicas {
+			plan.Remove = append(plan.Remove, p.Pods[nodeName]...)
+			continue
+		}
+		selected[nodeName] = true
+		planned += len(p.Pods[nodeName])
+	}
+
+	plan.Nodes = sortedKeys(selected)
+	for _, nodeName := range plan.Nodes {
+		if len(p.Pods[nodeName]) == 0 {
+			plan.Add = append(plan.Add, nodeName)
+		}
+	}
+	sort.Strings(plan.Remove)
+	plan.Violations = p.evaluate(selected).violations
+	return plan
+}
+
+// replicasOn is the number of pods a node adds to a placement: its running pods, or a new one.
+func (p *PlacementProblem) replicasOn(nodeName string) int {
+	if pods := len(p.Pods[nodeName]); pods > 0 {
+		return pods
+	}
+	return 1
+}
+
+// usefulness is the number of users that would be served by nodeName better than by the selected nodes.
+func (p *PlacementProblem) usefulness(selected map[string]bool, nodeName string) int {
+	users := 0
+	for _, nodeLatencies := range p.Latencies {
+		latency, ok := nodeLatencies[nodeName]
+		if !ok {
+			continue
+		}
+		better := true
+		for selectedNode := range selected {
+			if selectedLatency, ok := nodeLatencies[selectedNode]; ok && selectedLatency <= latency {
+				better = false
+				break
+			}
+		}
+		if better {
+			users++
+		}
+	}
+	return users
+}
+
+// EnableGlobalPlacement replaces the per-user decisions of the descheduler with a placement planned
+// on the whole latency matrix of every app. maxReplicas is the replica budget in pods (0: one per worker node).
+func (d *Descheduler) EnableGlobalPlacement(maxReplicas int) {
+	d.globalPlacement = true
+	d.maxReplicas = maxReplicas
+	d.objectives.AllowMinimax()
+}
+
+// buildPlacementProblem collects the measurements, the pods and the free capacity of the nodes for appName.
+// pending tells whether some pods of the app are not running yet.
+func (d *Descheduler) buildPlacementProblem(appName string) (problem *PlacementProblem, pending bool, err error) {
+	nodes, err := d.clientset.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, false, fmt.Errorf("error listing nodes: %v", err)
+	}
+	pods, err := d.clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, false, fmt.Errorf("error listing pods: %v", err)
+	}
+	deployment, err := d.clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), appName+"-deployment", metav1.GetOptions{})
+	if err != nil {
+		return nil, false, fmt.Errorf("error retrieving deployment: %v", err)
+	}
+
+	hard, hExists := d.hardLatencyThresholds.GetLatency(appName)
+	if !hExists {
+		hard = -1
+	}
+	soft, sExists := d.softLatencyThresholds.GetLatency(appName)
+	if !sExists {
+		soft = -1
+	}
+	problem = &PlacementProblem{
+		Latencies:     make(map[string]map[string]int64),
+		HardThreshold: hard,
+		SoftThreshold: soft,
+		Objective:     d.objectives.GetObjective(appName),
+		Pods:          make(map[string][]string),
+		Candidates:    make(map[string]bool),
+		MinReplicas:   int(d.defaultReplicas[appName]),
+		MaxReplicas:   d.maxReplicas,
+	}
+
+	// Free capacity of the nodes, compared with the requests of a pod of the app
+	used := make(map[string]v1.ResourceList)
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == "" || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			if pod.Labels["app"] == appName && pod.DeletionTimestamp == nil {
+				pending = true
+			}
+			continue
+		}
+		addResources(used, pod.Spec.NodeName, podRequests(&pod.Spec))
+		if pod.Labels["app"] == appName && pod.DeletionTimestamp == nil {
+			if len(pod.Status.PodIP) == 0 {
+				pending = true
+			}
+			problem.Pods[pod.Spec.NodeName] = append(problem.Pods[pod.Spec.NodeName], pod.Name)
+		}
+	}
+	requests := podRequests(&deployment.Spec.Template.Spec)
+	workers := 0
+	for _, node := range nodes.Items {
+		if _, ok := node.Labels["node-role.kubernetes.io/control-plane"]; ok || node.Spec.Unschedulable {
+			continue
+		}
+		workers++
+		fits := true
+		for resourceName, request := range requests {
+			free := node.Status.Allocatable[resourceName].DeepCopy()
+			if usedQuantity, ok := used[node.Name][resourceName]; ok {
+				free.Sub(usedQuantity)
+			}
+			if free.Cmp(request) < 0 {
+				fits = false
+			}
+		}
+		if fits {
+			problem.Candidates[node.Name] = true
+		}
+	}
+	if problem.MaxReplicas <= 0 {
+		problem.MaxReplicas = workers
+	}
+
+	for userID, nodeMeasurements := range d.latencyMeasurements.GetAppMeasurements(appName) {
+		if len(nodeMeasurements) == 0 {
+			continue
+		}
+		problem.Latencies[userID] = make(map[string]int64)
+		for nodeName, measurement := range nodeMeasurements {
+			problem.Latencies[userID][nodeName] = measurement.Measurement
+		}
+	}
+	return problem, pending, nil
+}
+
+func podRequests(spec *v1.PodSpec) v1.ResourceList {
+	requests := make(v1.ResourceList)
+	for _, container := range spec.Containers {
+		for resourceName, quantity := range container.Resources.Requests {
+			total := requests[resourceName]
+			total.Add(quantity)
+			requests[resourceName] = total
+		}
+	}
+	return requests
+}
+
+func addResources(used map[string]v1.ResourceList, nodeName string, requests v1.ResourceList) {
+	if _, ok := used[nodeName]; !ok {
+		used[nodeName] = make(v1.ResourceList)
+	}
+	for resourceName, quantity := range requests {
+		total, ok := used[nodeName][resourceName]
+		if !ok {
+			total = resource.Quantity{}
+		}
+		total.Add(quantity)
+		used[nodeName][resourceName] = total
+	}
+}
+
+// runGlobalPlacement plans the placement of appName and applies one change per cycle: pods are added
+// before the old ones are removed, and nothing changes while a new pod is still starting.
+func (d *Descheduler) runGlobalPlacement(appName string) {
+	problem, pending, err := d.buildPlacementProblem(appName)
+	if err != nil {
+		fmt.Printf("Error planning the placement of app %s: %v\n", appName, err)
+		return
+	}
+	d.shedOverload(appName)
+	d.associateUsers(appName, problem)
+	capacityRunsOut := false
+	if d.capacities[appName].limited() {
+		if required := d.requiredReplicas(appName); required > problem.MinReplicas {
+			problem.MinReplicas = required // don't remove the pods needed by the load
+		}
+		capacityRunsOut = d.capacityRunsOut(appName)
+	}
+	plan := planPlacement(problem)
+	placementViolations.WithLabelValues(appName).Set(float64(plan.Violations))
+	fmt.Printf("Placement plan for app %s: nodes %v, add %v, remove %v, violations %d -> %d\n", appName, plan.Nodes, plan.Add, plan.Remove, plan.CurrentViolations, plan.Violations)
+
+	if !d.autoscalingDisabled && !pending {
+		switch {
+		case len(plan.Add) > 0:
+			if err := d.increaseReplicasOnNode(appName, plan.Add[0], "global placement"); err != nil {
+				fmt.Printf("Error increasing replicas for app %s: %v\n", appName, err)
+			} else {
+				placementChanges.WithLabelValues(appName, "add").Inc()
+			}
+		case len(plan.Remove) > 0:
+			if err := d.scaleInPod(appName, plan.Remove[0], evictionReasonPlacement); err == errPodDraining {
+				fmt.Printf("Waiting for pod %s of app %s to drain\n", plan.Remove[0], appName)
+			} else if err != nil {
+				fmt.Printf("Error removing pod %s of app %s: %v\n", plan.Remove[0], appName, err)
+			} else {
+				placementChanges.WithLabelValues(appName, "remove").Inc()
+				nodeName := nodeOfPod(problem.Pods, plan.Remove[0])
+				problem.Pods[nodeName] = withoutPod(problem.Pods[nodeName], plan.Remove[0])
+				if len(problem.Pods[nodeName]) == 0 {
+					delete(problem.Pods, nodeName)
+				}
+				if appPods := d.appPods[appName]; appPods != nil {
+					appPods[nodeName] = withoutPod(appPods[nodeName], plan.Remove[0])
+					if len(appPods[nodeName]) == 0 {
+						delete(appPods, nodeName)
+					}
+				}
+				d.associateUsers(appName, problem)
+			}
+		case capacityRunsOut:
+			nodeName, ok := d.chooseScaleUpNode(appName, true)
+			if !ok {
+				break
+			}
+			if err := d.increaseReplicasOnNode(appName, nodeName, "capacity"); err != nil {
+				fmt.Printf("Error increasing replicas for app %s: %v\n", appName, err)
+			} else {
+				placementChanges.WithLabelValues(appName, "add").Inc()
+			}
+		}
+	}
+}
+
+func nodeOfPod(pods map[string][]string, podName string) string {
+	for nodeName, nodePods := range pods {
+		for _, name := range nodePods {
+			if name == podName {
+				return nodeName
+			}
+		}
+	}
+	return ""
+}
+
+// withoutPod returns the pods without podName, in a new slice.
+func withoutPod(pods []string, podName string) []string {
+	remaining := make([]string, 0, len(pods))
+	for _, name := range pods {
+		if name != podName {
+			remaining = append(remaining, name)
+		}
+	}
+	return remaining
+}
+
+// associateUsers associates every user to the pod of the best node it was measured on, among the
+// nodes that host the app now and have a pod with room, if that node is within the thresholds.
+func (d *Descheduler) associateUsers(appName string, problem *PlacementProblem) {
+	livePods := make(map[string]bool)
+	for _, nodePods := range problem.Pods {
+		for _, podName := range nodePods {
+			livePods[podName] = true
+		}
+	}
+	userMeasurements := d.latencyMeasurements.GetAppMeasurements(appName)
+	for _, userID := range sortedKeys(userMeasurements) {
+		if association, ok := d.user_Cluster.GetUserClusterAssociation(userID, appName); ok && !livePods[association.PodName] {
+			d.dissociate(userID, appName)
+		}
+		bestNode := ""
+		var best *LatencyMeasurement
+		denied := false
+		for _, nodeName := range sortedKeys(userMeasurements[userID]) {
+			measurement := userMeasurements[userID][nodeName]
+			if len(problem.Pods[nodeName]) == 0 || (best != nil && measurement.Measurement >= best.Measurement) {
+				continue
+			}
+			if d.capacities[appName].limited() && !d.hasRoomOnNode(appName, nodeName, userID) {
+				denied = true
+				continue
+			}
+			bestNode, best = nodeName, measurement
+		}
+		if best == nil || (problem.HardThreshold >= 0 && best.Measurement > problem.HardThreshold) {
+			if _, ok := d.user_Cluster.GetUserClusterAssociation(userID, appName); ok {
+				d.dissociate(userID, appName)
+			}
+			if denied {
+				d.denyUser(appName, userID)
+			}
+			continue
+		}
+		podName := best.PodName
+		if !livePods[podName] {
+			podName = problem.Pods[bestNode][0]
+		}
+		isSoft := problem.SoftThreshold >= 0 && best.Measurement <= problem.SoftThreshold
+		d.associate(userID, appName, bestNode, &LatencyMeasurement{
+			PodNamespace: best.PodNamespace,
+			PodName:      podName,
+			Measurement:  best.Measurement,
+			Timestamp:    best.Timestamp,
+		}, isSoft)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPlanPlacement(t *testing.T) {
+	tests := []struct {
+		name       string
+		problem    PlacementProblem
+		nodes      []string
+		add        []string
+		remove     []string
+		violations int
+	}{
+		{
+			name: "closest node of every user",
+			problem: PlacementProblem{
+				Latencies:   map[string]map[string]int64{"u1": {"n1": 10, "n2": 80}, "u2": {"n1": 80, "n2": 10}},
+				Candidates:  map[string]bool{"n1": true, "n2": true, "n3": true},
+				MinReplicas: 1, MaxReplicas: 3,
+			},
+			nodes: []string{"n1", "n2"},
+			add:   []string{"n1", "n2"},
+		},
+		{
+			name: "the budget counts the pods, not the nodes",
+			problem: PlacementProblem{
+				Latencies:   map[string]map[string]int64{"u1": {"n1": 10}, "u2": {"n2": 10}},
+				Pods:        map[string][]string{"n1": {"a-1", "a-2"}},
+				Candidates:  map[string]bool{"n2": true},
+				MinReplicas: 1, MaxReplicas: 2,
+			},
+			nodes:      []string{"n1"},
+			violations: 1,
+		},
+		{
+			name: "pods exploring unmeasured nodes are kept within the budget",
+			problem: PlacementProblem{
+				Latencies:   map[string]map[string]int64{"u1": {"n1": 10}, "u2": {"n1": 100}},
+				Pods:        map[string][]string{"n1": {"a-1"}, "n3": {"a-3"}},
+				Candidates:  map[string]bool{"n2": true},
+				MinReplicas: 1, MaxReplicas: 2,
+			},
+			nodes:      []string{"n1", "n3"},
+			violations: 1,
+		},
+		{
+			name: "pods exploring unmeasured nodes are removed above the budget",
+			problem: PlacementProblem{
+				Latencies:   map[string]map[string]int64{"u1": {"n1": 10}, "u2": {"n1": 100}},
+				Pods:        map[string][]string{"n1": {"a-1"}, "n3": {"a-3"}},
+				Candidates:  map[string]bool{"n2": true},
+				MinReplicas: 1, MaxReplicas: 1,
+			},
+			nodes:      []string{"n1"},
+			remove:     []string{"a-3"},
+			violations: 1,
+		},
+		{
+			name: "an unmeasured node is explored while users violate the thresholds",
+			problem: PlacementProblem{
+				Latencies:   map[string]map[string]int64{"u1": {"n1": 10}, "u2": {"n1": 100}},
+				Pods:        map[string][]string{"n1": {"a-1"}},
+				Candidates:  map[string]bool{"n2": true},
+				MinReplicas: 1, MaxReplicas: 3,
+			},
+			nodes:      []string{"n1", "n2"},
+			add:        []string{"n2"},
+			violations: 1,
+		},
+		{
+			name: "pods of the dropped nodes are removed down to the minimum replicas",
+			problem: PlacementProblem{
+				Latencies:   map[string]map[string]int64{"u1": {"n1": 10, "n2": 20, "n3": 30}},
+				Pods:        map[string][]string{"n1": {"a-1"}, "n2": {"a-2"}, "n3": {"a-3", "a-4"}},
+				MinReplicas: 2, MaxReplicas: 4,
+			},
+			nodes:  []string{"n1", "n2"},
+			remove: []string{"a-3", "a-4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.problem.HardThreshold, tt.problem.SoftThreshold = 50, -1
+			if tt.problem.Pods == nil {
+				tt.problem.Pods = make(map[string][]string)
+			}
+			plan := planPlacement(&tt.problem)
+			if !reflect.DeepEqual(plan.Nodes, tt.nodes) || !reflect.DeepEqual(plan.Add, tt.add) || !reflect.DeepEqual(plan.Remove, tt.remove) {
+				t.Errorf("got nodes %v add %v remove %v, want %v %v %v", plan.Nodes, plan.Add, plan.Remove, tt.nodes, tt.add, tt.remove)
+			}
+			if plan.Violations != tt.violations {
+				t.Errorf("got %d violations, want %d", plan.Violations, tt.violations)
+			}
+			replicas := len(plan.Add)
+			for _, nodeName := range plan.Nodes {
+				replicas += len(tt.problem.Pods[nodeName])
+			}
+			if budget := tt.problem.MaxReplicas; replicas > budget && replicas > tt.problem.MinReplicas {
+				t.Errorf("planned %d replicas, above the budget of %d", replicas, budget)
+			}
+		})
+	}
+}
+
+// TestRunGlobalPlacementRemovesOnePod removes one of the two pods of a node dropped by the plan:
+// the other one keeps running until the next cycle.
+func TestRunGlobalPlacementRemovesOnePod(t *testing.T) {
+	running := func(pod *v1.Pod) *v1.Pod {
+		pod.Status.PodIP = "10.244.0.1"
+		return pod
+	}
+	d, clientset := newTestDescheduler(testNode("n1"), testNode("n2"), testDeployment("a", 3),
+		running(testPod("a", "a-1", "n1", nil)), running(testPod("a", "a-2", "n1", nil)), running(testPod("a", "a-3", "n2", nil)))
+	d.EnableGlobalPlacement(0)
+	d.defaultReplicas["a"] = 1
+	d.hardLatencyThresholds.SetLatency("a", 50)
+	d.latencyMeasurements.AddLatency("a", "u1", "n2", &LatencyMeasurement{PodName: "a-3", Measurement: 10, Timestamp: clock.Now()})
+	if err := d.refreshAppPods("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	d.runGlobalPlacement("a")
+	if want := map[string][]string{"n1": {"a-2"}, "n2": {"a-3"}}; !reflect.DeepEqual(d.appPods["a"], want) {
+		t.Errorf("pods of the app %v, want %v", d.appPods["a"], want)
+	}
+	deployment, err := clientset.AppsV1().Deployments("default").Get(context.Background(), "a-deployment", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *deployment.Spec.Replicas != 2 {
+		t.Errorf("deployment scaled to %d replicas, want 2", *deployment.Spec.Replicas)
+	}
+	if clusterInfo, ok := d.user_Cluster.GetUserClusterAssociation("u1", "a"); !ok || clusterInfo.PodName != "a-3" {
+		t.Errorf("user associated to %+v, want pod a-3", clusterInfo)
+	}
+}
+
+func TestWithoutPod(t *testing.T) {
+	tests := []struct {
+		pods []string
+		pod  string
+		want []string
+	}{
+		{[]string{"a-1", "a-2"}, "a-1", []string{"a-2"}},
+		{[]string{"a-1"}, "a-1", []string{}},
+		{[]string{"a-1"}, "a-2", []string{"a-1"}},
+	}
+	for _, tt := range tests {
+		if got := withoutPod(tt.pods, tt.pod); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("withoutPod(%v, %s) = %v, want %v", tt.pods, tt.pod, got, tt.want)
+		}
+	}
+}
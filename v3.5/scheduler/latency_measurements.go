@@ -12,105 +12,8 @@ type LatencyMeasurement struct {
 	PodName      string
 	Measurement  int64
 	Timestamp    time.Time
-}
-
-type LatencyMeasurements struct {
-	sync.RWMutex
-	data map[string]map[string]map[string]*LatencyMeasurement // appName -> userID -> nodeName -> LatencyMeasurement
-}
-
-func NewLatencyMeasurements() *LatencyMeasurements {
-	return &LatencyMeasurements{
-		data: make(map[string]map[string]map[string]*LatencyMeasurement),
-	}
-}
-
-func (l *LatencyMeasurements) AddLatency(appName, userID, nodeName string, measurement *LatencyMeasurement) {
-	l.Lock()
-	defer l.Unlock()
-	appMeasurements, ok := l.data[appName]
-	if !ok {
-		appMeasurements = make(map[string]map[string]*LatencyMeasurement)
-		l.data[appName] = appMeasurements
-	}
-	userMeasurements, ok := appMeasurements[userID]
-	if !ok {
-		userMeasurements = make(map[string]*LatencyMeasurement)
-		appMeasurements[userID] = userMeasurements
-	}
-
-	existingMeasurement, ok := userMeasurements[nodeName]
-	if !ok || existingMeasurement.Timestamp.Before(measurement.Timestamp) {
-		userMeasurements[nodeName] = measurement
-	}
-}
-
-func (l *LatencyMeasurements) DeleteLatency(appName, userID, nodeName string) {
-	l.Lock()
-	defer l.Unlock()
-	if appMeasurements, ok := l.data[appName]; ok {
-		if userMeasurements, ok := appMeasurements[userID]; ok {
-			delete(userMeasurements, nodeName)
-		}
-	}
-}
-
-func (l *LatencyMeasurements) GetMeasurement(appName, userID, nodeName string) (*LatencyMeasurement, bool) {
-	l.RLock()
-	defer l.RUnlock()
-	value, ok := l.data[appName][userID][nodeName]
-	return value, ok
-}
-
-func (l *LatencyMeasurements) GetMeasurements() map[string]map[string]map[string]*LatencyMeasurement {
-	l.RLock()
-	defer l.RUnlock()
-	return l.data
-}
-
-func (l *LatencyMeasurements) GetTotalMeasurementsPerUserApp(appName, userID string) int {
-	l.RLock()
-	defer l.RUnlock()
-	return len(l.data[appName][userID])
-}
-
-func (l *LatencyMeasurements) UpdateMeasurements(newMeasurements map[string]map[string]map[string]*LatencyMeasurement) {
-	for appName, userMeasurements := range newMeasurements {
-		for userID, nodeMeasurements := range userMeasurements {
-			for nodeName, measurement := range nodeMeasurements {
-				l.AddLatency(appName, userID, nodeName, measurement)
-			}
-		}
-	}
-}
-
-func (l *LatencyMeasurements) CleanupMeasurementsOlderThan(minutes int) {
-	l.RLock()
-	defer l.RUnlock()
-	podsPerApp := make(map[string]map[string]bool) // appName -> map of pods
-	expirationDuration := time.Duration(minutes) * time.Minute
-	for appName, appMeasurements := range l.data {
-		for userID, userMeasurements := range appMeasurements {
-			for nodeName, nodeMeasurement := range userMeasurements {
-				if time.Since(nodeMeasurement.Timestamp) > expirationDuration {
-					delete(userMeasurements, nodeName)
-				}
-				// Keep track of the pods for this app
-				if _, ok := podsPerApp[appName]; !ok {
-					podsPerApp[appName] = make(map[string]bool)
-				}
-				podsPerApp[appName][nodeMeasurement.PodName] = true
-			}
-			// Se dopo la pulizia, le misurazioni dell'app per l'utente sono vuote, allora rimuovi anche l'utente
-			if len(l.data[appName][userID]) == 0 {
-				delete(l.data[appName], userID)
-			}
-		}
-		if len(l.data[appName]) == 0 {
-			delete(l.data, appName)
-		}
-	}
-	//DecreseReplicaSet??
+	Requests     int64  // requests of the user counted by the meter since the previous read
+	SourceIP     string `json:",omitempty"` // client IP seen by the meter, for the cohorts
 }
 
 type LatencyThresholds struct {
@@ -144,6 +47,17 @@ func (lt *LatencyThresholds) GetLatency(appName string) (int64, bool) {
 	return value, ok
 }
 
+// GetAll returns a copy of the thresholds.
+func (lt *LatencyThresholds) GetAll() map[string]int64 {
+	lt.RLock()
+	defer lt.RUnlock()
+	thresholds := make(map[string]int64, len(lt.data))
+	for appName, latency := range lt.data {
+		thresholds[appName] = latency
+	}
+	return thresholds
+}
+
 type NodeLatencyInfo struct {
 	NodeName    string
 	Measurement int64
@@ -183,12 +97,16 @@ type ClusterInfo struct {
 	PodName           string
 	CreatedAt         time.Time
 	HasSoftConstraint bool
-	latency           int64
+	Latency           int64
 }
 
+// UserClusterAssociation is shared by the descheduler, the admin API and the informers, so every
+// access takes its lock. The stored ClusterInfo are never changed in place, only replaced: the
+// pointers returned by the getters can be read without the lock.
 type UserClusterAssociation struct {
 	Data    map[string]map[string]*ClusterInfo //userID -> appName -> cluster measure
 	changed bool
+	mu      sync.RWMutex
 }
 
 func NewUserClusterAssociation() *UserClusterAssociation {
@@ -198,7 +116,9 @@ func NewUserClusterAssociation() *UserClusterAssociation {
 	}
 }
 
-func (u *UserClusterAssociation) AddAssociation(userID, appName, clusterName string, measurement *LatencyMeasurement, isSoft bool) {
+func (u *UserClusterAssociation) AddAssociation(userID, appName, clusterName string, measurement *LatencyMeasurement, isSoft bool, objective LatencyObjective) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	userAssociations, ok := u.Data[userID]
 	if !ok {
 		userAssociations = make(map[string]*ClusterInfo)
@@ -206,37 +126,92 @@ func (u *UserClusterAssociation) AddAssociation(userID, appName, clusterName str
 	}
 
 	if currentClusterInfo, exists := userAssociations[appName]; exists {
-		// Aggiorna l'associazione solo se la nuova misurazione di latenza è inferiore
-		if currentClusterInfo.latency > measurement.Measurement {
-			fmt.Printf("Updating association for App %s: User %s from latency %d to %d\n", appName, userID, currentClusterInfo.latency, measurement.Measurement)
-			currentClusterInfo.ClusterName = clusterName
-			currentClusterInfo.PodName = measurement.PodName
-			currentClusterInfo.latency = measurement.Measurement
-			currentClusterInfo.HasSoftConstraint = isSoft
-			currentClusterInfo.CreatedAt = time.Now()
+		// Aggiorna l'associazione solo se la nuova misurazione è migliore per l'obiettivo dell'app
+		if objective.replacesAssociation(currentClusterInfo, measurement.Measurement, isSoft) {
+			fmt.Printf("Updating association for App %s: User %s from latency %d to %d\n", appName, userID, currentClusterInfo.Latency, measurement.Measurement)
+			userAssociations[appName] = &ClusterInfo{
+				ClusterName:       clusterName,
+				PodName:           measurement.PodName,
+				Latency:           measurement.Measurement,
+				HasSoftConstraint: isSoft,
+				CreatedAt:         clock.Now(),
+			}
 			u.changed = true
 		} else {
-			fmt.Printf("Existing association for App %s: User %s has lower or equal latency. No update required.\n", appName, userID)
+			fmt.Printf("Existing association for App %s: User %s is not improved (objective %s). No update required.\n", appName, userID, objective)
 		}
 	} else {
 		// Se non esiste un'associazione precedente, crea una nuova
 		userAssociations[appName] = &ClusterInfo{
 			ClusterName:       clusterName,
 			PodName:           measurement.PodName,
-			latency:           measurement.Measurement,
+			Latency:           measurement.Measurement,
 			HasSoftConstraint: isSoft,
-			CreatedAt:         time.Now(),
+			CreatedAt:         clock.Now(),
 		}
 		fmt.Printf("New association created for App %s: User %s, latency %d\n", appName, userID, measurement.Measurement)
 		u.changed = true
 	}
 }
 
+// RestoreAssociation puts back an association read from a previous run, without marking the data as changed.
+func (u *UserClusterAssociation) RestoreAssociation(userID, appName string, clusterInfo *ClusterInfo) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	userAssociations, ok := u.Data[userID]
+	if !ok {
+		userAssociations = make(map[string]*ClusterInfo)
+		u.Data[userID] = userAssociations
+	}
+	userAssociations[appName] = clusterInfo
+}
+
+// ReplaceAssociations puts in place the associations of a restored state, userID -> appName ->
+// cluster info, and marks them as changed to republish what the consistency check dropped.
+func (u *UserClusterAssociation) ReplaceAssociations(associations map[string]map[string]*ClusterInfo) {
+	data := make(map[string]map[string]*ClusterInfo, len(associations))
+	for userID, appAssociations := range associations {
+		data[userID] = make(map[string]*ClusterInfo, len(appAssociations))
+		for appName, clusterInfo := range appAssociations {
+			data[userID][appName] = clusterInfo
+		}
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.Data = data
+	u.changed = true
+}
+
+// GetUserClusterAssociations returns a copy of the associations, userID -> appName -> cluster info.
 func (u *UserClusterAssociation) GetUserClusterAssociations() map[string]map[string]*ClusterInfo {
-	return u.Data
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	associations := make(map[string]map[string]*ClusterInfo, len(u.Data))
+	for userID, appAssociations := range u.Data {
+		associations[userID] = make(map[string]*ClusterInfo, len(appAssociations))
+		for appName, clusterInfo := range appAssociations {
+			associations[userID][appName] = clusterInfo
+		}
+	}
+	return associations
+}
+
+// GetAppAssociations returns the associations of the app, userID -> cluster info.
+func (u *UserClusterAssociation) GetAppAssociations(appName string) map[string]*ClusterInfo {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	associations := make(map[string]*ClusterInfo)
+	for userID, appAssociations := range u.Data {
+		if clusterInfo, ok := appAssociations[appName]; ok {
+			associations[userID] = clusterInfo
+		}
+	}
+	return associations
 }
 
 func (u *UserClusterAssociation) GetUserClusterAssociation(userID, appName string) (*ClusterInfo, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
 	userAssociation, userExists := u.Data[userID]
 	if !userExists {
 		return nil, false
@@ -245,14 +220,110 @@ func (u *UserClusterAssociation) GetUserClusterAssociation(userID, appName strin
 	return value, ok
 }
 
+// IsPodAssociated tells if a user of the app is associated to the pod.
+func (u *UserClusterAssociation) IsPodAssociated(appName, podName string) bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	for _, appAssociations := range u.Data {
+		if clusterInfo, ok := appAssociations[appName]; ok && clusterInfo.PodName == podName {
+			return true
+		}
+	}
+	return false
+}
+
 func (u *UserClusterAssociation) RemoveUserClusterAssiciation(userID, appName string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	if userAssociations, ok := u.Data[userID]; ok {
 		delete(userAssociations, appName)
 		u.changed = true
 	}
 }
 
+// MovePodAssociations moves the users of the app associated to fromPod to toPod, on toNode, and
+// returns them, sorted.
+func (u *UserClusterAssociation) MovePodAssociations(appName, fromPod, toNode, toPod string) []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var moved []string
+	for userID, appAssociations := range u.Data {
+		clusterInfo, ok := appAssociations[appName]
+		if !ok || clusterInfo.PodName != fromPod {
+			continue
+		}
+		movedInfo := *clusterInfo
+		movedInfo.ClusterName = toNode
+		movedInfo.PodName = toPod
+		movedInfo.CreatedAt = clock.Now()
+		appAssociations[appName] = &movedInfo
+		u.changed = true
+		moved = append(moved, userID)
+	}
+	sort.Strings(moved)
+	return moved
+}
+
+// Changed tells if the associations changed since they were last published.
+func (u *UserClusterAssociation) Changed() bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.changed
+}
+
+// SetChanged marks the associations as changed (to publish them) or as published.
+func (u *UserClusterAssociation) SetChanged(changed bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.changed = changed
+}
+
+// RemoveAssociationsWhere removes the associations matching stale (to a deleted node or pod) and
+// returns how many.
+func (u *UserClusterAssociation) RemoveAssociationsWhere(stale func(appName string, clusterInfo *ClusterInfo) bool) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	removed := 0
+	for userID, appAssociations := range u.Data {
+		for appName, clusterInfo := range appAssociations {
+			if stale(appName, clusterInfo) {
+				fmt.Printf("Removed stale association: %s - %s (pod %s)\n", userID, clusterInfo.ClusterName, clusterInfo.PodName)
+				delete(appAssociations, appName)
+				removed++
+			}
+		}
+		if len(appAssociations) == 0 {
+			delete(u.Data, userID)
+		}
+	}
+	if removed > 0 {
+		u.changed = true
+	}
+	return removed
+}
+
+// RenewAssociationsWhere restarts the expiration of the associations of the app matching held,
+// replacing them with a copy so the readers of the previous ClusterInfo aren't raced, and returns how many.
+func (u *UserClusterAssociation) RenewAssociationsWhere(appName string, held func(clusterInfo *ClusterInfo) bool) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	renewed := 0
+	for _, appAssociations := range u.Data {
+		clusterInfo, ok := appAssociations[appName]
+		if !ok || !held(clusterInfo) {
+			continue
+		}
+		renewedInfo := *clusterInfo
+		renewedInfo.CreatedAt = clock.Now()
+		appAssociations[appName] = &renewedInfo
+		renewed++
+	}
+	return renewed
+}
+
 func (u *UserClusterAssociation) CleanupAssociationsOlderThan(minutes int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	keysToDelete := make(map[string][]string) // A map of userID to a slice of appNames to delete
 	expirationDuration := time.Duration(minutes) * time.Minute
 
@@ -262,7 +333,7 @@ func (u *UserClusterAssociation) CleanupAssociationsOlderThan(minutes int64) {
 			//clusterMeasureTimestamp := clusterMeasure.createdAt.UnixNano() / int64(time.Millisecond)
 			//fmt.Println("Cluster Measure created at ", clusterMeasure.createdAt, "\tconverted: ", clusterMeasureTimestamp) //debug
 			//fmt.Println("ExpirationTimestamp: ", expirationTimestamp)                                                      //debug
-			if time.Since(clusterMeasure.CreatedAt) > expirationDuration {
+			if clock.Since(clusterMeasure.CreatedAt) > expirationDuration {
 				fmt.Println("Cleaned association: ", userID, " - ", clusterMeasure.ClusterName, "(too old)") //debug
 				if _, ok := keysToDelete[userID]; !ok {
 					keysToDelete[userID] = make([]string, 0)
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// LatencyObjective is what the placement and the associations of an app optimize, once the hard
+// threshold is met; it is selected with the latency_objective annotation of the pods.
+type LatencyObjective string
+
+const (
+	ObjectiveMean      LatencyObjective = "mean"       // minimize the mean latency of the users
+	ObjectiveMinimax   LatencyObjective = "minimax"    // minimize the latency of the worst served user
+	ObjectiveSoftCount LatencyObjective = "soft_count" // maximize the users under the soft threshold
+
+	latencyObjectiveAnnotation = "latency_objective"
+	defaultLatencyObjective    = ObjectiveMean
+)
+
+func parseLatencyObjective(value string) (LatencyObjective, error) {
+	switch objective := LatencyObjective(value); objective {
+	case ObjectiveMean, ObjectiveMinimax, ObjectiveSoftCount:
+		return objective, nil
+	default:
+		return "", fmt.Errorf("unknown latency objective %q (mean, minimax or soft_count)", value)
+	}
+}
+
+// getLatencyObjective returns the objective in the annotations of the pod, or "" if not set.
+func getLatencyObjective(pod *v1.Pod) (LatencyObjective, error) {
+	value, ok := pod.Annotations[latencyObjectiveAnnotation]
+	if !ok {
+		return "", nil
+	}
+	return parseLatencyObjective(value)
+}
+
+type LatencyObjectives struct {
+	data           map[string]LatencyObjective //appName -> objective
+	minimaxAllowed bool                        // minimax is only planned by the global placement
+	sync.RWMutex
+}
+
+func NewLatencyObjectives() *LatencyObjectives {
+	return &LatencyObjectives{
+		data: make(map[string]LatencyObjective),
+	}
+}
+
+// AllowMinimax accepts the minimax objective, with the global placement. The greedy descheduler moves
+// one user at a time to its lowest latency, which is what mean does: it can't trade the latency of the
+// other users for the worst one.
+func (lo *LatencyObjectives) AllowMinimax() {
+	lo.Lock()
+	defer lo.Unlock()
+	lo.minimaxAllowed = true
+}
+
+// SetObjective sets the objective of the app, unless it is minimax without the global placement.
+func (lo *LatencyObjectives) SetObjective(appName string, objective LatencyObjective) error {
+	lo.Lock()
+	defer lo.Unlock()
+	if objective == ObjectiveMinimax && !lo.minimaxAllowed {
+		return fmt.Errorf("objective %s of app %s needs --placement global", objective, appName)
+	}
+	lo.data[appName] = objective
+	return nil
+}
+
+func (lo *LatencyObjectives) RemoveObjective(appName string) {
+	lo.Lock()
+	defer lo.Unlock()
+	delete(lo.data, appName)
+}
+
+// GetObjective returns the objective of the app, or the default one.
+func (lo *LatencyObjectives) GetObjective(appName string) LatencyObjective {
+	lo.RLock()
+	defer lo.RUnlock()
+	if objective, ok := lo.data[appName]; ok {
+		return objective
+	}
+	return defaultLatencyObjective
+}
+
+func (lo *LatencyObjectives) IsSet(appName string) bool {
+	lo.RLock()
+	defer lo.RUnlock()
+	_, ok := lo.data[appName]
+	return ok
+}
+
+// GetAll returns a copy of the objectives.
+func (lo *LatencyObjectives) GetAll() map[string]LatencyObjective {
+	lo.RLock()
+	defer lo.RUnlock()
+	objectives := make(map[string]LatencyObjective, len(lo.data))
+	for appName, objective := range lo.data {
+		objectives[appName] = objective
+	}
+	return objectives
+}
+
+// replacesAssociation tells whether a user associated to current should move to a node measured
+// at latency (isSoft: within the soft threshold). With soft_count a user within the soft threshold
+// is not moved, since it would not increase the users under it; otherwise the lower latency wins.
+func (objective LatencyObjective) replacesAssociation(current *ClusterInfo, latency int64, isSoft bool) bool {
+	if objective == ObjectiveSoftCount && current.HasSoftConstraint != isSoft {
+		return isSoft
+	}
+	if objective == ObjectiveSoftCount && current.HasSoftConstraint {
+		return false
+	}
+	return current.Latency > latency
+}
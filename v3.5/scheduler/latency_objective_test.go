@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetLatencyObjective(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        LatencyObjective
+		wantErr     bool
+	}{
+		{"not set", nil, "", false},
+		{"mean", map[string]string{latencyObjectiveAnnotation: "mean"}, ObjectiveMean, false},
+		{"minimax", map[string]string{latencyObjectiveAnnotation: "minimax"}, ObjectiveMinimax, false},
+		{"soft count", map[string]string{latencyObjectiveAnnotation: "soft_count"}, ObjectiveSoftCount, false},
+		{"unknown", map[string]string{latencyObjectiveAnnotation: "median"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objective, err := getLatencyObjective(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}})
+			if (err != nil) != tt.wantErr || objective != tt.want {
+				t.Errorf("got %q, %v, want %q (error %v)", objective, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLatencyObjectives(t *testing.T) {
+	objectives := NewLatencyObjectives()
+	if objectives.GetObjective("a") != defaultLatencyObjective || objectives.IsSet("a") {
+		t.Errorf("unset objective %q", objectives.GetObjective("a"))
+	}
+	objectives.AllowMinimax()
+	objectives.SetObjective("a", ObjectiveMinimax)
+	if objectives.GetObjective("a") != ObjectiveMinimax || !objectives.IsSet("a") || len(objectives.GetAll()) != 1 {
+		t.Errorf("objectives %v, want a minimax", objectives.GetAll())
+	}
+	objectives.RemoveObjective("a")
+	if objectives.IsSet("a") || len(objectives.GetAll()) != 0 {
+		t.Errorf("objectives %v after the removal", objectives.GetAll())
+	}
+}
+
+func TestSetObjective(t *testing.T) {
+	tests := []struct {
+		name      string
+		objective LatencyObjective
+		global    bool
+		want      LatencyObjective
+		wantErr   bool
+	}{
+		{"mean", ObjectiveMean, false, ObjectiveMean, false},
+		{"soft count", ObjectiveSoftCount, false, ObjectiveSoftCount, false},
+		{"minimax rejected with the greedy placement", ObjectiveMinimax, false, defaultLatencyObjective, true},
+		{"minimax with the global placement", ObjectiveMinimax, true, ObjectiveMinimax, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDescheduler()
+			if tt.global {
+				d.EnableGlobalPlacement(0)
+			}
+			err := d.objectives.SetObjective("a", tt.objective)
+			if (err != nil) != tt.wantErr || d.objectives.GetObjective("a") != tt.want {
+				t.Errorf("got %q, %v, want %q (error %v)", d.objectives.GetObjective("a"), err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReplacesAssociation(t *testing.T) {
+	tests := []struct {
+		name      string
+		objective LatencyObjective
+		current   ClusterInfo
+		latency   int64
+		isSoft    bool
+		want      bool
+	}{
+		{"mean: lower latency", ObjectiveMean, ClusterInfo{Latency: 40}, 30, false, true},
+		{"mean: higher latency", ObjectiveMean, ClusterInfo{Latency: 40}, 50, true, false},
+		{"mean: same latency", ObjectiveMean, ClusterInfo{Latency: 40}, 40, false, false},
+		{"minimax: lower latency", ObjectiveMinimax, ClusterInfo{Latency: 40, HasSoftConstraint: true}, 30, false, true},
+		{"soft count: into the soft threshold", ObjectiveSoftCount, ClusterInfo{Latency: 30}, 35, true, true},
+		{"soft count: out of the soft threshold", ObjectiveSoftCount, ClusterInfo{Latency: 30, HasSoftConstraint: true}, 10, false, false},
+		{"soft count: already within", ObjectiveSoftCount, ClusterInfo{Latency: 30, HasSoftConstraint: true}, 10, true, false},
+		{"soft count: both above, lower latency", ObjectiveSoftCount, ClusterInfo{Latency: 80}, 60, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.objective.replacesAssociation(&tt.current, tt.latency, tt.isSoft); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// AppLatencyStats summarizes, for an app, how well its users are served.
+type AppLatencyStats struct {
+	Users         int
+	UnservedUsers int     // users without an association to a valid node
+	UnservedRatio float64 // UnservedUsers / Users
+	P95LatencyMs  int64   // 95th percentile of the best latency of each user
+	MaxLatencyMs  int64   // latency of the worst served user
+	MeanLatencyMs float64
+	ComputedAt    time.Time
+}
+
+// LatencyStatsStore holds the stats computed at the end of every descheduler cycle,
+// so they can be read concurrently (e.g. by the external metrics API).
+type LatencyStatsStore struct {
+	sync.RWMutex
+	data map[string]*AppLatencyStats // appName -> stats
+}
+
+func NewLatencyStatsStore() *LatencyStatsStore {
+	return &LatencyStatsStore{
+		data: make(map[string]*AppLatencyStats),
+	}
+}
+
+func (s *LatencyStatsStore) Set(data map[string]*AppLatencyStats) {
+	s.Lock()
+	defer s.Unlock()
+	s.data = data
+}
+
+func (s *LatencyStatsStore) Get() map[string]*AppLatencyStats {
+	s.RLock()
+	defer s.RUnlock()
+	return s.data
+}
+
+// computeAppLatencyStats uses the latency of the association as the latency of a user,
+// and the best measured node for the users without association.
+func computeAppLatencyStats(measurements map[string]map[string]map[string]*LatencyMeasurement, associations *UserClusterAssociation) map[string]*AppLatencyStats {
+	stats := make(map[string]*AppLatencyStats)
+	for appName, userMeasurements := range measurements {
+		var latencies []int64
+		appStats := &AppLatencyStats{ComputedAt: clock.Now()}
+		for userID, nodeMeasurements := range userMeasurements {
+			if len(nodeMeasurements) == 0 {
+				continue
+			}
+			appStats.Users++
+			if association, ok := associations.GetUserClusterAssociation(userID, appName); ok {
+				latencies = append(latencies, association.Latency)
+				continue
+			}
+			appStats.UnservedUsers++
+			best := int64(-1)
+			for _, measurement := range nodeMeasurements {
+				if best == -1 || measurement.Measurement < best {
+					best = measurement.Measurement
+				}
+			}
+			latencies = append(latencies, best)
+		}
+		if appStats.Users == 0 {
+			continue
+		}
+		appStats.UnservedRatio = float64(appStats.UnservedUsers) / float64(appStats.Users)
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		appStats.P95LatencyMs = latencies[(len(latencies)*95+99)/100-1]
+		appStats.MaxLatencyMs = latencies[len(latencies)-1]
+		var sum int64
+		for _, latency := range latencies {
+			sum += latency
+		}
+		appStats.MeanLatencyMs = float64(sum) / float64(len(latencies))
+		stats[appName] = appStats
+	}
+	return stats
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestComputeAppLatencyStats(t *testing.T) {
+	tests := []struct {
+		name         string
+		measurements map[string]map[string]int64 // userID -> nodeName -> latency of app a
+		associations map[string]int64            // userID -> latency of the association
+		want         *AppLatencyStats            // nil if the app has no stats
+	}{
+		{
+			name:         "associated users",
+			measurements: map[string]map[string]int64{"u1": {"n1": 30}, "u2": {"n1": 50}},
+			associations: map[string]int64{"u1": 20, "u2": 40},
+			want:         &AppLatencyStats{Users: 2, P95LatencyMs: 40, MaxLatencyMs: 40, MeanLatencyMs: 30},
+		},
+		{
+			name:         "unserved users at their best node",
+			measurements: map[string]map[string]int64{"u1": {"n1": 30}, "u2": {"n1": 90, "n2": 60}},
+			associations: map[string]int64{"u1": 30},
+			want:         &AppLatencyStats{Users: 2, UnservedUsers: 1, UnservedRatio: 0.5, P95LatencyMs: 60, MaxLatencyMs: 60, MeanLatencyMs: 45},
+		},
+		{
+			name:         "users without measurements not counted",
+			measurements: map[string]map[string]int64{"u1": {"n1": 30}, "u2": {}},
+			want:         &AppLatencyStats{Users: 1, UnservedUsers: 1, UnservedRatio: 1, P95LatencyMs: 30, MaxLatencyMs: 30, MeanLatencyMs: 30},
+		},
+		{
+			name:         "no user",
+			measurements: map[string]map[string]int64{"u1": {}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			measurements := map[string]map[string]map[string]*LatencyMeasurement{"a": {}}
+			for userID, nodes := range tt.measurements {
+				measurements["a"][userID] = make(map[string]*LatencyMeasurement)
+				for nodeName, latency := range nodes {
+					measurements["a"][userID][nodeName] = &LatencyMeasurement{Measurement: latency}
+				}
+			}
+			associations := NewUserClusterAssociation()
+			for userID, latency := range tt.associations {
+				associations.RestoreAssociation(userID, "a", &ClusterInfo{ClusterName: "n1", PodName: "a-1", Latency: latency})
+			}
+			stats, ok := computeAppLatencyStats(measurements, associations)["a"]
+			if tt.want == nil {
+				if ok {
+					t.Errorf("got stats %+v", stats)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("no stats")
+			}
+			stats.ComputedAt = tt.want.ComputedAt
+			if *stats != *tt.want {
+				t.Errorf("got %+v, want %+v", stats, tt.want)
+			}
+		})
+	}
+}
+
+func TestComputeAppLatencyStatsPercentile(t *testing.T) {
+	tests := []struct {
+		users int
+		p95   int64
+	}{
+		{1, 1},
+		{19, 19},
+		{20, 19},
+		{100, 95},
+		{101, 96},
+	}
+	for _, tt := range tests {
+		measurements := map[string]map[string]map[string]*LatencyMeasurement{"a": {}}
+		for i := 1; i <= tt.users; i++ {
+			measurements["a"]["u"+strconv.Itoa(i)] = map[string]*LatencyMeasurement{"n1": {Measurement: int64(i)}}
+		}
+		stats := computeAppLatencyStats(measurements, NewUserClusterAssociation())["a"]
+		if stats.P95LatencyMs != tt.p95 || stats.MaxLatencyMs != int64(tt.users) {
+			t.Errorf("%d users: p95 %d and max %d, want %d and %d", tt.users, stats.P95LatencyMs, stats.MaxLatencyMs, tt.p95, tt.users)
+		}
+	}
+}
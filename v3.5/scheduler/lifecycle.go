@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// EnableLifecycleInformers watches the nodes and the pods, so the measurements and the associations
+// of a deleted node or pod are pruned as soon as no cycle runs, before anything is decided on them,
+// and the routing managers stop sending users to a pod that is gone. The number of worker nodes
+// follows the informer.
+func (d *Descheduler) EnableLifecycleInformers(scheduler *CustomScheduler) {
+	d.lifecycleInformers = true
+	d.scheduler = scheduler
+}
+
+// runLifecycleInformers is started by Run once the state is restored.
+func (d *Descheduler) runLifecycleInformers(stopCh <-chan struct{}) {
+	var nodeStore cache.Store
+	nodeStore, nodeController := cache.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return d.clientset.CoreV1().Nodes().List(context.TODO(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return d.clientset.CoreV1().Nodes().Watch(context.TODO(), options)
+			},
+		},
+		&v1.Node{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { d.countWorkerNodes(nodeStore) },
+			UpdateFunc: func(oldObj, newObj interface{}) { d.countWorkerNodes(nodeStore) },
+			DeleteFunc: func(obj interface{}) {
+				if node, ok := deletedObject(obj).(*v1.Node); ok {
+					d.queuePrune(lifecyclePrune{nodeName: node.Name})
+				}
+				d.countWorkerNodes(nodeStore)
+			},
+		},
+	)
+	_, podController := cache.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = "app"
+				return d.clientset.CoreV1().Pods(v1.NamespaceAll).List(context.TODO(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.LabelSelector = "app"
+				return d.clientset.CoreV1().Pods(v1.NamespaceAll).Watch(context.TODO(), options)
+			},
+		},
+		&v1.Pod{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			UpdateFunc: d.podUpdated,
+			DeleteFunc: func(obj interface{}) {
+				if pod, ok := deletedObject(obj).(*v1.Pod); ok {
+					d.queuePrune(lifecyclePrune{pod: pod})
+				}
+			},
+		},
+	)
+	go nodeController.Run(stopCh)
+	go podController.Run(stopCh)
+	go d.pruneBetweenCycles(stopCh)
+}
+
+// podUpdated queues the prune of a pod once, when it starts terminating or finishes.
+func (d *Descheduler) podUpdated(oldObj, newObj interface{}) {
+	if oldPod, pod := oldObj.(*v1.Pod), newObj.(*v1.Pod); !podGone(oldPod) && podGone(pod) {
+		d.queuePrune(lifecyclePrune{pod: pod})
+	}
+}
+
+// podGone tells if the pod is terminating or finished, so no user can be sent to it.
+func podGone(pod *v1.Pod) bool {
+	return pod.DeletionTimestamp != nil || pod.Status.Phase == v1.PodFailed || pod.Status.Phase == v1.PodSucceeded
+}
+
+// deletedObject unwraps the last known state of an object whose deletion was missed by the watch.
+func deletedObject(obj interface{}) interface{} {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
+	}
+	return obj
+}
+
+// countWorkerNodes updates the number of nodes that can run the pods of the apps.
+func (d *Descheduler) countWorkerNodes(nodeStore cache.Store) {
+	workers := int64(0)
+	for _, obj := range nodeStore.List() {
+		if _, ok := obj.(*v1.Node).Labels["node-role.kubernetes.io/control-plane"]; !ok {
+			workers++
+		}
+	}
+	if previous := atomic.SwapInt64(&d.workerNodes, workers); previous != workers {
+		fmt.Printf("Worker nodes: %d -> %d\n", previous, workers)
+	}
+}
+
+// lifecyclePrune is a deleted node (nodeName) or a pod that is terminating or gone, seen by the
+// informers and pruned between the cycles.
+type lifecyclePrune struct {
+	nodeName string
+	pod      *v1.Pod
+}
+
+// queuePrune keeps the prune for pruneBetweenCycles, so the informers never wait for the running cycle.
+func (d *Descheduler) queuePrune(prune lifecyclePrune) {
+	d.pruneMutex.Lock()
+	d.pendingPrunes = append(d.pendingPrunes, prune)
+	d.pruneMutex.Unlock()
+	select {
+	case d.pruneSignal <- struct{}{}:
+	default: // already signaled
+	}
+}
+
+// pruneBetweenCycles applies the queued prunes as soon as no cycle runs, and publishes the
+// associations they remove, instead of waiting for the next cycle.
+func (d *Descheduler) pruneBetweenCycles(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-d.pruneSignal:
+		}
+		d.cycleMutex.Lock()
+		d.applyPrunes()
+		d.publishSnapshot()
+		d.cycleMutex.Unlock()
+	}
+}
+
+// applyPrunes prunes the nodes and pods queued by the informers; it is called under cycleMutex, by
+// pruneBetweenCycles and by the cycle before it decides anything.
+func (d *Descheduler) applyPrunes() {
+	d.pruneMutex.Lock()
+	prunes := d.pendingPrunes
+	d.pendingPrunes = nil
+	d.pruneMutex.Unlock()
+	for _, prune := range prunes {
+		if prune.pod != nil {
+			d.prunePod(prune.pod)
+		} else {
+			d.pruneNode(prune.nodeName)
+		}
+	}
+}
+
+// pruneNode forgets a deleted node: its measurements, the associations to its pods and the visits of
+// the scheduler, so the node is neither chosen nor waited for.
+func (d *Descheduler) pruneNode(nodeName string) {
+	onNode := func(node string, _ *LatencyMeasurement) bool { return node == nodeName }
+	pruned := d.latencyMeasurements.DeleteWhere(onNode)
+	for _, measurements := range []*LatencyMeasurements{d.invalidNodes, d.hardValidNodes, d.softValidNodes} {
+		measurements.DeleteWhere(onNode)
+	}
+	removed := d.user_Cluster.RemoveAssociationsWhere(func(_ string, clusterInfo *ClusterInfo) bool {
+		return clusterInfo.ClusterName == nodeName
+	})
+	for _, nodePods := range d.appPods {
+		delete(nodePods, nodeName)
+	}
+	if d.explorer != nil {
+		d.explorer.forgetNode(nodeName)
+	}
+	userLatency.DeletePartialMatch(prometheus.Labels{"node": nodeName})
+	worstUserLatency.DeletePartialMatch(prometheus.Labels{"node": nodeName})
+	nodeScores.DeletePartialMatch(prometheus.Labels{"node": nodeName})
+	if d.scheduler != nil {
+		d.mutex.Lock()
+		for _, visitedNodes := range d.scheduler.visitedNodesPerApp {
+			delete(visitedNodes, nodeName)
+		}
+		d.mutex.Unlock()
+	}
+	fmt.Printf("Node %s deleted: pruned %d measurements and %d associations\n", nodeName, pruned, removed)
+	if removed > 0 {
+		d.updateAssociationMetrics()
+		d.publishAssociations()
+	}
+}
+
+// prunePod forgets a pod that is terminating or gone: the users associated to it are sent back to
+// the other pods by the routing managers, and are associated again at the next cycle.
+func (d *Descheduler) prunePod(pod *v1.Pod) {
+	appName := pod.Labels["app"]
+	ofPod := func(_ string, measurement *LatencyMeasurement) bool { return measurement.PodName == pod.Name }
+	pruned := d.latencyMeasurements.DeleteWhere(ofPod)
+	for _, measurements := range []*LatencyMeasurements{d.invalidNodes, d.hardValidNodes, d.softValidNodes} {
+		measurements.DeleteWhere(ofPod)
+	}
+	removed := d.user_Cluster.RemoveAssociationsWhere(func(app string, clusterInfo *ClusterInfo) bool {
+		return app == appName && clusterInfo.PodName == pod.Name
+	})
+	if nodePods, ok := d.appPods[appName]; ok && pod.Spec.NodeName != "" {
+		nodePods[pod.Spec.NodeName] = withoutPod(nodePods[pod.Spec.NodeName], pod.Name)
+	}
+	if pruned == 0 && removed == 0 {
+		return
+	}
+	fmt.Printf("Pod %s of app %s removed: pruned %d measurements and %d associations\n", pod.Name, appName, pruned, removed)
+	if removed > 0 {
+		d.updateAssociationMetrics()
+		d.publishAssociations()
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLifecyclePrunes(t *testing.T) {
+	deleting := testPod("a", "a-1", "n1", nil)
+	deleting.Status.Phase = v1.PodSucceeded
+	tests := []struct {
+		name         string
+		prune        lifecyclePrune
+		measurements int      // left for u1 after the cycle
+		associated   bool     // u1 still associated to a-1
+		n1Pods       []string // pods of app a left on n1
+	}{
+		{"node deleted", lifecyclePrune{nodeName: "n1"}, 1, false, nil},
+		{"pod gone", lifecyclePrune{pod: deleting}, 1, false, []string{"a-2"}},
+		{"other node deleted", lifecyclePrune{nodeName: "n3"}, 2, true, []string{"a-1", "a-2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDescheduler()
+			d.latencyMeasurements.UpdateMeasurements(map[string]map[string]map[string]*LatencyMeasurement{"a": {"u1": {
+				"n1": {PodName: "a-1", Measurement: 20, Timestamp: time.Now()},
+				"n2": {PodName: "a-3", Measurement: 30, Timestamp: time.Now()},
+			}}})
+			d.user_Cluster.RestoreAssociation("u1", "a", &ClusterInfo{ClusterName: "n1", PodName: "a-1"})
+			d.appPods["a"] = map[string][]string{"n1": {"a-1", "a-2"}, "n2": {"a-3"}}
+
+			d.queuePrune(tt.prune)
+			if _, ok := d.user_Cluster.GetUserClusterAssociation("u1", "a"); !ok {
+				t.Fatal("pruned before the cycle")
+			}
+			d.applyPrunes()
+
+			if got := len(d.latencyMeasurements.GetMeasurements()["a"]["u1"]); got != tt.measurements {
+				t.Errorf("%d measurements left, want %d", got, tt.measurements)
+			}
+			if _, ok := d.user_Cluster.GetUserClusterAssociation("u1", "a"); ok != tt.associated {
+				t.Errorf("associated %v, want %v", ok, tt.associated)
+			}
+			if got := d.appPods["a"]["n1"]; len(got) != len(tt.n1Pods) {
+				t.Errorf("pods on n1 %v, want %v", got, tt.n1Pods)
+			}
+			if len(d.pendingPrunes) != 0 {
+				t.Errorf("%d prunes left in the queue", len(d.pendingPrunes))
+			}
+		})
+	}
+}
+
+// TestQueuePruneDuringCycle queues a prune while a cycle runs: the informer doesn't wait for it.
+func TestQueuePruneDuringCycle(t *testing.T) {
+	d, _ := newTestDescheduler()
+	d.cycleMutex.Lock()
+	defer d.cycleMutex.Unlock()
+	done := make(chan struct{})
+	go func() {
+		d.queuePrune(lifecyclePrune{nodeName: "n1"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("prune blocked by the cycle")
+	}
+}
+
+// TestPruneBetweenCycles prunes a pod without waiting for the next cycle, once the running one ends.
+func TestPruneBetweenCycles(t *testing.T) {
+	d, _ := newTestDescheduler()
+	d.user_Cluster.RestoreAssociation("u1", "a", &ClusterInfo{ClusterName: "n1", PodName: "a-1"})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go d.pruneBetweenCycles(stopCh)
+
+	d.cycleMutex.Lock()
+	d.queuePrune(lifecyclePrune{pod: testPod("a", "a-1", "n1", nil)})
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := d.user_Cluster.GetUserClusterAssociation("u1", "a"); !ok {
+		t.Fatal("pruned during the cycle")
+	}
+	d.cycleMutex.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, associated := d.user_Cluster.GetUserClusterAssociation("u1", "a")
+		_, snapshotted := d.lastSnapshot().associations["u1"]["a"]
+		if !associated && !snapshotted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("association still there (snapshot: %v) after the cycle", snapshotted)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if d.user_Cluster.Changed() {
+		t.Error("removed association not published")
+	}
+}
+
+func TestPodUpdated(t *testing.T) {
+	running := testPod("a", "a-1", "n1", nil)
+	terminating := running.DeepCopy()
+	terminating.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	relabeled := terminating.DeepCopy()
+	relabeled.Labels["version"] = "2"
+	failed := running.DeepCopy()
+	failed.Status.Phase = v1.PodFailed
+	tests := []struct {
+		name     string
+		old, new *v1.Pod
+		queued   int
+	}{
+		{"starts terminating", running, terminating, 1},
+		{"update of a terminating pod", terminating, relabeled, 0},
+		{"failed", running, failed, 1},
+		{"failed pod deleted", failed, terminating, 0},
+		{"running pod updated", running, running.DeepCopy(), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDescheduler()
+			d.podUpdated(tt.old, tt.new)
+			if len(d.pendingPrunes) != tt.queued {
+				t.Errorf("%d prunes queued, want %d", len(d.pendingPrunes), tt.queued)
+			}
+		})
+	}
+}
@@ -3,10 +3,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
+	"scheduler/shared/controltls"
+	"scheduler/shared/tokenauth"
 )
 
 type PauseSignal struct {
@@ -17,9 +21,101 @@ type PauseSignal struct {
 func main() {
 	fmt.Println("Starting custom scheduler...")
 	var kubeconfigPath string
+	var associationsNamespace string
+	var routingManagerAddress string
+	var tokenFile string
+	var meterControlPort int
+	var meterSelector, controlCAFile, controlServerName string
+	var metricsAddress string
+	var externalMetricsAddress, tlsCertFile, tlsKeyFile string
+	var disableAutoscaling bool
+	var stateConfigMap string
+	var placement string
+	var maxReplicas int
+	var evictionMode, migrationsConfigMap string
+	var drainTimeout time.Duration
+	var adminAddress, adminAllowedUsers string
+	var exploration string
+	var explorationBudget int
+	var cohorts bool
+	var cohortPrefixV4, cohortPrefixV6 int
+	var cohortRegionsFile, cohortOverrides string
+	var maxUsersPerApp, metricsTopUsers int
+	var minPodBenefit int64
+	var simulate, simVerbose bool
+	var simTrace string
+	var simNodes, simUsers int
+	var simDuration time.Duration
+	var simSeed, simJitter int64
 	flag.StringVar(&kubeconfigPath, "kubeconfig", "", "Path to the kubeconfig file")
+	flag.StringVar(&associationsNamespace, "associations-namespace", "routing", "Namespace of the ConfigMaps where the user-cluster associations are published")
+	flag.StringVar(&routingManagerAddress, "routing-manager-address", "", "Address (host:port) of the routing manager control endpoint to also push the associations to (legacy, disabled if empty)")
+	flag.StringVar(&tokenFile, "token-file", defaultTokenFile, "Projected ServiceAccount token (audience "+tokenauth.DefaultAudience+") used to authenticate to the control endpoints of the latency meters and routing manager")
+	flag.IntVar(&meterControlPort, "meter-control-port", 8081, "Port of the latency meter control endpoints")
+	flag.StringVar(&meterSelector, "meter-selector", defaultMeterSelector, "Label selector of the pods with a latency meter, the only ones contacted for the measurements")
+	flag.StringVar(&controlCAFile, "control-ca-file", "", "CA certificates verifying the control endpoints of the latency meters and routing manager (encrypted but not verified if empty)")
+	flag.StringVar(&controlServerName, "control-server-name", controltls.DefaultServerName, "Name in the certificates of the control endpoints, verified with --control-ca-file")
+	flag.StringVar(&metricsAddress, "metrics-address", ":10260", "Address where the Prometheus metrics are served")
+	flag.StringVar(&externalMetricsAddress, "external-metrics-address", ":10261", "Address where the external.metrics.k8s.io API is served (disabled if empty)")
+	flag.StringVar(&tlsCertFile, "tls-cert-file", "", "Certificate of the external metrics and admin APIs (self-signed if empty)")
+	flag.StringVar(&tlsKeyFile, "tls-private-key-file", "", "Private key of the external metrics and admin APIs")
+	flag.BoolVar(&disableAutoscaling, "disable-autoscaling", false, "Don't change the replicas of the apps, leaving them to HorizontalPodAutoscalers")
+	flag.StringVar(&stateConfigMap, "state-configmap", "kube-system/latency-aware-scheduler-state", "ConfigMap (namespace/name) where the state is checkpointed and restored from at startup (disabled if empty)")
+	flag.StringVar(&placement, "placement", "greedy", "Descheduling strategy: greedy (per user) or global (placement planned on the whole latency matrix of every app)")
+	flag.IntVar(&maxReplicas, "max-replicas", 0, "Replica budget of every app with the global placement (0: one per worker node)")
+	flag.StringVar(&evictionMode, "eviction-mode", "delete", "How the descheduler moves pods: delete, or migrate (make-before-break: the replacement is created and serving before the pod is evicted)")
+	flag.StringVar(&migrationsConfigMap, "migrations-configmap", "kube-system/latency-aware-scheduler-migrations", "ConfigMap (namespace/name) where the migrations and their status are kept, with --eviction-mode migrate")
+	flag.DurationVar(&drainTimeout, "drain-timeout", time.Minute, "Time the routing managers have to drain a pod before it is evicted (0: evict without draining)")
+	flag.StringVar(&adminAddress, "admin-address", ":10262", "Address where the admin API is served, with the certificate of the external metrics API (disabled if empty)")
+	flag.StringVar(&adminAllowedUsers, "admin-allowed-users", "", "Identities (comma separated) authorized to use the admin API, authenticated with their Kubernetes token (the admin API is disabled if empty)")
+	flag.StringVar(&exploration, "exploration", "none", "Exploration policy of the nodes not measured enough by the users: none (round-robin of the scheduler only), epsilon-greedy, ucb or thompson")
+	flag.IntVar(&explorationBudget, "exploration-budget", 2, "Probe replicas per app per hour placed by the exploration (overridden by the latency-aware-scheduler/exploration-budget annotation of the Deployment)")
+	flag.BoolVar(&cohorts, "cohorts", false, "Group the users by the network of their IP (or by region), so the thresholds, placement and routing apply to the cohorts")
+	flag.IntVar(&cohortPrefixV4, "cohort-prefix-v4", 24, "Prefix length of the IPv4 networks of the cohorts")
+	flag.IntVar(&cohortPrefixV6, "cohort-prefix-v6", 48, "Prefix length of the IPv6 networks of the cohorts")
+	flag.StringVar(&cohortRegionsFile, "cohort-regions-file", "", "JSON file mapping networks to regions, e.g. [{\"cidr\": \"10.1.0.0/16\", \"region\": \"eu-west\"}]; the users of a region form one cohort")
+	flag.StringVar(&cohortOverrides, "cohort-overrides", "", "User IDs (comma separated) kept out of the cohorts, with their own measurements and association")
+	flag.IntVar(&maxUsersPerApp, "max-users-per-app", 0, "Users per app kept in the measurement store, the least recently measured are evicted beyond (0: unlimited)")
+	flag.IntVar(&metricsTopUsers, "metrics-top-users", defaultMetricsTopUsers, "Users per app with the worst latency exposed with their own series in the metrics (0: none)")
+	flag.Int64Var(&minPodBenefit, "min-pod-benefit", 0, "Benefit (ms of margin to the threshold, or saved, summed over the users that would move to it) above which a pod on a node bad for a user is kept")
+	flag.BoolVar(&simulate, "simulate", false, "Run the offline simulator instead of the scheduler")
+	flag.StringVar(&simTrace, "sim-trace", "", "JSON latency trace replayed by the simulator (generated if empty)")
+	flag.IntVar(&simNodes, "sim-nodes", 4, "Worker nodes of the generated trace")
+	flag.IntVar(&simUsers, "sim-users", 10, "Users of the generated trace")
+	flag.DurationVar(&simDuration, "sim-duration", 30*time.Minute, "Simulated time")
+	flag.Int64Var(&simSeed, "sim-seed", 1, "Seed of the simulation")
+	flag.Int64Var(&simJitter, "sim-jitter", 2, "Maximum jitter (ms) added to every simulated measurement")
+	flag.BoolVar(&simVerbose, "sim-verbose", false, "Print the logs of the scheduler and descheduler during the simulation")
 	flag.Parse()
 
+	if placement != "greedy" && placement != "global" {
+		fmt.Println("placement must be greedy or global")
+		return
+	}
+	if evictionMode != "delete" && evictionMode != "migrate" {
+		fmt.Println("eviction-mode must be delete or migrate")
+		return
+	}
+
+	var explorer *Explorer
+	if exploration != string(explorationNone) {
+		seed := time.Now().UnixNano()
+		if simulate {
+			seed = simSeed // reproducible
+		}
+		var err error
+		explorer, err = NewExplorer(ExplorationPolicy(exploration), explorationBudget, seed)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	if simulate {
+		runSimulation(simTrace, simNodes, simUsers, simDuration, simSeed, simJitter, simVerbose, placement == "global", maxReplicas, evictionMode == "migrate", explorer)
+		return
+	}
+
 	if kubeconfigPath == "" {
 		fmt.Println("kubeconfig path must be specified")
 		return
@@ -39,12 +135,86 @@ func main() {
 
 	mutex := &sync.Mutex{}
 	//pastMeasurements := make(map[string]map[string]int64) //appName -> nodeName -> latency
-	//pauseDescheduler := make(chan PauseSignal)
+	pauseDescheduler := make(chan PauseSignal)
 	hardLatencyThresholds := NewLatencyThreshold()
 	softLatencyThresholds := NewLatencyThreshold()
-	customScheduler := NewCustomScheduler(clientset /*pauseDescheduler,*/, mutex, hardLatencyThresholds, softLatencyThresholds)
+	objectives := NewLatencyObjectives()
+	customScheduler := NewCustomScheduler(clientset, mutex, hardLatencyThresholds, softLatencyThresholds, objectives)
 	latencyMeasurements := NewLatencyMeasurements()
-	descheduler := NewDescheduler(clientset, mutex, latencyMeasurements /*pauseDescheduler,*/, hardLatencyThresholds, softLatencyThresholds)
+	latencyMeasurements.SetMaxUsersPerApp(maxUsersPerApp)
+	associationPublisher := NewAssociationPublisher(clientset, associationsNamespace)
+	controlTLSConfig, err := controltls.ClientConfig(controlCAFile, controlServerName)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if controlCAFile == "" {
+		fmt.Println("The certificates of the control endpoints aren't verified: set --control-ca-file")
+	}
+	descheduler := NewDescheduler(clientset, mutex, latencyMeasurements, hardLatencyThresholds, softLatencyThresholds, objectives, associationPublisher, routingManagerAddress, NewControlClient(tokenFile, controlTLSConfig), meterControlPort, disableAutoscaling)
+	descheduler.SetMeterSelector(meterSelector)
+	descheduler.SetMetricsTopUsers(metricsTopUsers)
+	descheduler.SetMinPodBenefit(minPodBenefit)
+
+	if stateConfigMap != "" {
+		namespace, name, ok := strings.Cut(stateConfigMap, "/")
+		if !ok {
+			fmt.Println("state-configmap must be in the form namespace/name")
+			return
+		}
+		descheduler.EnableStateCheckpoints(NewStateStore(clientset, namespace, name), customScheduler)
+	}
+
+	if placement == "global" {
+		descheduler.EnableGlobalPlacement(maxReplicas)
+	}
+
+	if drainTimeout > 0 {
+		descheduler.EnableDraining(drainTimeout)
+	}
+
+	if evictionMode == "migrate" {
+		namespace, name, ok := strings.Cut(migrationsConfigMap, "/")
+		if !ok {
+			fmt.Println("migrations-configmap must be in the form namespace/name")
+			return
+		}
+		descheduler.EnableMigrations(NewMigrationStore(clientset, namespace, name))
+	}
+
+	descheduler.EnablePauseSignals(pauseDescheduler)
+	descheduler.EnableLifecycleInformers(customScheduler)
+	if cohorts {
+		var overrides []string
+		for _, userID := range strings.Split(cohortOverrides, ",") {
+			if userID = strings.TrimSpace(userID); userID != "" {
+				overrides = append(overrides, userID)
+			}
+		}
+		config, err := NewCohortConfig(cohortPrefixV4, cohortPrefixV6, cohortRegionsFile, overrides)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if err := descheduler.EnableCohorts(config); err != nil {
+			fmt.Println("Error enabling the cohorts:", err)
+			return
+		}
+	}
+	if explorer != nil {
+		descheduler.EnableExploration(explorer)
+	}
+
+	registerQueueDepth(customScheduler)
+	go serveMetrics(metricsAddress)
+	if externalMetricsAddress != "" {
+		go NewExternalMetricsServer(descheduler.stats, checkInterval).Serve(externalMetricsAddress, tlsCertFile, tlsKeyFile)
+	}
+	if adminAddress != "" && adminAllowedUsers != "" {
+		go NewAdminServer(descheduler, customScheduler, pauseDescheduler, tokenauth.New(clientset, tokenauth.AllowedUsers(adminAllowedUsers))).Serve(adminAddress, tlsCertFile, tlsKeyFile)
+	} else if adminAddress != "" {
+		fmt.Println("Admin API disabled: nobody is authorized with --admin-allowed-users")
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(2) // Aggiungi 2 al wait group per attendere entrambe le goroutine
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"container/heap"
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// measurementShards spreads the users over independent locks, so the scrapes, the descheduling cycle
+// and the admin API don't wait on each other.
+const measurementShards = 64
+
+// LatencyMeasurements stores the last measurement of every user on every node, appName -> userID ->
+// nodeName. The users are sharded by app and user; the readers get copies of the maps, which they
+// can keep and iterate without a lock. The measurements themselves are shared with the copies and
+// must not be modified once added.
+//
+// The measurements expire through a heap of their timestamps, so a cleanup only visits the expired
+// ones, and with a cap on the users of an app the least recently measured user is evicted.
+type LatencyMeasurements struct {
+	shards         [measurementShards]measurementShard
+	maxUsersPerApp int          // 0: unbounded
+	users          sync.Map     // appName -> *atomic.Int64, users of the app over all the shards
+	tick           atomic.Int64 // orders the measurements of the users over all the shards, for the LRU
+}
+
+type measurementShard struct {
+	sync.RWMutex
+	apps    map[string]map[string]*userMeasurements // appName -> userID -> measurements
+	lru     map[string]*list.List                   // appName -> *userMeasurements, least recently measured first
+	expiry  expiryHeap
+	size    int              // measurements in the shard; the stale items of expiry are dropped when it is much bigger
+	emptied map[userKey]bool // users left without measurements by DeleteLatency, removed by the next cleanup
+}
+
+type userKey struct {
+	appName, userID string
+}
+
+type userMeasurements struct {
+	userID  string
+	nodes   map[string]*LatencyMeasurement
+	element *list.Element
+	tick    int64 // last measurement of the user, ordered over all the shards
+}
+
+// expiryItem is a measurement in the expiry heap; it is stale if the measurement was replaced or
+// deleted since.
+type expiryItem struct {
+	timestamp time.Time
+	userKey
+	nodeName string
+}
+
+type expiryHeap []expiryItem
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].timestamp.Before(h[j].timestamp) }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiryItem)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+func NewLatencyMeasurements() *LatencyMeasurements {
+	l := &LatencyMeasurements{}
+	for i := range l.shards {
+		l.shards[i].apps = make(map[string]map[string]*userMeasurements)
+		l.shards[i].lru = make(map[string]*list.List)
+		l.shards[i].emptied = make(map[userKey]bool)
+	}
+	return l
+}
+
+// SetMaxUsersPerApp caps the users kept for every app (0: unbounded); beyond it, adding a user evicts
+// the user of the app measured least recently.
+func (l *LatencyMeasurements) SetMaxUsersPerApp(maxUsers int) {
+	l.maxUsersPerApp = maxUsers
+}
+
+// shard hashes the app and the user with FNV-1a.
+func (l *LatencyMeasurements) shard(appName, userID string) *measurementShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(appName); i++ {
+		hash = (hash ^ uint32(appName[i])) * 16777619
+	}
+	hash *= 16777619 // separator
+	for i := 0; i < len(userID); i++ {
+		hash = (hash ^ uint32(userID[i])) * 16777619
+	}
+	return &l.shards[hash%measurementShards]
+}
+
+func (l *LatencyMeasurements) userCount(appName string) *atomic.Int64 {
+	if count, ok := l.users.Load(appName); ok {
+		return count.(*atomic.Int64)
+	}
+	count, _ := l.users.LoadOrStore(appName, new(atomic.Int64))
+	return count.(*atomic.Int64)
+}
+
+func (l *LatencyMeasurements) AddLatency(appName, userID, nodeName string, measurement *LatencyMeasurement) {
+	s := l.shard(appName, userID)
+	s.Lock()
+	appMeasurements, ok := s.apps[appName]
+	if !ok {
+		appMeasurements = make(map[string]*userMeasurements)
+		s.apps[appName] = appMeasurements
+		s.lru[appName] = list.New()
+	}
+	user, ok := appMeasurements[userID]
+	added := !ok
+	if added {
+		user = &userMeasurements{userID: userID, nodes: make(map[string]*LatencyMeasurement)}
+		user.element = s.lru[appName].PushBack(user)
+		appMeasurements[userID] = user
+	}
+	existingMeasurement, ok := user.nodes[nodeName]
+	if !ok || existingMeasurement.Timestamp.Before(measurement.Timestamp) {
+		if !ok {
+			s.size++
+		}
+		user.nodes[nodeName] = measurement
+		heap.Push(&s.expiry, expiryItem{timestamp: measurement.Timestamp, userKey: userKey{appName, userID}, nodeName: nodeName})
+		if len(s.expiry) > 2*s.size+1024 {
+			s.compactExpiry()
+		}
+		user.tick = l.tick.Add(1)
+		s.lru[appName].MoveToBack(user.element)
+	}
+	s.Unlock()
+
+	if added && l.userCount(appName).Add(1) > int64(l.maxUsersPerApp) && l.maxUsersPerApp > 0 {
+		l.evictLeastRecentlyMeasured(appName)
+	}
+}
+
+// compactExpiry rebuilds the expiry heap from the measurements, without the stale items left by the
+// replaced and deleted ones (the stores that are never cleaned up would grow forever).
+func (s *measurementShard) compactExpiry() {
+	expiry := make(expiryHeap, 0, s.size)
+	for appName, appMeasurements := range s.apps {
+		for userID, user := range appMeasurements {
+			for nodeName, measurement := range user.nodes {
+				expiry = append(expiry, expiryItem{timestamp: measurement.Timestamp, userKey: userKey{appName, userID}, nodeName: nodeName})
+			}
+		}
+	}
+	heap.Init(&expiry)
+	s.expiry = expiry
+}
+
+// evictLeastRecentlyMeasured removes the user of the app measured least recently: the oldest among
+// the first users of the shards. The shards are locked one at a time.
+func (l *LatencyMeasurements) evictLeastRecentlyMeasured(appName string) {
+	for {
+		var oldest *measurementShard
+		var oldestTick int64
+		for i := range l.shards {
+			s := &l.shards[i]
+			s.RLock()
+			if users, ok := s.lru[appName]; ok && users.Len() > 0 {
+				if tick := users.Front().Value.(*userMeasurements).tick; oldest == nil || tick < oldestTick {
+					oldest, oldestTick = s, tick
+				}
+			}
+			s.RUnlock()
+		}
+		if oldest == nil {
+			return
+		}
+		oldest.Lock()
+		users := oldest.lru[appName]
+		if users == nil || users.Len() == 0 || users.Front().Value.(*userMeasurements).tick != oldestTick {
+			oldest.Unlock() // measured again in the meantime
+			continue
+		}
+		user := users.Front().Value.(*userMeasurements)
+		oldest.removeUser(appName, user)
+		oldest.Unlock()
+		l.userCount(appName).Add(-1)
+		measurementEvictions.WithLabelValues(appName).Inc()
+		return
+	}
+}
+
+// removeUser drops the user, with the shard locked.
+func (s *measurementShard) removeUser(appName string, user *userMeasurements) {
+	s.size -= len(user.nodes)
+	s.lru[appName].Remove(user.element)
+	delete(s.apps[appName], user.userID)
+	if len(s.apps[appName]) == 0 {
+		delete(s.apps, appName)
+		delete(s.lru, appName)
+	}
+}
+
+// DeleteLatency removes a measurement. The user is kept, without measurements, until the next
+// cleanup.
+func (l *LatencyMeasurements) DeleteLatency(appName, userID, nodeName string) {
+	s := l.shard(appName, userID)
+	s.Lock()
+	defer s.Unlock()
+	if user, ok := s.apps[appName][userID]; ok {
+		if _, ok := user.nodes[nodeName]; ok {
+			delete(user.nodes, nodeName)
+			s.size--
+		}
+		if len(user.nodes) == 0 {
+			s.emptied[userKey{appName, userID}] = true
+		}
+	}
+}
+
+// DeleteWhere removes the measurements matching stale (of a deleted node or pod) and returns how many.
+func (l *LatencyMeasurements) DeleteWhere(stale func(nodeName string, measurement *LatencyMeasurement) bool) int {
+	deleted := 0
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.Lock()
+		for appName, appMeasurements := range s.apps {
+			for _, user := range appMeasurements {
+				for nodeName, measurement := range user.nodes {
+					if stale(nodeName, measurement) {
+						delete(user.nodes, nodeName)
+						s.size--
+						deleted++
+					}
+				}
+				if len(user.nodes) == 0 {
+					s.removeUser(appName, user)
+					l.userCount(appName).Add(-1)
+				}
+			}
+		}
+		s.Unlock()
+	}
+	return deleted
+}
+
+func (l *LatencyMeasurements) GetMeasurement(appName, userID, nodeName string) (*LatencyMeasurement, bool) {
+	s := l.shard(appName, userID)
+	s.RLock()
+	defer s.RUnlock()
+	user, ok := s.apps[appName][userID]
+	if !ok {
+		return nil, false
+	}
+	value, ok := user.nodes[nodeName]
+	return value, ok
+}
+
+// GetMeasurements returns a copy of all the measurements, appName -> userID -> nodeName.
+func (l *LatencyMeasurements) GetMeasurements() map[string]map[string]map[string]*LatencyMeasurement {
+	measurements := make(map[string]map[string]map[string]*LatencyMeasurement)
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.RLock()
+		for appName, appMeasurements := range s.apps {
+			if _, ok := measurements[appName]; !ok {
+				measurements[appName] = make(map[string]map[string]*LatencyMeasurement)
+			}
+			for userID, user := range appMeasurements {
+				measurements[appName][userID] = copyNodeMeasurements(user.nodes)
+			}
+		}
+		s.RUnlock()
+	}
+	return measurements
+}
+
+// GetAppMeasurements returns a copy of the measurements of an app, userID -> nodeName (nil if the app
+// has none), without copying the other apps.
+func (l *LatencyMeasurements) GetAppMeasurements(appName string) map[string]map[string]*LatencyMeasurement {
+	var measurements map[string]map[string]*LatencyMeasurement
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.RLock()
+		for userID, user := range s.apps[appName] {
+			if measurements == nil {
+				measurements = make(map[string]map[string]*LatencyMeasurement)
+			}
+			measurements[userID] = copyNodeMeasurements(user.nodes)
+		}
+		s.RUnlock()
+	}
+	return measurements
+}
+
+// GetUserMeasurements returns a copy of the measurements of a user, nodeName -> measurement.
+func (l *LatencyMeasurements) GetUserMeasurements(appName, userID string) map[string]*LatencyMeasurement {
+	s := l.shard(appName, userID)
+	s.RLock()
+	defer s.RUnlock()
+	user, ok := s.apps[appName][userID]
+	if !ok {
+		return nil
+	}
+	return copyNodeMeasurements(user.nodes)
+}
+
+func copyNodeMeasurements(nodes map[string]*LatencyMeasurement) map[string]*LatencyMeasurement {
+	copied := make(map[string]*LatencyMeasurement, len(nodes))
+	for nodeName, measurement := range nodes {
+		copied[nodeName] = measurement
+	}
+	return copied
+}
+
+// CountUsers returns the users of the app with measurements.
+func (l *LatencyMeasurements) CountUsers(appName string) int {
+	count, ok := l.users.Load(appName)
+	if !ok {
+		return 0
+	}
+	return int(count.(*atomic.Int64).Load())
+}
+
+func (l *LatencyMeasurements) GetTotalMeasurementsPerUserApp(appName, userID string) int {
+	s := l.shard(appName, userID)
+	s.RLock()
+	defer s.RUnlock()
+	if user, ok := s.apps[appName][userID]; ok {
+		return len(user.nodes)
+	}
+	return 0
+}
+
+func (l *LatencyMeasurements) UpdateMeasurements(newMeasurements map[string]map[string]map[string]*LatencyMeasurement) {
+	for appName, userMeasurements := range newMeasurements {
+		for userID, nodeMeasurements := range userMeasurements {
+			for nodeName, measurement := range nodeMeasurements {
+				l.AddLatency(appName, userID, nodeName, measurement)
+			}
+		}
+	}
+}
+
+// CleanupMeasurementsOlderThan removes the measurements older than the given minutes, and the users
+// left without measurements.
+func (l *LatencyMeasurements) CleanupMeasurementsOlderThan(minutes int) {
+	l.expire(time.Duration(minutes) * time.Minute)
+}
+
+func (l *LatencyMeasurements) expire(ttl time.Duration) {
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.Lock()
+		for s.expiry.Len() > 0 && clock.Since(s.expiry[0].timestamp) > ttl {
+			item := heap.Pop(&s.expiry).(expiryItem)
+			user, ok := s.apps[item.appName][item.userID]
+			if !ok {
+				continue
+			}
+			if measurement, ok := user.nodes[item.nodeName]; ok && measurement.Timestamp.Equal(item.timestamp) {
+				delete(user.nodes, item.nodeName)
+				s.size--
+			}
+			if len(user.nodes) == 0 {
+				s.removeUser(item.appName, user)
+				l.userCount(item.appName).Add(-1)
+			}
+		}
+		for key := range s.emptied {
+			if user, ok := s.apps[key.appName][key.userID]; ok && len(user.nodes) == 0 {
+				s.removeUser(key.appName, user)
+				l.userCount(key.appName).Add(-1)
+			}
+		}
+		if len(s.emptied) > 0 {
+			s.emptied = make(map[userKey]bool)
+		}
+		s.Unlock()
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// storeStep adds a measurement of the user on the node, minutes after the start.
+type storeStep struct {
+	user, node string
+	minutes    int
+}
+
+func TestLatencyMeasurementsMaxUsers(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxUsers int
+		steps    []storeStep
+		want     []string // users kept
+	}{
+		{"unbounded", 0, []storeStep{{"u1", "n1", 0}, {"u2", "n1", 1}, {"u3", "n1", 2}}, []string{"u1", "u2", "u3"}},
+		{"least recently measured evicted", 2, []storeStep{{"u1", "n1", 0}, {"u2", "n1", 1}, {"u3", "n1", 2}}, []string{"u2", "u3"}},
+		{"measured again kept", 2, []storeStep{{"u1", "n1", 0}, {"u2", "n1", 1}, {"u1", "n2", 2}, {"u3", "n1", 3}}, []string{"u1", "u3"}},
+		{"older measurement doesn't refresh", 2, []storeStep{{"u1", "n1", 2}, {"u2", "n1", 3}, {"u1", "n1", 1}, {"u3", "n1", 4}}, []string{"u2", "u3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLatencyMeasurements()
+			l.SetMaxUsersPerApp(tt.maxUsers)
+			start := time.Unix(1700000000, 0)
+			for _, step := range tt.steps {
+				l.AddLatency("a", step.user, step.node, &LatencyMeasurement{Measurement: 10, Timestamp: start.Add(time.Duration(step.minutes) * time.Minute)})
+			}
+			if l.CountUsers("a") != len(tt.want) {
+				t.Errorf("counted %d users, want %d", l.CountUsers("a"), len(tt.want))
+			}
+			got := l.GetAppMeasurements("a")
+			if len(got) != len(tt.want) {
+				t.Fatalf("kept users %v, want %v", sortedKeys(got), tt.want)
+			}
+			for _, userID := range tt.want {
+				if _, ok := got[userID]; !ok {
+					t.Errorf("user %s evicted, kept %v", userID, sortedKeys(got))
+				}
+			}
+		})
+	}
+}
+
+func TestLatencyMeasurementsCleanup(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   []storeStep
+		deleted [][2]string // userID, nodeName deleted before the cleanup
+		want    map[string]int
+	}{
+		{"fresh measurements kept", []storeStep{{"u1", "n1", 9}, {"u1", "n2", 5}}, nil, map[string]int{"u1": 2}},
+		{"expired measurements removed", []storeStep{{"u1", "n1", 9}, {"u1", "n2", 3}}, nil, map[string]int{"u1": 1}},
+		{"users without measurements removed", []storeStep{{"u1", "n1", 2}, {"u2", "n1", 9}}, nil, map[string]int{"u2": 1}},
+		{"replaced measurement not expired by its old timestamp", []storeStep{{"u1", "n1", 2}, {"u1", "n1", 9}}, nil, map[string]int{"u1": 1}},
+		{"users emptied by a deletion removed", []storeStep{{"u1", "n1", 9}, {"u2", "n1", 9}}, [][2]string{{"u1", "n1"}}, map[string]int{"u2": 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(previous Clock) { clock = previous }(clock)
+			start := time.Unix(1700000000, 0)
+			clock = NewVirtualClock(start.Add(10 * time.Minute))
+			l := NewLatencyMeasurements()
+			for _, step := range tt.steps {
+				l.AddLatency("a", step.user, step.node, &LatencyMeasurement{Measurement: 10, Timestamp: start.Add(time.Duration(step.minutes) * time.Minute)})
+			}
+			for _, deleted := range tt.deleted {
+				l.DeleteLatency("a", deleted[0], deleted[1])
+			}
+			l.CleanupMeasurementsOlderThan(6)
+			got := l.GetAppMeasurements("a")
+			if len(got) != len(tt.want) || l.CountUsers("a") != len(tt.want) {
+				t.Fatalf("kept users %v (counted %d), want %v", sortedKeys(got), l.CountUsers("a"), tt.want)
+			}
+			for userID, nodes := range tt.want {
+				if len(got[userID]) != nodes {
+					t.Errorf("user %s: %d measurements, want %d", userID, len(got[userID]), nodes)
+				}
+			}
+		})
+	}
+}
+
+const (
+	benchmarkApps    = 10
+	benchmarkNodes   = 10
+	benchmarkSamples = 1000000
+	benchmarkUsers   = benchmarkSamples / (benchmarkApps * benchmarkNodes)
+)
+
+var (
+	benchmarkAppNames  = benchmarkNames("app-", benchmarkApps)
+	benchmarkNodeNames = benchmarkNames("node-", benchmarkNodes)
+	benchmarkUserIDs   = benchmarkNames("user-", benchmarkUsers)
+	benchmarkStart     = time.Now()
+
+	filledStore       *LatencyMeasurements
+	filledStoreOnce   sync.Once
+	benchmarkSequence atomic.Int64
+)
+
+func benchmarkNames(prefix string, n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = prefix + strconv.Itoa(i)
+	}
+	return names
+}
+
+func benchmarkMeasurement(sequence int64) *LatencyMeasurement {
+	return &LatencyMeasurement{PodNamespace: "default", PodName: "pod", Measurement: sequence % 100, Timestamp: benchmarkStart.Add(time.Duration(sequence)), Requests: 1}
+}
+
+// benchmarkSample maps the i-th measurement to its app, user and node.
+func benchmarkSample(i int) (string, string, string) {
+	return benchmarkAppNames[i%benchmarkApps], benchmarkUserIDs[(i/benchmarkApps)%benchmarkUsers], benchmarkNodeNames[(i/(benchmarkApps*benchmarkUsers))%benchmarkNodes]
+}
+
+// filled returns the store with the benchmarkSamples measurements, filled by the first benchmark
+// that reads it, out of its timer.
+func filled(b *testing.B) *LatencyMeasurements {
+	b.StopTimer()
+	filledStoreOnce.Do(func() {
+		filledStore = NewLatencyMeasurements()
+		for i := 0; i < benchmarkSamples; i++ {
+			appName, userID, nodeName := benchmarkSample(i)
+			filledStore.AddLatency(appName, userID, nodeName, benchmarkMeasurement(int64(i)))
+		}
+	})
+	b.StartTimer()
+	return filledStore
+}
+
+func BenchmarkStoreAddLatency(b *testing.B) {
+	l := NewLatencyMeasurements()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		appName, userID, nodeName := benchmarkSample(i)
+		l.AddLatency(appName, userID, nodeName, benchmarkMeasurement(int64(i)))
+	}
+}
+
+func BenchmarkStoreAddLatencyParallel(b *testing.B) {
+	l := filled(b)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := benchmarkSequence.Add(1)
+			appName, userID, nodeName := benchmarkSample(int(i))
+			l.AddLatency(appName, userID, nodeName, benchmarkMeasurement(benchmarkSamples+i))
+		}
+	})
+}
+
+// BenchmarkStoreAddLatencyCapped evicts the least recently measured user with every new one.
+func BenchmarkStoreAddLatencyCapped(b *testing.B) {
+	l := NewLatencyMeasurements()
+	l.SetMaxUsersPerApp(benchmarkUsers / 2)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		appName, userID, nodeName := benchmarkSample(i)
+		l.AddLatency(appName, userID, nodeName, benchmarkMeasurement(int64(i)))
+	}
+}
+
+func BenchmarkStoreGetMeasurementParallel(b *testing.B) {
+	l := filled(b)
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			appName, userID, nodeName := benchmarkSample(i)
+			l.GetMeasurement(appName, userID, nodeName)
+			i++
+		}
+	})
+}
+
+// BenchmarkStoreMixedParallel reads a user 9 times every write.
+func BenchmarkStoreMixedParallel(b *testing.B) {
+	l := filled(b)
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			appName, userID, nodeName := benchmarkSample(i)
+			if i%10 == 0 {
+				l.AddLatency(appName, userID, nodeName, benchmarkMeasurement(benchmarkSamples+benchmarkSequence.Add(1)))
+			} else {
+				l.GetUserMeasurements(appName, userID)
+			}
+			i++
+		}
+	})
+}
+
+// BenchmarkStoreGetAppMeasurements copies the users x nodes of an app.
+func BenchmarkStoreGetAppMeasurements(b *testing.B) {
+	l := filled(b)
+	for i := 0; i < b.N; i++ {
+		l.GetAppMeasurements(benchmarkAppNames[i%benchmarkApps])
+	}
+}
+
+// BenchmarkStoreCleanupExpired expires b.N measurements, each of its own user.
+func BenchmarkStoreCleanupExpired(b *testing.B) {
+	b.StopTimer()
+	l := NewLatencyMeasurements()
+	for i := 0; i < b.N; i++ {
+		l.AddLatency(benchmarkAppNames[i%benchmarkApps], "user-"+strconv.Itoa(i), benchmarkNodeNames[i%benchmarkNodes], benchmarkMeasurement(int64(i)))
+	}
+	b.StartTimer()
+	l.expire(-time.Hour) // the samples are at most b.N nanoseconds in the future: all expire
+}
+
+// BenchmarkStoreCleanupNothingExpired scans the filled store, with nothing to expire.
+func BenchmarkStoreCleanupNothingExpired(b *testing.B) {
+	l := filled(b)
+	for i := 0; i < b.N; i++ {
+		l.CleanupMeasurementsOlderThan(60)
+	}
+}
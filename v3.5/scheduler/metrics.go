@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// Scheduler
+	schedulingAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "latency_aware_scheduler_scheduling_attempts_total",
+		Help: "Scheduling attempts by result (scheduled, error).",
+	}, []string{"result"})
+	schedulingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "latency_aware_scheduler_scheduling_duration_seconds",
+		Help:    "Time spent scheduling a pod, from the dequeue to the bind.",
+		Buckets: prometheus.DefBuckets,
+	})
+	bindErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "latency_aware_scheduler_bind_errors_total",
+		Help: "Failed bindings of a pod to a node.",
+	})
+	nodeScores = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "latency_aware_scheduler_node_score",
+		Help: "Last score computed for a node while scheduling a pod of the app.",
+	}, []string{"app", "node"})
+
+	// Descheduler
+	evictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "latency_aware_descheduler_evictions_total",
+		Help: "Pods evicted by the descheduler, by reason.",
+	}, []string{"app", "reason"})
+	userLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{ // the users are in the admin API, not in the labels
+		Name:    "latency_aware_descheduler_user_latency_milliseconds",
+		Help:    "Latencies between the users and the nodes of the app, observed every cycle.",
+		Buckets: []float64{5, 10, 20, 30, 40, 50, 75, 100, 150, 200, 300, 500, 1000},
+	}, []string{"app", "node"})
+	worstUserLatency = prometheus.NewGaugeVec(prometheus.GaugeOpts{ // bounded by --metrics-top-users per app
+		Name: "latency_aware_descheduler_worst_user_latency_milliseconds",
+		Help: "Last latency measured between a user and a node, for the users of the app with the worst best node.",
+	}, []string{"app", "user", "node"})
+	associationCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "latency_aware_descheduler_associations",
+		Help: "Users associated to a pod of the app.",
+	}, []string{"app"})
+	replicaChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "latency_aware_descheduler_replica_changes_total",
+		Help: "Changes of the replica count of an app, by direction (up, down).",
+	}, []string{"app", "direction"})
+	scrapeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "latency_aware_descheduler_scrape_errors_total",
+		Help: "Errors collecting the measurements from the latency meters, by namespace.",
+	}, []string{"namespace"})
+	placementViolations = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "latency_aware_descheduler_placement_violations",
+		Help: "Users violating the latency thresholds with the placement planned for the app.",
+	}, []string{"app"})
+	placementChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "latency_aware_descheduler_placement_changes_total",
+		Help: "Pods added or removed to apply the planned placement, by action (add, remove).",
+	}, []string{"app", "action"})
+	migrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "latency_aware_descheduler_migrations_total",
+		Help: "Make-before-break migrations of pods that ended, by phase (Completed, Failed).",
+	}, []string{"app", "phase"})
+	drains = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "latency_aware_descheduler_drains_total",
+		Help: "Pods drained through the routing managers before their eviction, by result (acknowledged, timed_out).",
+	}, []string{"app", "result"})
+	appPaused = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "latency_aware_descheduler_app_paused",
+		Help: "1 if the descheduling and autoscaling of the app are paused (annotation or admin API), 0 otherwise.",
+	}, []string{"app"})
+	measurementEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "latency_aware_descheduler_measurement_evictions_total",
+		Help: "Users whose measurements were evicted because the app reached --max-users-per-app, least recently measured first.",
+	}, []string{"app"})
+	explorationProbes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "latency_aware_descheduler_exploration_probes_total",
+		Help: "Probe replicas placed on unmeasured or uncertain nodes, by exploration policy.",
+	}, []string{"app", "policy"})
+)
+
+const (
+	evictionReasonInvalidNode   = "invalid_node"
+	evictionReasonSoftCondition = "soft_condition"
+	evictionReasonScaleIn       = "scale_in"
+	evictionReasonPlacement     = "placement"
+
+	drainResultAcknowledged = "acknowledged"
+	drainResultTimedOut     = "timed_out"
+)
+
+func init() {
+	prometheus.MustRegister(schedulingAttempts, schedulingDuration, bindErrors, nodeScores,
+		evictions, userLatency, worstUserLatency, associationCount, replicaChanges, scrapeErrors,
+		placementViolations, placementChanges, migrations, drains, appPaused, explorationProbes, measurementEvictions)
+}
+
+// observeWorstUsers exposes the latencies of the topUsers users of the app farthest from their best
+// node, so the operators see who is badly served while the series stay bounded however many users
+// the app has.
+func observeWorstUsers(appName string, userMeasurements map[string]map[string]*LatencyMeasurement, topUsers int) {
+	for _, userID := range worstUsers(userMeasurements, topUsers) {
+		for nodeName, measurement := range userMeasurements[userID] {
+			worstUserLatency.WithLabelValues(appName, userID, nodeName).Set(float64(measurement.Measurement))
+		}
+	}
+}
+
+// worstUsers returns the n users with the highest latency to their best node, the worst first (ties
+// by user ID).
+func worstUsers(userMeasurements map[string]map[string]*LatencyMeasurement, n int) []string {
+	best := make(map[string]int64)
+	var users []string
+	for _, userID := range sortedKeys(userMeasurements) {
+		for _, measurement := range userMeasurements[userID] {
+			if latency, ok := best[userID]; !ok || measurement.Measurement < latency {
+				best[userID] = measurement.Measurement
+			}
+		}
+		if _, ok := best[userID]; ok {
+			users = append(users, userID)
+		}
+	}
+	sort.SliceStable(users, func(i, j int) bool { return best[users[i]] > best[users[j]] })
+	if len(users) > n {
+		users = users[:n]
+	}
+	return users
+}
+
+// registerQueueDepth exposes the number of pods waiting in the scheduling queue.
+func registerQueueDepth(s *CustomScheduler) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "latency_aware_scheduler_queue_depth",
+		Help: "Pods waiting in the scheduling queue.",
+	}, func() float64 {
+		return float64(s.queue.Len())
+	}))
+}
+
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	fmt.Println("Serving metrics at", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		fmt.Println("Error serving metrics:", err)
+	}
+}
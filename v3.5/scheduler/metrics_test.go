@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWorstUsers(t *testing.T) {
+	measurements := map[string]map[string]*LatencyMeasurement{
+		"u1": {"n1": {Measurement: 10}, "n2": {Measurement: 90}},
+		"u2": {"n1": {Measurement: 50}, "n2": {Measurement: 40}},
+		"u3": {"n1": {Measurement: 40}},
+		"u4": {},
+	}
+	tests := []struct {
+		n    int
+		want []string
+	}{
+		{0, nil},
+		{1, []string{"u2"}},
+		{2, []string{"u2", "u3"}},
+		{10, []string{"u2", "u3", "u1"}},
+	}
+	for _, tt := range tests {
+		if got := worstUsers(measurements, tt.n); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%d users: got %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestObserveWorstUsers(t *testing.T) {
+	worstUserLatency.Reset()
+	defer worstUserLatency.Reset()
+	observeWorstUsers("a", map[string]map[string]*LatencyMeasurement{
+		"u1": {"n1": {Measurement: 10}, "n2": {Measurement: 90}},
+		"u2": {"n1": {Measurement: 50}, "n2": {Measurement: 40}},
+	}, 1)
+	if count := testutil.CollectAndCount(worstUserLatency); count != 2 {
+		t.Errorf("got %d series, want the 2 nodes of u2", count)
+	}
+	if got := testutil.ToFloat64(worstUserLatency.WithLabelValues("a", "u2", "n1")); got != 50 {
+		t.Errorf("got %v, want 50", got)
+	}
+}
+
+func TestCountersIncremented(t *testing.T) {
+	tests := []struct {
+		name    string
+		counter prometheus.Counter
+		run     func(t *testing.T)
+	}{
+		{"eviction of a scale-in", evictions.WithLabelValues("a", evictionReasonScaleIn), func(t *testing.T) {
+			d, _ := newTestDescheduler(testNode("n1"), testDeployment("a", 2), testPod("a", "a-1", "n1", nil), testPod("a", "a-2", "n1", nil))
+			if err := d.scaleIn("a", []string{"a-2"}, evictionReasonScaleIn); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"replicas down", replicaChanges.WithLabelValues("a", "down"), func(t *testing.T) {
+			d, _ := newTestDescheduler(testNode("n1"), testDeployment("a", 2), testPod("a", "a-1", "n1", nil), testPod("a", "a-2", "n1", nil))
+			if err := d.scaleIn("a", []string{"a-2"}, evictionReasonScaleIn); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"replicas up", replicaChanges.WithLabelValues("a", "up"), func(t *testing.T) {
+			d, _ := newTestDescheduler(testDeployment("a", 1))
+			if err := d.increaseReplicas("a"); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"scrape error", scrapeErrors.WithLabelValues("default"), func(t *testing.T) {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "boom", http.StatusInternalServerError)
+			}))
+			defer server.Close()
+			host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			meter := testPod("a", "a-1", "n1", nil)
+			meter.Labels["latency-meter"] = "enabled"
+			meter.Status.PodIP = host
+			d, _ := newTestDescheduler(meter)
+			d.controlClient = NewControlClient(writeTokenFile(t), server.Client().Transport.(*http.Transport).TLSClientConfig)
+			d.meterControlPort, _ = strconv.Atoi(port)
+			if _, err := d.getLatencyMeasurements(); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(tt.counter)
+			tt.run(t)
+			if got := testutil.ToFloat64(tt.counter); got != before+1 {
+				t.Errorf("got %v, want %v", got, before+1)
+			}
+		})
+	}
+}
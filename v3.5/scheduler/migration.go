@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// MigrationPhase is the progress of a make-before-break migration.
+type MigrationPhase string
+
+const (
+	MigrationPending   MigrationPhase = "Pending"   // replica added, waiting for the replacement to be scheduled on the target node
+	MigrationStarting  MigrationPhase = "Starting"  // replacement on the target node, waiting for it to be Ready
+	MigrationShifting  MigrationPhase = "Shifting"  // users moved to the replacement, waiting for their traffic
+	MigrationCompleted MigrationPhase = "Completed" // old pod evicted
+	MigrationFailed    MigrationPhase = "Failed"    // replacement removed, old pod kept
+
+	migrationTimeout    = 5 * time.Minute // of every phase
+	migrationHistoryTTL = time.Hour       // completed and failed migrations are kept this long
+)
+
+// Migration moves a pod of an app to another node: the replacement is created first, on TargetNode,
+// the users of the old pod are moved to it once it is Ready, and the old pod is evicted only when
+// the replacement receives their traffic.
+type Migration struct {
+	ID         string         `json:"id"`
+	App        string         `json:"app"`
+	SourcePod  string         `json:"sourcePod"`
+	SourceNode string         `json:"sourceNode"`
+	TargetNode string         `json:"targetNode"`
+	TargetPod  string         `json:"targetPod,omitempty"`
+	Reason     string         `json:"reason"`
+	Phase      MigrationPhase `json:"phase"`
+	Message    string         `json:"message,omitempty"`
+	MovedUsers []string       `json:"movedUsers,omitempty"` // users moved from SourcePod to TargetPod
+	StartedAt  time.Time      `json:"startedAt"`
+	UpdatedAt  time.Time      `json:"updatedAt"` // last phase change
+}
+
+func (m *Migration) active() bool {
+	return m.Phase != MigrationCompleted && m.Phase != MigrationFailed
+}
+
+// MigrationStore keeps the migrations in a ConfigMap, one key per migration, so they can be
+// inspected with kubectl and resumed after a restart. Like the associations and the checkpoint, they
+// are kept in a ConfigMap rather than in a custom resource with a status: the scheduler installs no
+// CRD and needs no other RBAC, only the descheduler writes them, and there are few of them (one in
+// progress per app, the ended ones for an hour), so they fit in one object.
+type MigrationStore struct {
+	clientset  kubernetes.Interface
+	namespace  string
+	name       string
+	migrations map[string]*Migration // ID -> migration
+}
+
+func NewMigrationStore(clientset kubernetes.Interface, namespace, name string) *MigrationStore {
+	return &MigrationStore{
+		clientset:  clientset,
+		namespace:  namespace,
+		name:       name,
+		migrations: make(map[string]*Migration),
+	}
+}
+
+// Load reads the migrations saved by a previous run.
+func (ms *MigrationStore) Load() error {
+	configMap, err := ms.clientset.CoreV1().ConfigMaps(ms.namespace).Get(context.Background(), ms.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading migrations from ConfigMap %s/%s: %v", ms.namespace, ms.name, err)
+	}
+	for id, data := range configMap.Data {
+		var migration Migration
+		if err := json.Unmarshal([]byte(data), &migration); err != nil {
+			fmt.Printf("Ignoring migration %s: %v\n", id, err)
+			continue
+		}
+		ms.migrations[id] = &migration
+	}
+	return nil
+}
+
+// Save writes every migration, and drops the ones that ended more than migrationHistoryTTL ago, or
+// the oldest ended ones if they don't fit in the ConfigMap.
+func (ms *MigrationStore) Save() error {
+	data := make(map[string]string)
+	size := 0
+	for id, migration := range ms.migrations {
+		if !migration.active() && clock.Since(migration.UpdatedAt) > migrationHistoryTTL {
+			delete(ms.migrations, id)
+			continue
+		}
+		payload, err := json.Marshal(migration)
+		if err != nil {
+			return fmt.Errorf("error marshaling migration %s: %v", id, err)
+		}
+		data[id] = string(payload)
+		size += len(id) + len(payload)
+	}
+	ended := make([]*Migration, 0, len(ms.migrations))
+	for _, migration := range ms.migrations {
+		if !migration.active() {
+			ended = append(ended, migration)
+		}
+	}
+	sort.Slice(ended, func(i, j int) bool {
+		return ended[i].UpdatedAt.Before(ended[j].UpdatedAt)
+	})
+	for _, migration := range ended {
+		if size <= maxConfigMapDataSize {
+			break
+		}
+		size -= len(migration.ID) + len(data[migration.ID])
+		delete(data, migration.ID)
+		delete(ms.migrations, migration.ID)
+	}
+
+	configMaps := ms.clientset.CoreV1().ConfigMaps(ms.namespace)
+	configMap, err := configMaps.Get(context.Background(), ms.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		configMap = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: ms.name, Namespace: ms.namespace},
+			Data:       data,
+		}
+		_, err = configMaps.Create(context.Background(), configMap, metav1.CreateOptions{})
+	} else if err == nil {
+		configMap.Data = data
+		_, err = configMaps.Update(context.Background(), configMap, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("error saving migrations in ConfigMap %s/%s: %v", ms.namespace, ms.name, err)
+	}
+	return nil
+}
+
+// Active returns the migrations in progress, oldest first.
+func (ms *MigrationStore) Active() []*Migration {
+	var active []*Migration
+	for _, migration := range ms.migrations {
+		if migration.active() {
+			active = append(active, migration)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].ID < active[j].ID
+	})
+	return active
+}
+
+// activeForApp returns the migration in progress for the app, if any.
+func (ms *MigrationStore) activeForApp(appName string) *Migration {
+	for _, migration := range ms.Active() {
+		if migration.App == appName {
+			return migration
+		}
+	}
+	return nil
+}
+
+// isMigrating tells whether podName is the old pod or the replacement of a migration in progress,
+// or the old pod of a completed one, which the ReplicaSet controller is removing.
+func (ms *MigrationStore) isMigrating(podName string) bool {
+	for _, migration := range ms.migrations {
+		if migration.SourcePod == podName && migration.Phase != MigrationFailed {
+			return true
+		}
+		if migration.TargetPod == podName && migration.active() {
+			return true
+		}
+	}
+	return false
+}
+
+// EnableMigrations makes the descheduler migrate the pods it would delete, make-before-break.
+func (d *Descheduler) EnableMigrations(store *MigrationStore) {
+	d.migrations = store
+}
+
+// startMigration starts moving pod to a better node for the users without association. It returns
+// false if there is no such node, or if another migration of the app is in progress, so the pod stays.
+func (d *Descheduler) startMigration(appName string, pod *v1.Pod, reason string) bool {
+	if migration := d.migrations.activeForApp(appName); migration != nil {
+		fmt.Printf("Not migrating pod %s: migration %s of app %s in progress\n", pod.Name, migration.ID, appName)
+		return false
+	}
+	targetNode, ok := d.chooseScaleUpNode(appName, false)
+	if !ok || targetNode == pod.Spec.NodeName {
+		fmt.Printf("Not migrating pod %s: no better node for app %s\n", pod.Name, appName)
+		return false
+	}
+	now := clock.Now()
+	migration := &Migration{
+		ID:         fmt.Sprintf("%s-%d", pod.Name, now.Unix()),
+		App:        appName,
+		SourcePod:  pod.Name,
+		SourceNode: pod.Spec.NodeName,
+		TargetNode: targetNode,
+		Reason:     reason,
+		Phase:      MigrationPending,
+		StartedAt:  now,
+		UpdatedAt:  now,
+	}
+	intent := PlacementIntent{Node: targetNode, Reason: "migration of " + pod.Name, Migration: migration.ID}
+	if err := d.increaseReplicasWithIntent(appName, intent); err != nil {
+		fmt.Printf("Error starting the migration of pod %s: %v\n", pod.Name, err)
+		return false
+	}
+	d.migrations.migrations[migration.ID] = migration
+	fmt.Printf("Migration %s started: pod %s of app %s from node %s to node %s (%s)\n", migration.ID, pod.Name, appName, migration.SourceNode, targetNode, reason)
+	return true
+}
+
+func (d *Descheduler) setMigrationPhase(migration *Migration, phase MigrationPhase, message string) {
+	migration.Phase = phase
+	migration.Message = message
+	migration.UpdatedAt = clock.Now()
+	fmt.Printf("Migration %s: %s %s\n", migration.ID, phase, message)
+	if !migration.active() {
+		migrations.WithLabelValues(migration.App, string(phase)).Inc()
+		eventType := v1.EventTypeNormal
+		if phase == MigrationFailed {
+			eventType = v1.EventTypeWarning
+		}
+		d.recorder.Eventf(deploymentReference(migration.App), eventType, "Migration"+string(phase), "Migration %s of pod %s from node %s to %s: %s",
+			migration.ID, migration.SourcePod, migration.SourceNode, migration.TargetNode, message)
+	}
+}
+
+// advanceMigrations moves every migration in progress forward by at most one phase.
+func (d *Descheduler) advanceMigrations() {
+	if d.migrations == nil {
+		return
+	}
+	for _, migration := range d.migrations.Active() {
+		if err := d.advanceMigration(migration); err == errPodDraining {
+			fmt.Printf("Migration %s waiting for a pod to drain\n", migration.ID)
+		} else if err != nil {
+			fmt.Printf("Error advancing migration %s: %v\n", migration.ID, err)
+		}
+	}
+}
+
+func (d *Descheduler) advanceMigration(migration *Migration) error {
+	timedOut := clock.Since(migration.UpdatedAt) > migrationTimeout
+	switch migration.Phase {
+	case MigrationPending:
+		pods, err := d.clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{
+			LabelSelector: fmt.Sprintf("app=%s", migration.App),
+		})
+		if err != nil {
+			return fmt.Errorf("error listing pods: %v", err)
+		}
+		for _, pod := range pods.Items {
+			if pod.Annotations[migrationAnnotation] != migration.ID || pod.DeletionTimestamp != nil || pod.Spec.NodeName == "" {
+				continue
+			}
+			migration.TargetPod = pod.Name
+			if pod.Spec.NodeName != migration.TargetNode {
+				d.failMigration(migration, fmt.Sprintf("replacement %s scheduled on node %s", pod.Name, pod.Spec.NodeName))
+				return nil
+			}
+			d.setMigrationPhase(migration, MigrationStarting, "replacement "+pod.Name)
+			return nil
+		}
+		if timedOut {
+			d.failMigration(migration, "replacement not scheduled in time")
+		}
+
+	case MigrationStarting:
+		pod, err := d.clientset.CoreV1().Pods(appNamespace).Get(context.Background(), migration.TargetPod, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			d.failMigration(migration, "replacement deleted")
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error retrieving pod %s: %v", migration.TargetPod, err)
+		}
+		if !podReady(pod) {
+			if timedOut {
+				d.failMigration(migration, "replacement not Ready in time")
+			}
+			return nil
+		}
+		migration.MovedUsers = d.moveAssociations(migration.App, migration.SourcePod, migration.TargetNode, migration.TargetPod)
+		if len(migration.MovedUsers) == 0 {
+			return d.completeMigration(migration)
+		}
+		d.setMigrationPhase(migration, MigrationShifting, fmt.Sprintf("%d users moved", len(migration.MovedUsers)))
+
+	case MigrationShifting:
+		for _, nodeMeasurements := range d.latencyMeasurements.GetAppMeasurements(migration.App) {
+			if measurement, ok := nodeMeasurements[migration.TargetNode]; ok && measurement.PodName == migration.TargetPod && measurement.Timestamp.After(migration.UpdatedAt) {
+				return d.completeMigration(migration)
+			}
+		}
+		if timedOut {
+			d.moveAssociations(migration.App, migration.TargetPod, migration.SourceNode, migration.SourcePod)
+			d.failMigration(migration, "no traffic on the replacement")
+		}
+	}
+	return nil
+}
+
+// completeMigration evicts the old pod, now that the replacement serves its users.
+func (d *Descheduler) completeMigration(migration *Migration) error {
+	if err := d.scaleInPod(migration.App, migration.SourcePod, migration.Reason); err != nil {
+		return err
+	}
+	d.setMigrationPhase(migration, MigrationCompleted, "pod "+migration.SourcePod+" evicted")
+	return nil
+}
+
+// failMigration removes the replacement, or the replica added for it if it wasn't scheduled, and
+// keeps the old pod. While the replacement is draining, or if the replica can't be removed, the
+// migration stays in its phase and fails again at the next cycle.
+func (d *Descheduler) failMigration(migration *Migration, message string) {
+	if migration.TargetPod == "" {
+		if err := d.cancelMigrationReplica(migration.App, migration.ID); err != nil {
+			fmt.Printf("Migration %s failing (%s): %v\n", migration.ID, message, err)
+			return
+		}
+	} else {
+		err := d.scaleInPod(migration.App, migration.TargetPod, evictionReasonScaleIn)
+		if err == errPodDraining {
+			fmt.Printf("Migration %s failing (%s): waiting for the replacement to drain\n", migration.ID, message)
+			return
+		}
+		if err != nil {
+			message += ", error removing the replacement: " + err.Error()
+		}
+	}
+	d.setMigrationPhase(migration, MigrationFailed, message)
+}
+
+// moveAssociations moves the users of the app associated to fromPod to toPod, on toNode, and returns them.
+func (d *Descheduler) moveAssociations(appName, fromPod, toNode, toPod string) []string {
+	return d.user_Cluster.MovePodAssociations(appName, fromPod, toNode, toPod)
+}
+
+func podReady(pod *v1.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != v1.PodRunning {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAdvanceMigration(t *testing.T) {
+	const id = "a-1-1000"
+	ready := func(pod *v1.Pod) *v1.Pod {
+		pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+		return pod
+	}
+	podNodes := map[string]string{"a-1": "n1", "a-2": "n2", "a-other": "n3"}
+	tagged := func(podName, nodeName string) *v1.Pod {
+		return ready(testPod("a", podName, nodeName, map[string]string{migrationAnnotation: id, nodeHintAnnotation: nodeName}))
+	}
+	tests := []struct {
+		name         string
+		pods         []*v1.Pod
+		phase        MigrationPhase // of the migration before the cycle
+		targetPod    string
+		associations map[string]string // userID -> pod, on the node of the migration side
+		traffic      bool              // a user measured the replacement after the users moved
+		after        time.Duration     // since the last phase change
+		wantPhase    MigrationPhase
+		wantTarget   string
+		wantReplicas int32
+		wantUsers    map[string]string
+	}{
+		{
+			name:         "pending: the tagged replacement is found",
+			pods:         []*v1.Pod{ready(testPod("a", "a-1", "n1", nil)), ready(testPod("a", "a-other", "n3", nil)), tagged("a-2", "n2")},
+			phase:        MigrationPending,
+			wantPhase:    MigrationStarting,
+			wantTarget:   "a-2",
+			wantReplicas: 3,
+		},
+		{
+			name:         "pending: a new pod without the tag is not the replacement",
+			pods:         []*v1.Pod{ready(testPod("a", "a-1", "n1", nil)), ready(testPod("a", "a-other", "n2", nil))},
+			phase:        MigrationPending,
+			wantPhase:    MigrationPending,
+			wantReplicas: 3,
+		},
+		{
+			name:         "pending: replacement on another node",
+			pods:         []*v1.Pod{ready(testPod("a", "a-1", "n1", nil)), tagged("a-2", "n3")},
+			phase:        MigrationPending,
+			wantPhase:    MigrationFailed,
+			wantTarget:   "a-2",
+			wantReplicas: 2,
+		},
+		{
+			name:         "pending: the replica added for a replacement never scheduled is removed",
+			pods:         []*v1.Pod{ready(testPod("a", "a-1", "n1", nil)), testPod("a", "a-2", "", nil)},
+			phase:        MigrationPending,
+			after:        migrationTimeout + time.Second,
+			wantPhase:    MigrationFailed,
+			wantReplicas: 2,
+		},
+		{
+			name:         "starting: the users move to the ready replacement",
+			pods:         []*v1.Pod{ready(testPod("a", "a-1", "n1", nil)), tagged("a-2", "n2")},
+			phase:        MigrationStarting,
+			targetPod:    "a-2",
+			associations: map[string]string{"u1": "a-1", "u2": "a-other"},
+			wantPhase:    MigrationShifting,
+			wantTarget:   "a-2",
+			wantReplicas: 3,
+			wantUsers:    map[string]string{"u1": "a-2", "u2": "a-other"},
+		},
+		{
+			name:         "starting: without users the old pod is removed",
+			pods:         []*v1.Pod{ready(testPod("a", "a-1", "n1", nil)), tagged("a-2", "n2")},
+			phase:        MigrationStarting,
+			targetPod:    "a-2",
+			wantPhase:    MigrationCompleted,
+			wantTarget:   "a-2",
+			wantReplicas: 2,
+		},
+		{
+			name:         "starting: replacement not ready in time",
+			pods:         []*v1.Pod{ready(testPod("a", "a-1", "n1", nil)), testPod("a", "a-2", "n2", map[string]string{migrationAnnotation: id})},
+			phase:        MigrationStarting,
+			targetPod:    "a-2",
+			after:        migrationTimeout + time.Second,
+			wantPhase:    MigrationFailed,
+			wantTarget:   "a-2",
+			wantReplicas: 2,
+		},
+		{
+			name:         "shifting: completed with traffic on the replacement",
+			pods:         []*v1.Pod{ready(testPod("a", "a-1", "n1", nil)), tagged("a-2", "n2")},
+			phase:        MigrationShifting,
+			targetPod:    "a-2",
+			associations: map[string]string{"u1": "a-2"},
+			traffic:      true,
+			after:        time.Minute,
+			wantPhase:    MigrationCompleted,
+			wantTarget:   "a-2",
+			wantReplicas: 2,
+			wantUsers:    map[string]string{"u1": "a-2"},
+		},
+		{
+			name:         "shifting: the users go back without traffic on the replacement",
+			pods:         []*v1.Pod{ready(testPod("a", "a-1", "n1", nil)), tagged("a-2", "n2")},
+			phase:        MigrationShifting,
+			targetPod:    "a-2",
+			associations: map[string]string{"u1": "a-2"},
+			after:        migrationTimeout + time.Second,
+			wantPhase:    MigrationFailed,
+			wantTarget:   "a-2",
+			wantReplicas: 2,
+			wantUsers:    map[string]string{"u1": "a-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(previous Clock) { clock = previous }(clock)
+			virtualClock := NewVirtualClock(time.Unix(1000, 0))
+			clock = virtualClock
+
+			deployment := testDeployment("a", 3)
+			if tt.phase == MigrationPending {
+				if err := setPlacementIntents(deployment, []PlacementIntent{{Node: "n2", Migration: id, ExpiresAt: clock.Now().Add(placementIntentTTL + tt.after)}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			objects := []runtime.Object{deployment}
+			for _, pod := range tt.pods {
+				objects = append(objects, pod)
+			}
+			d, clientset := newTestDescheduler(objects...)
+			d.EnableMigrations(NewMigrationStore(clientset, "kube-system", "latency-aware-scheduler-migrations"))
+			migration := &Migration{ID: id, App: "a", SourcePod: "a-1", SourceNode: "n1", TargetNode: "n2", TargetPod: tt.targetPod,
+				Phase: tt.phase, StartedAt: clock.Now(), UpdatedAt: clock.Now()}
+			d.migrations.migrations[id] = migration
+			for userID, podName := range tt.associations {
+				d.user_Cluster.RestoreAssociation(userID, "a", &ClusterInfo{ClusterName: podNodes[podName], PodName: podName, CreatedAt: clock.Now()})
+			}
+
+			virtualClock.Advance(tt.after)
+			if tt.traffic {
+				d.latencyMeasurements.AddLatency("a", "u1", "n2", &LatencyMeasurement{PodName: "a-2", Measurement: 10, Timestamp: clock.Now()})
+			}
+			if err := d.advanceMigration(migration); err != nil {
+				t.Fatalf("advanceMigration: %v", err)
+			}
+
+			if migration.Phase != tt.wantPhase || migration.TargetPod != tt.wantTarget {
+				t.Errorf("phase %s target %q, want %s %q (%s)", migration.Phase, migration.TargetPod, tt.wantPhase, tt.wantTarget, migration.Message)
+			}
+			deployment, err := clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), "a-deployment", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *deployment.Spec.Replicas != tt.wantReplicas {
+				t.Errorf("%d replicas, want %d", *deployment.Spec.Replicas, tt.wantReplicas)
+			}
+			if tt.wantPhase == MigrationFailed && tt.wantTarget == "" && len(getPlacementIntents(deployment)) > 0 {
+				t.Errorf("intent of the failed migration left on the deployment: %v", getPlacementIntents(deployment))
+			}
+			users := make(map[string]string)
+			for userID, clusterInfo := range d.user_Cluster.GetAppAssociations("a") {
+				users[userID] = clusterInfo.PodName
+			}
+			if tt.wantUsers == nil {
+				tt.wantUsers = tt.associations
+			}
+			if len(users) != 0 || len(tt.wantUsers) != 0 {
+				if !reflect.DeepEqual(users, tt.wantUsers) {
+					t.Errorf("users %v, want %v", users, tt.wantUsers)
+				}
+			}
+		})
+	}
+}
+
+// TestMigrationReplacementTagged starts a migration, lets the scheduler consume its intent with the binding, and finds
+// the tagged replacement among the new pods of the app.
+func TestMigrationReplacementTagged(t *testing.T) {
+	source := testPod("a", "a-1", "n1", nil)
+	d, clientset := newTestDescheduler(testNode("n1"), testNode("n2"), testDeployment("a", 1), source, testPod("a", "a-crashed", "", nil))
+	d.EnableMigrations(NewMigrationStore(clientset, "kube-system", "latency-aware-scheduler-migrations"))
+	d.hardLatencyThresholds.SetLatency("a", 50)
+	d.latencyMeasurements.AddLatency("a", "u1", "n2", &LatencyMeasurement{PodName: "b-1", Measurement: 10, Timestamp: clock.Now()})
+	if !d.startMigration("a", source, "test") {
+		t.Fatal("migration not started")
+	}
+	migration := d.migrations.activeForApp("a")
+
+	deployment, _ := clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), "a-deployment", metav1.GetOptions{})
+	if err := d.scheduler.deployments.GetStore().Add(deployment); err != nil {
+		t.Fatal(err)
+	}
+	replacement := testPod("a", "a-2", "", nil)
+	if _, err := clientset.CoreV1().Pods(appNamespace).Create(context.Background(), replacement, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	hint := d.scheduler.placementHint(replacement)
+	if hint == nil || hint.Node != "n2" {
+		t.Fatalf("hint %v, want n2", hint)
+	}
+	d.scheduler.consumePlacementIntent(replacement, hint) // bound to n2
+	tagged, _ := clientset.CoreV1().Pods(appNamespace).Get(context.Background(), "a-2", metav1.GetOptions{})
+	if tagged.Annotations[migrationAnnotation] != migration.ID || tagged.Annotations[nodeHintAnnotation] != "n2" {
+		t.Fatalf("replacement annotations %v", tagged.Annotations)
+	}
+	tagged.Spec.NodeName = "n2"
+	if _, err := clientset.CoreV1().Pods(appNamespace).Update(context.Background(), tagged, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	crashed, _ := clientset.CoreV1().Pods(appNamespace).Get(context.Background(), "a-crashed", metav1.GetOptions{})
+	crashed.Spec.NodeName = "n2" // another new pod of the app, scheduled first
+	if _, err := clientset.CoreV1().Pods(appNamespace).Update(context.Background(), crashed, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.advanceMigration(migration); err != nil {
+		t.Fatal(err)
+	}
+	if migration.Phase != MigrationStarting || migration.TargetPod != "a-2" {
+		t.Errorf("phase %s target %q, want Starting a-2", migration.Phase, migration.TargetPod)
+	}
+}
+
+func TestMigrationStoreSave(t *testing.T) {
+	defer func(previous Clock) { clock = previous }(clock)
+	virtualClock := NewVirtualClock(time.Unix(100000, 0))
+	clock = virtualClock
+	tests := []struct {
+		name      string
+		ended     int
+		endedAgo  time.Duration // the i-th ended migration ended (i+1)*endedAgo ago
+		message   int           // size of the message of the ended migrations
+		active    int
+		wantSaved int
+	}{
+		{"recent history kept", 2, 20 * time.Minute, 0, 1, 3},
+		{"old history dropped", 4, 25 * time.Minute, 0, 1, 3},
+		{"oldest history dropped above the ConfigMap size", 1200, time.Second, 1024, 2, 2 + maxConfigMapDataSize/1200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			store := NewMigrationStore(clientset, "kube-system", "migrations")
+			for i := 0; i < tt.ended; i++ {
+				id := fmt.Sprintf("ended-%04d", i)
+				store.migrations[id] = &Migration{ID: id, Phase: MigrationCompleted, Message: strings.Repeat("x", tt.message), UpdatedAt: clock.Now().Add(-time.Duration(i+1) * tt.endedAgo)}
+			}
+			for i := 0; i < tt.active; i++ {
+				id := fmt.Sprintf("active-%d", i)
+				store.migrations[id] = &Migration{ID: id, Phase: MigrationShifting, UpdatedAt: clock.Now()}
+			}
+			if err := store.Save(); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			restored := NewMigrationStore(clientset, "kube-system", "migrations")
+			if err := restored.Load(); err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if len(restored.migrations) > tt.wantSaved || len(restored.migrations) < tt.wantSaved-tt.wantSaved/10 {
+				t.Errorf("%d migrations saved, want about %d", len(restored.migrations), tt.wantSaved)
+			}
+			for id := range restored.migrations {
+				if id != "ended-0000" && strings.HasPrefix(id, "ended-") {
+					if _, ok := restored.migrations["ended-0000"]; !ok {
+						t.Errorf("migration %s kept, but not the one that ended last", id)
+					}
+					break
+				}
+			}
+			if len(restored.Active()) != tt.active {
+				t.Errorf("%d active migrations restored, want %d", len(restored.Active()), tt.active)
+			}
+		})
+	}
+}
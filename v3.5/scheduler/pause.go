@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// pausedAnnotation, set to "true" on the Deployment of an app, pauses its descheduling and autoscaling.
+	pausedAnnotation = "latency-aware-scheduler/paused"
+
+	pauseSourceAnnotation = "annotation"
+	pauseSourceAdminAPI   = "admin_api"
+)
+
+// EnablePauseSignals pauses and resumes the apps on the signals sent by the admin API.
+func (d *Descheduler) EnablePauseSignals(signals <-chan PauseSignal) {
+	go func() {
+		for signal := range signals {
+			d.pauseMutex.Lock()
+			if signal.isPaused {
+				d.pausedApps[signal.appName] = true
+			} else {
+				delete(d.pausedApps, signal.appName)
+			}
+			d.pauseMutex.Unlock()
+			if signal.isPaused {
+				fmt.Printf("Admin API: pausing app %s from the next descheduling cycle\n", signal.appName)
+			} else {
+				fmt.Printf("Admin API: resuming app %s from the next descheduling cycle\n", signal.appName)
+			}
+		}
+	}()
+}
+
+// pauseSources tells why the app is paused: the annotation of its Deployment and/or the admin API
+// (empty if the app isn't paused).
+func (d *Descheduler) pauseSources(appName string) ([]string, error) {
+	var sources []string
+	deployment, err := d.clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), appName+"-deployment", metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("error retrieving deployment: %v", err)
+	}
+	if err == nil {
+		if paused, _ := strconv.ParseBool(deployment.Annotations[pausedAnnotation]); paused {
+			sources = append(sources, pauseSourceAnnotation)
+		}
+	}
+	d.pauseMutex.Lock()
+	if d.pausedApps[appName] {
+		sources = append(sources, pauseSourceAdminAPI)
+	}
+	d.pauseMutex.Unlock()
+	return sources, nil
+}
+
+// checkPause tells whether the app is paused in this cycle, logging and exporting the changes. A
+// paused app keeps its pods and replicas, and its users keep their associations while their pods
+// exist; the migrations and drains already started are completed.
+func (d *Descheduler) checkPause(appName string) bool {
+	sources, err := d.pauseSources(appName)
+	if err != nil {
+		fmt.Printf("Error reading the pause of app %s: %v\n", appName, err)
+		sources = d.pauseState[appName] // keep the last known state
+	}
+	paused := len(sources) > 0
+	_, wasPaused := d.pauseState[appName]
+	switch {
+	case paused && !wasPaused:
+		fmt.Printf("Descheduling and autoscaling of app %s paused (%v)\n", appName, sources)
+	case !paused && wasPaused:
+		fmt.Printf("Descheduling and autoscaling of app %s resumed\n", appName)
+	}
+	if paused {
+		d.pauseState[appName] = sources
+		appPaused.WithLabelValues(appName).Set(1)
+		d.holdAssociations(appName)
+		fmt.Printf("App %s is paused, skipping it\n", appName)
+	} else {
+		delete(d.pauseState, appName)
+		appPaused.WithLabelValues(appName).Set(0)
+	}
+	return paused
+}
+
+// holdAssociations keeps the associations of the app to pods that still run from expiring, so the
+// routing doesn't change while the app is paused.
+func (d *Descheduler) holdAssociations(appName string) {
+	d.user_Cluster.RenewAssociationsWhere(appName, func(clusterInfo *ClusterInfo) bool {
+		return containsString(d.appPods[appName][clusterInfo.ClusterName], clusterInfo.PodName)
+	})
+}
+
+// PausedApps returns the paused apps with the reasons of the pause.
+func (d *Descheduler) PausedApps() (map[string][]string, error) {
+	deployments, err := d.clientset.AppsV1().Deployments(appNamespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing deployments: %v", err)
+	}
+	paused := make(map[string][]string)
+	for _, deployment := range deployments.Items {
+		appName, ok := strings.CutSuffix(deployment.Name, "-deployment")
+		if value, _ := strconv.ParseBool(deployment.Annotations[pausedAnnotation]); ok && value {
+			paused[appName] = append(paused[appName], pauseSourceAnnotation)
+		}
+	}
+	d.pauseMutex.Lock()
+	defer d.pauseMutex.Unlock()
+	for appName := range d.pausedApps {
+		paused[appName] = append(paused[appName], pauseSourceAdminAPI)
+	}
+	return paused, nil
+}
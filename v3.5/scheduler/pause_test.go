@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func pausedDeployment(appName, value string) runtime.Object {
+	deployment := testDeployment(appName, 1)
+	deployment.Annotations = map[string]string{pausedAnnotation: value}
+	return deployment
+}
+
+func TestCheckPause(t *testing.T) {
+	tests := []struct {
+		name       string
+		deployment runtime.Object
+		adminAPI   bool
+		podRunning bool // the pod of the association of u1
+		sources    []string
+		held       bool // the association of u1 refreshed
+	}{
+		{"not paused", testDeployment("a", 1), false, true, nil, false},
+		{"paused by annotation", pausedDeployment("a", "true"), false, true, []string{pauseSourceAnnotation}, true},
+		{"annotation not true", pausedDeployment("a", "no"), false, true, nil, false},
+		{"paused by the admin API", testDeployment("a", 1), true, true, []string{pauseSourceAdminAPI}, true},
+		{"paused by both", pausedDeployment("a", "true"), true, true, []string{pauseSourceAnnotation, pauseSourceAdminAPI}, true},
+		{"paused without deployment", nil, true, true, []string{pauseSourceAdminAPI}, true},
+		{"association to a pod gone not held", pausedDeployment("a", "true"), false, false, []string{pauseSourceAnnotation}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(previous Clock) { clock = previous }(clock)
+			start := time.Unix(1700000000, 0)
+			virtualClock := NewVirtualClock(start)
+			clock = virtualClock
+			var objects []runtime.Object
+			if tt.deployment != nil {
+				objects = append(objects, tt.deployment)
+			}
+			d, _ := newTestDescheduler(objects...)
+			if tt.adminAPI {
+				d.pausedApps["a"] = true
+			}
+			if tt.podRunning {
+				d.appPods["a"] = map[string][]string{"n1": {"a-1"}}
+			}
+			d.user_Cluster.RestoreAssociation("u1", "a", &ClusterInfo{ClusterName: "n1", PodName: "a-1", CreatedAt: start})
+			virtualClock.Advance(time.Minute)
+
+			if paused := d.checkPause("a"); paused != (len(tt.sources) > 0) {
+				t.Errorf("paused %v, want sources %v", paused, tt.sources)
+			}
+			if sources := d.pauseState["a"]; !reflect.DeepEqual(sources, tt.sources) {
+				t.Errorf("pause state %v, want %v", sources, tt.sources)
+			}
+			clusterInfo, _ := d.user_Cluster.GetUserClusterAssociation("u1", "a")
+			if held := clusterInfo.CreatedAt.After(start); held != tt.held {
+				t.Errorf("association refreshed at %v, want held %v", clusterInfo.CreatedAt, tt.held)
+			}
+		})
+	}
+}
+
+func TestCheckPauseResume(t *testing.T) {
+	d, _ := newTestDescheduler(testDeployment("a", 1))
+	for _, step := range []struct {
+		adminAPI bool
+		paused   bool
+	}{
+		{false, false},
+		{true, true},
+		{true, true},
+		{false, false}, // resumed
+	} {
+		d.pauseMutex.Lock()
+		if step.adminAPI {
+			d.pausedApps["a"] = true
+		} else {
+			delete(d.pausedApps, "a")
+		}
+		d.pauseMutex.Unlock()
+		if paused := d.checkPause("a"); paused != step.paused {
+			t.Errorf("paused %v, want %v", paused, step.paused)
+		}
+		if _, ok := d.pauseState["a"]; ok != step.paused {
+			t.Errorf("pause state %v, want paused %v", d.pauseState, step.paused)
+		}
+	}
+}
+
+func TestPausedApps(t *testing.T) {
+	tests := []struct {
+		name     string
+		objects  []runtime.Object
+		adminAPI []string
+		want     map[string][]string
+	}{
+		{"none", []runtime.Object{testDeployment("a", 1)}, nil, map[string][]string{}},
+		{"by annotation", []runtime.Object{pausedDeployment("a", "true"), testDeployment("b", 1)}, nil, map[string][]string{"a": {pauseSourceAnnotation}}},
+		{"by the admin API", []runtime.Object{testDeployment("a", 1)}, []string{"b"}, map[string][]string{"b": {pauseSourceAdminAPI}}},
+		{"by both", []runtime.Object{pausedDeployment("a", "1")}, []string{"a"}, map[string][]string{"a": {pauseSourceAnnotation, pauseSourceAdminAPI}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDescheduler(tt.objects...)
+			for _, appName := range tt.adminAPI {
+				d.pausedApps[appName] = true
+			}
+			paused, err := d.PausedApps()
+			if err != nil {
+				t.Fatalf("PausedApps: %v", err)
+			}
+			if !reflect.DeepEqual(paused, tt.want) {
+				t.Errorf("got %v, want %v", paused, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnablePauseSignals(t *testing.T) {
+	d, _ := newTestDescheduler()
+	signals := make(chan PauseSignal)
+	d.EnablePauseSignals(signals)
+	signals <- PauseSignal{isPaused: true, appName: "a"}
+	signals <- PauseSignal{isPaused: true, appName: "b"}
+	signals <- PauseSignal{isPaused: false, appName: "a"}
+	close(signals)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		d.pauseMutex.Lock()
+		paused := make(map[string]bool, len(d.pausedApps))
+		for appName := range d.pausedApps {
+			paused[appName] = true
+		}
+		d.pauseMutex.Unlock()
+		if reflect.DeepEqual(paused, map[string]bool{"b": true}) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("paused apps %v, want only b", paused)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestHoldAssociationsConcurrentAdminRead reads the associations through the admin API while paused
+// cycles hold them; run with -race, the held associations are replaced instead of changed in place.
+func TestHoldAssociationsConcurrentAdminRead(t *testing.T) {
+	d, _ := newTestDescheduler(pausedDeployment("a", "true"))
+	d.appPods["a"] = map[string][]string{"n1": {"a-1"}}
+	d.user_Cluster.RestoreAssociation("u1", "a", &ClusterInfo{ClusterName: "n1", PodName: "a-1", CreatedAt: clock.Now()})
+	d.publishSnapshot()
+	// the tokens are reviewed on another clientset, whose lock would order the reads after the cycles
+	handler := newTestAdminServer(d, fake.NewSimpleClientset())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			request := httptest.NewRequest(http.MethodGet, adminPrefix+"associations", nil)
+			request.Header.Set("Authorization", "Bearer admin-token")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if recorder.Code != http.StatusOK {
+				t.Errorf("got status %d", recorder.Code)
+			}
+		}
+	}()
+	for i := 0; i < 500; i++ {
+		if !d.checkPause("a") {
+			t.Fatal("app not paused")
+		}
+	}
+	<-done
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// placementIntentsAnnotation, on the Deployment of an app, lists the nodes where its next pods
+	// must go. It is written together with the replica increase and consumed by the scheduler; unlike
+	// the pod template, annotating the Deployment doesn't roll out its pods.
+	placementIntentsAnnotation = "latency-aware-scheduler/placement-intents"
+	// nodeHintAnnotation, on a pod, names the node the pod should be scheduled on.
+	nodeHintAnnotation = "latency-aware-scheduler/node-hint"
+	// migrationAnnotation, on a pod, names the migration it was created for: the scheduler tags the
+	// pod that consumes the intent of a migration, so the migration finds its replacement.
+	migrationAnnotation = "latency-aware-scheduler/migration"
+	placementIntentTTL  = 5 * time.Minute
+)
+
+// PlacementIntent is a short-lived request to schedule the next pod of an app on Node.
+type PlacementIntent struct {
+	Node      string    `json:"node"`
+	Reason    string    `json:"reason,omitempty"`
+	Migration string    `json:"migration,omitempty"` // ID of the migration the pod replaces a pod for
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func getPlacementIntents(deployment *appsv1.Deployment) []PlacementIntent {
+	var intents []PlacementIntent
+	value, ok := deployment.Annotations[placementIntentsAnnotation]
+	if !ok {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(value), &intents); err != nil {
+		fmt.Printf("Ignoring the placement intents of deployment %s: %v\n", deployment.Name, err)
+		return nil
+	}
+	var valid []PlacementIntent
+	for _, intent := range intents {
+		if clock.Now().Before(intent.ExpiresAt) {
+			valid = append(valid, intent)
+		}
+	}
+	return valid
+}
+
+func setPlacementIntents(deployment *appsv1.Deployment, intents []PlacementIntent) error {
+	if len(intents) == 0 {
+		delete(deployment.Annotations, placementIntentsAnnotation)
+		return nil
+	}
+	value, err := json.Marshal(intents)
+	if err != nil {
+		return err
+	}
+	if deployment.Annotations == nil {
+		deployment.Annotations = make(map[string]string)
+	}
+	deployment.Annotations[placementIntentsAnnotation] = string(value)
+	return nil
+}
+
+// increaseReplicasOnNode adds a replica to the app and, in the same update, an intent to schedule it on nodeName.
+func (d *Descheduler) increaseReplicasOnNode(appName, nodeName, reason string) error {
+	return d.increaseReplicasWithIntent(appName, PlacementIntent{Node: nodeName, Reason: reason})
+}
+
+// increaseReplicasWithIntent adds a replica to the app and, in the same update, the intent for it.
+func (d *Descheduler) increaseReplicasWithIntent(appName string, intent PlacementIntent) error {
+	nodeName, reason := intent.Node, intent.Reason
+	intent.ExpiresAt = clock.Now().Add(placementIntentTTL)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, err := d.clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), appName+"-deployment", metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		intents := append(getPlacementIntents(deployment), intent)
+		if err := setPlacementIntents(deployment, intents); err != nil {
+			return err
+		}
+		*deployment.Spec.Replicas++
+		_, err = d.clientset.AppsV1().Deployments(appNamespace).Update(context.Background(), deployment, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error updating deployment: %v", err)
+	}
+	replicaChanges.WithLabelValues(appName, "up").Inc()
+	fmt.Printf("Increased the replicas of app %s, the new pod will go to node %s (%s)\n", appName, nodeName, reason)
+	return nil
+}
+
+// placementHint returns the placement requested for pod: its own node hint, or the oldest placement
+// intent of its app, or nil if there is none. The intent stays on the Deployment until the pod is
+// bound to its node (consumePlacementIntent), so the intent of a refused node or of a failed binding
+// goes to the next pod. It runs without the scheduler mutex: the Deployment is read from the informer
+// cache, and read again (and cleared of the expired intents) only when the cache shows intents.
+func (s *CustomScheduler) placementHint(pod *v1.Pod) *PlacementIntent {
+	if nodeName, ok := pod.Annotations[nodeHintAnnotation]; ok {
+		return &PlacementIntent{Node: nodeName}
+	}
+	appName, ok := pod.Labels["app"]
+	if !ok {
+		return nil
+	}
+	cached, exists, err := s.deployments.GetStore().GetByKey(appNamespace + "/" + appName + "-deployment")
+	if err != nil || !exists {
+		return nil
+	}
+	if _, annotated := cached.(*appsv1.Deployment).Annotations[placementIntentsAnnotation]; !annotated {
+		return nil
+	}
+
+	deployment, err := s.clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), appName+"-deployment", metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("Error reading the placement intents of app %s: %v\n", appName, err)
+		return nil
+	}
+	intents := getPlacementIntents(deployment)
+	if len(intents) > 0 {
+		return &intents[0]
+	}
+	if _, annotated := deployment.Annotations[placementIntentsAnnotation]; annotated { // only expired intents left
+		setPlacementIntents(deployment, nil)
+		if _, err := s.clientset.AppsV1().Deployments(appNamespace).Update(context.Background(), deployment, metav1.UpdateOptions{}); err != nil {
+			fmt.Printf("Error dropping the expired placement intents of app %s: %v\n", appName, err)
+		}
+	}
+	return nil
+}
+
+// consumePlacementIntent removes the intent pod was bound with from the Deployment of its app, and tags
+// the pod with the migration of the intent. The node hint of the pod itself has nothing to remove.
+func (s *CustomScheduler) consumePlacementIntent(pod *v1.Pod, intent *PlacementIntent) {
+	if intent == nil || intent.ExpiresAt.IsZero() {
+		return
+	}
+	appName := pod.Labels["app"]
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, err := s.clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), appName+"-deployment", metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		consumed := false
+		var intents []PlacementIntent
+		for _, other := range getPlacementIntents(deployment) {
+			if !consumed && other.Node == intent.Node && other.Migration == intent.Migration && other.ExpiresAt.Equal(intent.ExpiresAt) {
+				consumed = true
+				continue
+			}
+			intents = append(intents, other)
+		}
+		if !consumed { // expired, or canceled with its migration
+			return nil
+		}
+		if err := setPlacementIntents(deployment, intents); err != nil {
+			return err
+		}
+		_, err = s.clientset.AppsV1().Deployments(appNamespace).Update(context.Background(), deployment, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		fmt.Printf("Error consuming the placement intent of app %s: %v\n", appName, err)
+	}
+	if intent.Migration != "" {
+		if err := s.tagMigrationPod(pod, *intent); err != nil {
+			fmt.Printf("Error tagging pod %s for migration %s: %v\n", pod.Name, intent.Migration, err)
+		}
+	}
+}
+
+// tagMigrationPod annotates the replacement of a migration with its node and the migration ID.
+func (s *CustomScheduler) tagMigrationPod(pod *v1.Pod, intent PlacementIntent) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := s.clientset.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if current.Annotations == nil {
+			current.Annotations = make(map[string]string)
+		}
+		current.Annotations[nodeHintAnnotation] = intent.Node
+		current.Annotations[migrationAnnotation] = intent.Migration
+		_, err = s.clientset.CoreV1().Pods(pod.Namespace).Update(context.Background(), current, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// cancelMigrationReplica removes the replica added for a migration whose replacement was never
+// scheduled, with its intent if it is still there.
+func (d *Descheduler) cancelMigrationReplica(appName, migrationID string) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, err := d.clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), appName+"-deployment", metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		var intents []PlacementIntent
+		for _, intent := range getPlacementIntents(deployment) {
+			if intent.Migration != migrationID {
+				intents = append(intents, intent)
+			}
+		}
+		if err := setPlacementIntents(deployment, intents); err != nil {
+			return err
+		}
+		*deployment.Spec.Replicas--
+		_, err = d.clientset.AppsV1().Deployments(appNamespace).Update(context.Background(), deployment, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error decreasing deployment replicas: %v", err)
+	}
+	replicaChanges.WithLabelValues(appName, "down").Inc()
+	return nil
+}
+
+// hintedNode returns the node of the placement hint among nodes, or nil if it isn't there or it
+// can't take the pod (control plane or unschedulable), as the scale-up candidates.
+func hintedNode(nodes []v1.Node, nodeName string) *v1.Node {
+	if nodeName == "" {
+		return nil
+	}
+	for i := range nodes {
+		if nodes[i].Name != nodeName {
+			continue
+		}
+		if _, ok := nodes[i].Labels["node-role.kubernetes.io/control-plane"]; ok || nodes[i].Spec.Unschedulable {
+			fmt.Println("Node ", nodeName, " of the placement hint is a control-plane or unschedulable node, ignoring it")
+			return nil
+		}
+		return &nodes[i]
+	}
+	fmt.Println("Node ", nodeName, " of the placement hint not found, ignoring it")
+	return nil
+}
+
+// chooseScaleUpNode picks the node for a new replica of appName, among the worker nodes without a pod
+// of the app (or all of them, with allowHosting, when the pods are out of capacity): the one that was measured within the hard threshold by most users without association
+// (all the users, if everyone is associated), then the one the fewest of them found invalid.
+// It returns false if every candidate is known to be invalid for all of them.
+func (d *Descheduler) chooseScaleUpNode(appName string, allowHosting bool) (string, bool) {
+	nodes, err := d.clientset.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		fmt.Printf("Error listing nodes: %v\n", err)
+		return "", false
+	}
+	pods, err := d.clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("app=%s", appName),
+	})
+	if err != nil {
+		fmt.Printf("Error listing pods: %v\n", err)
+		return "", false
+	}
+	hosting := make(map[string]bool)
+	for _, pod := range pods.Items {
+		hosting[pod.Spec.NodeName] = true
+	}
+
+	measurements := d.latencyMeasurements.GetAppMeasurements(appName)
+	invalid := d.invalidNodes.GetAppMeasurements(appName)
+	var users, unserved []string
+	for userID := range measurements {
+		users = append(users, userID)
+	}
+	for userID := range invalid {
+		if _, ok := measurements[userID]; !ok {
+			users = append(users, userID)
+		}
+	}
+	for _, userID := range users {
+		if _, ok := d.user_Cluster.GetUserClusterAssociation(userID, appName); !ok {
+			unserved = append(unserved, userID)
+		}
+	}
+	if len(unserved) == 0 {
+		unserved = users
+	}
+	h, hExists := d.hardLatencyThresholds.GetLatency(appName)
+
+	bestNode := ""
+	var bestValid, bestInvalid int
+	var bestLatency int64
+	for _, node := range nodes.Items {
+		if _, ok := node.Labels["node-role.kubernetes.io/control-plane"]; ok || node.Spec.Unschedulable || (hosting[node.Name] && !allowHosting) {
+			continue
+		}
+		valid, invalidCount := 0, 0
+		var latency int64
+		for _, userID := range unserved {
+			if measurement, ok := measurements[userID][node.Name]; ok && (!hExists || measurement.Measurement <= h) {
+				valid++
+				latency += measurement.Measurement
+			} else if _, ok := invalid[userID][node.Name]; ok {
+				invalidCount++
+			}
+		}
+		if len(unserved) > 0 && invalidCount == len(unserved) {
+			continue
+		}
+		better := bestNode == "" || valid > bestValid ||
+			(valid == bestValid && invalidCount < bestInvalid) ||
+			(valid == bestValid && invalidCount == bestInvalid && valid > 0 && latency*int64(bestValid) < bestLatency*int64(valid)) ||
+			(valid == bestValid && invalidCount == bestInvalid && latency*int64(bestValid) == bestLatency*int64(valid) && node.Name < bestNode)
+		if better {
+			bestNode, bestValid, bestInvalid, bestLatency = node.Name, valid, invalidCount, latency
+		}
+	}
+	if bestNode == "" {
+		return "", false
+	}
+	fmt.Printf("Scale-up of app %s targeted to node %s: measured valid by %d of %d unserved users, invalid for %d\n", appName, bestNode, bestValid, len(unserved), bestInvalid)
+	return bestNode, true
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestPlacementHint(t *testing.T) {
+	withIntents := func(replicas int32, intents ...PlacementIntent) *appsv1.Deployment {
+		deployment := testDeployment("a", replicas)
+		if err := setPlacementIntents(deployment, intents); err != nil {
+			t.Fatal(err)
+		}
+		return deployment
+	}
+	now := clock.Now()
+	tests := []struct {
+		name      string
+		hint      map[string]string  // annotations of the pod
+		cached    *appsv1.Deployment // in the informer cache, nil if not there
+		live      *appsv1.Deployment // in the cluster
+		want      string
+		calls     int // API calls
+		remaining int // intents left on the live Deployment, the hint doesn't consume them
+	}{
+		{
+			name:  "node hint of the pod",
+			hint:  map[string]string{nodeHintAnnotation: "n2"},
+			live:  withIntents(2, PlacementIntent{Node: "n1", ExpiresAt: now.Add(time.Minute)}),
+			want:  "n2",
+			calls: 0, remaining: 1,
+		},
+		{
+			name: "deployment not in the cache",
+			live: withIntents(2, PlacementIntent{Node: "n1", ExpiresAt: now.Add(time.Minute)}),
+			want: "", calls: 0, remaining: 1,
+		},
+		{
+			name:   "cached deployment without intents",
+			cached: testDeployment("a", 2),
+			live:   testDeployment("a", 2),
+			want:   "", calls: 0,
+		},
+		{
+			name:   "oldest intent",
+			cached: withIntents(3, PlacementIntent{Node: "n1", ExpiresAt: now.Add(time.Minute)}, PlacementIntent{Node: "n2", ExpiresAt: now.Add(time.Minute)}),
+			live:   withIntents(3, PlacementIntent{Node: "n1", ExpiresAt: now.Add(time.Minute)}, PlacementIntent{Node: "n2", ExpiresAt: now.Add(time.Minute)}),
+			want:   "n1", calls: 1, remaining: 2,
+		},
+		{
+			name:   "expired intents dropped",
+			cached: withIntents(2, PlacementIntent{Node: "n1", ExpiresAt: now.Add(-time.Minute)}),
+			live:   withIntents(2, PlacementIntent{Node: "n1", ExpiresAt: now.Add(-time.Minute)}),
+			want:   "", calls: 2, remaining: 0,
+		},
+		{
+			name:   "stale cache, intent already consumed",
+			cached: withIntents(2, PlacementIntent{Node: "n1", ExpiresAt: now.Add(time.Minute)}),
+			live:   testDeployment("a", 2),
+			want:   "", calls: 1, remaining: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, clientset := newTestDescheduler(tt.live)
+			if tt.cached != nil {
+				if err := d.scheduler.deployments.GetStore().Add(tt.cached); err != nil {
+					t.Fatal(err)
+				}
+			}
+			clientset.ClearActions()
+			got := ""
+			if hint := d.scheduler.placementHint(testPod("a", "a-new", "", tt.hint)); hint != nil {
+				got = hint.Node
+			}
+			if got != tt.want {
+				t.Errorf("hint %q, want %q", got, tt.want)
+			}
+			if calls := len(clientset.Actions()); calls != tt.calls {
+				t.Errorf("%d API calls, want %d", calls, tt.calls)
+			}
+			deployment, err := clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), "a-deployment", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remaining := len(getPlacementIntents(deployment)); remaining != tt.remaining {
+				t.Errorf("%d intents left, want %d", remaining, tt.remaining)
+			}
+		})
+	}
+}
+
+// TestPlacementIntentRoundTrip consumes the intent written by the descheduler with a scale-up, on the
+// Deployment of the app namespace.
+func TestPlacementIntentRoundTrip(t *testing.T) {
+	d, clientset := newTestDescheduler(testDeployment("a", 1))
+	if err := d.increaseReplicasOnNode("a", "n2", "test"); err != nil {
+		t.Fatalf("increaseReplicasOnNode: %v", err)
+	}
+	deployment, err := clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), "a-deployment", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *deployment.Spec.Replicas != 2 {
+		t.Errorf("%d replicas, want 2", *deployment.Spec.Replicas)
+	}
+	if err := d.scheduler.deployments.GetStore().Add(deployment); err != nil {
+		t.Fatal(err)
+	}
+	pod := testPod("a", "a-new", "", nil)
+	pod.Namespace = "other" // the namespace of the pod doesn't matter
+	hint := d.scheduler.placementHint(pod)
+	if hint == nil || hint.Node != "n2" {
+		t.Fatalf("hint %v, want n2", hint)
+	}
+	if again := d.scheduler.placementHint(pod); again == nil || again.Node != "n2" {
+		t.Errorf("intent consumed before the binding: %v", again)
+	}
+	d.scheduler.consumePlacementIntent(pod, hint)
+	if again := d.scheduler.placementHint(pod); again != nil {
+		t.Errorf("intent consumed twice: %v", again)
+	}
+	d.scheduler.consumePlacementIntent(pod, hint) // already gone
+	deployment, err = clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), "a-deployment", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if intents := getPlacementIntents(deployment); len(intents) != 0 {
+		t.Errorf("intents %v left", intents)
+	}
+}
+
+func TestHintedNode(t *testing.T) {
+	controlPlane := testNode("n1")
+	controlPlane.Labels = map[string]string{"node-role.kubernetes.io/control-plane": ""}
+	cordoned := testNode("n2")
+	cordoned.Spec.Unschedulable = true
+	nodes := []v1.Node{*controlPlane, *cordoned, *testNode("n3")}
+	tests := []struct {
+		name string
+		hint string
+		want string // "" for no node
+	}{
+		{name: "no hint", hint: "", want: ""},
+		{name: "worker node", hint: "n3", want: "n3"},
+		{name: "control plane", hint: "n1", want: ""},
+		{name: "unschedulable", hint: "n2", want: ""},
+		{name: "unknown node", hint: "n4", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if node := hintedNode(nodes, tt.hint); node != nil {
+				got = node.Name
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSchedulePodConsumesIntent schedules a pod with the intent of its app, which is consumed only once
+// the pod is bound to the hinted node.
+func TestSchedulePodConsumesIntent(t *testing.T) {
+	tests := []struct {
+		name      string
+		cordoned  bool // the hinted node is unschedulable
+		bindError bool
+		remaining int
+	}{
+		{name: "bound to the hinted node", remaining: 0},
+		{name: "binding failed", bindError: true, remaining: 1},
+		{name: "hinted node unschedulable", cordoned: true, remaining: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hinted := testNode("n2")
+			hinted.Spec.Unschedulable = tt.cordoned
+			deployment := testDeployment("a", 2)
+			if err := setPlacementIntents(deployment, []PlacementIntent{{Node: "n2", ExpiresAt: clock.Now().Add(time.Minute)}}); err != nil {
+				t.Fatal(err)
+			}
+			pod := testPod("a", "a-2", "", nil)
+			d, clientset := newTestDescheduler(testNode("n1"), hinted, deployment, pod)
+			d.scheduler.recorder = record.NewFakeRecorder(10)
+			clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if action.GetSubresource() != "binding" {
+					return false, nil, nil
+				}
+				if tt.bindError {
+					return true, nil, fmt.Errorf("binding refused")
+				}
+				return true, action.(k8stesting.CreateAction).GetObject(), nil
+			})
+			if err := d.scheduler.deployments.GetStore().Add(deployment); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.scheduler.informer.GetStore().Add(pod); err != nil {
+				t.Fatal(err)
+			}
+
+			err := d.scheduler.schedulePod(appNamespace + "/a-2")
+			if tt.bindError != (err != nil) {
+				t.Errorf("error %v, want error %v", err, tt.bindError)
+			}
+			live, err := clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), "a-deployment", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remaining := len(getPlacementIntents(live)); remaining != tt.remaining {
+				t.Errorf("%d intents left, want %d", remaining, tt.remaining)
+			}
+		})
+	}
+}
+
+func TestChooseScaleUpNode(t *testing.T) {
+	controlPlane := testNode("cp")
+	controlPlane.Labels = map[string]string{"node-role.kubernetes.io/control-plane": ""}
+	cordoned := testNode("n4")
+	cordoned.Spec.Unschedulable = true
+	measured := func(latencies map[string]map[string]int64) *LatencyMeasurements {
+		measurements := NewLatencyMeasurements()
+		for userID, nodes := range latencies {
+			for nodeName, latency := range nodes {
+				measurements.AddLatency("a", userID, nodeName, &LatencyMeasurement{Measurement: latency, Timestamp: clock.Now()})
+			}
+		}
+		return measurements
+	}
+	tests := []struct {
+		name         string
+		latencies    map[string]map[string]int64 // user -> node -> latency, within the threshold of 50 ms or not
+		invalid      map[string][]string         // user -> nodes found invalid
+		associated   []string                    // users with a pod
+		allowHosting bool
+		want         string
+		wantOK       bool
+	}{
+		{
+			name:      "most valid unserved users",
+			latencies: map[string]map[string]int64{"u1": {"n2": 40, "n3": 10}, "u2": {"n2": 30, "n3": 90}},
+			want:      "n2", wantOK: true,
+		},
+		{
+			name:      "lowest mean latency on a tie",
+			latencies: map[string]map[string]int64{"u1": {"n2": 40, "n3": 10}},
+			want:      "n3", wantOK: true,
+		},
+		{
+			name:       "associated users ignored",
+			latencies:  map[string]map[string]int64{"u1": {"n2": 10, "n3": 90}, "u2": {"n3": 10}},
+			associated: []string{"u1"},
+			want:       "n3", wantOK: true,
+		},
+		{
+			name:      "control plane and unschedulable nodes skipped",
+			latencies: map[string]map[string]int64{"u1": {"cp": 5, "n4": 5, "n3": 40}},
+			want:      "n3", wantOK: true,
+		},
+		{
+			name:      "hosting node skipped",
+			latencies: map[string]map[string]int64{"u1": {"n1": 5, "n3": 40}},
+			want:      "n3", wantOK: true,
+		},
+		{
+			name:         "hosting node allowed",
+			latencies:    map[string]map[string]int64{"u1": {"n1": 5, "n3": 40}},
+			allowHosting: true,
+			want:         "n1", wantOK: true,
+		},
+		{
+			name:    "fewest invalid",
+			invalid: map[string][]string{"u1": {"n2"}, "u2": {"n2", "n3"}},
+			want:    "n3", wantOK: true,
+		},
+		{
+			name:    "every candidate invalid",
+			invalid: map[string][]string{"u1": {"n2", "n3"}},
+			want:    "", wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDescheduler(controlPlane.DeepCopy(), testNode("n1"), testNode("n2"), testNode("n3"), cordoned.DeepCopy(), testPod("a", "a-1", "n1", nil))
+			d.latencyMeasurements = measured(tt.latencies)
+			for userID, nodes := range tt.invalid {
+				for _, nodeName := range nodes {
+					d.invalidNodes.AddLatency("a", userID, nodeName, &LatencyMeasurement{Measurement: 500, Timestamp: clock.Now()})
+				}
+			}
+			for _, userID := range tt.associated {
+				d.user_Cluster.RestoreAssociation(userID, "a", &ClusterInfo{ClusterName: "n1", PodName: "a-1", CreatedAt: clock.Now()})
+			}
+			d.hardLatencyThresholds.SetLatency("a", 50)
+
+			got, ok := d.chooseScaleUpNode("a", tt.allowHosting)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got %q %v, want %q %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
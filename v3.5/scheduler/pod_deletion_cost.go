@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// podDeletionCostAnnotation tells the ReplicaSet controller which pods to remove first when the
+	// replicas decrease: the ones with the lowest cost (unscheduled and not ready pods still go first).
+	podDeletionCostAnnotation = "controller.kubernetes.io/pod-deletion-cost"
+	victimDeletionCost        = math.MinInt32
+	associationValue          = 1000 // value of a user associated to a pod
+	softAssociationValue      = 500  // added if the user is within the soft threshold
+)
+
+// podValue is what removing the pod would cost: every associated user is worth associationValue
+// (plus softAssociationValue within the soft threshold) minus its latency, so the pods serving more
+// users, and serving them better, are kept.
+func (d *Descheduler) podValue(appName, podName string) int32 {
+	var value int64
+	for _, appAssociations := range d.user_Cluster.GetUserClusterAssociations() {
+		clusterInfo, ok := appAssociations[appName]
+		if !ok || clusterInfo.PodName != podName {
+			continue
+		}
+		userValue := int64(associationValue) - clusterInfo.Latency
+		if clusterInfo.HasSoftConstraint {
+			userValue += softAssociationValue
+		}
+		if userValue < 1 {
+			userValue = 1 // an associated pod is always worth more than an unassociated one
+		}
+		value += userValue
+	}
+	if value > math.MaxInt32 {
+		value = math.MaxInt32
+	}
+	return int32(value)
+}
+
+// setDeletionCost writes the deletion cost of the pod, if it changed.
+func (d *Descheduler) setDeletionCost(namespace, podName string, cost int32) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pod, err := d.clientset.CoreV1().Pods(namespace).Get(context.Background(), podName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		value := strconv.FormatInt(int64(cost), 10)
+		if pod.Annotations[podDeletionCostAnnotation] == value {
+			return nil
+		}
+		if pod.Annotations == nil {
+			pod.Annotations = make(map[string]string)
+		}
+		pod.Annotations[podDeletionCostAnnotation] = value
+		_, err = d.clientset.CoreV1().Pods(namespace).Update(context.Background(), pod, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// scaleIn removes the victims from the app: once they are drained, the pods are annotated with their
+// deletion cost (the victims with the lowest one) and the replicas are decreased once, so the
+// ReplicaSet controller deletes the victims. Nothing is left half done on error: at worst some costs
+// are updated. It returns errPodDraining while some victim is draining.
+func (d *Descheduler) scaleIn(appName string, victims []string, reason string) error {
+	if len(victims) == 0 {
+		return nil
+	}
+	pods, err := d.clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("app=%s", appName),
+	})
+	if err != nil {
+		return fmt.Errorf("error retrieving pods: %v", err)
+	}
+	draining := 0
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil || !containsString(victims, pod.Name) {
+			continue
+		}
+		drained, err := d.drainPod(appName, pod, "")
+		if err != nil {
+			return err
+		}
+		if !drained {
+			draining++
+		}
+	}
+	if draining > 0 {
+		return errPodDraining
+	}
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		cost := d.podValue(appName, pod.Name)
+		if containsString(victims, pod.Name) {
+			cost = victimDeletionCost
+		}
+		if err := d.setDeletionCost(pod.Namespace, pod.Name, cost); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("error setting the deletion cost of pod %s: %v", pod.Name, err)
+		}
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, err := d.clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), appName+"-deployment", metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		*deployment.Spec.Replicas -= int32(len(victims))
+		_, err = d.clientset.AppsV1().Deployments(appNamespace).Update(context.Background(), deployment, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error decreasing deployment replicas: %v", err)
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil || !containsString(victims, pod.Name) {
+			continue
+		}
+		replicaChanges.WithLabelValues(appName, "down").Inc()
+		evictions.WithLabelValues(appName, reason).Inc()
+		d.recordPodEvent(pod, appName, v1.EventTypeNormal, "ScaledIn", "Replicas decreased with the pod first to go: "+scaleInMessage(reason))
+		fmt.Printf("Scaled in app %s, pod %s marked for removal (%s)\n", appName, pod.Name, reason)
+	}
+	return nil
+}
+
+func scaleInMessage(reason string) string {
+	switch reason {
+	case evictionReasonScaleIn:
+		return "no user is associated to it and the app is above its baseline replicas"
+	case evictionReasonPlacement:
+		return "it isn't part of the placement planned for the users of the app"
+	}
+	return fmt.Sprintf("its users moved to the pod that replaced it (%s)", reason)
+}
+
+// scaleInPod decreases the replicas of the app so that podName is the pod removed.
+func (d *Descheduler) scaleInPod(appName, podName, reason string) error {
+	return d.scaleIn(appName, []string{podName}, reason)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodValue(t *testing.T) {
+	tests := []struct {
+		name         string
+		associations map[string]ClusterInfo // userID -> association to app a
+		want         int32
+	}{
+		{"no user", nil, 0},
+		{"users of another pod", map[string]ClusterInfo{"u1": {PodName: "a-2", Latency: 10}}, 0},
+		{"one user", map[string]ClusterInfo{"u1": {PodName: "a-1", Latency: 10}}, 990},
+		{"within the soft threshold", map[string]ClusterInfo{"u1": {PodName: "a-1", Latency: 10, HasSoftConstraint: true}}, 1490},
+		{"users summed", map[string]ClusterInfo{"u1": {PodName: "a-1", Latency: 10}, "u2": {PodName: "a-1", Latency: 100}}, 1890},
+		{"slow user still worth something", map[string]ClusterInfo{"u1": {PodName: "a-1", Latency: 5000}}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDescheduler()
+			for userID, clusterInfo := range tt.associations {
+				clusterInfo := clusterInfo
+				d.user_Cluster.RestoreAssociation(userID, "a", &clusterInfo)
+			}
+			if got := d.podValue("a", "a-1"); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScaleIn(t *testing.T) {
+	tests := []struct {
+		name     string
+		victims  []string
+		deployed int32
+		costs    map[string]int32 // pod -> deletion cost afterwards, absent if not set
+	}{
+		{"no victim", nil, 3, map[string]int32{}},
+		{"one victim", []string{"a-3"}, 2, map[string]int32{"a-1": 990, "a-2": 0, "a-3": math.MinInt32}},
+		{"two victims", []string{"a-2", "a-3"}, 1, map[string]int32{"a-1": 990, "a-2": math.MinInt32, "a-3": math.MinInt32}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, clientset := newTestDescheduler(
+				testNode("n1"), testDeployment("a", 3),
+				testPod("a", "a-1", "n1", nil), testPod("a", "a-2", "n1", nil), testPod("a", "a-3", "n1", nil),
+			)
+			d.user_Cluster.RestoreAssociation("u1", "a", &ClusterInfo{ClusterName: "n1", PodName: "a-1", Latency: 10})
+
+			if err := d.scaleIn("a", tt.victims, evictionReasonScaleIn); err != nil {
+				t.Fatalf("scaleIn: %v", err)
+			}
+			deployment, _ := clientset.AppsV1().Deployments("default").Get(context.Background(), "a-deployment", metav1.GetOptions{})
+			if *deployment.Spec.Replicas != tt.deployed {
+				t.Errorf("deployment replicas %d, want %d", *deployment.Spec.Replicas, tt.deployed)
+			}
+			for _, podName := range []string{"a-1", "a-2", "a-3"} {
+				pod, _ := clientset.CoreV1().Pods("default").Get(context.Background(), podName, metav1.GetOptions{})
+				value, ok := pod.Annotations[podDeletionCostAnnotation]
+				want, wantOk := tt.costs[podName]
+				if ok != wantOk || (ok && value != strconv.Itoa(int(want))) {
+					t.Errorf("pod %s: deletion cost %q, want %d (set %v)", podName, value, want, wantOk)
+				}
+			}
+		})
+	}
+}
+
+func TestSetDeletionCost(t *testing.T) {
+	d, clientset := newTestDescheduler(testPod("a", "a-1", "n1", map[string]string{podDeletionCostAnnotation: "10"}))
+	for _, cost := range []int32{10, 20} {
+		before := len(clientset.Actions())
+		if err := d.setDeletionCost("default", "a-1", cost); err != nil {
+			t.Fatalf("setDeletionCost: %v", err)
+		}
+		updated := false
+		for _, action := range clientset.Actions()[before:] {
+			updated = updated || action.GetVerb() == "update"
+		}
+		if updated != (cost != 10) {
+			t.Errorf("cost %d: updated %v", cost, updated)
+		}
+	}
+	if err := d.setDeletionCost("default", "gone", 1); err == nil {
+		t.Error("cost of a missing pod set")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -15,20 +16,24 @@ import (
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 )
 
 type CustomScheduler struct {
-	clientset             *kubernetes.Clientset
+	clientset             kubernetes.Interface
 	mutex                 *sync.Mutex
 	queue                 workqueue.RateLimitingInterface
 	informer              cache.SharedIndexInformer
+	deployments           cache.SharedIndexInformer // Deployments of the apps, for their placement intents
 	visitedNodesPerApp    map[string]map[string]bool
 	hardLatencyThresholds *LatencyThresholds
 	softLatencyThresholds *LatencyThresholds
+	objectives            *LatencyObjectives
+	recorder              record.EventRecorder
 }
 
-func NewCustomScheduler(clientset *kubernetes.Clientset, mutex *sync.Mutex, hardLatencyThresholds, softLatencyThresholds *LatencyThresholds) *CustomScheduler {
+func NewCustomScheduler(clientset kubernetes.Interface, mutex *sync.Mutex, hardLatencyThresholds, softLatencyThresholds *LatencyThresholds, objectives *LatencyObjectives) *CustomScheduler {
 	informer := cache.NewSharedIndexInformer(
 		&cache.ListWatch{
 			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
@@ -45,6 +50,20 @@ func NewCustomScheduler(clientset *kubernetes.Clientset, mutex *sync.Mutex, hard
 		cache.Indexers{},
 	)
 
+	deployments := cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return clientset.AppsV1().Deployments(appNamespace).List(context.TODO(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return clientset.AppsV1().Deployments(appNamespace).Watch(context.TODO(), options)
+			},
+		},
+		&appsv1.Deployment{},
+		0,
+		cache.Indexers{},
+	)
+
 	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
 
 	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -60,18 +79,22 @@ func NewCustomScheduler(clientset *kubernetes.Clientset, mutex *sync.Mutex, hard
 		clientset:             clientset,
 		mutex:                 mutex,
 		informer:              informer,
+		deployments:           deployments,
 		queue:                 queue,
 		visitedNodesPerApp:    make(map[string]map[string]bool),
 		hardLatencyThresholds: hardLatencyThresholds,
 		softLatencyThresholds: softLatencyThresholds,
+		objectives:            objectives,
+		recorder:              newEventRecorder(clientset, schedulerComponent),
 	}
 }
 
 func (s *CustomScheduler) Run() {
 	rand.Seed(time.Now().UnixNano())
 	go s.informer.Run(make(chan struct{}))
+	go s.deployments.Run(make(chan struct{}))
 	// Attendi che l'informer sia sincronizzato
-	if !cache.WaitForCacheSync(make(chan struct{}), s.informer.HasSynced) {
+	if !cache.WaitForCacheSync(make(chan struct{}), s.informer.HasSynced, s.deployments.HasSynced) {
 		panic(fmt.Errorf("timeout waiting for cache sync"))
 	}
 
@@ -85,11 +108,16 @@ func (s *CustomScheduler) Run() {
 		func() {
 			defer s.queue.Done(key)
 			fmt.Printf("Processing pod: %s\n", key) //debug
+			start := time.Now()
 			err := s.schedulePod(key.(string))
+			schedulingDuration.Observe(time.Since(start).Seconds())
 			if err != nil {
 				fmt.Printf("Error scheduling pod: %v\n", err)
+				s.recordSchedulingFailure(key.(string), err)
+				schedulingAttempts.WithLabelValues("error").Inc()
 				s.queue.AddRateLimited(key)
 			} else {
+				schedulingAttempts.WithLabelValues("scheduled").Inc()
 				s.queue.Forget(key)
 			}
 		}()
@@ -97,9 +125,6 @@ func (s *CustomScheduler) Run() {
 }
 
 func (s *CustomScheduler) schedulePod(key string) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
 	// Ottieni il pod associato alla chiave
 	pod, exists, err := s.informer.GetStore().GetByKey(key)
 	if err != nil {
@@ -110,44 +135,76 @@ func (s *CustomScheduler) schedulePod(key string) error {
 		return nil
 	}
 
-	// Scegli un nodo sul quale pianificare il pod
-	node, err := s.chooseNodeForPod(pod.(*v1.Pod))
+	// the placement intent may update the Deployment, so it is read, and consumed once the pod is bound,
+	// without the mutex held by the descheduler cycles
+	hint := s.placementHint(pod.(*v1.Pod))
+	decision, err := s.bindPod(pod.(*v1.Pod), hint)
 	if err != nil {
 		return err
 	}
+	if decision.Hinted {
+		s.consumePlacementIntent(pod.(*v1.Pod), hint)
+	}
+	return nil
+}
+
+// bindPod chooses the node of the pod, the one of hint if it can take it, and binds the pod to it.
+func (s *CustomScheduler) bindPod(pod *v1.Pod, hint *PlacementIntent) (*SchedulingDecision, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	hintedNodeName := ""
+	if hint != nil {
+		hintedNodeName = hint.Node
+	}
+	// Scegli un nodo sul quale pianificare il pod
+	node, decision, err := s.chooseNodeForPod(pod, hintedNodeName)
+	if err != nil {
+		return nil, err
+	}
 
 	// Assegna il pod al nodo scelto
-	err = s.assignPodToNode(pod.(*v1.Pod), node)
+	err = s.assignPodToNode(pod, node, decision)
+	if err != nil {
+		return nil, err
+	}
 
 	// Aggiorna le informazioni sul nodo nel tuo elenco di nodi
 	updatedNode, err := s.clientset.CoreV1().Nodes().Get(context.TODO(), node.Name, metav1.GetOptions{})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	*node = *updatedNode
-	return err
+	return decision, nil
 }
 
-func (s *CustomScheduler) chooseNodeForPod(pod *v1.Pod) (*v1.Node, error) {
+// chooseNodeForPod picks the node of the pod, the one of hint (from placementHint) if it can take the pod.
+func (s *CustomScheduler) chooseNodeForPod(pod *v1.Pod, hint string) (*v1.Node, *SchedulingDecision, error) {
 	nodes, err := s.clientset.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	nodesToConsider := nodes.Items
 
 	if len(nodesToConsider) == 0 {
-		return nil, fmt.Errorf("no nodes available")
+		return nil, nil, errNoNodes
 	}
 
-	selectedNode, err := s.getBestNode(pod, nodesToConsider)
+	decision := &SchedulingDecision{}
+	selectedNode, err := s.getBestNode(pod, nodesToConsider, hint, decision)
+	if err != nil {
+		return nil, nil, err
+	}
 	fmt.Println("BESTNODE: ", selectedNode.Name) //DEBUG
-	return selectedNode, err
+	return selectedNode, decision, nil
 }
 
-func (s *CustomScheduler) getBestNode(pod *v1.Pod, nodes []v1.Node) (*v1.Node, error) {
-	var bestNode *v1.Node
-	var bestScore float64
+// getBestNode picks the node of the pod and records in decision why, with the runner-up.
+func (s *CustomScheduler) getBestNode(pod *v1.Pod, nodes []v1.Node, hint string, decision *SchedulingDecision) (*v1.Node, error) {
+	var bestNode, runnerUp *v1.Node
+	var bestScore, runnerUpScore float64
+	candidates := 0
 
 	appName, ok := pod.Labels["app"]
 	if !ok {
@@ -165,6 +222,14 @@ func (s *CustomScheduler) getBestNode(pod *v1.Pod, nodes []v1.Node) (*v1.Node, e
 	if !exists && softLatencyThreshold != -1 { //se non esisteva il soft constraint e ne ho trovato uno
 		s.softLatencyThresholds.SetLatency(appName, softLatencyThreshold)
 	}
+	objective, err := getLatencyObjective(pod)
+	if err != nil {
+		fmt.Printf("Ignoring the objective of pod %s/%s: %v\n", pod.Namespace, pod.Name, err)
+	} else if !s.objectives.IsSet(appName) && objective != "" {
+		if err := s.objectives.SetObjective(appName, objective); err != nil {
+			fmt.Printf("Ignoring the objective of pod %s/%s: %v\n", pod.Namespace, pod.Name, err)
+		}
+	}
 	//DEBUG
 	fmt.Println("\nAppName: ", appName)
 	fmt.Println("VisitedNodes for the App: ", s.visitedNodesPerApp[appName])
@@ -172,6 +237,18 @@ func (s *CustomScheduler) getBestNode(pod *v1.Pod, nodes []v1.Node) (*v1.Node, e
 	sLatency, sExists := s.softLatencyThresholds.GetLatency(appName)
 	fmt.Println("Latency Threshold:\tHard (exists: ", hExists, "): ", hLatency, "\tSoft (exists: ", sExists, "): ", sLatency)
 
+	if hintedNode := hintedNode(nodes, hint); hintedNode != nil {
+		if _, ok := s.visitedNodesPerApp[appName]; !ok {
+			s.visitedNodesPerApp[appName] = make(map[string]bool)
+		}
+		s.visitedNodesPerApp[appName][hintedNode.Name] = true
+		fmt.Println("BestNode from the placement hint: ", hintedNode.Name)
+		decision.Score = getNodeScore(*hintedNode)
+		decision.Reason = "placement hint of the descheduler, for the users without a pod within the thresholds"
+		decision.Hinted = true
+		return hintedNode, nil
+	}
+
 	for i, node := range nodes {
 		fmt.Println()                           //DEBUG
 		fmt.Println("Node ", i, ":", node.Name) //DEBUG
@@ -195,23 +272,35 @@ func (s *CustomScheduler) getBestNode(pod *v1.Pod, nodes []v1.Node) (*v1.Node, e
 		fmt.Println("NOT visited") //DEBUG
 		nodeScore := getNodeScore(node)
 		fmt.Println("NodeScore: ", nodeScore) //DEBUG
+		nodeScores.WithLabelValues(appName, node.Name).Set(nodeScore)
+		candidates++
 		if bestNode == nil || nodeScore > bestScore {
+			runnerUp, runnerUpScore = bestNode, bestScore
 			bestNode = &nodes[i]
 			bestScore = nodeScore
 			fmt.Println("BestNode Corrente: ", bestNode.Name)
+		} else if runnerUp == nil || nodeScore > runnerUpScore {
+			runnerUp, runnerUpScore = &nodes[i], nodeScore
 		}
 	}
 
 	if bestNode == nil {
 		// Se tutti i nodi sono stati visitati
 		delete(s.visitedNodesPerApp, appName)
-		return s.getBestNode(pod, nodes)
+		decision.NewRound = true
+		return s.getBestNode(pod, nodes, "", decision)
 
 	} else {
 		s.visitedNodesPerApp[appName][bestNode.Name] = true
 	}
 
 	fmt.Println("BestNode Totale: ", bestNode.Name)
+	decision.Score = bestScore
+	decision.Reason = fmt.Sprintf("most allocatable CPU and memory among the %d worker nodes without a pod of app %s", candidates, appName)
+	if runnerUp != nil {
+		decision.RunnerUp = runnerUp.Name
+		decision.RunnerUpScore = runnerUpScore
+	}
 	return bestNode, nil
 }
 
@@ -229,7 +318,7 @@ func getNodeScore(node v1.Node) float64 {
 	return totalScore
 }
 
-func (s *CustomScheduler) assignPodToNode(pod *v1.Pod, node *v1.Node) error {
+func (s *CustomScheduler) assignPodToNode(pod *v1.Pod, node *v1.Node, decision *SchedulingDecision) error {
 	binding := &v1.Binding{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      pod.Name,
@@ -245,10 +334,12 @@ func (s *CustomScheduler) assignPodToNode(pod *v1.Pod, node *v1.Node) error {
 
 	err := s.clientset.CoreV1().Pods(pod.Namespace).Bind(context.TODO(), binding, metav1.CreateOptions{})
 	if err != nil {
+		bindErrors.Inc()
 		return err
 	}
 
 	fmt.Printf("Assigned pod %s/%s to node %s\n\n", pod.Namespace, pod.Name, node.Name)
+	s.recorder.Eventf(pod, v1.EventTypeNormal, "Scheduled", "Successfully assigned %s/%s to %s: %s", pod.Namespace, pod.Name, node.Name, decision)
 	return nil
 }
 
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// SimulationTrace describes the simulated cluster and the latency between every user and node over time.
+type SimulationTrace struct {
+	Nodes            []string        `json:"nodes"`
+	Apps             []SimulatedApp  `json:"apps"`
+	Users            []SimulatedUser `json:"users"`
+	Latencies        []LatencySample `json:"latencies"`
+	DefaultLatencyMs int64           `json:"defaultLatencyMs"` // latency of the user-node pairs missing from the trace
+}
+
+type SimulatedApp struct {
+	Name           string `json:"name"`
+	Replicas       int32  `json:"replicas"`
+	HardMaxLatency int64  `json:"hardMaxLatency"`           // -1 if not set
+	SoftMaxLatency int64  `json:"softMaxLatency"`           // -1 if not set
+	Objective      string `json:"objective,omitempty"`      // latency_objective annotation of the pods
+	MaxUsersPerPod int    `json:"maxUsersPerPod,omitempty"` // max_users_per_pod annotation of the pods
+}
+
+// UnmarshalJSON leaves the thresholds missing from the trace unset (-1) instead of 0.
+func (a *SimulatedApp) UnmarshalJSON(data []byte) error {
+	type simulatedApp SimulatedApp // without this method
+	app := simulatedApp{HardMaxLatency: -1, SoftMaxLatency: -1}
+	if err := json.Unmarshal(data, &app); err != nil {
+		return err
+	}
+	*a = SimulatedApp(app)
+	return nil
+}
+
+type SimulatedUser struct {
+	ID  string `json:"id"`
+	App string `json:"app"`
+}
+
+// LatencySample sets the latency between User and Node from AtSeconds on.
+type LatencySample struct {
+	AtSeconds int64  `json:"atSeconds"`
+	User      string `json:"user"`
+	Node      string `json:"node"`
+	LatencyMs int64  `json:"latencyMs"`
+}
+
+func LoadSimulationTrace(path string) (*SimulationTrace, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	trace := &SimulationTrace{DefaultLatencyMs: 100}
+	if err := json.Unmarshal(data, trace); err != nil {
+		return nil, fmt.Errorf("error parsing trace %s: %v", path, err)
+	}
+	return trace, nil
+}
+
+// GenerateSimulationTrace creates a single app whose users have a random, constant latency (5-80ms) to every node.
+func GenerateSimulationTrace(nodes, users int, seed int64) *SimulationTrace {
+	r := rand.New(rand.NewSource(seed))
+	trace := &SimulationTrace{
+		Apps:             []SimulatedApp{{Name: "nginx", Replicas: 2, HardMaxLatency: 40, SoftMaxLatency: 30}},
+		DefaultLatencyMs: 100,
+	}
+	for i := 1; i <= nodes; i++ {
+		trace.Nodes = append(trace.Nodes, fmt.Sprintf("node-%d", i))
+	}
+	for i := 1; i <= users; i++ {
+		userID := fmt.Sprintf("user-%d", i)
+		trace.Users = append(trace.Users, SimulatedUser{ID: userID, App: "nginx"})
+		for _, nodeName := range trace.Nodes {
+			trace.Latencies = append(trace.Latencies, LatencySample{User: userID, Node: nodeName, LatencyMs: 5 + r.Int63n(76)})
+		}
+	}
+	return trace
+}
+
+// latency returns the latency between userID and nodeName after elapsed from the start of the simulation.
+func (t *SimulationTrace) latency(userID, nodeName string, elapsed time.Duration) int64 {
+	latency := t.DefaultLatencyMs
+	found := int64(-1)
+	for _, sample := range t.Latencies {
+		if sample.User == userID && sample.Node == nodeName && sample.AtSeconds <= int64(elapsed.Seconds()) && sample.AtSeconds >= found {
+			latency = sample.LatencyMs
+			found = sample.AtSeconds
+		}
+	}
+	return latency
+}
+
+type AppSimulationReport struct {
+	ConvergenceSeconds float64 `json:"convergenceSeconds"` // virtual time of the last measurement violating the SLOs, -1 if still violated at the end
+	Evictions          int     `json:"evictions"`
+	ReplicaTimeline    []int32 `json:"replicaTimeline"` // replicas at the end of every cycle
+	MaxReplicas        int32   `json:"maxReplicas"`
+	FinalReplicas      int32   `json:"finalReplicas"`
+	HardSLOCompliance  float64 `json:"hardSloCompliance"` // fraction of the requests under the hard threshold
+	SoftSLOCompliance  float64 `json:"softSloCompliance"` // fraction of the requests under the soft threshold
+	MeanLatencyMs      float64 `json:"meanLatencyMs"`
+
+	requests, hardCompliant, softCompliant int
+	latencySum                             int64
+	lastViolationCycle                     int
+	lastViolation                          time.Time
+}
+
+type SimulationReport struct {
+	DurationSeconds float64                         `json:"durationSeconds"`
+	Cycles          int                             `json:"cycles"`
+	Seed            int64                           `json:"seed"`
+	Apps            map[string]*AppSimulationReport `json:"apps"`
+}
+
+// Simulator runs the CustomScheduler and the Descheduler against a fake clientset, on a virtual clock.
+// It plays the role of the ReplicaSet controller, of the latency meters and of the routing manager.
+type Simulator struct {
+	trace       *SimulationTrace
+	clientset   *fake.Clientset
+	clock       *VirtualClock
+	start       time.Time
+	rand        *rand.Rand
+	jitter      int64
+	scheduler   *CustomScheduler
+	descheduler *Descheduler
+	podSeq      int
+	bindings    int
+	reconciling bool
+	cycle       int
+	report      *SimulationReport
+}
+
+func NewSimulator(trace *SimulationTrace, seed, jitter int64) *Simulator {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sim := &Simulator{
+		trace:     trace,
+		clientset: fake.NewSimpleClientset(),
+		clock:     NewVirtualClock(start),
+		start:     start,
+		rand:      rand.New(rand.NewSource(seed)),
+		jitter:    jitter,
+		report:    &SimulationReport{Seed: seed, Apps: make(map[string]*AppSimulationReport)},
+	}
+	clock = sim.clock
+
+	sim.clientset.PrependReactor("list", "*", sim.sortedList)
+	sim.clientset.PrependReactor("create", "pods", sim.bind)
+	sim.clientset.PrependReactor("delete", "pods", sim.countEviction)
+
+	mutex := &sync.Mutex{}
+	hardLatencyThresholds := NewLatencyThreshold()
+	softLatencyThresholds := NewLatencyThreshold()
+	objectives := NewLatencyObjectives()
+	sim.scheduler = NewCustomScheduler(sim.clientset, mutex, hardLatencyThresholds, softLatencyThresholds, objectives)
+	sim.descheduler = NewDescheduler(sim.clientset, mutex, NewLatencyMeasurements(), hardLatencyThresholds, softLatencyThresholds, objectives,
+		NewAssociationPublisher(sim.clientset, "routing"), "", nil, 0, false)
+	sim.descheduler.collectMeasurements = sim.measure
+	sim.descheduler.EnableStateCheckpoints(NewStateStore(sim.clientset, "kube-system", "latency-aware-scheduler-state"), sim.scheduler)
+	return sim
+}
+
+// sortedList returns the objects ordered by name, so the simulation doesn't depend on map ordering.
+func (sim *Simulator) sortedList(action k8stesting.Action) (bool, runtime.Object, error) {
+	listAction, ok := action.(k8stesting.ListActionImpl)
+	if !ok {
+		return false, nil, nil
+	}
+	list, err := sim.clientset.Tracker().List(action.GetResource(), listAction.GetKind(), action.GetNamespace())
+	if err != nil {
+		return true, nil, err
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return true, nil, err
+	}
+	sort.Slice(items, func(i, j int) bool {
+		a, _ := meta.Accessor(items[i])
+		b, _ := meta.Accessor(items[j])
+		return a.GetNamespace()+"/"+a.GetName() < b.GetNamespace()+"/"+b.GetName()
+	})
+	return true, list, meta.SetList(list, items)
+}
+
+// bind emulates the binding subresource: the pod gets the node and an IP, and starts running.
+func (sim *Simulator) bind(action k8stesting.Action) (bool, runtime.Object, error) {
+	if action.GetSubresource() != "binding" {
+		return false, nil, nil
+	}
+	binding := action.(k8stesting.CreateAction).GetObject().(*v1.Binding)
+	obj, err := sim.clientset.Tracker().Get(v1.SchemeGroupVersion.WithResource("pods"), binding.Namespace, binding.Name)
+	if err != nil {
+		return true, nil, err
+	}
+	pod := obj.(*v1.Pod).DeepCopy()
+	pod.Spec.NodeName = binding.Target.Name
+	pod.Status.Phase = v1.PodRunning
+	pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+	sim.bindings++
+	pod.Status.PodIP = fmt.Sprintf("10.244.%d.%d", sim.bindings/250, sim.bindings%250+1)
+	return true, binding, sim.clientset.Tracker().Update(v1.SchemeGroupVersion.WithResource("pods"), pod, pod.Namespace)
+}
+
+func (sim *Simulator) countEviction(action k8stesting.Action) (bool, runtime.Object, error) {
+	if sim.reconciling {
+		return false, nil, nil
+	}
+	deleteAction := action.(k8stesting.DeleteAction)
+	obj, err := sim.clientset.Tracker().Get(v1.SchemeGroupVersion.WithResource("pods"), deleteAction.GetNamespace(), deleteAction.GetName())
+	if err == nil {
+		if appReport, ok := sim.report.Apps[obj.(*v1.Pod).Labels["app"]]; ok {
+			appReport.Evictions++
+		}
+	}
+	return false, nil, nil
+}
+
+func (sim *Simulator) setup() error {
+	ctx := context.Background()
+	controlPlane := &v1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   "control-plane",
+		Labels: map[string]string{"node-role.kubernetes.io/control-plane": ""},
+	}}
+	if _, err := sim.clientset.CoreV1().Nodes().Create(ctx, controlPlane, metav1.CreateOptions{}); err != nil {
+		return err
+	}
+	for _, nodeName := range sim.trace.Nodes {
+		node := &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: nodeName},
+			Status: v1.NodeStatus{Allocatable: v1.ResourceList{
+				v1.ResourceCPU:    resource.MustParse("4"),
+				v1.ResourceMemory: resource.MustParse("8Gi"),
+			}},
+		}
+		if _, err := sim.clientset.CoreV1().Nodes().Create(ctx, node, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+	}
+	for _, app := range sim.trace.Apps {
+		replicas := app.Replicas
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: app.Name + "-deployment", Namespace: "default"},
+			Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		}
+		if _, err := sim.clientset.AppsV1().Deployments("default").Create(ctx, deployment, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+		sim.report.Apps[app.Name] = &AppSimulationReport{lastViolationCycle: -1}
+	}
+	return nil
+}
+
+// reconcile creates or deletes the pods of every app to match the replicas of its deployment.
+func (sim *Simulator) reconcile() error {
+	ctx := context.Background()
+	sim.reconciling = true
+	defer func() { sim.reconciling = false }()
+	for _, app := range sim.trace.Apps {
+		deployment, err := sim.clientset.AppsV1().Deployments("default").Get(ctx, app.Name+"-deployment", metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		pods, err := sim.clientset.CoreV1().Pods("default").List(ctx, metav1.ListOptions{LabelSelector: "app=" + app.Name})
+		if err != nil {
+			return err
+		}
+		replicas := int(*deployment.Spec.Replicas)
+		for i := len(pods.Items); i < replicas; i++ {
+			sim.podSeq++
+			annotations := make(map[string]string)
+			if app.HardMaxLatency >= 0 {
+				annotations["hard_max_latency"] = strconv.FormatInt(app.HardMaxLatency, 10)
+			}
+			if app.SoftMaxLatency >= 0 {
+				annotations["soft_max_latency"] = strconv.FormatInt(app.SoftMaxLatency, 10)
+			}
+			if app.Objective != "" {
+				annotations[latencyObjectiveAnnotation] = app.Objective
+			}
+			if app.MaxUsersPerPod > 0 {
+				annotations[maxUsersPerPodAnnotation] = strconv.Itoa(app.MaxUsersPerPod)
+			}
+			pod := &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        fmt.Sprintf("%s-%05d", app.Name, sim.podSeq),
+					Namespace:   "default",
+					Labels:      map[string]string{"app": app.Name},
+					Annotations: annotations,
+				},
+				Spec: v1.PodSpec{SchedulerName: "latency-aware-scheduler"},
+			}
+			if _, err := sim.clientset.CoreV1().Pods("default").Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+				return err
+			}
+		}
+		// Like the ReplicaSet controller, remove the unscheduled pods first, then the ones with the
+		// lowest deletion cost, then the newest ones
+		for i := len(pods.Items) - 1; i >= replicas; i-- {
+			victim := pods.Items[i]
+			for _, pod := range pods.Items {
+				if (pod.Spec.NodeName == "") != (victim.Spec.NodeName == "") {
+					if pod.Spec.NodeName == "" {
+						victim = pod
+					}
+					continue
+				}
+				if deletionCost(&pod) < deletionCost(&victim) {
+					victim = pod
+				}
+			}
+			if err := sim.clientset.CoreV1().Pods("default").Delete(ctx, victim.Name, metav1.DeleteOptions{}); err != nil {
+				return err
+			}
+			if victim.Spec.NodeName != "" {
+				sim.report.Apps[app.Name].Evictions++ // scale-in requested by the descheduler
+			}
+			pods, _ = sim.clientset.CoreV1().Pods("default").List(ctx, metav1.ListOptions{LabelSelector: "app=" + app.Name})
+		}
+	}
+	return nil
+}
+
+func deletionCost(pod *v1.Pod) int64 {
+	cost, err := strconv.ParseInt(pod.Annotations[podDeletionCostAnnotation], 10, 32)
+	if err != nil {
+		return 0
+	}
+	return cost
+}
+
+func (sim *Simulator) schedulePending() {
+	pods, err := sim.clientset.CoreV1().Pods("default").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return
+	}
+	// the Deployment informer of the scheduler doesn't run in simulation: its cache is filled here
+	deployments, err := sim.clientset.AppsV1().Deployments("default").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return
+	}
+	cached := make([]interface{}, len(deployments.Items))
+	for i := range deployments.Items {
+		cached[i] = &deployments.Items[i]
+	}
+	if err := sim.scheduler.deployments.GetStore().Replace(cached, ""); err != nil {
+		return
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Spec.NodeName != "" {
+			continue
+		}
+		hint := sim.scheduler.placementHint(pod)
+		hintedNodeName := ""
+		if hint != nil {
+			hintedNodeName = hint.Node
+		}
+		node, decision, err := sim.scheduler.chooseNodeForPod(pod, hintedNodeName)
+		if err != nil {
+			fmt.Printf("Error scheduling pod: %v\n", err)
+			continue
+		}
+		if err := sim.scheduler.assignPodToNode(pod, node, decision); err != nil {
+			fmt.Printf("Error scheduling pod: %v\n", err)
+			continue
+		}
+		if decision.Hinted {
+			sim.scheduler.consumePlacementIntent(pod, hint)
+		}
+	}
+}
+
+// measure emulates the routing manager and the latency meters: every user sends a request
+// to its associated pod (or to a random pod of the app) and the meter of that pod measures it.
+func (sim *Simulator) measure() (map[string]map[string]map[string]*LatencyMeasurement, error) {
+	measurements := make(map[string]map[string]map[string]*LatencyMeasurement)
+	podsPerApp := make(map[string][]v1.Pod)
+	pods, err := sim.clientset.CoreV1().Pods("default").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.PodIP != "" {
+			podsPerApp[pod.Labels["app"]] = append(podsPerApp[pod.Labels["app"]], pod)
+		}
+	}
+
+	elapsed := sim.clock.Since(sim.start)
+	violated := make(map[string]bool)
+	for _, user := range sim.trace.Users {
+		appPods := podsPerApp[user.App]
+		if len(appPods) == 0 {
+			continue
+		}
+		target := appPods[sim.rand.Intn(len(appPods))]
+		if association, ok := sim.descheduler.user_Cluster.GetUserClusterAssociation(user.ID, user.App); ok {
+			for _, pod := range appPods {
+				if pod.Name == association.PodName {
+					target = pod
+					break
+				}
+			}
+		}
+		latency := sim.trace.latency(user.ID, target.Spec.NodeName, elapsed)
+		if sim.jitter > 0 {
+			latency += sim.rand.Int63n(2*sim.jitter+1) - sim.jitter
+		}
+		if latency < 0 {
+			latency = 0
+		}
+		if _, ok := measurements[user.App]; !ok {
+			measurements[user.App] = make(map[string]map[string]*LatencyMeasurement)
+		}
+		measurements[user.App][user.ID] = map[string]*LatencyMeasurement{
+			target.Spec.NodeName: {PodNamespace: target.Namespace, PodName: target.Name, Measurement: latency, Timestamp: sim.clock.Now(), Requests: 1},
+		}
+
+		appReport := sim.report.Apps[user.App]
+		appReport.requests++
+		appReport.latencySum += latency
+		hard, soft := sim.thresholds(user.App)
+		if hard < 0 || latency <= hard {
+			appReport.hardCompliant++
+		} else {
+			violated[user.App] = true
+		}
+		if soft < 0 || latency <= soft {
+			appReport.softCompliant++
+		} else if hard < 0 {
+			violated[user.App] = true
+		}
+	}
+	for appName := range violated {
+		sim.report.Apps[appName].lastViolationCycle = sim.cycle
+		sim.report.Apps[appName].lastViolation = sim.clock.Now()
+	}
+	return measurements, nil
+}
+
+func (sim *Simulator) thresholds(appName string) (int64, int64) {
+	for _, app := range sim.trace.Apps {
+		if app.Name == appName {
+			return app.HardMaxLatency, app.SoftMaxLatency
+		}
+	}
+	return -1, -1
+}
+
+// Run advances the virtual clock by checkInterval per cycle until duration, and returns the report.
+func (sim *Simulator) Run(duration time.Duration) (*SimulationReport, error) {
+	if err := sim.setup(); err != nil {
+		return nil, err
+	}
+	N_tot, err := sim.descheduler.getTotalNodes()
+	if err != nil {
+		return nil, err
+	}
+	for sim.cycle = 0; sim.clock.Since(sim.start) < duration; sim.cycle++ {
+		if err := sim.reconcile(); err != nil {
+			return nil, err
+		}
+		sim.schedulePending()
+		sim.clock.Advance(checkInterval)
+		sim.descheduler.RunOnce(N_tot)
+		for appName, appReport := range sim.report.Apps {
+			replicas, err := sim.descheduler.getReplicasByApp(appName)
+			if err != nil {
+				return nil, err
+			}
+			appReport.ReplicaTimeline = append(appReport.ReplicaTimeline, replicas)
+			if replicas > appReport.MaxReplicas {
+				appReport.MaxReplicas = replicas
+			}
+			appReport.FinalReplicas = replicas
+		}
+	}
+
+	sim.report.Cycles = sim.cycle
+	sim.report.DurationSeconds = sim.clock.Since(sim.start).Seconds()
+	for _, appReport := range sim.report.Apps {
+		// the cycles last longer than checkInterval when the descheduler waits for the scheduler
+		switch {
+		case appReport.lastViolationCycle == sim.cycle-1:
+			appReport.ConvergenceSeconds = -1
+		case appReport.lastViolationCycle < 0:
+			appReport.ConvergenceSeconds = 0
+		default:
+			appReport.ConvergenceSeconds = appReport.lastViolation.Sub(sim.start).Seconds()
+		}
+		if appReport.requests > 0 {
+			appReport.HardSLOCompliance = float64(appReport.hardCompliant) / float64(appReport.requests)
+			appReport.SoftSLOCompliance = float64(appReport.softCompliant) / float64(appReport.requests)
+			appReport.MeanLatencyMs = float64(appReport.latencySum) / float64(appReport.requests)
+		}
+	}
+	return sim.report, nil
+}
+
+// runSimulation runs the simulation mode of the scheduler and prints the report as JSON.
+func runSimulation(tracePath string, nodes, users int, duration time.Duration, seed, jitter int64, verbose, globalPlacement bool, maxReplicas int, migrate bool, explorer *Explorer) {
+	var trace *SimulationTrace
+	if tracePath != "" {
+		var err error
+		trace, err = LoadSimulationTrace(tracePath)
+		if err != nil {
+			fmt.Println("Error loading the trace:", err)
+			return
+		}
+	} else {
+		trace = GenerateSimulationTrace(nodes, users, seed)
+	}
+
+	stdout := os.Stdout
+	if !verbose { // the scheduling logic is very chatty
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err == nil {
+			os.Stdout = devNull
+			defer devNull.Close()
+		}
+	}
+	sim := NewSimulator(trace, seed, jitter)
+	if globalPlacement {
+		sim.descheduler.EnableGlobalPlacement(maxReplicas)
+	}
+	if migrate {
+		sim.descheduler.EnableMigrations(NewMigrationStore(sim.clientset, "kube-system", "latency-aware-scheduler-migrations"))
+	}
+	if explorer != nil {
+		sim.descheduler.EnableExploration(explorer)
+	}
+	report, err := sim.Run(duration)
+	os.Stdout = stdout
+	if err != nil {
+		fmt.Println("Error running the simulation:", err)
+		return
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+}
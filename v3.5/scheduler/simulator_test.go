@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadSimulationTraceThresholds(t *testing.T) {
+	tests := []struct {
+		name     string
+		app      string
+		hard     int64
+		soft     int64
+		replicas int32
+	}{
+		{"both thresholds", `{"name": "a", "replicas": 2, "hardMaxLatency": 40, "softMaxLatency": 30}`, 40, 30, 2},
+		{"no soft threshold", `{"name": "a", "replicas": 1, "hardMaxLatency": 40}`, 40, -1, 1},
+		{"no threshold", `{"name": "a"}`, -1, -1, 0},
+		{"explicit zero", `{"name": "a", "hardMaxLatency": 0, "softMaxLatency": -1}`, 0, -1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "trace.json")
+			if err := os.WriteFile(path, []byte(`{"nodes": ["n1"], "apps": [`+tt.app+`]}`), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			trace, err := LoadSimulationTrace(path)
+			if err != nil {
+				t.Fatalf("LoadSimulationTrace: %v", err)
+			}
+			app := trace.Apps[0]
+			if app.HardMaxLatency != tt.hard || app.SoftMaxLatency != tt.soft || app.Replicas != tt.replicas {
+				t.Errorf("got hard %d soft %d replicas %d, want %d %d %d", app.HardMaxLatency, app.SoftMaxLatency, app.Replicas, tt.hard, tt.soft, tt.replicas)
+			}
+			if trace.DefaultLatencyMs != 100 {
+				t.Errorf("default latency %d, want 100", trace.DefaultLatencyMs)
+			}
+		})
+	}
+}
+
+func TestSimulationConvergence(t *testing.T) {
+	tests := []struct {
+		name      string
+		trace     func() *SimulationTrace
+		duration  time.Duration
+		converged bool
+	}{
+		{"generated trace", func() *SimulationTrace { return GenerateSimulationTrace(4, 10, 1) }, 20 * time.Minute, true},
+		{"unreachable threshold", func() *SimulationTrace {
+			trace := GenerateSimulationTrace(2, 2, 1)
+			trace.Apps[0].HardMaxLatency, trace.Apps[0].SoftMaxLatency = 1, -1
+			return trace
+		}, 5 * time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(previous Clock) { clock = previous }(clock)
+			report, err := NewSimulator(tt.trace(), 1, 2).Run(tt.duration)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			app := report.Apps["nginx"]
+			if !tt.converged {
+				if app.ConvergenceSeconds != -1 {
+					t.Errorf("converged after %vs with an unreachable threshold", app.ConvergenceSeconds)
+				}
+				return
+			}
+			if app.ConvergenceSeconds < 0 || app.ConvergenceSeconds > report.DurationSeconds {
+				t.Fatalf("convergence %vs out of the %vs of the simulation", app.ConvergenceSeconds, report.DurationSeconds)
+			}
+			// the cycles where the descheduler waited for the scheduler last longer than checkInterval
+			cycles := float64(app.lastViolationCycle + 1)
+			if app.ConvergenceSeconds < cycles*checkInterval.Seconds() {
+				t.Errorf("convergence %vs shorter than the %v cycles before it", app.ConvergenceSeconds, cycles)
+			}
+			if report.DurationSeconds < float64(report.Cycles)*checkInterval.Seconds() {
+				t.Errorf("%d cycles in %vs", report.Cycles, report.DurationSeconds)
+			}
+		})
+	}
+}
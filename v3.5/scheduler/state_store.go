@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	stateDataKey = "state.json"
+	stateVersion = 1
+)
+
+// SchedulerState is the in-memory state of the scheduler and the descheduler that must survive a restart.
+type SchedulerState struct {
+	Version               int
+	SavedAt               time.Time
+	Measurements          map[string]map[string]map[string]*LatencyMeasurement // appName -> userID -> nodeName -> measurement
+	Associations          map[string]map[string]*ClusterInfo                   // userID -> appName -> cluster info
+	HardLatencyThresholds map[string]int64
+	SoftLatencyThresholds map[string]int64
+	LatencyObjectives     map[string]LatencyObjective
+	DefaultReplicas       map[string]int32             // replicas of the apps before they were scaled up
+	VisitedNodesPerApp    map[string]map[string]bool   // appName -> nodeName -> visited
+	PausedApps            []string                     // apps paused through the admin API
+	ThresholdOverrides    map[string]ThresholdsRequest // thresholds set through the admin API, over the pod annotations
+}
+
+// StateStore checkpoints the SchedulerState into a ConfigMap.
+type StateStore struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+	saved     string // last saved payload, without SavedAt
+}
+
+func NewStateStore(clientset kubernetes.Interface, namespace, name string) *StateStore {
+	return &StateStore{
+		clientset: clientset,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+// Save writes the state if it changed since the last checkpoint. If the state doesn't fit in a
+// ConfigMap the measurements are left out, since they are collected again within a cycle.
+func (st *StateStore) Save(state *SchedulerState) error {
+	state.Version = stateVersion
+	state.SavedAt = time.Time{}
+	unchanged, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error marshaling scheduler state: %v", err)
+	}
+	if string(unchanged) == st.saved {
+		return nil
+	}
+
+	state.SavedAt = clock.Now()
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error marshaling scheduler state: %v", err)
+	}
+	if len(payload) > maxConfigMapDataSize {
+		fmt.Printf("Scheduler state too large (%d bytes), saving it without measurements\n", len(payload))
+		measurements := state.Measurements
+		state.Measurements = nil
+		payload, err = json.Marshal(state)
+		state.Measurements = measurements
+		if err != nil {
+			return fmt.Errorf("error marshaling scheduler state: %v", err)
+		}
+		if len(payload) > maxConfigMapDataSize {
+			return fmt.Errorf("scheduler state too large (%d bytes)", len(payload))
+		}
+	}
+
+	configMaps := st.clientset.CoreV1().ConfigMaps(st.namespace)
+	configMap, err := configMaps.Get(context.Background(), st.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		configMap = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: st.name, Namespace: st.namespace},
+			Data:       map[string]string{stateDataKey: string(payload)},
+		}
+		_, err = configMaps.Create(context.Background(), configMap, metav1.CreateOptions{})
+	} else if err == nil {
+		if configMap.Data == nil {
+			configMap.Data = make(map[string]string)
+		}
+		configMap.Data[stateDataKey] = string(payload)
+		_, err = configMaps.Update(context.Background(), configMap, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("error saving scheduler state in ConfigMap %s/%s: %v", st.namespace, st.name, err)
+	}
+	st.saved = string(unchanged)
+	return nil
+}
+
+// Load returns the last checkpoint, or nil if there is none.
+func (st *StateStore) Load() (*SchedulerState, error) {
+	configMap, err := st.clientset.CoreV1().ConfigMaps(st.namespace).Get(context.Background(), st.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading scheduler state from ConfigMap %s/%s: %v", st.namespace, st.name, err)
+	}
+	var state SchedulerState
+	if err := json.Unmarshal([]byte(configMap.Data[stateDataKey]), &state); err != nil {
+		return nil, fmt.Errorf("error unmarshaling scheduler state: %v", err)
+	}
+	if state.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported scheduler state version %d", state.Version)
+	}
+	if state.Measurements == nil {
+		state.Measurements = make(map[string]map[string]map[string]*LatencyMeasurement)
+	}
+	if state.Associations == nil {
+		state.Associations = make(map[string]map[string]*ClusterInfo)
+	}
+	if state.HardLatencyThresholds == nil {
+		state.HardLatencyThresholds = make(map[string]int64)
+	}
+	if state.SoftLatencyThresholds == nil {
+		state.SoftLatencyThresholds = make(map[string]int64)
+	}
+	if state.LatencyObjectives == nil {
+		state.LatencyObjectives = make(map[string]LatencyObjective)
+	}
+	if state.DefaultReplicas == nil {
+		state.DefaultReplicas = make(map[string]int32)
+	}
+	if state.VisitedNodesPerApp == nil {
+		state.VisitedNodesPerApp = make(map[string]map[string]bool)
+	}
+	if state.ThresholdOverrides == nil {
+		state.ThresholdOverrides = make(map[string]ThresholdsRequest)
+	}
+	return &state, nil
+}
+
+// reconcileState drops from a restored state what no longer matches the cluster: nodes that were
+// removed, associations to pods that are gone or moved, apps whose deployment was deleted.
+// Default replicas are lowered to the current ones, and thresholds are read again from the pods,
+// except the ones set through the admin API.
+func (d *Descheduler) reconcileState(state *SchedulerState) error {
+	nodes, err := d.clientset.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing nodes: %v", err)
+	}
+	pods, err := d.clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing pods: %v", err)
+	}
+	liveNodes := make(map[string]bool)
+	for _, node := range nodes.Items {
+		liveNodes[node.Name] = true
+	}
+	livePods := make(map[string]*v1.Pod)  // namespace/podName -> pod
+	appPods := make(map[string][]*v1.Pod) // appName -> pods of appNamespace
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		livePods[pod.Namespace+"/"+pod.Name] = pod
+		if appName, ok := pod.Labels["app"]; ok && pod.Namespace == appNamespace {
+			appPods[appName] = append(appPods[appName], pod)
+		}
+	}
+	pruned := 0
+
+	for _, userMeasurements := range state.Measurements {
+		for _, nodeMeasurements := range userMeasurements {
+			for nodeName := range nodeMeasurements {
+				if !liveNodes[nodeName] {
+					delete(nodeMeasurements, nodeName)
+					pruned++
+				}
+			}
+		}
+	}
+	for _, visitedNodes := range state.VisitedNodesPerApp {
+		for nodeName := range visitedNodes {
+			if !liveNodes[nodeName] {
+				delete(visitedNodes, nodeName)
+				pruned++
+			}
+		}
+	}
+	for userID, appAssociations := range state.Associations {
+		for appName, clusterInfo := range appAssociations {
+			pod, ok := livePods[appNamespace+"/"+clusterInfo.PodName] // the associations are to the pods of appNamespace
+			if !ok || pod.Spec.NodeName != clusterInfo.ClusterName {
+				fmt.Printf("Dropping restored association of user %s for app %s: pod %s no longer on node %s\n", userID, appName, clusterInfo.PodName, clusterInfo.ClusterName)
+				delete(appAssociations, appName)
+				pruned++
+			}
+		}
+		if len(appAssociations) == 0 {
+			delete(state.Associations, userID)
+		}
+	}
+	for appName, replicas := range state.DefaultReplicas {
+		deployment, err := d.clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), appName+"-deployment", metav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("error retrieving deployment: %v", err)
+		}
+		if errors.IsNotFound(err) {
+			fmt.Printf("Dropping restored state of app %s: deployment not found\n", appName)
+			delete(state.DefaultReplicas, appName)
+			delete(state.VisitedNodesPerApp, appName)
+			delete(state.HardLatencyThresholds, appName)
+			delete(state.SoftLatencyThresholds, appName)
+			delete(state.LatencyObjectives, appName)
+			delete(state.ThresholdOverrides, appName)
+			pruned++
+			continue
+		}
+		if current := *deployment.Spec.Replicas; current < replicas {
+			fmt.Printf("Deployment of app %s scaled down to %d while the scheduler was stopped, using it as default replicas\n", appName, current)
+			state.DefaultReplicas[appName] = current
+		}
+	}
+	for appName := range state.ThresholdOverrides {
+		if _, checked := state.DefaultReplicas[appName]; checked {
+			continue
+		}
+		_, err := d.clientset.AppsV1().Deployments(appNamespace).Get(context.Background(), appName+"-deployment", metav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("error retrieving deployment: %v", err)
+		}
+		if errors.IsNotFound(err) {
+			fmt.Printf("Dropping the thresholds of app %s set through the admin API: deployment not found\n", appName)
+			delete(state.ThresholdOverrides, appName)
+			pruned++
+		}
+	}
+	for appName, pods := range appPods {
+		hard, soft, err := d.scheduler.getLatencyThreshold(pods[0])
+		if err != nil {
+			continue
+		}
+		updateThreshold(state.HardLatencyThresholds, appName, hard)
+		updateThreshold(state.SoftLatencyThresholds, appName, soft)
+		if objective, err := getLatencyObjective(pods[0]); err == nil && objective != "" {
+			state.LatencyObjectives[appName] = objective
+		} else {
+			delete(state.LatencyObjectives, appName)
+		}
+	}
+	for appName, override := range state.ThresholdOverrides {
+		if override.HardMs != nil {
+			state.HardLatencyThresholds[appName] = *override.HardMs
+		}
+		if override.SoftMs != nil {
+			state.SoftLatencyThresholds[appName] = *override.SoftMs
+		}
+	}
+	fmt.Printf("Scheduler state checked against the cluster: %d stale entries dropped\n", pruned)
+	return nil
+}
+
+func updateThreshold(thresholds map[string]int64, appName string, threshold int64) {
+	if threshold == -1 {
+		delete(thresholds, appName)
+		return
+	}
+	thresholds[appName] = threshold
+}
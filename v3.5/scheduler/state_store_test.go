@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestDescheduler returns a descheduler and its scheduler on a fake cluster with the objects.
+func newTestDescheduler(objects ...runtime.Object) (*Descheduler, *fake.Clientset) {
+	clientset := fake.NewSimpleClientset(objects...)
+	mutex := &sync.Mutex{}
+	hardLatencyThresholds, softLatencyThresholds, objectives := NewLatencyThreshold(), NewLatencyThreshold(), NewLatencyObjectives()
+	scheduler := NewCustomScheduler(clientset, mutex, hardLatencyThresholds, softLatencyThresholds, objectives)
+	d := NewDescheduler(clientset, mutex, NewLatencyMeasurements(), hardLatencyThresholds, softLatencyThresholds, objectives,
+		NewAssociationPublisher(clientset, "routing"), "", nil, 0, false)
+	d.EnableStateCheckpoints(NewStateStore(clientset, "kube-system", "latency-aware-scheduler-state"), scheduler)
+	return d, clientset
+}
+
+func testNode(name string) *v1.Node {
+	return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+}
+
+func testPod(appName, podName, nodeName string, annotations map[string]string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: podName, Namespace: "default", Labels: map[string]string{"app": appName}, Annotations: annotations},
+		Spec:       v1.PodSpec{NodeName: nodeName},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	}
+}
+
+func inNamespace(pod *v1.Pod, namespace string) *v1.Pod {
+	pod.Namespace = namespace
+	return pod
+}
+
+func testDeployment(appName string, replicas int32) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: appName + "-deployment", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+	}
+}
+
+func TestStateCheckpointRestore(t *testing.T) {
+	hard40 := map[string]string{"hard_max_latency": "40"}
+	tests := []struct {
+		name         string
+		restoreOn    []runtime.Object // cluster when the scheduler restarts
+		associations map[string]string
+		replicas     int32
+		override     int64 // hard threshold set through the admin API before the restart, 0 if none
+		hard         int64 // -1 if dropped
+	}{
+		{
+			name:         "unchanged cluster",
+			restoreOn:    []runtime.Object{testNode("n1"), testPod("a", "a-1", "n1", hard40), testDeployment("a", 3)},
+			associations: map[string]string{"u1": "a-1"},
+			replicas:     2,
+			hard:         40,
+		},
+		{
+			name:         "pod moved to another node",
+			restoreOn:    []runtime.Object{testNode("n1"), testNode("n2"), testPod("a", "a-1", "n2", hard40), testDeployment("a", 3)},
+			associations: map[string]string{},
+			replicas:     2,
+			hard:         40,
+		},
+		{
+			name:         "pod of the same name in another namespace",
+			restoreOn:    []runtime.Object{testNode("n1"), inNamespace(testPod("a", "a-1", "n1", map[string]string{"hard_max_latency": "25"}), "other"), testDeployment("a", 3)},
+			associations: map[string]string{},
+			replicas:     2,
+			hard:         40,
+		},
+		{
+			name:         "deployment scaled down while stopped",
+			restoreOn:    []runtime.Object{testNode("n1"), testPod("a", "a-1", "n1", hard40), testDeployment("a", 1)},
+			associations: map[string]string{"u1": "a-1"},
+			replicas:     1,
+			hard:         40,
+		},
+		{
+			name:         "threshold removed from the pods",
+			restoreOn:    []runtime.Object{testNode("n1"), testPod("a", "a-1", "n1", nil), testDeployment("a", 3)},
+			associations: map[string]string{"u1": "a-1"},
+			replicas:     2,
+			hard:         -1,
+		},
+		{
+			name:         "threshold read again from the pods",
+			restoreOn:    []runtime.Object{testNode("n1"), testPod("a", "a-1", "n1", map[string]string{"hard_max_latency": "25"}), testDeployment("a", 3)},
+			associations: map[string]string{"u1": "a-1"},
+			replicas:     2,
+			hard:         25,
+		},
+		{
+			name:         "deployment deleted",
+			restoreOn:    []runtime.Object{testNode("n1"), testPod("a", "a-1", "n1", nil)},
+			associations: map[string]string{"u1": "a-1"},
+			hard:         -1,
+		},
+		{
+			name:         "threshold of the admin API kept over the pods",
+			restoreOn:    []runtime.Object{testNode("n1"), testPod("a", "a-1", "n1", map[string]string{"hard_max_latency": "25"}), testDeployment("a", 3)},
+			associations: map[string]string{"u1": "a-1"},
+			replicas:     2,
+			override:     60,
+			hard:         60,
+		},
+		{
+			name:         "threshold of the admin API dropped with the deployment",
+			restoreOn:    []runtime.Object{testNode("n1"), testPod("a", "a-1", "n1", nil)},
+			associations: map[string]string{"u1": "a-1"},
+			override:     60,
+			hard:         -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved, savedClientset := newTestDescheduler()
+			saved.user_Cluster.RestoreAssociation("u1", "a", &ClusterInfo{ClusterName: "n1", PodName: "a-1", CreatedAt: time.Now()})
+			saved.hardLatencyThresholds.SetLatency("a", 40)
+			saved.defaultReplicas["a"] = 2
+			if tt.override != 0 {
+				saved.hardLatencyThresholds.SetLatency("a", tt.override)
+				saved.thresholdOverrides["a"] = ThresholdsRequest{HardMs: &tt.override}
+			}
+			if err := saved.stateStore.Save(saved.captureState()); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			checkpoint, err := savedClientset.CoreV1().ConfigMaps("kube-system").Get(context.Background(), "latency-aware-scheduler-state", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("checkpoint: %v", err)
+			}
+
+			restored, _ := newTestDescheduler(append(tt.restoreOn, checkpoint)...)
+			if err := restored.restoreState(); err != nil {
+				t.Fatalf("restoreState: %v", err)
+			}
+			for userID, podName := range tt.associations {
+				clusterInfo, ok := restored.user_Cluster.GetUserClusterAssociation(userID, "a")
+				if !ok || clusterInfo.PodName != podName {
+					t.Errorf("user %s: restored %+v, want pod %s", userID, clusterInfo, podName)
+				}
+			}
+			if got := len(restored.user_Cluster.GetUserClusterAssociations()); got != len(tt.associations) {
+				t.Errorf("restored %d users with associations, want %d", got, len(tt.associations))
+			}
+			if !restored.user_Cluster.Changed() {
+				t.Error("restored associations are not republished")
+			}
+			if replicas := restored.captureState().DefaultReplicas["a"]; replicas != tt.replicas {
+				t.Errorf("default replicas %d, want %d", replicas, tt.replicas)
+			}
+			hard, ok := restored.hardLatencyThresholds.GetLatency("a")
+			if !ok {
+				hard = -1
+			}
+			if hard != tt.hard {
+				t.Errorf("hard threshold %d, want %d", hard, tt.hard)
+			}
+		})
+	}
+}
+
+// TestStateCaptureConcurrentRestore captures the state while another goroutine restores and reads it,
+// as the admin API does during a cycle (go test -race).
+func TestStateCaptureConcurrentRestore(t *testing.T) {
+	d, _ := newTestDescheduler(testNode("n1"), testPod("a", "a-1", "n1", nil), testDeployment("a", 2))
+	associations := map[string]map[string]*ClusterInfo{"u1": {"a": {ClusterName: "n1", PodName: "a-1", CreatedAt: time.Now()}}}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			d.user_Cluster.ReplaceAssociations(associations)
+			d.replicasMutex.Lock()
+			d.defaultReplicas["a"] = int32(i)
+			d.replicasMutex.Unlock()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			d.captureState()
+		}
+	}()
+	wg.Wait()
+	if _, ok := d.user_Cluster.GetUserClusterAssociation("u1", "a"); !ok {
+		t.Error("association lost")
+	}
+}
@@ -0,0 +1,123 @@
+// Package cohorts groups the users by the network of their IP, for the descheduler, which places the
+// cohorts instead of the individual users, and for the routing managers, which route a user without
+// an association of its own by the association of its cohort.
+package cohorts
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+)
+
+const (
+	// DataKey holds the configuration in the ConfigMaps of the associations, next to them.
+	DataKey = "cohorts.json"
+	// NetworkPrefix and RegionPrefix start the keys of the cohorts, e.g. net:192.0.2.0/24 or region:eu-west.
+	NetworkPrefix = "net:"
+	RegionPrefix  = "region:"
+)
+
+// Region maps the users of a network to a region.
+type Region struct {
+	CIDR   string `json:"cidr"`
+	Region string `json:"region"`
+
+	network *net.IPNet
+}
+
+// Config groups the users by the network of their IP: the most specific region that contains it, or
+// else its /PrefixV4 (or /PrefixV6) network. The Overrides users, and the users without a source IP,
+// are kept individually. The descheduler publishes it to the routing managers as JSON.
+type Config struct {
+	PrefixV4  int       `json:"prefixV4"`
+	PrefixV6  int       `json:"prefixV6"`
+	Regions   []*Region `json:"regions,omitempty"`
+	Overrides []string  `json:"overrides,omitempty"`
+
+	overrides map[string]bool
+}
+
+// Load validates the prefix lengths and loads the regions from the JSON file regionsFile,
+// e.g. [{"cidr": "10.1.0.0/16", "region": "eu-west"}], if it isn't empty.
+func Load(prefixV4, prefixV6 int, regionsFile string, overrides []string) (*Config, error) {
+	config := &Config{PrefixV4: prefixV4, PrefixV6: prefixV6, Overrides: overrides}
+	if regionsFile != "" {
+		data, err := os.ReadFile(regionsFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the cohort regions: %v", err)
+		}
+		if err := json.Unmarshal(data, &config.Regions); err != nil {
+			return nil, fmt.Errorf("error parsing the cohort regions: %v", err)
+		}
+	}
+	if err := config.init(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Parse reads the configuration published by the descheduler.
+func Parse(payload string) (*Config, error) {
+	var config Config
+	if err := json.Unmarshal([]byte(payload), &config); err != nil {
+		return nil, err
+	}
+	if err := config.init(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func (c *Config) init() error {
+	if c.PrefixV4 < 1 || c.PrefixV4 > 32 || c.PrefixV6 < 1 || c.PrefixV6 > 128 {
+		return fmt.Errorf("the cohort prefixes must be between 1 and 32 (IPv4) and 1 and 128 (IPv6)")
+	}
+	for i, region := range c.Regions {
+		var err error
+		if _, region.network, err = net.ParseCIDR(region.CIDR); err != nil {
+			return fmt.Errorf("region %d: invalid CIDR %s: %v", i, region.CIDR, err)
+		}
+		if region.Region == "" {
+			return fmt.Errorf("region %d: no name for %s", i, region.CIDR)
+		}
+	}
+	c.overrides = make(map[string]bool)
+	for _, userID := range c.Overrides {
+		c.overrides[userID] = true
+	}
+	return nil
+}
+
+// KeptIndividually counts the Overrides users.
+func (c *Config) KeptIndividually() int {
+	return len(c.overrides)
+}
+
+// Cohort returns the cohort of the user with the IP sourceIP, or the user itself if it is kept individually.
+func (c *Config) Cohort(userID, sourceIP string) string {
+	ip := net.ParseIP(sourceIP)
+	if c.overrides[userID] || ip == nil {
+		return userID
+	}
+	var region *Region
+	for _, candidate := range c.Regions {
+		if candidate.network.Contains(ip) {
+			if region == nil || maskSize(candidate.network) > maskSize(region.network) {
+				region = candidate
+			}
+		}
+	}
+	if region != nil {
+		return RegionPrefix + region.Region
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return NetworkPrefix + (&net.IPNet{IP: ip4.Mask(net.CIDRMask(c.PrefixV4, 32)), Mask: net.CIDRMask(c.PrefixV4, 32)}).String()
+	}
+	return NetworkPrefix + (&net.IPNet{IP: ip.Mask(net.CIDRMask(c.PrefixV6, 128)), Mask: net.CIDRMask(c.PrefixV6, 128)}).String()
+}
+
+func maskSize(network *net.IPNet) int {
+	ones, _ := network.Mask.Size()
+	return ones
+}
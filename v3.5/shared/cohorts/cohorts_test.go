@@ -0,0 +1,97 @@
+package cohorts
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCohort(t *testing.T) {
+	config, err := Parse(`{"prefixV4": 24, "prefixV6": 48, "overrides": ["vip"], "regions": [
+		{"cidr": "10.1.0.0/16", "region": "eu-west"},
+		{"cidr": "10.1.2.0/24", "region": "eu-west-dublin"}]}`)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	tests := []struct {
+		name     string
+		userID   string
+		sourceIP string
+		want     string
+	}{
+		{"IPv4 network", "u1", "192.0.2.77", "net:192.0.2.0/24"},
+		{"IPv6 network", "u1", "2001:db8:1:2::7", "net:2001:db8:1::/48"},
+		{"region", "u1", "10.1.9.1", "region:eu-west"},
+		{"most specific region", "u1", "10.1.2.3", "region:eu-west-dublin"},
+		{"user kept individually", "vip", "192.0.2.77", "vip"},
+		{"no source IP", "u1", "", "u1"},
+		{"unreadable source IP", "u1", "nope", "u1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := config.Cohort(tt.userID, tt.sourceIP); got != tt.want {
+				t.Errorf("got cohort %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		wantErr string
+	}{
+		{"valid", `{"prefixV4": 24, "prefixV6": 48}`, ""},
+		{"IPv4 prefix out of range", `{"prefixV4": 33, "prefixV6": 48}`, "prefixes"},
+		{"no IPv6 prefix", `{"prefixV4": 24}`, "prefixes"},
+		{"invalid region CIDR", `{"prefixV4": 24, "prefixV6": 48, "regions": [{"cidr": "10.1/16", "region": "a"}]}`, "invalid CIDR"},
+		{"region without a name", `{"prefixV4": 24, "prefixV6": 48, "regions": [{"cidr": "10.1.0.0/16"}]}`, "no name"},
+		{"not JSON", `prefix`, "invalid character"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.payload)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Parse: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestLoadParseRoundTrip publishes a loaded configuration, as the descheduler does, and parses it
+// as a routing manager: both must find the same cohorts.
+func TestLoadParseRoundTrip(t *testing.T) {
+	regionsFile := filepath.Join(t.TempDir(), "regions.json")
+	if err := os.WriteFile(regionsFile, []byte(`[{"cidr": "10.1.0.0/16", "region": "eu-west"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(24, 48, regionsFile, []string{"vip"})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	payload, err := json.Marshal(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Parse(string(payload))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	for _, user := range [][2]string{{"u1", "10.1.9.1"}, {"u1", "192.0.2.77"}, {"vip", "10.1.9.1"}} {
+		if got, want := parsed.Cohort(user[0], user[1]), loaded.Cohort(user[0], user[1]); got != want {
+			t.Errorf("user %s at %s: cohort %s for the routing manager, %s for the descheduler", user[0], user[1], got, want)
+		}
+	}
+	if _, err := Load(24, 48, filepath.Join(t.TempDir(), "missing.json"), nil); err == nil {
+		t.Error("missing regions file accepted")
+	}
+}
@@ -0,0 +1,82 @@
+// Package controltls serves the control endpoints of the latency meter and the routing manager over
+// TLS, and verifies them in the scheduler, so the token of the scheduler never travels in clear.
+package controltls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+// DefaultServerName is the DNS name of the certificates of the control endpoints, verified by the
+// scheduler: the meters are reached by pod IP, so the certificates can't name them.
+const DefaultServerName = "latency-control"
+
+// SelfSigned generates a certificate for name, valid for a year.
+func SelfSigned(name string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// ServerConfig returns the TLS configuration of the control endpoints with the given certificate, or
+// with a self-signed one for DefaultServerName if certFile is empty.
+func ServerConfig(certFile, keyFile string) (*tls.Config, error) {
+	var certificate tls.Certificate
+	var err error
+	if certFile != "" {
+		certificate, err = tls.LoadX509KeyPair(certFile, keyFile)
+	} else {
+		certificate, err = SelfSigned(DefaultServerName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading the certificate of the control endpoints: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// ServerConfigFromEnv returns the ServerConfig of the certificate and key in CONTROL_TLS_CERT_FILE and
+// CONTROL_TLS_KEY_FILE.
+func ServerConfigFromEnv() (*tls.Config, error) {
+	return ServerConfig(os.Getenv("CONTROL_TLS_CERT_FILE"), os.Getenv("CONTROL_TLS_KEY_FILE"))
+}
+
+// ClientConfig returns the TLS configuration that verifies the certificates of the control endpoints
+// for serverName against the CA certificates in caFile. Without caFile the connection is still
+// encrypted, but the certificates (e.g. self-signed) aren't verified.
+func ClientConfig(caFile, serverName string) (*tls.Config, error) {
+	if caFile == "" {
+		return &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS12}, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the CA of the control endpoints: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in %s", caFile)
+	}
+	return &tls.Config{RootCAs: roots, ServerName: serverName, MinVersion: tls.VersionTLS12}, nil
+}
@@ -0,0 +1,123 @@
+package controltls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCA writes a CA certificate and a certificate it signed for serverName, returning their files.
+func writeCA(t *testing.T, serverName string) (caFile, certFile, keyFile string) {
+	dir := t.TempDir()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: serverName},
+		DNSNames:     []string{serverName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	files := map[string][]byte{
+		"ca.crt":  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		"tls.crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		"tls.key": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "ca.crt"), filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+}
+
+func TestControlTLS(t *testing.T) {
+	caFile, certFile, keyFile := writeCA(t, DefaultServerName)
+	otherCAFile, _, _ := writeCA(t, DefaultServerName)
+	tests := []struct {
+		name       string
+		signed     bool // served with the certificate of the CA, self-signed otherwise
+		caFile     string
+		serverName string
+		wantErr    bool
+	}{
+		{"verified", true, caFile, DefaultServerName, false},
+		{"other server name", true, caFile, "other", true},
+		{"other CA", true, otherCAFile, DefaultServerName, true},
+		{"self-signed rejected with a CA", false, caFile, DefaultServerName, true},
+		{"self-signed encrypted without CA", false, "", DefaultServerName, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var serverConfigErr error
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			if tt.signed {
+				server.TLS, serverConfigErr = ServerConfig(certFile, keyFile)
+			} else {
+				server.TLS, serverConfigErr = ServerConfig("", "")
+			}
+			if serverConfigErr != nil {
+				t.Fatal(serverConfigErr)
+			}
+			server.StartTLS()
+			defer server.Close()
+
+			clientConfig, err := ClientConfig(tt.caFile, tt.serverName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+			response, err := client.Get(server.URL)
+			if err == nil {
+				response.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	if _, err := ServerConfig(filepath.Join(t.TempDir(), "missing.crt"), "missing.key"); err == nil {
+		t.Error("missing certificate loaded")
+	}
+	if _, err := ClientConfig(filepath.Join(t.TempDir(), "missing.crt"), DefaultServerName); err == nil {
+		t.Error("missing CA loaded")
+	}
+	empty := filepath.Join(t.TempDir(), "empty.crt")
+	os.WriteFile(empty, nil, 0o600)
+	if _, err := ClientConfig(empty, DefaultServerName); err == nil {
+		t.Error("CA without certificates loaded")
+	}
+}
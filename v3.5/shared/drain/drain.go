@@ -0,0 +1,42 @@
+// Package drain defines the annotations with which the scheduler drains a pod through the routing
+// managers before removing it: the routing managers stop sending it new requests and acknowledge
+// once the requests in flight are done.
+package drain
+
+import "time"
+
+const (
+	// DeadlineAnnotation marks a pod about to be removed, until the time the routing managers have to drain it.
+	DeadlineAnnotation = "latency-aware-scheduler/drain-deadline"
+	// AckAnnotationPrefix, followed by the name of a routing manager pod, acknowledges the drain.
+	AckAnnotationPrefix = "drained.latency-aware-scheduler/"
+	// EvictionAnnotation holds the reason of an eviction that waits for the drain.
+	EvictionAnnotation = "latency-aware-scheduler/drain-eviction"
+)
+
+// AckAnnotation is the annotation with which the routing manager pod replica acknowledges the drain.
+func AckAnnotation(replica string) string {
+	return AckAnnotationPrefix + replica
+}
+
+// Deadline returns the drain deadline in the annotations of a pod; draining is false if the pod isn't
+// draining, err is set if the deadline is unreadable.
+func Deadline(annotations map[string]string) (deadline time.Time, draining bool, err error) {
+	value, ok := annotations[DeadlineAnnotation]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	deadline, err = time.Parse(time.RFC3339, value)
+	return deadline, true, err
+}
+
+// Pending counts the routing manager replicas that didn't acknowledge the drain yet.
+func Pending(annotations map[string]string, replicas []string) int {
+	pending := 0
+	for _, replica := range replicas {
+		if _, acked := annotations[AckAnnotation(replica)]; !acked {
+			pending++
+		}
+	}
+	return pending
+}
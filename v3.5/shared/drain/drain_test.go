@@ -0,0 +1,53 @@
+package drain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeadline(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        time.Time
+		draining    bool
+		wantErr     bool
+	}{
+		{"not draining", nil, time.Time{}, false, false},
+		{"draining", map[string]string{DeadlineAnnotation: "2024-01-02T03:04:05Z"}, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), true, false},
+		{"unreadable deadline", map[string]string{DeadlineAnnotation: "soon"}, time.Time{}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deadline, draining, err := Deadline(tt.annotations)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if draining != tt.draining || !deadline.Equal(tt.want) {
+				t.Errorf("got %v draining %v, want %v draining %v", deadline, draining, tt.want, tt.draining)
+			}
+		})
+	}
+}
+
+func TestPending(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		replicas    []string
+		want        int
+	}{
+		{"no routing manager", map[string]string{}, nil, 0},
+		{"nobody acknowledged", map[string]string{DeadlineAnnotation: "2024-01-02T03:04:05Z"}, []string{"rm-1", "rm-2"}, 2},
+		{"one acknowledged", map[string]string{AckAnnotation("rm-1"): "2024-01-02T03:04:00Z"}, []string{"rm-1", "rm-2"}, 1},
+		{"acknowledged by a replica that is gone", map[string]string{AckAnnotation("rm-0"): "2024-01-02T03:04:00Z"}, []string{"rm-1"}, 1},
+		{"all acknowledged", map[string]string{AckAnnotation("rm-1"): "", AckAnnotation("rm-2"): ""}, []string{"rm-1", "rm-2"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Pending(tt.annotations, tt.replicas); got != tt.want {
+				t.Errorf("got %d pending, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// Package tokenauth authenticates the callers of the control endpoints of the latency meter, the
+// routing manager and the scheduler with their Kubernetes token (TokenReview).
+package tokenauth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// DefaultAllowedUsers is the identity of the scheduler, the only caller of the meters and routing managers.
+	DefaultAllowedUsers = "system:serviceaccount:kube-system:custom-scheduler"
+	// DefaultAudience is the audience of the projected token the scheduler presents to the control
+	// endpoints, so the tokens of the API server (and of the other components) are rejected.
+	DefaultAudience = "latency-control"
+	reviewCacheTTL  = time.Minute
+)
+
+// Authorizer decides if an authenticated user can make the request.
+type Authorizer func(user authenticationv1.UserInfo, r *http.Request) (bool, error)
+
+type cachedReview struct {
+	user      authenticationv1.UserInfo
+	expiresAt time.Time
+}
+
+// Authenticator authenticates the bearer token of the requests with a TokenReview (cached for a
+// minute) and lets the authorizer decide on the authenticated identity.
+type Authenticator struct {
+	clientset  kubernetes.Interface
+	authorizer Authorizer
+	audiences  []string                // accepted audiences of the tokens, those of the API server if empty
+	cache      map[string]cachedReview // token -> authenticated user
+	mu         sync.Mutex
+	now        func() time.Time
+}
+
+// New returns an Authenticator of the tokens issued for one of the audiences, or for the API server
+// if none is given.
+func New(clientset kubernetes.Interface, authorizer Authorizer, audiences ...string) *Authenticator {
+	return &Authenticator{
+		clientset:  clientset,
+		authorizer: authorizer,
+		audiences:  audiences,
+		cache:      make(map[string]cachedReview),
+		now:        time.Now,
+	}
+}
+
+// AllowedUsers authorizes only the identities in the comma separated list.
+func AllowedUsers(list string) Authorizer {
+	allowed := make(map[string]bool)
+	for _, user := range strings.Split(list, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			allowed[user] = true
+		}
+	}
+	return func(user authenticationv1.UserInfo, _ *http.Request) (bool, error) {
+		return allowed[user.Username], nil
+	}
+}
+
+// AllowedUsersFromEnv authorizes the identities of ALLOWED_USERS (comma separated), or the scheduler
+// if it isn't set.
+func AllowedUsersFromEnv() Authorizer {
+	allowed := os.Getenv("ALLOWED_USERS")
+	if allowed == "" {
+		allowed = DefaultAllowedUsers
+	}
+	return AllowedUsers(allowed)
+}
+
+// AudiencesFromEnv returns the audiences of TOKEN_AUDIENCES (comma separated), or DefaultAudience if
+// it isn't set.
+func AudiencesFromEnv() []string {
+	list := os.Getenv("TOKEN_AUDIENCES")
+	if list == "" {
+		list = DefaultAudience
+	}
+	var audiences []string
+	for _, audience := range strings.Split(list, ",") {
+		if audience = strings.TrimSpace(audience); audience != "" {
+			audiences = append(audiences, audience)
+		}
+	}
+	return audiences
+}
+
+// Authenticate returns the identity of the token.
+func (a *Authenticator) Authenticate(token string) (authenticationv1.UserInfo, error) {
+	a.mu.Lock()
+	review, ok := a.cache[token]
+	a.mu.Unlock()
+	if ok && a.now().Before(review.expiresAt) {
+		return review.user, nil
+	}
+
+	result, err := a.clientset.AuthenticationV1().TokenReviews().Create(context.Background(), &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: a.audiences},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return authenticationv1.UserInfo{}, fmt.Errorf("token review failed: %v", err)
+	}
+	if !result.Status.Authenticated {
+		return authenticationv1.UserInfo{}, fmt.Errorf("token not authenticated: %s", result.Status.Error)
+	}
+	// An authenticator unaware of the audiences doesn't return them: the token is valid only for the API server
+	if len(a.audiences) > 0 && !intersects(a.audiences, result.Status.Audiences) {
+		return authenticationv1.UserInfo{}, fmt.Errorf("token not issued for the audiences %v", a.audiences)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	for cachedToken, cached := range a.cache { // drop the expired reviews
+		if now.After(cached.expiresAt) {
+			delete(a.cache, cachedToken)
+		}
+	}
+	a.cache[token] = cachedReview{user: result.Status.User, expiresAt: now.Add(reviewCacheTTL)}
+	return result.Status.User, nil
+}
+
+func intersects(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type userKey struct{}
+
+// User returns the identity authenticated by the Middleware for the request.
+func User(r *http.Request) (authenticationv1.UserInfo, bool) {
+	user, ok := r.Context().Value(userKey{}).(authenticationv1.UserInfo)
+	return user, ok
+}
+
+// Middleware rejects the requests without a valid bearer token of an authorized identity.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || token == r.Header.Get("Authorization") {
+			http.Error(w, "Missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		user, err := a.Authenticate(token)
+		if err != nil {
+			log.Printf("Unauthenticated request to %s from %s: %v", r.URL.Path, r.RemoteAddr, err)
+			http.Error(w, "Unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		allowed, err := a.authorizer(user, r)
+		if err != nil {
+			log.Printf("Error authorizing the request to %s from %s: %v", r.URL.Path, user.Username, err)
+			http.Error(w, "Authorization failed", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			log.Printf("Forbidden request to %s from %s", r.URL.Path, user.Username)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
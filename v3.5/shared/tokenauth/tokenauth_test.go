@@ -0,0 +1,155 @@
+package tokenauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fakeTokenReviews authenticates the tokens of users (token -> username) and counts the reviews. The
+// tokens are issued for the API server, or for the audience after the "@" (e.g. "token@audience").
+func fakeTokenReviews(users map[string]string, reviews *int) *fake.Clientset {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		*reviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		audience := "https://kubernetes.default.svc"
+		if _, tokenAudience, ok := strings.Cut(review.Spec.Token, "@"); ok {
+			audience = tokenAudience
+		}
+		username, ok := users[review.Spec.Token]
+		if ok && len(review.Spec.Audiences) > 0 && !intersects(review.Spec.Audiences, []string{audience}) {
+			review.Status = authenticationv1.TokenReviewStatus{Error: "token audiences is invalid for the target audiences"}
+		} else if ok {
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: username}, Audiences: []string{audience}}
+		} else {
+			review.Status = authenticationv1.TokenReviewStatus{Error: "invalid token"}
+		}
+		return true, review, nil
+	})
+	return clientset
+}
+
+func TestMiddleware(t *testing.T) {
+	users := map[string]string{
+		"scheduler-token": DefaultAllowedUsers,
+		"other-token":     "system:serviceaccount:default:other",
+	}
+	tests := []struct {
+		name          string
+		authorization string
+		allowed       string
+		want          int
+	}{
+		{"no token", "", DefaultAllowedUsers, http.StatusUnauthorized},
+		{"not a bearer token", "Basic abc", DefaultAllowedUsers, http.StatusUnauthorized},
+		{"invalid token", "Bearer nope", DefaultAllowedUsers, http.StatusUnauthorized},
+		{"allowed identity", "Bearer scheduler-token", DefaultAllowedUsers, http.StatusOK},
+		{"other identity", "Bearer other-token", DefaultAllowedUsers, http.StatusForbidden},
+		{"list of identities", "Bearer other-token", " system:serviceaccount:default:other , " + DefaultAllowedUsers, http.StatusOK},
+		{"nobody allowed", "Bearer scheduler-token", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reviews := 0
+			authenticator := New(fakeTokenReviews(users, &reviews), AllowedUsers(tt.allowed))
+			var seen string
+			handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				user, _ := User(r)
+				seen = user.Username
+			}))
+			request := httptest.NewRequest(http.MethodPost, "/measurements", nil)
+			if tt.authorization != "" {
+				request.Header.Set("Authorization", tt.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if recorder.Code != tt.want {
+				t.Errorf("got status %d, want %d", recorder.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && seen != users[tt.authorization[len("Bearer "):]] {
+				t.Errorf("handler saw user %q", seen)
+			}
+		})
+	}
+}
+
+func TestAuthenticateCachesReviews(t *testing.T) {
+	reviews := 0
+	authenticator := New(fakeTokenReviews(map[string]string{"token": "user"}, &reviews), AllowedUsers("user"))
+	now := time.Unix(0, 0)
+	authenticator.now = func() time.Time { return now }
+
+	for _, step := range []struct {
+		after   time.Duration
+		reviews int
+	}{
+		{0, 1},
+		{30 * time.Second, 1},
+		{31 * time.Second, 2}, // the cached review expired
+	} {
+		now = now.Add(step.after)
+		if _, err := authenticator.Authenticate("token"); err != nil {
+			t.Fatalf("Authenticate: %v", err)
+		}
+		if reviews != step.reviews {
+			t.Errorf("after %v: %d reviews, want %d", step.after, reviews, step.reviews)
+		}
+	}
+	if _, err := authenticator.Authenticate("unknown"); err == nil {
+		t.Error("unknown token authenticated")
+	}
+}
+
+func TestAuthenticateAudiences(t *testing.T) {
+	users := map[string]string{
+		"api-token":                        DefaultAllowedUsers,
+		"control-token@" + DefaultAudience: DefaultAllowedUsers,
+		"other-token@other":                DefaultAllowedUsers,
+	}
+	tests := []struct {
+		name      string
+		audiences []string
+		token     string
+		wantErr   bool
+	}{
+		{"API server token without audiences", nil, "api-token", false},
+		{"API server token rejected", []string{DefaultAudience}, "api-token", true},
+		{"token of the audience", []string{DefaultAudience}, "control-token@" + DefaultAudience, false},
+		{"token of another audience", []string{DefaultAudience}, "other-token@other", true},
+		{"one of the audiences", []string{"other", DefaultAudience}, "other-token@other", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reviews := 0
+			authenticator := New(fakeTokenReviews(users, &reviews), AllowedUsers(DefaultAllowedUsers), tt.audiences...)
+			if _, err := authenticator.Authenticate(tt.token); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAudiencesFromEnv(t *testing.T) {
+	tests := []struct {
+		env  string
+		want []string
+	}{
+		{"", []string{DefaultAudience}},
+		{"a", []string{"a"}},
+		{" a , b,", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Setenv("TOKEN_AUDIENCES", tt.env)
+		if got := AudiencesFromEnv(); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%q: got %v, want %v", tt.env, got, tt.want)
+		}
+	}
+}